@@ -2,30 +2,14 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"runtime"
+	"log/slog"
 	"strings"
+	"time"
 
-	"github.com/shirou/gopsutil/v3/process"
 	"github.com/urfave/cli/v2"
 )
 
 var (
-	// OsqueryDarwin default installation
-	OsqueryDarwin = []string{
-		"/private/var/osquery/io.osquery.agent.plist",
-		"/opt/osquery/lib/osquery.app/Contents/MacOS/osqueryd",
-	}
-	// OsqueryLinux default installation
-	OsqueryLinux = []string{
-		"/usr/lib/systemd/system/osqueryd.service",
-		"/opt/osquery/bin/osqueryd",
-	}
-	// OsqueryWindows default installation
-	OsqueryWindows = []string{
-		"C:\\Program Files\\osquery\\manage-osqueryd.ps1",
-		"C:\\Program Files\\osquery\\osqueryd\\osqueryd.exe",
-	}
 	// FlagTLSServerCerts for TLS server certificates
 	FlagTLSServerCerts = "--tls_server_certs"
 	// FlagOsqueryVersion to get osquery version
@@ -52,17 +36,21 @@ type VerifyRequest FlagsRequest
 
 // VerifyResponse for verify requests from osctrld
 type VerifyResponse struct {
-	Flags          string `json:"flags"`
-	Certificate    string `json:"certificate"`
-	OsqueryVersion string `json:"osquery_version"`
+	Flags             string `json:"flags"`
+	Certificate       string `json:"certificate"`
+	OsqueryVersion    string `json:"osquery_version"`
+	OsqueryVersionMax string `json:"osquery_version_max"`
+	OsqueryVersionPin string `json:"osquery_version_pin"`
 }
 
 // Function to action on enroll command
-func enrollNode(c *cli.Context) error {
-	if jsonConfig.Verbose {
-		log.Printf("Enrolling node in %s", osctrlURLs.Enroll)
+func enrollNode(c *cli.Context, pr *Profile) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
 	}
-	script, err := retrieveScript(jsonConfig.Secret, osctrlURLs.Enroll, jsonConfig.Insecure)
+	pr.log().Debug(fmt.Sprintf("Enrolling node in %s", pr.URLs.Enroll), LogFieldArtifact, "script", LogFieldURL, pr.URLs.Enroll)
+	script, err := retrieveScript(secret, pr.URLs.Enroll, pr.Config.Insecure)
 	if err != nil {
 		return fmt.Errorf("error retrieving enroll - %v", err)
 	}
@@ -71,49 +59,65 @@ func enrollNode(c *cli.Context) error {
 }
 
 // Function to action on flags command
-func getFlags(c *cli.Context) error {
-	if jsonConfig.Verbose {
-		log.Printf("Getting flags from %s", osctrlURLs.Flags)
+func getFlags(c *cli.Context, pr *Profile) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
 	}
-	flags, err := retrieveFlags(jsonConfig.Secret, jsonConfig.SecretFile, jsonConfig.CertFile)
+	l := pr.log().With(LogFieldArtifact, "flags")
+	l.Debug(fmt.Sprintf("Getting flags from %s", pr.URLs.Flags), LogFieldURL, pr.URLs.Flags)
+	flags, etag, err := retrieveFlags(secret, pr.Config.SecretFile, pr.Config.CertFile, pr.URLs.Flags, pr.Config.Insecure)
+	recordFetch(pr, "flags", pr.URLs.Flags, etag, err)
+	secretRejected(pr, err)
 	if err != nil {
 		return fmt.Errorf("error retrieving flags - %v", err)
 	}
-	if jsonConfig.Verbose {
+	if pr.Config.Verbose {
 		fmt.Println(flags)
 	}
-	if err := writeContentExists(jsonConfig.FlagFile, flags, "flags", jsonConfig.Force); err != nil {
+	err = applyContent(pr, secret, "flags", pr.Config.FlagFile, flags, pr.URLs.Flags)
+	recordApply(pr, "flags", pr.Config.FlagFile, err)
+	if err != nil {
 		return err
 	}
-	log.Printf("✅ flags ready in %s", jsonConfig.FlagFile)
+	l.Info(fmt.Sprintf("flags ready in %s", pr.Config.FlagFile), emoji("✅"), LogFieldPath, pr.Config.FlagFile)
 	return nil
 }
 
 // Function to action on cert command
-func getCert(c *cli.Context) error {
-	if jsonConfig.Verbose {
-		log.Printf("Getting cert from %s", osctrlURLs.Cert)
+func getCert(c *cli.Context, pr *Profile) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
 	}
-	cert, err := retrieveCert(jsonConfig.Secret, osctrlURLs.Cert, jsonConfig.Insecure)
+	l := pr.log().With(LogFieldArtifact, "cert")
+	l.Debug(fmt.Sprintf("Getting cert from %s", pr.URLs.Cert), LogFieldURL, pr.URLs.Cert)
+	cert, etag, err := retrieveCert(secret, pr.URLs.Cert, pr.Config.Insecure)
+	recordFetch(pr, "cert", pr.URLs.Cert, etag, err)
+	secretRejected(pr, err)
 	if err != nil {
 		return fmt.Errorf("error retrieving cert - %v", err)
 	}
-	if jsonConfig.Verbose {
+	if pr.Config.Verbose {
 		fmt.Println(cert)
 	}
-	if err := writeContentExists(jsonConfig.CertFile, cert, "cert", jsonConfig.Force); err != nil {
+	err = applyContent(pr, secret, "cert", pr.Config.CertFile, cert, pr.URLs.Cert)
+	recordApply(pr, "cert", pr.Config.CertFile, err)
+	if err != nil {
 		return err
 	}
-	log.Printf("✅ cert ready in %s", jsonConfig.CertFile)
+	l.Info(fmt.Sprintf("cert ready in %s", pr.Config.CertFile), emoji("✅"), LogFieldPath, pr.Config.CertFile)
 	return nil
 }
 
 // Function to action on remove command. It retrieves the script to run the removal from osctrl
-func removeNode(c *cli.Context) error {
-	if jsonConfig.Verbose {
-		log.Printf("Removing node in %s", osctrlURLs.Remove)
+func removeNode(c *cli.Context, pr *Profile) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
 	}
-	script, err := retrieveScript(jsonConfig.Secret, osctrlURLs.Remove, jsonConfig.Insecure)
+	pr.log().Debug(fmt.Sprintf("Removing node in %s", pr.URLs.Remove), LogFieldArtifact, "script", LogFieldURL, pr.URLs.Remove)
+	script, err := retrieveScript(secret, pr.URLs.Remove, pr.Config.Insecure)
 	if err != nil {
 		return fmt.Errorf("error retrieving remove - %v", err)
 	}
@@ -122,111 +126,156 @@ func removeNode(c *cli.Context) error {
 	return nil
 }
 
+// Helper to log a passed check of a verification and add it to the report
+func (r *VerifyReport) pass(l *slog.Logger, check, message string) {
+	l.Info(message, emoji("✅"))
+	r.Checks = append(r.Checks, VerifyCheck{Check: check, OK: true, Message: message})
+}
+
+// Helper to log a failed check of a verification and add it to the report
+func (r *VerifyReport) fail(l *slog.Logger, check, message string) {
+	l.Error(message)
+	r.Checks = append(r.Checks, VerifyCheck{Check: check, Message: message})
+}
+
 // Function to action on verify command. It verifies flags, cert and secret for and enrolled node in osctrl
-func verifyNode(c *cli.Context) error {
-	// Compare secret with local
-	if jsonConfig.Verbose {
-		log.Printf("Comparing secret with %s", jsonConfig.SecretFile)
+// The report is kept in the state, so the daemon can show the last verification
+func verifyNode(c *cli.Context, pr *Profile) error {
+	report := &VerifyReport{Time: time.Now().UTC()}
+	err := verifyProfile(pr, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	recordVerify(pr, report)
+	return err
+}
+
+// Function to verify flags, cert, secret and osqueryd of a profile, adding each check to the report
+func verifyProfile(pr *Profile, report *VerifyReport) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
 	}
-	if checkFileContent(jsonConfig.SecretFile, jsonConfig.Secret) {
-		log.Println("✅ osquery secret is valid")
+	l := pr.log()
+	// Compare secret with local
+	ls := l.With(LogFieldArtifact, "secret", LogFieldPath, pr.Config.SecretFile)
+	ls.Debug(fmt.Sprintf("Comparing secret with %s", pr.Config.SecretFile))
+	if checkFileContent(pr.Config.SecretFile, secret) {
+		report.pass(ls, "secret", "osquery secret is valid")
 	} else {
-		log.Printf("❌ osquery secret mismatch")
+		report.fail(ls, "secret", "osquery secret mismatch")
 	}
 	fmt.Println()
 	// Retrieve verification
-	if jsonConfig.Verbose {
-		log.Printf("Retrieving verification from %s", osctrlURLs.Verify)
-	}
-	verification, err := retrieveVerify(jsonConfig.Secret, jsonConfig.SecretFile, jsonConfig.CertFile, osctrlURLs.Verify, jsonConfig.Insecure)
+	l.Debug(fmt.Sprintf("Retrieving verification from %s", pr.URLs.Verify), LogFieldURL, pr.URLs.Verify)
+	verification, err := retrieveVerify(secret, pr.Config.SecretFile, pr.Config.CertFile, pr.URLs.Verify, pr.Config.Insecure)
 	if err != nil {
 		return fmt.Errorf("error retrieving verification - %v", err)
 	}
 	// Compare flags with local
-	if jsonConfig.Verbose {
-		log.Printf("Comparing flags with %s", jsonConfig.FlagFile)
-	}
-	if checkFileContent(jsonConfig.FlagFile, strings.TrimSpace(verification.Flags)) {
-		log.Println("✅ flags are valid")
+	lf := l.With(LogFieldArtifact, "flags", LogFieldPath, pr.Config.FlagFile)
+	lf.Debug(fmt.Sprintf("Comparing flags with %s", pr.Config.FlagFile))
+	if checkFileContent(pr.Config.FlagFile, strings.TrimSpace(verification.Flags)) {
+		report.pass(lf, "flags", "flags are valid")
 	} else {
-		log.Printf("❌ flags mismatch")
+		report.fail(lf, "flags", "flags mismatch")
 	}
 	fmt.Println()
 	// Retrieve certificate if flag is present
 	if strings.Contains(verification.Flags, FlagTLSServerCerts) {
 		// Compare certificate with local
-		if jsonConfig.Verbose {
-			log.Printf("Comparing certificate with %s", jsonConfig.CertFile)
-		}
-		if checkFileContent(jsonConfig.CertFile, strings.TrimSpace(verification.Certificate)) {
-			log.Println("✅ osquery certificate is valid")
+		lc := l.With(LogFieldArtifact, "cert", LogFieldPath, pr.Config.CertFile)
+		lc.Debug(fmt.Sprintf("Comparing certificate with %s", pr.Config.CertFile))
+		if checkFileContent(pr.Config.CertFile, strings.TrimSpace(verification.Certificate)) {
+			report.pass(lc, "cert", "osquery certificate is valid")
 		} else {
-			log.Printf("❌ osquery certificate mismatch")
+			report.fail(lc, "cert", "osquery certificate mismatch")
 		}
 		fmt.Println()
 	}
 	// Check local files
-	var localFiles []string
-	switch runtime.GOOS {
-	case DarwinOS:
-		localFiles = OsqueryDarwin
-	case LinuxOS:
-		localFiles = OsqueryLinux
-	case WindowsOS:
-		localFiles = OsqueryWindows
-	}
+	lo := l.With(LogFieldArtifact, "osqueryd")
+	localFiles := pr.Config.OsqueryLayout.RequiredFiles()
+	lo.Debug(fmt.Sprintf("Using osquery layout %s", pr.Config.OsqueryLayout.Name))
 	validLocal := true
-	for _, l := range localFiles {
-		if jsonConfig.Verbose {
-			log.Printf("Checking %s", l)
-		}
-		if !checkFileExist(l) {
-			log.Printf("❌ %s is missing", l)
+	for _, f := range localFiles {
+		lo.Debug(fmt.Sprintf("Checking %s", f), LogFieldPath, f)
+		if !checkFileExist(f) {
+			report.fail(lo.With(LogFieldPath, f), "files", fmt.Sprintf("%s is missing", f))
 			validLocal = false
 		}
 	}
 	if validLocal {
-		log.Println("✅ osquery local files are present")
-		fmt.Println()
-		// osquery version check
-		if jsonConfig.Verbose {
-			log.Printf("Expecting osquery %s or higher", verification.OsqueryVersion)
-		}
-		existingVersion := getOsqueryVersion()
-		if jsonConfig.Verbose {
-			log.Printf("Existing version is %s", existingVersion)
+		report.pass(lo, "files", "osquery local files are present")
+		for _, d := range []string{pr.Config.OsqueryLayout.Database, pr.Config.OsqueryLayout.Extensions} {
+			if d != "" && !checkFileExist(d) {
+				lo.Debug(fmt.Sprintf("%s is not present", d), LogFieldPath, d)
+			}
 		}
-		if osqueryVersionCompare(existingVersion, verification.OsqueryVersion) > 1 {
-			log.Printf("❌ osquery version (%s) is lower than required (%s)", existingVersion, verification.OsqueryVersion)
+		fmt.Println()
+		// osquery version check, local configuration takes precedence over server values
+		policy := VersionPolicy{
+			Min: verification.OsqueryVersion,
+			Max: verification.OsqueryVersionMax,
+			Pin: verification.OsqueryVersionPin,
+		}.Merge(pr.Config.OsqueryVersion)
+		lo.Debug(fmt.Sprintf("Expecting osquery %s", policy))
+		existingVersion := getOsqueryVersion(pr.Config.OsqueryLayout.Binary)
+		lo.Debug(fmt.Sprintf("Existing version is %s", existingVersion))
+		violations, err := evaluateVersionPolicy(existingVersion, policy)
+		if err != nil {
+			report.fail(lo, "version", fmt.Sprintf("osquery version could not be evaluated - %v", err))
+		} else if len(violations) > 0 {
+			for _, v := range violations {
+				report.fail(lo, "version", fmt.Sprintf("osquery version (%s) %s", existingVersion, v))
+			}
 		} else {
-			log.Printf("✅ osquery version (%s) is valid", existingVersion)
+			report.pass(lo, "version", fmt.Sprintf("osquery version (%s) is valid (%s)", existingVersion, policy))
 		}
 		fmt.Println()
 		// Check if osquery is running
-		if jsonConfig.Verbose {
-			log.Println("Checking running process")
-		}
-		ps, err := process.Processes()
+		lo.Debug("Checking running process")
+		instances, err := discoverOsqueryd(pr.Config.OsqueryLayout.Binary)
 		if err != nil {
-			return fmt.Errorf("error getting processes - %s", err)
+			return err
 		}
-		osqueryRunning := false
-		var osqueryPid int32
-		for _, p := range ps {
-			pCmd, _ := p.Cmdline()
-			if strings.Contains(pCmd, "/osqueryd ") {
-				osqueryRunning = true
-				osqueryPid = p.Pid
-				break
-			}
+		if len(instances) == 0 {
+			report.fail(lo, "running", "osqueryd is NOT running")
+			return nil
 		}
-		if osqueryRunning {
-			log.Printf("✅ osqueryd is running (pid %d)", osqueryPid)
-		} else {
-			log.Printf("❌ osqueryd is NOT running")
+		for _, i := range instances {
+			report.pass(lo.With("pid", i.Pid), "running", fmt.Sprintf("osqueryd %s is running (pid %d, user %s, uptime %s, cpu %.1f%%, rss %s)", i.Role, i.Pid, i.User, i.Uptime(), i.CPU, formatBytes(i.RSS)))
+		}
+		daemons := osquerydDaemons(instances)
+		// With several osqueryd on the host, only the one using the flagfile of this profile is checked
+		if own := osquerydWithFlagfile(daemons, pr.Config.FlagFile); len(own) > 0 {
+			daemons = own
+		}
+		if len(daemons) > 1 {
+			lo.Warn(fmt.Sprintf("%d osqueryd daemons are running, only one is expected", len(daemons)))
+		}
+		fmt.Println()
+		// Check if osquery is running with current flags and certificate
+		lo.Debug("Checking flags and certificate used by running process")
+		certFile := ""
+		if strings.Contains(verification.Flags, FlagTLSServerCerts) {
+			certFile = pr.Config.CertFile
+		}
+		for _, d := range daemons {
+			ld := lo.With("pid", d.Pid)
+			ld.Debug(fmt.Sprintf("osqueryd (pid %d) started %s with flagfile %s", d.Pid, d.StartTime.Format(time.RFC3339), d.FlagFile))
+			reasons := checkStaleOsqueryd(d, pr.Config.FlagFile, certFile)
+			if len(reasons) == 0 {
+				report.pass(ld, "stale", fmt.Sprintf("osqueryd (pid %d) is using current flags", d.Pid))
+				continue
+			}
+			for _, r := range reasons {
+				ld.Error(r)
+			}
+			report.fail(ld, "stale", fmt.Sprintf("osqueryd (pid %d) restart required", d.Pid))
 		}
 	} else {
-		log.Printf("❌ please install osquery")
+		report.fail(lo, "files", "please install osquery")
 	}
 	return nil
 }
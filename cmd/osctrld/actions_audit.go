@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on audit verify command
+func verifyAudit(c *cli.Context) error {
+	count, problems, err := verifyAuditLog(loadedConfig.Audit.File)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		logger.Info(fmt.Sprintf("audit log %s is valid, %d records", loadedConfig.Audit.File, count), emoji("✅"), LogFieldPath, loadedConfig.Audit.File)
+		return nil
+	}
+	for _, p := range problems {
+		logger.Error(p, LogFieldPath, loadedConfig.Audit.File)
+	}
+	return cli.Exit(fmt.Sprintf("\n❌ audit log is not valid after %d records", count), 1)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on history command
+func showHistory(c *cli.Context) error {
+	if backupStore == nil {
+		return fmt.Errorf("backups are disabled")
+	}
+	pr, err := selectProfile(loadedConfig.Profiles, profileName)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range []string{"flags", "cert"} {
+		path, _ := artifactPath(pr, artifact)
+		index, err := backupStore.Index(artifact, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s (%s)\n", artifact, path)
+		if len(index.Versions) == 0 {
+			fmt.Println("  no versions")
+			continue
+		}
+		current := auditFileHash(path)
+		for i := len(index.Versions) - 1; i >= 0; i-- {
+			v := index.Versions[i]
+			marker := ""
+			if v.SHA256 == current {
+				marker = " (current)"
+			}
+			fmt.Printf("  %d  %s  %s  %s%s\n", v.Version, v.Time.Local().Format("2006-01-02 15:04:05"), shortHash(v.SHA256), formatBytes(uint64(v.Size)), marker)
+		}
+	}
+	return nil
+}
+
+// Function to action on rollback command
+func rollbackNode(c *cli.Context) error {
+	if backupStore == nil {
+		return fmt.Errorf("backups are disabled")
+	}
+	pr, err := selectProfile(loadedConfig.Profiles, profileName)
+	if err != nil {
+		return err
+	}
+	lock, err := lockProfile(pr, c.Command.FullName())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	artifact := c.Args().Get(0)
+	path, err := artifactPath(pr, artifact)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if c.Args().Len() > 1 {
+		if version, err = strconv.Atoi(c.Args().Get(1)); err != nil || version <= 0 {
+			return fmt.Errorf("invalid version %s", c.Args().Get(1))
+		}
+	}
+	v, err := rollbackArtifact(backupStore, artifact, path, version)
+	if err != nil {
+		return err
+	}
+	l := pr.log().With(LogFieldArtifact, artifact, LogFieldPath, path)
+	l.Info(fmt.Sprintf("%s restored to version %d from %s", artifact, v.Version, v.Time.Local().Format("2006-01-02 15:04:05")), emoji("⏪"))
+	if c.Bool("restart") {
+		if err := restartOsqueryd(osPlatform); err != nil {
+			return err
+		}
+		l.Info("osqueryd restarted", emoji("🔄"))
+	}
+	return nil
+}
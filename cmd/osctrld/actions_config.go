@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on config show command, secrets are redacted
+func showConfig(c *cli.Context) error {
+	pr, err := selectProfile(loadedConfig.Profiles, profileName)
+	if err != nil {
+		return err
+	}
+	lines, err := formatConfiguration(pr, c.Bool("origin"))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// Helper to format the effective configuration of a profile, with secrets redacted and optionally where each value came from
+func formatConfiguration(pr *Profile, origin bool) ([]string, error) {
+	effective, err := effectiveConfiguration(pr.Config, pr.Layers)
+	if err != nil {
+		return nil, fmt.Errorf("error generating configuration - %v", err)
+	}
+	var lines []string
+	for _, k := range sortedConfigKeys(effective) {
+		v := effective[k]
+		value := redactConfigValue(k, v.Value)
+		if v.Encrypted {
+			value = redactedValue
+		}
+		if origin {
+			lines = append(lines, fmt.Sprintf("%s = %v (%s: %s)", k, value, v.Origin, v.Source))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s = %v", k, value))
+		}
+	}
+	return lines, nil
+}
+
+// Function to action on config validate command
+func validateConfig(c *cli.Context) error {
+	profiles, err := selectProfiles(loadedConfig.Profiles, profileName)
+	if err != nil {
+		return err
+	}
+	problems := validateProfilesConfiguration(profiles)
+	if len(problems) == 0 {
+		logger.Info("configuration is valid", emoji("✅"))
+		return nil
+	}
+	for _, p := range problems {
+		logger.Error(p)
+	}
+	return cli.Exit(fmt.Sprintf("\n❌ configuration has %d problems", len(problems)), 1)
+}
+
+// Function to action on config init command
+func initConfig(c *cli.Context) error {
+	content, err := generateConfiguration(osPlatform, c.String("format"))
+	if err != nil {
+		return fmt.Errorf("error generating configuration - %v", err)
+	}
+	output := c.String("output")
+	if output == defEmptyValue {
+		fmt.Printf("%s", content)
+		return nil
+	}
+	if checkFileExist(output) && !c.Bool("force") {
+		return fmt.Errorf("%s exists, please use --force to overwrite", output)
+	}
+	if err := os.WriteFile(output, content, 0600); err != nil {
+		return fmt.Errorf("error writing configuration to %s - %v", output, err)
+	}
+	logger.Info(fmt.Sprintf("configuration ready in %s", output), emoji("✅"), LogFieldPath, output)
+	return nil
+}
+
+// Function to action on config encrypt command
+func encryptConfig(c *cli.Context) error {
+	value := c.Args().First()
+	if value == defEmptyValue {
+		// Reading from stdin keeps the value out of shell history and process list
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading value - %v", err)
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+	if value == defEmptyValue {
+		return fmt.Errorf("empty value to encrypt")
+	}
+	keyPath := resolveKeyFile(keyFile, osPlatform)
+	key, err := loadOrGenerateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptValue(value, key)
+	if err != nil {
+		return fmt.Errorf("error encrypting value - %v", err)
+	}
+	fmt.Println(encrypted)
+	return nil
+}
+
+// Function to action on config rekey command
+func rekeyConfig(c *cli.Context) error {
+	keyPath := resolveKeyFile(keyFile, osPlatform)
+	oldKey, err := loadEncryptionKey(keyPath)
+	if err != nil {
+		return err
+	}
+	newKeyPath := c.String("new-key-file")
+	var newKey []byte
+	if newKeyPath != defEmptyValue {
+		newKey, err = loadOrGenerateKey(newKeyPath)
+	} else {
+		newKey, err = generateEncryptionKey()
+	}
+	if err != nil {
+		return err
+	}
+	file, _ := resolveConfigFile(osPlatform)
+	dropIns, err := configDropIns(file)
+	if err != nil {
+		return fmt.Errorf("error listing drop-ins - %v", err)
+	}
+	// Prepare all files before writing any, so a failure does not leave a mix of keys
+	var rekeyed []rekeyedFile
+	for _, f := range append([]string{file}, dropIns...) {
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("error reading %s - %v", f, err)
+		}
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("error reading %s - %v", f, err)
+		}
+		newContent, count, err := rekeyContent(string(content), oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("error with %s - %v", f, err)
+		}
+		if count > 0 {
+			rekeyed = append(rekeyed, rekeyedFile{path: f, before: string(content), after: newContent, perm: info.Mode().Perm()})
+			logger.Info(fmt.Sprintf("%d values re-encrypted in %s", count, f), emoji("🔐"))
+		}
+	}
+	// The key is rotated in place unless a new key file is provided
+	rotateKey := defEmptyValue
+	if newKeyPath == defEmptyValue {
+		rotateKey = keyPath
+		newKeyPath = keyPath
+	}
+	if err := applyRekey(rekeyed, rotateKey, newKey, c.Bool("keep-old-key")); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("configuration rekeyed, new key in %s", newKeyPath), emoji("✅"))
+	return nil
+}
+
+// rekeyedFile keeps the content of a configuration file before and after rekeying
+type rekeyedFile struct {
+	path   string
+	before string
+	after  string
+	perm   os.FileMode
+}
+
+// Function to write rekeyed configuration files and then rotate the key in keyPath, if any. On failure, the files
+// already written and the key are restored, so configuration files always match the key. Once the files are verified
+// with the new key, the old key is removed unless it is kept as .old
+func applyRekey(files []rekeyedFile, keyPath string, newKey []byte, keepOld bool) error {
+	var written []rekeyedFile
+	restore := func() {
+		for _, f := range written {
+			if err := writeFileAtomic(f.path, []byte(f.before), f.perm); err != nil {
+				logger.Error(fmt.Sprintf("error restoring %s - %v", f.path, err))
+			}
+		}
+	}
+	for _, f := range files {
+		if err := writeFileAtomic(f.path, []byte(f.after), f.perm); err != nil {
+			restore()
+			return fmt.Errorf("error writing %s - %v", f.path, err)
+		}
+		written = append(written, f)
+	}
+	if keyPath == defEmptyValue {
+		if err := verifyRekey(files, newKey); err != nil {
+			restore()
+			return err
+		}
+		return nil
+	}
+	oldKeyPath := keyPath + ".old"
+	if err := os.Rename(keyPath, oldKeyPath); err != nil {
+		restore()
+		return fmt.Errorf("error keeping old key - %v", err)
+	}
+	restoreKey := func() {
+		restore()
+		if err := os.Rename(oldKeyPath, keyPath); err != nil {
+			logger.Error(fmt.Sprintf("error restoring key %s - %v", keyPath, err))
+		}
+	}
+	if err := writeEncryptionKey(keyPath, newKey); err != nil {
+		restoreKey()
+		return fmt.Errorf("error writing new key - %v", err)
+	}
+	key, err := loadEncryptionKey(keyPath)
+	if err == nil {
+		err = verifyRekey(files, key)
+	}
+	if err != nil {
+		restoreKey()
+		return err
+	}
+	if keepOld {
+		logger.Info(fmt.Sprintf("old key kept in %s", oldKeyPath), emoji("🔑"))
+		return nil
+	}
+	// The old key decrypts old copies of the configuration, it is not left behind
+	if err := os.Remove(oldKeyPath); err != nil {
+		return fmt.Errorf("error removing old key %s - %v", oldKeyPath, err)
+	}
+	return nil
+}
+
+// Helper to verify that rekeyed configuration files were written and all their values decrypt with the key
+func verifyRekey(files []rekeyedFile, key []byte) error {
+	for _, f := range files {
+		content, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("error verifying %s - %v", f.path, err)
+		}
+		if string(content) != f.after {
+			return fmt.Errorf("error verifying %s - content changed while rekeying", f.path)
+		}
+		for _, v := range encryptedValueRegex.FindAllString(f.after, -1) {
+			if _, err := decryptValue(v, key); err != nil {
+				return fmt.Errorf("error verifying %s - %v", f.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Helper to load a key file, generating it if it does not exist
+func loadOrGenerateKey(path string) ([]byte, error) {
+	if checkFileExist(path) {
+		return loadEncryptionKey(path)
+	}
+	key, err := generateEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEncryptionKey(path, key); err != nil {
+		return nil, fmt.Errorf("error writing key to %s - %v", path, err)
+	}
+	logger.Info(fmt.Sprintf("new key generated in %s", path), emoji("🔑"))
+	return key, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Helper to send a request to the control API of the daemon, printing the raw response with --json
+func controlRequest(c *cli.Context, method, path string, body any, out any) (bool, error) {
+	if !loadedConfig.Control.Enabled {
+		return false, fmt.Errorf("control API is disabled in the configuration")
+	}
+	content, err := newControlClient(loadedConfig.Control.Socket).Do(method, path, profileName, body, out)
+	if err != nil {
+		return false, err
+	}
+	if c.Bool("json") {
+		fmt.Print(string(content))
+		return true, nil
+	}
+	return false, nil
+}
+
+// Helper to print the response of a request that changes the daemon
+func printControlResponse(resp ControlResponse) {
+	fmt.Println(resp.Message)
+	for _, p := range resp.Profiles {
+		fmt.Printf("  %s\n", p)
+	}
+	if resp.PausedUntil != nil {
+		fmt.Printf("remediation resumes at %s\n", resp.PausedUntil.Local().Format("2006-01-02 15:04:05"))
+	}
+}
+
+// Function to action on ctl status command
+func ctlStatus(c *cli.Context) error {
+	var status ControlStatus
+	done, err := controlRequest(c, http.MethodGet, ControlPathStatus, nil, &status)
+	if err != nil || done {
+		return err
+	}
+	fmt.Printf("%s %s (pid %d) running since %s, reconciling every %s\n", appName, status.Version, status.Pid, formatStateTime(status.Started), status.Interval)
+	if status.PausedUntil != nil {
+		fmt.Printf("remediation paused until %s (%s left)\n", status.PausedUntil.Local().Format("2006-01-02 15:04:05"), time.Until(*status.PausedUntil).Truncate(time.Second))
+	}
+	for _, name := range sortedKeys(status.Profiles) {
+		printProfileState(name, status.Profiles[name])
+	}
+	return nil
+}
+
+// Function to action on ctl verify command
+func ctlVerify(c *cli.Context) error {
+	var reports map[string]*VerifyReport
+	done, err := controlRequest(c, http.MethodGet, ControlPathVerify, nil, &reports)
+	if err != nil || done {
+		return err
+	}
+	for _, name := range sortedKeys(reports) {
+		r := reports[name]
+		if r == nil {
+			fmt.Printf("%s: never verified\n", name)
+			continue
+		}
+		fmt.Printf("%s: verified %s, %d of %d checks failed\n", name, formatStateTime(r.Time), r.Failed(), len(r.Checks))
+		for _, check := range r.Checks {
+			mark := "✅"
+			if !check.OK {
+				mark = "❌"
+			}
+			fmt.Printf("  %s %-8s %s\n", mark, check.Check, check.Message)
+		}
+		if r.Error != defEmptyValue {
+			fmt.Printf("  ❌ %-8s %s\n", "error", r.Error)
+		}
+	}
+	return nil
+}
+
+// Function to action on ctl sync command
+func ctlSync(c *cli.Context) error {
+	var resp ControlResponse
+	done, err := controlRequest(c, http.MethodPost, ControlPathSync, nil, &resp)
+	if err != nil || done {
+		return err
+	}
+	printControlResponse(resp)
+	return nil
+}
+
+// Function to action on ctl pause command
+func ctlPause(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("duration to pause is required, in minutes or like 1h30m")
+	}
+	if _, err := parsePauseDuration(c.Args().First()); err != nil {
+		return err
+	}
+	var resp ControlResponse
+	done, err := controlRequest(c, http.MethodPost, ControlPathPause, ControlPauseRequest{Duration: c.Args().First()}, &resp)
+	if err != nil || done {
+		return err
+	}
+	printControlResponse(resp)
+	return nil
+}
+
+// Function to action on ctl resume command
+func ctlResume(c *cli.Context) error {
+	var resp ControlResponse
+	done, err := controlRequest(c, http.MethodPost, ControlPathResume, nil, &resp)
+	if err != nil || done {
+		return err
+	}
+	printControlResponse(resp)
+	return nil
+}
+
+// Function to action on ctl reload command
+func ctlReload(c *cli.Context) error {
+	var resp ControlResponse
+	done, err := controlRequest(c, http.MethodPost, ControlPathReload, nil, &resp)
+	if err != nil || done {
+		return err
+	}
+	printControlResponse(resp)
+	return nil
+}
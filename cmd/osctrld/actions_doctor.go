@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Helper to get the emoji for the status of a step of doctor
+func doctorEmoji(status string) string {
+	switch status {
+	case DoctorOK:
+		return "✅"
+	case DoctorWarn:
+		return "⚠️ "
+	case DoctorFail:
+		return "❌"
+	}
+	return "⏭️ "
+}
+
+// Function to action on doctor command, it checks step by step what each profile needs to work with osctrl
+func doctorNodes(c *cli.Context, profiles []*Profile) error {
+	var reports []*DoctorReport
+	failed, steps := 0, 0
+	for _, pr := range profiles {
+		d := &Doctor{pr: pr, timeout: c.Duration("timeout")}
+		report := d.Run()
+		reports = append(reports, report)
+		failed += report.Failed()
+		steps += len(report.Steps)
+	}
+	if c.Bool("json") {
+		content, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+	} else {
+		for _, r := range reports {
+			fmt.Printf("%s:\n", r.Profile)
+			for _, s := range r.Steps {
+				fmt.Printf("  %s %-18s %s\n", doctorEmoji(s.Status), s.Step, s.Detail)
+				if s.Diagnosis != defEmptyValue {
+					fmt.Printf("     %-18s → %s\n", "", s.Diagnosis)
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("\n❌ %d of %d steps failed", failed, steps), 1)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on heartbeat command, it sends the heartbeat of each profile once
+func heartbeatNodes(c *cli.Context, profiles []*Profile) error {
+	for _, pr := range profiles {
+		if c.Bool("dry-run") {
+			content, err := json.MarshalIndent(genHeartbeat(pr), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(content))
+			continue
+		}
+		if err := sendHeartbeat(pr); err != nil {
+			return err
+		}
+		pr.log().Info(fmt.Sprintf("heartbeat sent to %s", pr.URLs.Heartbeat), emoji("💓"), LogFieldURL, pr.URLs.Heartbeat)
+	}
+	return nil
+}
@@ -3,18 +3,53 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
 	"strings"
 )
 
-// Helper function to retrieve flags
-func retrieveFlags(secret, secretFile, certFile string) (string, error) {
+// Helper function to get the enroll secret of a profile, resolving it from its source until it succeeds
+func getSecret(pr *Profile) (string, error) {
+	if pr.Secret == nil {
+		return "", fmt.Errorf("secret is not configured in profile %s", pr.Name)
+	}
+	secret, err := pr.Secret.Get()
+	if err != nil {
+		return "", fmt.Errorf("error resolving secret from %s - %v", pr.Secret, err)
+	}
+	return secret, nil
+}
+
+// StatusError is returned when osctrl answers with a status code other than 200
+type StatusError struct {
+	Code int
+	Body string
+}
+
+// Error returns the status code and the response of osctrl
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d - Response: %s", e.Code, e.Body)
+}
+
+// Helper function to resolve the secret of a profile again the next time, if osctrl rejected it. It may have been rotated
+func secretRejected(pr *Profile, err error) {
+	var se *StatusError
+	if pr.Secret == nil || !errors.As(err, &se) {
+		return
+	}
+	if se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden {
+		pr.log().Debug(fmt.Sprintf("[%s] osctrl rejected the secret, it will be resolved again from %s", pr.Name, pr.Secret))
+		pr.Secret.Invalidate()
+	}
+}
+
+// Helper function to retrieve flags, with the ETag of the response if any
+func retrieveFlags(secret, secretFile, certFile, url string, insecure bool) (string, string, error) {
 	flagsData := FlagsRequest{
 		Secret:     secret,
 		SecretFile: secretFile,
@@ -22,34 +57,40 @@ func retrieveFlags(secret, secretFile, certFile string) (string, error) {
 	}
 	jsonReq, err := json.Marshal(flagsData)
 	if err != nil {
-		return "", fmt.Errorf("error parsing data - %s", err)
+		return "", "", fmt.Errorf("error parsing data - %s", err)
 	}
 	jsonParam := strings.NewReader(string(jsonReq))
-	code, body, err := SendRequest(http.MethodPost, osctrlURLs.Flags, jsonParam, map[string]string{}, jsonConfig.Insecure)
+	code, headers, body, err := SendRequestHeaders(http.MethodPost, url, jsonParam, map[string]string{}, insecure)
 	if err != nil {
-		return "", fmt.Errorf("error sending request - %v", err)
+		return "", "", fmt.Errorf("error sending request - %v", err)
 	}
 	if code != http.StatusOK {
-		return "", fmt.Errorf("HTTP %d - Response: %s", code, string(body))
+		return "", "", &StatusError{Code: code, Body: string(body)}
 	}
-	return fmt.Sprintf("%s", strings.TrimSpace(string(body))), nil
+	return fmt.Sprintf("%s", strings.TrimSpace(string(body))), headers.Get(ETag), nil
 }
 
 // Helper function to retrieve from server
 func genericRetrieve(url string, insecure bool, data any) ([]byte, error) {
+	body, _, err := genericRetrieveETag(url, insecure, data)
+	return body, err
+}
+
+// Helper function to retrieve from server, with the ETag of the response if any
+func genericRetrieveETag(url string, insecure bool, data any) ([]byte, string, error) {
 	jsonReq, err := json.Marshal(data)
 	if err != nil {
-		return []byte{}, fmt.Errorf("error parsing data - %s", err)
+		return []byte{}, "", fmt.Errorf("error parsing data - %s", err)
 	}
 	jsonParam := strings.NewReader(string(jsonReq))
-	code, body, err := SendRequest(http.MethodPost, url, jsonParam, map[string]string{}, insecure)
+	code, headers, body, err := SendRequestHeaders(http.MethodPost, url, jsonParam, map[string]string{}, insecure)
 	if err != nil {
-		return []byte{}, fmt.Errorf("error sending request - %v", err)
+		return []byte{}, "", fmt.Errorf("error sending request - %v", err)
 	}
 	if code != http.StatusOK {
-		return []byte{}, fmt.Errorf("HTTP %d - Response: %s", code, string(body))
+		return []byte{}, "", &StatusError{Code: code, Body: string(body)}
 	}
-	return body, nil
+	return body, headers.Get(ETag), nil
 }
 
 // Helper function to retrieve script
@@ -61,13 +102,13 @@ func retrieveScript(secret, url string, insecure bool) (string, error) {
 	return strings.TrimSpace(string(resp)), err
 }
 
-// Helper function to retrieve cert
-func retrieveCert(secret, url string, insecure bool) (string, error) {
+// Helper function to retrieve cert, with the ETag of the response if any
+func retrieveCert(secret, url string, insecure bool) (string, string, error) {
 	certData := CertRequest{
 		Secret: secret,
 	}
-	resp, err := genericRetrieve(url, insecure, certData)
-	return strings.TrimSpace(string(resp)), err
+	resp, etag, err := genericRetrieveETag(url, insecure, certData)
+	return strings.TrimSpace(string(resp)), etag, err
 }
 
 // Helper function to retrieve verify
@@ -94,11 +135,31 @@ func checkFileExist(path string) bool {
 	return (err == nil)
 }
 
+// Helper function to check if a path is writable, opening the file if exists or creating a temporary file in its directory
+func checkWritable(path string) error {
+	if path == "" {
+		return fmt.Errorf("empty path")
+	}
+	if checkFileExist(path) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".osctrld-write-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
 // Helper function to check if file content is the same - true if content is the same than file
 func checkFileContent(path, content string) bool {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("error opening %s - %v", path, err)
+		logger.Warn(fmt.Sprintf("error opening %s - %v", path, err), LogFieldPath, path)
 		return false
 	}
 	defer f.Close()
@@ -106,54 +167,83 @@ func checkFileContent(path, content string) bool {
 	return (strings.TrimSpace(string(fContent)) == content)
 }
 
-// Helper function to write content to a file if not different from existing
-func writeContentExists(path, content, name string, force bool) error {
+// Helper function to get the permissions of the file of an artifact, only the cert is readable by everyone
+func artifactPerm(name string) os.FileMode {
+	if name == "cert" {
+		return 0644
+	}
+	return 0600
+}
+
+// Helper function to write content to a file if not different from existing. Writes are recorded in the audit log, with the URL the content came from.
+// The file is replaced atomically, osqueryd never reads a partial file
+func writeContentExists(path, content, name, url string, force bool) error {
 	if checkFileExist(path) {
 		if !checkFileContent(path, content) {
 			if force {
-				if err := os.WriteFile(path, []byte(content), 0700); err != nil {
-					return fmt.Errorf("error overwriting %s to %s - %v", name, path, err)
+				backupBeforeWrite(name, path)
+				r := AuditRecord{Action: AuditActionWrite, Artifact: name, Path: path, URL: url, Before: auditFileHash(path), After: auditHash([]byte(content))}
+				if err := writeFileAtomic(path, []byte(content), artifactPerm(name)); err != nil {
+					err = fmt.Errorf("error overwriting %s to %s - %v", name, path, err)
+					auditOutcome(r, err)
+					return err
 				}
+				auditOutcome(r, nil)
 			} else {
 				return fmt.Errorf("%s exists, please use --force to overwrite", path)
 			}
 		}
 	} else {
-		if err := os.WriteFile(path, []byte(content), 0700); err != nil {
-			return fmt.Errorf("error writing %s to %s - %v", name, path, err)
+		r := AuditRecord{Action: AuditActionWrite, Artifact: name, Path: path, URL: url, After: auditHash([]byte(content))}
+		if err := writeFileAtomic(path, []byte(content), artifactPerm(name)); err != nil {
+			err = fmt.Errorf("error writing %s to %s - %v", name, path, err)
+			auditOutcome(r, err)
+			return err
 		}
+		auditOutcome(r, nil)
 	}
 	return nil
 }
 
-// Helper function to execute the "osqueryd -version" command and return output
-func getOsqueryVersion() string {
-	var osquerydBin string
-	switch runtime.GOOS {
-	case DarwinOS:
-		osquerydBin = OsqueryDarwin[1]
-	case LinuxOS:
-		osquerydBin = OsqueryLinux[1]
-	case WindowsOS:
-		osquerydBin = OsqueryWindows[1]
+// Helper function to write a file atomically, writing a temporary file in the same directory and renaming it
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".osctrld-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
 	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Helper function to execute the "osqueryd -version" command and return output
+func getOsqueryVersion(osquerydBin string) string {
 	cmd := exec.Command(osquerydBin, FlagOsqueryVersion)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("error running osqueryd - %v - %s", err, string(out))
+		logger.Warn(fmt.Sprintf("error running osqueryd - %v - %s", err, string(out)), LogFieldArtifact, "osqueryd")
 		return ""
 	}
-	splitted := strings.Split(strings.TrimSpace(string(out)), " ")
-	if len(splitted) < 2 {
-		return ""
-	}
-	return splitted[2]
+	return extractOsqueryVersion(string(out))
 }
 
-// Helper function to run the retrieved script from osctrl
-func runScript(directory, script string) (string, error) {
+// Helper function to run the retrieved script from osctrl, using the interpreter for the platform
+func runScript(p Platform, directory, script string) (string, error) {
 	// Create a temporary file for the script
-	tmpFile, err := os.CreateTemp(directory, "osctrld-script-*.sh")
+	tmpFile, err := os.CreateTemp(directory, "osctrld-script-*"+p.ScriptExtension())
 	if err != nil {
 		return "", fmt.Errorf("error creating temporary script file: %v", err)
 	}
@@ -176,8 +266,9 @@ func runScript(directory, script string) (string, error) {
 	var stderr bytes.Buffer
 
 	// Execute the script
-	cmd := exec.Command(tmpFile.Name())
-	cmd.CombinedOutput()
+	interpreter := p.ScriptInterpreter(tmpFile.Name())
+	cmd := exec.Command(interpreter[0], interpreter[1:]...)
+	r := AuditRecord{Action: AuditActionScript, Artifact: "script", Path: directory, Exec: interpreter, After: auditHash([]byte(script))}
 
 	// Set the command's output to the buffers
 	cmd.Stdout = &stdout
@@ -186,16 +277,36 @@ func runScript(directory, script string) (string, error) {
 	// Run the script
 	if err := cmd.Run(); err != nil {
 		// If the command fails, capture the error
-		return "", fmt.Errorf("error executing script: %v", err)
+		err = fmt.Errorf("error executing script: %v", err)
+		auditOutcome(r, err)
+		return "", err
 	}
+	auditOutcome(r, nil)
 	// Capture the output
 	output := stdout.String()
 	errOutput := stderr.String()
 
 	// If stderr has content but no error was returned, log it
 	if errOutput != "" {
-		log.Printf("script generated warnings: %s", errOutput)
+		logger.Warn(fmt.Sprintf("script generated warnings: %s", errOutput), LogFieldArtifact, "script")
 	}
 
 	return output, nil
 }
+
+// Helper function to restart the osqueryd service with the service manager for the platform
+func restartOsqueryd(p Platform) error {
+	command := p.ServiceManager().RestartCommand()
+	r := AuditRecord{Action: AuditActionRestart, Artifact: "osqueryd", Exec: command}
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("error restarting osqueryd with %s - %v - %s", p.ServiceManager().Name(), err, strings.TrimSpace(string(out)))
+	}
+	auditOutcome(r, err)
+	outcome := AuditOutcomeSuccess
+	if err != nil {
+		outcome = AuditOutcomeError
+	}
+	metrics.Add(MetricRestarts, 1, "outcome", outcome)
+	return err
+}
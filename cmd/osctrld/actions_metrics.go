@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on metrics command
+func writeMetrics(c *cli.Context, profiles []*Profile) error {
+	output := c.String("output")
+	if output == defEmptyValue {
+		output = loadedConfig.Metrics.Textfile
+	}
+	collectMetrics(metrics, profiles)
+	if output == defEmptyValue {
+		return metrics.Write(os.Stdout)
+	}
+	if problems := validateMetricsConfiguration(MetricsConfiguration{Textfile: output}); len(problems) > 0 {
+		return fmt.Errorf("%s", problems[0])
+	}
+	if err := writeMetricsTextfile(metrics, output); err != nil {
+		return fmt.Errorf("error writing metrics - %v", err)
+	}
+	logger.Info(fmt.Sprintf("metrics written to %s", output), emoji("📈"), LogFieldPath, output)
+	return nil
+}
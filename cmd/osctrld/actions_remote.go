@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on actions command, it polls osctrl once for each profile and runs the actions received
+func runRemoteActions(c *cli.Context, profiles []*Profile) error {
+	for _, pr := range profiles {
+		ra, err := newRemoteActions(c, pr, osPlatform)
+		if err != nil {
+			return err
+		}
+		// One shot runs do not wait for actions
+		ra.wait = 0
+		count, err := ra.Run()
+		if err != nil {
+			return err
+		}
+		pr.log().Info(fmt.Sprintf("%d actions received from %s", count, pr.URLs.Actions), emoji("📥"), LogFieldURL, pr.URLs.Actions)
+	}
+	return nil
+}
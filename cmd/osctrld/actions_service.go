@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on service install command
+func serviceInstall(c *cli.Context) error {
+	sm := osPlatform.ServiceManager()
+	s, err := resolveOsctrldService(sm, osPlatform, c.String("user"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		def := sm.OsctrldDefinition()
+		if def.Path != defEmptyValue {
+			content, err := renderServiceDefinition(def, s)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("# %s\n%s", def.Path, content)
+		}
+		for _, command := range sm.InstallOsctrldCommands(s) {
+			fmt.Println(strings.Join(command, " "))
+		}
+		return nil
+	}
+	var u *user.User
+	if s.User != defEmptyValue {
+		if osPlatform.Name() == WindowsOS {
+			return fmt.Errorf("--user is not supported in windows, the service runs as LocalSystem")
+		}
+		if u, err = ensureServiceUser(osPlatform, s.User, runServiceCommand); err != nil {
+			return err
+		}
+		if g, err := user.LookupGroupId(u.Gid); err == nil {
+			s.Group = g.Name
+		}
+	}
+	if err := ensureServiceDirs(serviceDirs(), u); err != nil {
+		return err
+	}
+	if err := installService(sm, s, runServiceCommand); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("%s service installed with %s, running %s with %s", s.Name, sm.Name(), s.Binary, s.Config), emoji("✅"), LogFieldPath, s.Definition)
+	return nil
+}
+
+// Function to action on service uninstall command
+func serviceUninstall(c *cli.Context) error {
+	sm := osPlatform.ServiceManager()
+	def := sm.OsctrldDefinition()
+	s := OsctrldService{Name: def.Name, Definition: def.Path}
+	if err := uninstallService(sm, s, runServiceCommand); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("%s service uninstalled from %s", s.Name, sm.Name()), emoji("✅"))
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Helper to format a time of the state, relative to now
+func formatStateTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format("2006-01-02 15:04:05"), time.Since(t).Truncate(time.Second))
+}
+
+// Function to action on status command, it only reads the local state
+func showStatus(c *cli.Context) error {
+	profiles, err := selectProfiles(loadedConfig.Profiles, profileName)
+	if err != nil {
+		return err
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		selected := State{Version: state.Version, Updated: state.Updated, Profiles: make(map[string]*ProfileState)}
+		for _, pr := range profiles {
+			if ps, ok := state.Profiles[pr.Name]; ok {
+				selected.Profiles[pr.Name] = ps
+			}
+		}
+		content, err := json.MarshalIndent(selected, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+	for _, pr := range profiles {
+		printProfileState(pr.Name, state.Profiles[pr.Name])
+	}
+	return nil
+}
+
+// Helper to print the state of a profile
+func printProfileState(name string, ps *ProfileState) {
+	if ps == nil {
+		fmt.Printf("%s: never synced\n", name)
+		return
+	}
+	fmt.Printf("%s: %s in %s\n", name, ps.Environment, ps.Server)
+	fmt.Printf("  last sync   %s\n", formatStateTime(ps.LastSync))
+	if !ps.LastHeartbeat.IsZero() {
+		fmt.Printf("  heartbeat   %s\n", formatStateTime(ps.LastHeartbeat))
+	}
+	for _, artifact := range []string{"flags", "cert"} {
+		as, ok := ps.Artifacts[artifact]
+		if !ok {
+			continue
+		}
+		fmt.Printf("  %s (%s)\n", artifact, as.Path)
+		fmt.Printf("    fetched   %s\n", formatStateTime(as.LastFetch))
+		fmt.Printf("    applied   %s\n", formatStateTime(as.LastApply))
+		if as.Hash != defEmptyValue {
+			current := auditFileHash(as.Path)
+			marker := ""
+			if current != as.Hash {
+				marker = " (modified since applied)"
+			}
+			fmt.Printf("    sha256    %s%s\n", shortHash(as.Hash), marker)
+		}
+		if as.ETag != defEmptyValue {
+			fmt.Printf("    etag      %s\n", as.ETag)
+		}
+		if as.Failures > 0 {
+			fmt.Printf("    failures  %d, last %s: %s\n", as.Failures, formatStateTime(as.ErrorTime), as.LastError)
+		}
+	}
+}
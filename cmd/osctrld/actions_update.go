@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Function to action on update command, it updates the osctrld binary if there is a new release
+func updateBinary(c *cli.Context) error {
+	// Without release manifest, osctrl is checked with the selected profile
+	var pr *Profile
+	if loadedConfig.Update.URL == defEmptyValue {
+		selected, err := selectProfile(loadedConfig.Profiles, profileName)
+		if err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with profile - %v", err)
+			return cli.Exit(exitError, 2)
+		}
+		if err := checkProfile(c, selected); err != nil {
+			return err
+		}
+		pr = selected
+	}
+	u, err := newUpdater(loadedConfig.Update, pr, osPlatform)
+	if err != nil {
+		return err
+	}
+	info, newer, err := u.Check()
+	if err != nil {
+		return err
+	}
+	if !newer {
+		logger.Info(fmt.Sprintf("%s %s is up to date", appName, OsctrldVersion), emoji("✅"))
+		return nil
+	}
+	if c.Bool("check") {
+		logger.Info(fmt.Sprintf("%s %s is available, running %s", appName, info.Version, OsctrldVersion), emoji("🆕"))
+		return nil
+	}
+	if err := u.Apply(info); err != nil {
+		return fmt.Errorf("error updating to %s - %v", info.Version, err)
+	}
+	logger.Info(fmt.Sprintf("%s updated from %s to %s", appName, OsctrldVersion, info.Version), emoji("🆕"), LogFieldPath, u.exe)
+	if c.Bool("restart") {
+		if err := u.restart(); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("%s service restarted", appName), emoji("🔄"))
+	}
+	return nil
+}
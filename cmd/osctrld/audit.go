@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Default audit log file name, inside the platform configuration directory
+	defAuditFile = "audit.log"
+	// Extension for the file that keeps the head of the audit log, to detect truncation
+	auditHeadExtension = ".head"
+	// Extension for the file locked while appending, shared by all osctrld processes
+	auditLockExtension = ".lock"
+	// Hash used as previous hash by the first record
+	auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+	// How much of the audit log is read at a time, from the end, to find the last record
+	auditChunkSize = 64 * 1024
+)
+
+const (
+	// AuditActionWrite for files written by osctrld
+	AuditActionWrite = "write"
+	// AuditActionScript for scripts executed by osctrld
+	AuditActionScript = "script"
+	// AuditActionRestart for restarts of osqueryd
+	AuditActionRestart = "restart"
+	// AuditActionRollback for files restored from backups
+	AuditActionRollback = "rollback"
+	// AuditActionHealth for health checks of osqueryd after a change
+	AuditActionHealth = "health"
+	// AuditActionRemote for actions requested by osctrl
+	AuditActionRemote = "remote"
+	// AuditActionInstall for packages installed by osctrld
+	AuditActionInstall = "install"
+	// AuditActionUpdate for updates of the osctrld binary
+	AuditActionUpdate = "update"
+	// AuditActionService for commands that register or unregister the osctrld service
+	AuditActionService = "service"
+	// AuditOutcomeSuccess when the action succeeded
+	AuditOutcomeSuccess = "success"
+	// AuditOutcomeError when the action failed
+	AuditOutcomeError = "error"
+)
+
+// AuditConfiguration to hold the audit log configuration
+type AuditConfiguration struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"`
+}
+
+// AuditRecord for each change made by osctrld, chained to the previous record by its hash
+type AuditRecord struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Artifact string    `json:"artifact,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Exec     []string  `json:"exec,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Pid      int       `json:"pid"`
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash"`
+}
+
+// AuditHead keeps the last record of the audit log
+type AuditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog appends hash chained records to a file
+type AuditLog struct {
+	path    string
+	command string
+	mutex   sync.Mutex
+}
+
+// auditLog records changes, nil when the audit log is disabled
+var auditLog *AuditLog
+
+// Helper to create an audit log for a file, the file is created with the first record
+func newAuditLog(path, command string) *AuditLog {
+	return &AuditLog{path: path, command: command}
+}
+
+// Helper to hash content for audit records, empty content has no hash
+func auditHash(content []byte) string {
+	if content == nil {
+		return defEmptyValue
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Helper to hash a file for audit records, missing files have no hash
+func auditFileHash(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return defEmptyValue
+	}
+	return auditHash(content)
+}
+
+// Helper to calculate the hash of a record, which covers all fields except the hash itself
+func (r AuditRecord) calculateHash() (string, error) {
+	r.Hash = defEmptyValue
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return auditHash(raw), nil
+}
+
+// Record appends a record to the audit log, chained to the last record in the file
+func (a *AuditLog) Record(r AuditRecord) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return fmt.Errorf("error creating audit directory - %v", err)
+	}
+	// Other osctrld processes append to the same file, the lock keeps reading the last record and appending atomic
+	lock, err := os.OpenFile(a.path+auditLockExtension, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit lock - %v", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock, true); err != nil {
+		return fmt.Errorf("error locking audit log - %v", err)
+	}
+	defer unlockFile(lock)
+	// The last record is read from the file every time, other osctrld processes may have appended records
+	last, err := lastAuditRecord(a.path)
+	if err != nil {
+		return err
+	}
+	r.Seq = 1
+	r.Prev = auditGenesisHash
+	if last != nil {
+		r.Seq = last.Seq + 1
+		r.Prev = last.Hash
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.Command = a.command
+	r.Pid = os.Getpid()
+	if r.Hash, err = r.calculateHash(); err != nil {
+		return fmt.Errorf("error hashing audit record - %v", err)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding audit record - %v", err)
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log - %v", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing audit log - %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing audit log - %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	head, err := json.Marshal(AuditHead{Seq: r.Seq, Hash: r.Hash})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path+auditHeadExtension, head, 0600)
+}
+
+// Helper to read the last record of an audit log, nil if the log is empty or missing
+func lastAuditRecord(path string) (*AuditRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log - %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Records have no maximum size, chunks are read backwards until the start of the last one
+	var tail []byte
+	offset := info.Size()
+	for offset > 0 {
+		size := min(int64(auditChunkSize), offset)
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading audit log - %v", err)
+		}
+		tail = append(chunk, tail...)
+		if idx := bytes.LastIndexByte(bytes.TrimRight(tail, " \t\r\n"), '\n'); idx >= 0 {
+			tail = tail[idx+1:]
+			break
+		}
+	}
+	last := bytes.TrimSpace(tail)
+	if len(last) == 0 {
+		return nil, nil
+	}
+	var r AuditRecord
+	if err := json.Unmarshal(last, &r); err != nil {
+		return nil, fmt.Errorf("invalid last record in audit log - %v", err)
+	}
+	return &r, nil
+}
+
+// Helper to record a change in the audit log, if enabled. Errors are logged, they never stop the change
+func audit(r AuditRecord) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Record(r); err != nil {
+		logger.Warn(fmt.Sprintf("error recording %s of %s in audit log - %v", r.Action, r.Artifact, err), LogFieldArtifact, r.Artifact)
+	}
+}
+
+// Helper to record the outcome of an action in the audit log
+func auditOutcome(r AuditRecord, err error) {
+	r.Outcome = AuditOutcomeSuccess
+	if err != nil {
+		r.Outcome = AuditOutcomeError
+		r.Error = err.Error()
+	}
+	audit(r)
+}
+
+// Function to verify the audit log, returns the number of valid records and the problems found
+func verifyAuditLog(path string) (uint64, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error opening audit log - %v", err)
+	}
+	defer f.Close()
+	var problems []string
+	var count uint64
+	prev := auditGenesisHash
+	// The previous hash of the last record, the head may be one record behind
+	before := auditGenesisHash
+	// Records have no maximum size, lines are read without a limit
+	reader := bufio.NewReader(f)
+	line := 0
+	for {
+		content, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, nil, fmt.Errorf("error reading audit log - %v", err)
+		}
+		if err == io.EOF && len(content) == 0 {
+			break
+		}
+		line++
+		raw := bytes.TrimSpace(content)
+		if len(raw) == 0 {
+			continue
+		}
+		var r AuditRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d is not a valid record - %v", line, err))
+			break
+		}
+		if r.Seq != count+1 {
+			problems = append(problems, fmt.Sprintf("line %d has sequence %d, expected %d, records are missing", line, r.Seq, count+1))
+			break
+		}
+		if r.Prev != prev {
+			problems = append(problems, fmt.Sprintf("record %d is not chained to the previous record", r.Seq))
+			break
+		}
+		hash, err := r.calculateHash()
+		if err != nil {
+			return count, nil, err
+		}
+		if hash != r.Hash {
+			problems = append(problems, fmt.Sprintf("record %d has been modified", r.Seq))
+			break
+		}
+		count++
+		before = prev
+		prev = r.Hash
+	}
+	if len(problems) > 0 {
+		return count, problems, nil
+	}
+	// The head detects records removed from the end, which keeps the chain valid. It is written after the record,
+	// so it can be one record behind if osctrld stopped in between
+	content, err := os.ReadFile(path + auditHeadExtension)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("audit head is missing - %v", err))
+		return count, problems, nil
+	}
+	var head AuditHead
+	if err := json.Unmarshal(content, &head); err != nil {
+		problems = append(problems, fmt.Sprintf("audit head is invalid - %v", err))
+		return count, problems, nil
+	}
+	current := head.Seq == count && head.Hash == prev
+	behind := count > 1 && head.Seq == count-1 && head.Hash == before
+	if !current && !behind {
+		problems = append(problems, fmt.Sprintf("audit log ends at record %d but head is record %d, the log has been truncated or the head modified", count, head.Seq))
+	}
+	return count, problems, nil
+}
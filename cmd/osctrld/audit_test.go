@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create an audit log with records for tests
+func testAuditLog(t *testing.T, records int) string {
+	path := filepath.Join(t.TempDir(), "audit", defAuditFile)
+	a := newAuditLog(path, "flags")
+	for i := 0; i < records; i++ {
+		err := a.Record(AuditRecord{Action: AuditActionWrite, Artifact: "flags", Path: fmt.Sprintf("/etc/osquery/%d.flags", i), Outcome: AuditOutcomeSuccess})
+		assert.NoError(t, err)
+	}
+	return path
+}
+
+// Helper to rewrite the lines of an audit log
+func rewriteAuditLog(t *testing.T, path string, rewrite func([]string) []string) {
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := rewrite(strings.Split(strings.TrimSpace(string(content)), "\n"))
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+}
+
+func TestAuditLogValid(t *testing.T) {
+	path := testAuditLog(t, 3)
+	count, problems, err := verifyAuditLog(path)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, uint64(3), count)
+	last, err := lastAuditRecord(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), last.Seq)
+	assert.Equal(t, "flags", last.Command)
+}
+
+func TestAuditLogConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defAuditFile)
+	// Each audit log is a different process appending to the same file
+	logs := []*AuditLog{newAuditLog(path, "daemon"), newAuditLog(path, "flags")}
+	var wg sync.WaitGroup
+	for _, a := range logs {
+		wg.Add(1)
+		go func(a *AuditLog) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.NoError(t, a.Record(AuditRecord{Action: AuditActionWrite, Artifact: "flags", Outcome: AuditOutcomeSuccess}))
+			}
+		}(a)
+	}
+	wg.Wait()
+	count, problems, err := verifyAuditLog(path)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, uint64(100), count)
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	t.Run("modified", func(t *testing.T) {
+		path := testAuditLog(t, 3)
+		rewriteAuditLog(t, path, func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "/etc/osquery/1.flags", "/tmp/1.flags", 1)
+			return lines
+		})
+		count, problems, err := verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), count)
+		assert.Contains(t, problems[0], "record 2 has been modified")
+	})
+	t.Run("removed", func(t *testing.T) {
+		path := testAuditLog(t, 3)
+		rewriteAuditLog(t, path, func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		})
+		_, problems, err := verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Contains(t, problems[0], "records are missing")
+	})
+	t.Run("truncated", func(t *testing.T) {
+		path := testAuditLog(t, 3)
+		rewriteAuditLog(t, path, func(lines []string) []string {
+			return lines[:2]
+		})
+		count, problems, err := verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), count)
+		assert.Contains(t, problems[0], "truncated")
+	})
+	t.Run("missing head", func(t *testing.T) {
+		path := testAuditLog(t, 1)
+		assert.NoError(t, os.Remove(path+auditHeadExtension))
+		_, problems, err := verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Contains(t, problems[0], "head is missing")
+	})
+	t.Run("head one record behind", func(t *testing.T) {
+		path := testAuditLog(t, 3)
+		head, err := os.ReadFile(path + auditHeadExtension)
+		assert.NoError(t, err)
+		// osctrld stopped after appending a record and before writing the head
+		assert.NoError(t, newAuditLog(path, "flags").Record(AuditRecord{Action: AuditActionWrite, Artifact: "cert", Outcome: AuditOutcomeSuccess}))
+		assert.NoError(t, os.WriteFile(path+auditHeadExtension, head, 0600))
+		count, problems, err := verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+		assert.Equal(t, uint64(4), count)
+		// Two records behind is not a crash
+		assert.NoError(t, newAuditLog(path, "flags").Record(AuditRecord{Action: AuditActionWrite, Artifact: "cert", Outcome: AuditOutcomeSuccess}))
+		assert.NoError(t, os.WriteFile(path+auditHeadExtension, head, 0600))
+		_, problems, err = verifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Contains(t, problems[0], "truncated or the head modified")
+	})
+}
+
+func TestAuditLogLargeRecord(t *testing.T) {
+	path := testAuditLog(t, 1)
+	a := newAuditLog(path, "flags")
+	// Records can be larger than the chunks read to find the last one
+	large := strings.Repeat("x", 3*auditChunkSize)
+	assert.NoError(t, a.Record(AuditRecord{Action: AuditActionScript, Artifact: "script", Exec: []string{"/bin/sh", large}, Outcome: AuditOutcomeSuccess}))
+	last, err := lastAuditRecord(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), last.Seq)
+	assert.NoError(t, a.Record(AuditRecord{Action: AuditActionWrite, Artifact: "flags", Outcome: AuditOutcomeSuccess}))
+	count, problems, err := verifyAuditLog(path)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, uint64(3), count)
+}
+
+func TestWriteContentExistsAudit(t *testing.T) {
+	dir := t.TempDir()
+	auditLog = newAuditLog(filepath.Join(dir, defAuditFile), "flags")
+	defer func() { auditLog = nil }()
+	file := filepath.Join(dir, "osquery.flags")
+	url := "https://osctrl.url/dev/osctrld-flags"
+	assert.NoError(t, writeContentExists(file, "--host_identifier=uuid", "flags", url, false))
+	// Same content is not written again
+	assert.NoError(t, writeContentExists(file, "--host_identifier=uuid", "flags", url, false))
+	assert.Error(t, writeContentExists(file, "--host_identifier=hostname", "flags", url, false))
+	assert.NoError(t, writeContentExists(file, "--host_identifier=hostname", "flags", url, true))
+
+	count, problems, err := verifyAuditLog(auditLog.path)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, uint64(2), count)
+	last, err := lastAuditRecord(auditLog.path)
+	assert.NoError(t, err)
+	assert.Equal(t, AuditActionWrite, last.Action)
+	assert.Equal(t, url, last.URL)
+	assert.Equal(t, auditHash([]byte("--host_identifier=uuid")), last.Before)
+	assert.Equal(t, auditHash([]byte("--host_identifier=hostname")), last.After)
+	assert.Equal(t, AuditOutcomeSuccess, last.Outcome)
+}
+
+func TestWriteContentExistsPerm(t *testing.T) {
+	if runtime.GOOS == WindowsOS {
+		t.Skip("permissions are not supported")
+	}
+	dir := t.TempDir()
+	flags := filepath.Join(dir, "osquery.flags")
+	cert := filepath.Join(dir, "osctrl.crt")
+	assert.NoError(t, writeContentExists(flags, "--host_identifier=uuid", "flags", "", false))
+	assert.NoError(t, writeContentExists(flags, "--host_identifier=hostname", "flags", "", true))
+	assert.NoError(t, writeContentExists(cert, "CERTIFICATE", "cert", "", false))
+	for path, perm := range map[string]os.FileMode{flags: 0600, cert: 0644} {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, perm, info.Mode().Perm(), path)
+	}
+	// Temporary files of the atomic writes are not left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default directory for backups, inside the platform configuration directory
+	defBackupDir = "backups"
+	// Default number of versions to keep for each artifact
+	defBackupKeep = 10
+	// Index file with all the versions of an artifact
+	backupIndexFile = "index.json"
+	// Extension for backup files
+	backupExtension = ".bak"
+)
+
+// BackupConfiguration to hold the backup configuration
+type BackupConfiguration struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+	Keep    int    `json:"keep"`
+	MaxAge  string `json:"maxAge"`
+}
+
+// BackupVersion keeps the metadata of a backed up version of an artifact
+type BackupVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+}
+
+// BackupIndex keeps all the versions of an artifact, oldest first
+type BackupIndex struct {
+	Artifact string          `json:"artifact"`
+	Path     string          `json:"path"`
+	Versions []BackupVersion `json:"versions"`
+}
+
+// BackupStore keeps previous versions of managed artifacts, applying the retention policy
+type BackupStore struct {
+	dir    string
+	keep   int
+	maxAge time.Duration
+	mutex  sync.Mutex
+}
+
+// backupStore keeps previous versions before they are overwritten, nil when backups are disabled
+var backupStore *BackupStore
+
+// Helper to create a backup store from the configuration
+func newBackupStore(cfg BackupConfiguration) (*BackupStore, error) {
+	s := &BackupStore{dir: cfg.Dir, keep: cfg.Keep}
+	if s.keep <= 0 {
+		s.keep = defBackupKeep
+	}
+	if cfg.MaxAge != defEmptyValue {
+		d, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid maximum age %s for backups", cfg.MaxAge)
+		}
+		s.maxAge = d
+	}
+	return s, nil
+}
+
+// Helper to get the directory for the versions of an artifact, different files for the same artifact are kept apart
+func (s *BackupStore) artifactDir(artifact, path string) string {
+	return filepath.Join(s.dir, artifact+"-"+auditHash([]byte(filepath.Clean(path)))[:12])
+}
+
+// Index returns all the versions of an artifact, oldest first
+func (s *BackupStore) Index(artifact, path string) (BackupIndex, error) {
+	index := BackupIndex{Artifact: artifact, Path: path}
+	content, err := os.ReadFile(filepath.Join(s.artifactDir(artifact, path), backupIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("error reading backup index - %v", err)
+	}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return index, fmt.Errorf("error parsing backup index - %v", err)
+	}
+	return index, nil
+}
+
+// Save keeps the current content of a file as a new version of the artifact, if it is not the same as the last one
+func (s *BackupStore) Save(artifact, path string) (*BackupVersion, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s - %v", path, err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index, err := s.Index(artifact, path)
+	if err != nil {
+		return nil, err
+	}
+	hash := auditHash(content)
+	if n := len(index.Versions); n > 0 && index.Versions[n-1].SHA256 == hash {
+		return &index.Versions[n-1], nil
+	}
+	v := BackupVersion{Version: 1, Time: time.Now().UTC(), SHA256: hash, Size: int64(len(content))}
+	if n := len(index.Versions); n > 0 {
+		v.Version = index.Versions[n-1].Version + 1
+	}
+	dir := s.artifactDir(artifact, path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating backup directory - %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(v.Version)+backupExtension), content, 0600); err != nil {
+		return nil, fmt.Errorf("error writing backup - %v", err)
+	}
+	index.Versions = append(index.Versions, v)
+	if err := s.writeIndex(s.prune(index)); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Helper to apply the retention policy to an index, removing the files of expired versions
+func (s *BackupStore) prune(index BackupIndex) BackupIndex {
+	var kept []BackupVersion
+	for i, v := range index.Versions {
+		expired := len(index.Versions)-i > s.keep
+		if s.maxAge > 0 && time.Since(v.Time) > s.maxAge && i < len(index.Versions)-1 {
+			expired = true
+		}
+		if expired {
+			os.Remove(filepath.Join(s.artifactDir(index.Artifact, index.Path), strconv.Itoa(v.Version)+backupExtension))
+			continue
+		}
+		kept = append(kept, v)
+	}
+	index.Versions = kept
+	return index
+}
+
+// Helper to write the index of an artifact
+func (s *BackupStore) writeIndex(index BackupIndex) error {
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.artifactDir(index.Artifact, index.Path), backupIndexFile), content, 0600)
+}
+
+// Content returns the content of a version of an artifact, version 0 is the latest one
+func (s *BackupStore) Content(artifact, path string, version int) (BackupVersion, []byte, error) {
+	index, err := s.Index(artifact, path)
+	if err != nil {
+		return BackupVersion{}, nil, err
+	}
+	if len(index.Versions) == 0 {
+		return BackupVersion{}, nil, fmt.Errorf("no versions of %s for %s", artifact, path)
+	}
+	i := len(index.Versions) - 1
+	if version != 0 {
+		i = sort.Search(len(index.Versions), func(n int) bool { return index.Versions[n].Version >= version })
+		if i == len(index.Versions) || index.Versions[i].Version != version {
+			return BackupVersion{}, nil, fmt.Errorf("version %d of %s does not exist", version, artifact)
+		}
+	}
+	v := index.Versions[i]
+	content, err := os.ReadFile(filepath.Join(s.artifactDir(artifact, path), strconv.Itoa(v.Version)+backupExtension))
+	if err != nil {
+		return v, nil, fmt.Errorf("error reading version %d of %s - %v", v.Version, artifact, err)
+	}
+	if auditHash(content) != v.SHA256 {
+		return v, nil, fmt.Errorf("version %d of %s is corrupted, hash does not match", v.Version, artifact)
+	}
+	return v, content, nil
+}
+
+// Find returns the newest version of an artifact with the given hash
+func (s *BackupStore) Find(artifact, path, hash string) (BackupVersion, error) {
+	index, err := s.Index(artifact, path)
+	if err != nil {
+		return BackupVersion{}, err
+	}
+	for i := len(index.Versions) - 1; i >= 0; i-- {
+		if index.Versions[i].SHA256 == hash {
+			return index.Versions[i], nil
+		}
+	}
+	return BackupVersion{}, fmt.Errorf("no version of %s for %s with hash %s", artifact, path, hash)
+}
+
+// Previous returns the version to roll back to from the current content: the newest version different from it and,
+// if the current content is backed up, older than it. Rolling back again keeps going back instead of undoing
+func (s *BackupStore) Previous(artifact, path, current string) (int, error) {
+	index, err := s.Index(artifact, path)
+	if err != nil {
+		return 0, err
+	}
+	end := len(index.Versions)
+	for i := end - 1; i >= 0; i-- {
+		if index.Versions[i].SHA256 == current {
+			end = i
+			break
+		}
+	}
+	for i := end - 1; i >= 0; i-- {
+		if index.Versions[i].SHA256 != current {
+			return index.Versions[i].Version, nil
+		}
+	}
+	return 0, fmt.Errorf("no previous version of %s for %s", artifact, path)
+}
+
+// Helper to keep the current content of a file before it is overwritten, if backups are enabled. Errors are logged
+func backupBeforeWrite(artifact, path string) {
+	if backupStore == nil {
+		return
+	}
+	if _, err := backupStore.Save(artifact, path); err != nil {
+		logger.Warn(fmt.Sprintf("error backing up %s - %v", path, err), LogFieldArtifact, artifact, LogFieldPath, path)
+	}
+}
+
+// Helper to get the managed file for an artifact in a profile
+func artifactPath(pr *Profile, artifact string) (string, error) {
+	switch artifact {
+	case "flags":
+		return pr.Config.FlagFile, nil
+	case "cert":
+		return pr.Config.CertFile, nil
+	}
+	return "", fmt.Errorf("unknown artifact %s, valid values are flags and cert", artifact)
+}
+
+// Function to restore a version of an artifact atomically, the current content is kept as new version first.
+// Without version, the previous one is restored
+func rollbackArtifact(s *BackupStore, artifact, path string, version int) (BackupVersion, error) {
+	if version == 0 {
+		previous, err := s.Previous(artifact, path, auditFileHash(path))
+		if err != nil {
+			return BackupVersion{}, err
+		}
+		version = previous
+	}
+	v, content, err := s.Content(artifact, path, version)
+	if err != nil {
+		return v, err
+	}
+	if _, err := s.Save(artifact, path); err != nil {
+		return v, fmt.Errorf("error backing up current %s - %v", artifact, err)
+	}
+	r := AuditRecord{Action: AuditActionRollback, Artifact: artifact, Path: path, Before: auditFileHash(path), After: v.SHA256}
+	err = writeFileAtomic(path, content, artifactPerm(artifact))
+	if err != nil {
+		err = fmt.Errorf("error restoring %s to %s - %v", artifact, path, err)
+	}
+	auditOutcome(r, err)
+	return v, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create a backup store in a temporary directory for tests
+func testBackupStore(t *testing.T, keep int, maxAge string) *BackupStore {
+	s, err := newBackupStore(BackupConfiguration{Enabled: true, Dir: filepath.Join(t.TempDir(), defBackupDir), Keep: keep, MaxAge: maxAge})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestBackupStoreSave(t *testing.T) {
+	s := testBackupStore(t, 3, "")
+	file := filepath.Join(t.TempDir(), "osquery.flags")
+	v, err := s.Save("flags", file)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	assert.NoError(t, os.WriteFile(file, []byte("--host_identifier=uuid"), 0600))
+	v, err = s.Save("flags", file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Version)
+	assert.Equal(t, auditHash([]byte("--host_identifier=uuid")), v.SHA256)
+	assert.Equal(t, int64(22), v.Size)
+	// Same content is not saved again
+	v, err = s.Save("flags", file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Version)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, os.WriteFile(file, []byte("--verbose="+strconv.Itoa(i)), 0600))
+		_, err = s.Save("flags", file)
+		assert.NoError(t, err)
+	}
+	index, err := s.Index("flags", file)
+	assert.NoError(t, err)
+	assert.Len(t, index.Versions, 3)
+	assert.Equal(t, 3, index.Versions[0].Version)
+	assert.Equal(t, 5, index.Versions[2].Version)
+	_, err = os.Stat(filepath.Join(s.artifactDir("flags", file), "2"+backupExtension))
+	assert.True(t, os.IsNotExist(err))
+	// Other files for the same artifact are kept apart
+	index, err = s.Index("flags", file+".other")
+	assert.NoError(t, err)
+	assert.Empty(t, index.Versions)
+}
+
+func TestBackupStoreMaxAge(t *testing.T) {
+	s := testBackupStore(t, 10, "1h")
+	file := filepath.Join(t.TempDir(), "osctrl.crt")
+	index := BackupIndex{Artifact: "cert", Path: file}
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute} {
+		index.Versions = append(index.Versions, BackupVersion{Version: i + 1, Time: time.Now().Add(-age)})
+	}
+	pruned := s.prune(index)
+	assert.Len(t, pruned.Versions, 1)
+	assert.Equal(t, 3, pruned.Versions[0].Version)
+	// The newest version is always kept
+	index.Versions = index.Versions[:2]
+	pruned = s.prune(index)
+	assert.Len(t, pruned.Versions, 1)
+	assert.Equal(t, 2, pruned.Versions[0].Version)
+
+	_, err := newBackupStore(BackupConfiguration{MaxAge: "month"})
+	assert.Error(t, err)
+}
+
+func TestRollbackArtifact(t *testing.T) {
+	s := testBackupStore(t, 10, "")
+	dir := t.TempDir()
+	auditLog = newAuditLog(filepath.Join(dir, defAuditFile), "rollback")
+	defer func() { auditLog = nil }()
+	file := filepath.Join(dir, "osquery.flags")
+	_, err := rollbackArtifact(s, "flags", file, 0)
+	assert.Error(t, err)
+
+	for _, content := range []string{"one", "two"} {
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+		_, err = s.Save("flags", file)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, os.WriteFile(file, []byte("three"), 0600))
+	v, err := rollbackArtifact(s, "flags", file, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Version)
+	assert.True(t, checkFileContent(file, "one"))
+	// Current content was kept before restoring
+	index, err := s.Index("flags", file)
+	assert.NoError(t, err)
+	assert.Len(t, index.Versions, 3)
+	assert.Equal(t, auditHash([]byte("three")), index.Versions[2].SHA256)
+	last, err := lastAuditRecord(auditLog.path)
+	assert.NoError(t, err)
+	assert.Equal(t, AuditActionRollback, last.Action)
+	assert.Equal(t, auditHash([]byte("one")), last.After)
+
+	_, err = rollbackArtifact(s, "flags", file, 7)
+	assert.Error(t, err)
+	// Corrupted versions are not restored
+	assert.NoError(t, os.WriteFile(filepath.Join(s.artifactDir("flags", file), "2"+backupExtension), []byte("tampered"), 0600))
+	_, err = rollbackArtifact(s, "flags", file, 2)
+	assert.Error(t, err)
+	assert.True(t, checkFileContent(file, "one"))
+}
+
+func TestRollbackArtifactPrevious(t *testing.T) {
+	s := testBackupStore(t, 10, "")
+	file := filepath.Join(t.TempDir(), "osquery.flags")
+	for _, content := range []string{"one", "two"} {
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+		_, err := s.Save("flags", file)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, os.WriteFile(file, []byte("three"), 0600))
+	// Each rollback goes back one version, instead of toggling between the newest ones
+	for _, expected := range []string{"two", "one"} {
+		_, err := rollbackArtifact(s, "flags", file, 0)
+		assert.NoError(t, err)
+		assert.True(t, checkFileContent(file, expected), expected)
+	}
+	_, err := rollbackArtifact(s, "flags", file, 0)
+	assert.EqualError(t, err, fmt.Sprintf("no previous version of flags for %s", file))
+	assert.True(t, checkFileContent(file, "one"))
+}
+
+func TestWriteContentExistsBackup(t *testing.T) {
+	backupStore = testBackupStore(t, 10, "")
+	defer func() { backupStore = nil }()
+	file := filepath.Join(t.TempDir(), "osquery.flags")
+	url := "https://osctrl.url/dev/osctrld-flags"
+	assert.NoError(t, writeContentExists(file, "--host_identifier=uuid", "flags", url, false))
+	assert.NoError(t, writeContentExists(file, "--host_identifier=hostname", "flags", url, true))
+	_, content, err := backupStore.Content("flags", file, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "--host_identifier=uuid", string(content))
+}
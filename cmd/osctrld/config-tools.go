@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Value to show instead of secrets
+	redactedValue = "********"
+	// ConfigFormatYAML for configuration files in YAML, with comments
+	ConfigFormatYAML = "yaml"
+	// ConfigFormatJSON for configuration files in JSON
+	ConfigFormatJSON = "json"
+)
+
+// secretConfigKeys with the configuration keys that hold secrets and must be redacted
+var secretConfigKeys = map[string]bool{
+	"secret":           true,
+	"secretstoretoken": true,
+}
+
+// Helper to collect all known configuration keys, lowercase and separated with dots
+func configKnownKeys() map[string]bool {
+	keys := make(map[string]bool)
+	collectConfigKeys(reflect.TypeOf(JSONConfiguration{}), "", keys)
+	return keys
+}
+
+// Helper to collect configuration keys from the json tags of a struct type
+func collectConfigKeys(t reflect.Type, prefix string, keys map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := strings.ToLower(name)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if f.Type.Kind() == reflect.Struct {
+			collectConfigKeys(f.Type, key, keys)
+			continue
+		}
+		keys[key] = true
+	}
+}
+
+// Helper to redact a configuration value if the key holds a secret, references to secret sources are kept
+func redactConfigValue(key string, value any) any {
+	if !secretConfigKeys[strings.ToLower(key)] {
+		return value
+	}
+	if s, ok := value.(string); ok && (s == "" || isSecretReference(s)) {
+		return value
+	}
+	return redactedValue
+}
+
+// Helper to validate the configuration, returns the list of problems found, empty if valid
+func validateConfiguration(cfg JSONConfiguration, layers *LayeredConfiguration) []string {
+	var problems []string
+	// Unknown keys, most likely typos
+	if layers != nil {
+		known := configKnownKeys()
+		var unknown []string
+		for k, v := range layers.values {
+			if !known[k] {
+				unknown = append(unknown, fmt.Sprintf("unknown key %s in %s", k, v.Source))
+			}
+		}
+		sort.Strings(unknown)
+		problems = append(problems, unknown...)
+	}
+	// Required values
+	if cfg.Environment == "" {
+		problems = append(problems, "environment is required")
+	}
+	if cfg.BaseURL == "" {
+		problems = append(problems, "baseurl is required")
+	} else if err := validateBaseURL(cfg.BaseURL); err != nil {
+		problems = append(problems, fmt.Sprintf("baseurl %s is invalid - %v", cfg.BaseURL, err))
+	}
+	// Secret sources
+	if _, err := parseSecretSource(cfg.Secret, cfg.SecretToken, cfg.Insecure); err != nil {
+		problems = append(problems, fmt.Sprintf("secret is invalid - %v", err))
+	}
+	// Version policy
+	for name, v := range map[string]string{"min": cfg.OsqueryVersion.Min, "max": cfg.OsqueryVersion.Max, "pin": cfg.OsqueryVersion.Pin} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseOsqueryVersion(v); err != nil {
+			problems = append(problems, fmt.Sprintf("osqueryVersion.%s is invalid - %v", name, err))
+		}
+	}
+	// Logging
+	if _, err := parseLogLevel(cfg.Log.Level, false); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level is invalid - %v", err))
+	}
+	switch strings.ToLower(cfg.Log.Format) {
+	case defEmptyValue, LogFormatAuto, LogFormatEmoji, LogFormatText, LogFormatJSON:
+	default:
+		problems = append(problems, fmt.Sprintf("log.format %s is invalid, valid values are auto, emoji, text and json", cfg.Log.Format))
+	}
+	switch strings.ToLower(cfg.Log.Output) {
+	case defEmptyValue, LogOutputStderr, LogOutputFile, LogOutputJournald:
+	case LogOutputSyslog:
+		if _, _, err := parseSyslogAddress(cfg.Log.SyslogAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("log.syslogAddress is invalid - %v", err))
+		}
+		if _, ok := syslogFacilities[strings.ToLower(cfg.Log.SyslogFacility)]; !ok && cfg.Log.SyslogFacility != defEmptyValue {
+			problems = append(problems, fmt.Sprintf("log.syslogFacility %s is invalid", cfg.Log.SyslogFacility))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("log.output %s is invalid, valid values are stderr, file, journald and syslog", cfg.Log.Output))
+	}
+	if cfg.Log.File != defEmptyValue {
+		if err := checkWritable(cfg.Log.File); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not writable - %v", cfg.Log.File, err))
+		}
+	}
+	// Backups
+	if cfg.Backups.Keep < 0 {
+		problems = append(problems, fmt.Sprintf("backups.keep %d is invalid, it must be positive", cfg.Backups.Keep))
+	}
+	if cfg.Backups.MaxAge != defEmptyValue {
+		if d, err := time.ParseDuration(cfg.Backups.MaxAge); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("backups.maxAge %s is invalid, it must be a duration like 720h", cfg.Backups.MaxAge))
+		}
+	}
+	// Lock
+	if _, err := parseLockTimeout(cfg.Lock.Timeout); err != nil {
+		problems = append(problems, fmt.Sprintf("lock.timeout is invalid - %v", err))
+	}
+	// Metrics
+	problems = append(problems, validateMetricsConfiguration(cfg.Metrics)...)
+	// Control API
+	problems = append(problems, validateControlConfiguration(cfg.Control)...)
+	// Self-update
+	if _, _, err := parseUpdateConfiguration(cfg.Update); err != nil {
+		problems = append(problems, fmt.Sprintf("update is invalid - %v", err))
+	}
+	// Guarded changes
+	if _, _, err := parseGuardDurations(cfg.Guard); err != nil {
+		problems = append(problems, fmt.Sprintf("guard is invalid - %v", err))
+	}
+	if cfg.Guard.MaxRestarts < 0 {
+		problems = append(problems, fmt.Sprintf("guard.maxRestarts %d is invalid, it must be positive", cfg.Guard.MaxRestarts))
+	}
+	// Heartbeat
+	if _, err := parseHeartbeatInterval(cfg.Heartbeat.Interval); err != nil {
+		problems = append(problems, fmt.Sprintf("heartbeat.interval is invalid - %v", err))
+	}
+	// Remote actions
+	if _, _, _, err := parseActionsConfiguration(cfg.Actions); err != nil {
+		problems = append(problems, fmt.Sprintf("actions is invalid - %v", err))
+	}
+	// Managed files must be writable
+	for _, p := range []string{cfg.SecretFile, cfg.FlagFile, cfg.CertFile} {
+		if err := checkWritable(p); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not writable - %v", p, err))
+		}
+	}
+	return problems
+}
+
+// Helper to validate the configuration of all profiles, returns the list of problems found, empty if valid
+func validateProfilesConfiguration(profiles []*Profile) []string {
+	var problems []string
+	for _, pr := range profiles {
+		for _, p := range validateConfiguration(pr.Config, pr.Layers) {
+			if len(profiles) > 1 {
+				p = fmt.Sprintf("profile %s: %s", pr.Name, p)
+			}
+			problems = append(problems, p)
+		}
+	}
+	return append(problems, validateProfiles(profiles)...)
+}
+
+// Helper to validate the format of the osctrl base URL
+func validateBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is missing")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("query and fragment are not allowed")
+	}
+	return nil
+}
+
+// configInitTemplate for the starter configuration file in YAML, with comments
+const configInitTemplate = `# Configuration for osctrld, generated for {{ .Platform }}
+osctrld:
+  # Enroll secret to authenticate against osctrl server. Instead of plaintext, it can be read from
+  # a file (file:/run/secrets/osctrl), an environment variable (env:NAME), the output of a command
+  # (exec:/usr/local/bin/get-secret) or an HTTP secret store (https://vault.url/osctrl)
+  secret: ""
+  # Token for the HTTP secret store, it can be a reference like file: or env:
+  secretStoreToken: ""
+  # Environment in osctrl to enroll nodes to, name or UUID
+  environment: "environment_name_or_UUID"
+  # Base URL for the osctrl server
+  baseurl: "https://osctrl.url"
+  # Path for the osquery installation
+  osquery: {{ printf "%q" .Config.OsqueryPath }}
+  # Secret file for osquery
+  secretFile: {{ printf "%q" .Config.SecretFile }}
+  # Flagfile for osquery
+  flags: {{ printf "%q" .Config.FlagFile }}
+  # Certificate for osquery, if needed
+  cert: {{ printf "%q" .Config.CertFile }}
+  # Ignore TLS warnings, often used with self-signed certificates
+  insecure: false
+  # Enable verbose informational messages
+  verbose: false
+  # Overwrite existing files for flags, certificate and secret
+  force: false
+  # Acceptable osquery versions, all values are optional
+  osqueryVersion:
+    min: ""
+    max: ""
+    pin: ""
+  # Osquery installation layout: auto, {{ .Layouts }} or custom
+  osqueryLayout:
+    name: "auto"
+    # Values below override the layout, empty values are taken from it. For {{ .Layout.Name }} they are:
+    #   binary: {{ printf "%q" .Layout.Binary }}
+    #   service: {{ printf "%q" .Layout.Service }}
+    #   database: {{ printf "%q" .Layout.Database }}
+    #   extensions: {{ printf "%q" .Layout.Extensions }}
+    binary: ""
+    service: ""
+    database: ""
+    extensions: ""
+  # Logging: level is debug, info, warn or error, and format is auto (emoji for terminals and text
+  # otherwise), emoji, text or json. Output is stderr, file, journald or syslog. With a file, logs are
+  # rotated when they reach maxSize megabytes. Syslog address can be unix:///dev/log or udp://host:514
+  log:
+    level: "info"
+    format: "auto"
+    output: ""
+    file: ""
+    maxSize: {{ .LogMaxSize }}
+    maxBackups: {{ .LogMaxBackups }}
+    journaldSocket: "{{ .JournaldSocket }}"
+    syslogAddress: "{{ .SyslogAddress }}"
+    syslogFacility: "{{ .SyslogFacility }}"
+  # Audit log of every file written, script executed and restart of osqueryd, hash chained to detect
+  # tampering. Default file is audit.log in the osctrld configuration directory
+  audit:
+    enabled: true
+    file: ""
+  # Previous versions of flags and cert are kept before they are overwritten, to be restored with
+  # rollback. The last keep versions are kept, and versions older than maxAge (like 720h) are removed
+  backups:
+    enabled: true
+    dir: ""
+    keep: {{ .BackupKeep }}
+    maxAge: ""
+  # State of osctrld: last sync, fetch and apply of each artifact, shown by status. Default directory
+  # is state in the osctrld configuration directory
+  state:
+    dir: ""
+  # Commands that change files take a lock for the profile in the state directory, and wait up to
+  # timeout for another osctrld process to release it
+  lock:
+    timeout: "{{ .LockTimeout }}"
+  # Prometheus metrics, served by the daemon in listen (like 127.0.0.1:9110) and written after each
+  # reconcile to textfile (like /var/lib/node_exporter/textfile/osctrld.prom) for node_exporter
+  metrics:
+    listen: ""
+    textfile: ""
+  # Control API of the daemon, in a unix socket only accessible by its user, used by osctrld ctl.
+  # Default socket is osctrld.sock in the state directory
+  control:
+    enabled: true
+    socket: ""
+  # Self-update of the osctrld binary: new releases are checked in osctrl, or in the manifest of url
+  # (JSON with version and url of the release). The checksums file of the release must be signed with
+  # the Ed25519 key of publicKey (base64). With auto, the daemon checks every interval, updates and
+  # restarts its service
+  update:
+    auto: false
+    url: ""
+    publicKey: ""
+    interval: "{{ .UpdateInterval }}"
+  # Guarded changes: when flags or cert change, osqueryd is restarted and watched for window. If it
+  # stops running, restarts more than maxRestarts times or osqueryi does not answer (with query),
+  # the previous version is restored, osqueryd restarted again and the failure reported to osctrl
+  guard:
+    enabled: false
+    window: "{{ .GuardWindow }}"
+    interval: "{{ .GuardInterval }}"
+    maxRestarts: {{ .GuardMaxRestarts }}
+    query: false
+  # Heartbeat: the status of the node (osquery version, osqueryd running, hashes of flags and cert,
+  # last verification and host facts) is sent by the daemon to osctrl every interval
+  heartbeat:
+    enabled: false
+    interval: "{{ .HeartbeatInterval }}"
+  # Remote actions: the daemon polls osctrl every interval for actions, holding the request up to
+  # wait for long polling. Actions must be signed with the Ed25519 key of publicKey (base64), and
+  # allowed limits them to a comma separated list of refresh-flags, rotate-cert, restart-osqueryd,
+  # re-enroll, support-bundle and upgrade-osquery. Empty allows all of them
+  actions:
+    enabled: false
+    publicKey: ""
+    interval: "{{ .ActionsInterval }}"
+    wait: ""
+    allowed: ""
+  # Named profiles, to manage several osctrl environments on one host. Values above are shared and
+  # each profile overrides them. Profiles must not share secretFile, flags or cert
+  # profiles:
+  #   production:
+  #     environment: "production"
+  #   canary:
+  #     environment: "canary"
+  #     secretFile: "/etc/osquery/canary.secret"
+  #     flags: "/etc/osquery/canary.flags"
+  #     cert: "/etc/osquery/canary.crt"
+`
+
+// Helper to generate a starter configuration for a platform, in YAML with comments or in JSON
+func generateConfiguration(p Platform, format string) ([]byte, error) {
+	var cfg JSONConfiguration
+	applyPlatformDefaults(&cfg, p)
+	layout := OsqueryLayout{Name: LayoutCustom}
+	var names []string
+	for _, l := range p.OsqueryLayouts() {
+		names = append(names, l.Name)
+	}
+	if len(names) > 0 {
+		layout = p.OsqueryLayouts()[0]
+	}
+	switch format {
+	case ConfigFormatJSON:
+		cfg.Environment = "environment_name_or_UUID"
+		cfg.BaseURL = "https://osctrl.url"
+		cfg.OsqueryLayout.Name = LayoutAuto
+		cfg.Log = LogConfiguration{
+			Level:          "info",
+			Format:         LogFormatAuto,
+			MaxSize:        defLogMaxSize,
+			MaxBackups:     defLogMaxBackups,
+			JournaldSocket: defJournaldSocket,
+			SyslogAddress:  defSyslogAddress,
+			SyslogFacility: defSyslogFacility,
+		}
+		cfg.Audit.Enabled = true
+		cfg.Backups = BackupConfiguration{Enabled: true, Keep: defBackupKeep}
+		cfg.Lock.Timeout = defLockTimeout.String()
+		cfg.Control.Enabled = true
+		cfg.Update.Interval = defUpdateInterval.String()
+		cfg.Guard = GuardConfiguration{Window: defGuardWindow.String(), Interval: defGuardInterval.String(), MaxRestarts: defGuardMaxRestarts}
+		cfg.Heartbeat.Interval = defHeartbeatInterval.String()
+		cfg.Actions.Interval = defActionsInterval.String()
+		return json.MarshalIndent(map[string]JSONConfiguration{configurationKey: cfg}, "", "  ")
+	case ConfigFormatYAML:
+		tmpl, err := template.New("config").Parse(configInitTemplate)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		data := struct {
+			Platform          string
+			Layouts           string
+			Layout            OsqueryLayout
+			Config            JSONConfiguration
+			LogMaxSize        int
+			LogMaxBackups     int
+			JournaldSocket    string
+			SyslogAddress     string
+			SyslogFacility    string
+			BackupKeep        int
+			GuardWindow       string
+			GuardInterval     string
+			GuardMaxRestarts  int
+			LockTimeout       string
+			HeartbeatInterval string
+			ActionsInterval   string
+			UpdateInterval    string
+		}{
+			Platform:          p.Name(),
+			Layouts:           strings.Join(names, ", "),
+			Layout:            layout,
+			Config:            cfg,
+			LogMaxSize:        defLogMaxSize,
+			LogMaxBackups:     defLogMaxBackups,
+			JournaldSocket:    defJournaldSocket,
+			SyslogAddress:     defSyslogAddress,
+			SyslogFacility:    defSyslogFacility,
+			BackupKeep:        defBackupKeep,
+			GuardWindow:       defGuardWindow.String(),
+			GuardInterval:     defGuardInterval.String(),
+			GuardMaxRestarts:  defGuardMaxRestarts,
+			LockTimeout:       defLockTimeout.String(),
+			HeartbeatInterval: defHeartbeatInterval.String(),
+			ActionsInterval:   defActionsInterval.String(),
+			UpdateInterval:    defUpdateInterval.String(),
+		}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
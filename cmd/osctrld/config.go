@@ -1,47 +1,555 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
 )
 
 const (
 	configurationKey = "osctrld"
+	// Directory for configuration drop-ins, next to the configuration file
+	configDropInDir = "conf.d"
+	// Default configuration file name, inside the platform configuration directory
+	defConfigFile = "osctrld.json"
+)
+
+const (
+	// OriginDefault for built-in default values
+	OriginDefault = "default"
+	// OriginFile for values from the configuration file
+	OriginFile = "file"
+	// OriginDropIn for values from drop-in files in conf.d
+	OriginDropIn = "drop-in"
+	// OriginEnv for values from environment variables
+	OriginEnv = "env"
+	// OriginFlag for values from command line flags
+	OriginFlag = "flag"
+	// OriginDetected for values detected in the host, like the osquery layout
+	OriginDetected = "detected"
+	// OriginDerived for values derived from other configuration values
+	OriginDerived = "derived"
 )
 
 // JSONConfiguration to hold all configuration values for osctrld
 type JSONConfiguration struct {
-	Secret       string `json:"secret"`
-	SecretFile   string `json:"secretFile"`
-	FlagFile     string `json:"flags"`
-	CertFile     string `json:"cert"`
-	EnrollScript string `json:"enrollScript"`
-	RemoveScript string `json:"removeScript"`
-	OsqueryPath  string `json:"osquery"`
-	Environment  string `json:"environment"`
-	BaseURL      string `json:"baseurl"`
-	Insecure     bool   `json:"insecure"`
-	Verbose      bool   `json:"verbose"`
-	Force        bool   `json:"force"`
+	Secret         string                 `json:"secret"`
+	SecretToken    string                 `json:"secretStoreToken"`
+	SecretFile     string                 `json:"secretFile"`
+	FlagFile       string                 `json:"flags"`
+	CertFile       string                 `json:"cert"`
+	EnrollScript   string                 `json:"enrollScript"`
+	RemoveScript   string                 `json:"removeScript"`
+	OsqueryPath    string                 `json:"osquery"`
+	Environment    string                 `json:"environment"`
+	BaseURL        string                 `json:"baseurl"`
+	Insecure       bool                   `json:"insecure"`
+	Verbose        bool                   `json:"verbose"`
+	Force          bool                   `json:"force"`
+	OsqueryVersion VersionPolicy          `json:"osqueryVersion"`
+	OsqueryLayout  OsqueryLayout          `json:"osqueryLayout"`
+	Log            LogConfiguration       `json:"log"`
+	Audit          AuditConfiguration     `json:"audit"`
+	Backups        BackupConfiguration    `json:"backups"`
+	Guard          GuardConfiguration     `json:"guard"`
+	Heartbeat      HeartbeatConfiguration `json:"heartbeat"`
+	Actions        ActionsConfiguration   `json:"actions"`
+	State          StateConfiguration     `json:"state"`
+	Lock           LockConfiguration      `json:"lock"`
+	Metrics        MetricsConfiguration   `json:"metrics"`
+	Control        ControlConfiguration   `json:"control"`
+	Update         UpdateConfiguration    `json:"update"`
+}
+
+// ConfigValue keeps an effective configuration value and where it came from
+type ConfigValue struct {
+	Value     any
+	Origin    string
+	Source    string
+	Encrypted bool
+}
+
+// LayeredConfiguration keeps configuration values merged field by field, each layer overriding the previous ones
+type LayeredConfiguration struct {
+	values map[string]ConfigValue
+}
+
+// LoadedConfiguration keeps the configuration resolved from all layers, with one profile for each osctrl environment
+type LoadedConfiguration struct {
+	Layers   *LayeredConfiguration
+	Profiles []*Profile
+	Log      LogConfiguration
+	Audit    AuditConfiguration
+	Backups  BackupConfiguration
+	State    StateConfiguration
+	Lock     LockConfiguration
+	Metrics  MetricsConfiguration
+	Control  ControlConfiguration
+	Update   UpdateConfiguration
+	Verbose  bool
+}
+
+// configFlagKeys maps the CLI flags that override configuration values to their configuration key
+var configFlagKeys = map[string]string{
+	"secret":         "secret",
+	"secret-token":   "secretstoretoken",
+	"environment":    "environment",
+	"secret-file":    "secretfile",
+	"flagfile":       "flags",
+	"certificate":    "cert",
+	"osctrl-url":     "baseurl",
+	"osquery-path":   "osquery",
+	"osquery-layout": "osquerylayout.name",
+	"insecure":       "insecure",
+	"verbose":        "verbose",
+	"force":          "force",
+	"log-level":      "log.level",
+	"log-format":     "log.format",
+	"log-file":       "log.file",
+	"log-output":     "log.output",
+	"lock-timeout":   "lock.timeout",
+}
+
+// Helper to create an empty layered configuration
+func newLayeredConfiguration() *LayeredConfiguration {
+	return &LayeredConfiguration{values: make(map[string]ConfigValue)}
+}
+
+// Set assigns a value to a key, overriding any previous value
+func (l *LayeredConfiguration) Set(key string, value any, origin, source string) {
+	l.values[strings.ToLower(key)] = ConfigValue{Value: value, Origin: origin, Source: source}
+}
+
+// Merge assigns all values from a layer, keys are flattened with dots
+func (l *LayeredConfiguration) Merge(values map[string]any, origin, source string) {
+	for k, v := range flattenConfig("", values) {
+		l.Set(k, v, origin, source)
+	}
+}
+
+// Get returns the value for a key, if it has been set by any layer
+func (l *LayeredConfiguration) Get(key string) (ConfigValue, bool) {
+	v, ok := l.values[strings.ToLower(key)]
+	return v, ok
+}
+
+// Decrypt replaces all encrypted values with their plaintext, in memory. The key is only loaded if needed
+func (l *LayeredConfiguration) Decrypt(loadKey func() ([]byte, error)) error {
+	var key []byte
+	for k, v := range l.values {
+		s, ok := v.Value.(string)
+		if !ok || !isEncryptedValue(s) {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = loadKey(); err != nil {
+				return err
+			}
+		}
+		plain, err := decryptValue(s, key)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s from %s - %v", k, v.Source, err)
+		}
+		v.Value = plain
+		v.Encrypted = true
+		l.values[k] = v
+	}
+	return nil
+}
+
+// Resolve records the values of keys resolved while loading, like platform defaults or the detected osquery
+// layout, so where they came from is reported. Only values that differ from the layered ones are recorded
+func (l *LayeredConfiguration) Resolve(cfg JSONConfiguration, origin, source string, keys ...string) error {
+	values, err := flattenConfiguration(cfg)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		key := strings.ToLower(k)
+		matched := false
+		for _, prefix := range keys {
+			prefix = strings.ToLower(prefix)
+			if key == prefix || strings.HasPrefix(key, prefix+".") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		current, ok := l.Get(key)
+		if (ok && fmt.Sprint(current.Value) == fmt.Sprint(v)) || (!ok && fmt.Sprint(v) == defEmptyValue) {
+			continue
+		}
+		l.Set(key, v, origin, source)
+	}
+	return nil
+}
+
+// Configuration returns the merged values as configuration
+func (l *LayeredConfiguration) Configuration() (JSONConfiguration, error) {
+	var cfg JSONConfiguration
+	nested := make(map[string]any)
+	for k, v := range l.values {
+		parts := strings.Split(k, ".")
+		m := nested
+		for _, p := range parts[:len(parts)-1] {
+			sub, ok := m[p].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[parts[len(parts)-1]] = v.Value
+	}
+	raw, err := json.Marshal(nested)
+	if err != nil {
+		return cfg, fmt.Errorf("error merging configuration - %v", err)
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing configuration - %v", err)
+	}
+	return cfg, nil
+}
+
+// Helper to flatten nested configuration values into keys separated with dots
+func flattenConfig(prefix string, values map[string]any) map[string]any {
+	flat := make(map[string]any)
+	for k, v := range values {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if sub, ok := v.(map[string]any); ok {
+			for sk, sv := range flattenConfig(key, sub) {
+				flat[sk] = sv
+			}
+			continue
+		}
+		flat[key] = v
+	}
+	return flat
+}
+
+// Helper to return the built-in default values
+func defaultConfigValues() map[string]any {
+	return map[string]any{
+		"insecure": false,
+		"verbose":  false,
+		"force":    false,
+		"osqueryLayout": map[string]any{
+			"name": LayoutAuto,
+		},
+		"log": map[string]any{
+			"level":          "info",
+			"format":         LogFormatAuto,
+			"maxSize":        defLogMaxSize,
+			"maxBackups":     defLogMaxBackups,
+			"journaldSocket": defJournaldSocket,
+			"syslogAddress":  defSyslogAddress,
+			"syslogFacility": defSyslogFacility,
+		},
+		"audit": map[string]any{
+			"enabled": true,
+		},
+		"backups": map[string]any{
+			"enabled": true,
+			"keep":    defBackupKeep,
+		},
+		"lock": map[string]any{
+			"timeout": defLockTimeout.String(),
+		},
+		"control": map[string]any{
+			"enabled": true,
+		},
+		"update": map[string]any{
+			"auto":     false,
+			"interval": defUpdateInterval.String(),
+		},
+		"guard": map[string]any{
+			"enabled":     false,
+			"window":      defGuardWindow.String(),
+			"interval":    defGuardInterval.String(),
+			"maxRestarts": defGuardMaxRestarts,
+			"query":       false,
+		},
+		"heartbeat": map[string]any{
+			"enabled":  false,
+			"interval": defHeartbeatInterval.String(),
+		},
+		"actions": map[string]any{
+			"enabled":  false,
+			"interval": defActionsInterval.String(),
+		},
+	}
+}
+
+// Helper to read a single configuration file and return its values, under the osctrld key
+func readConfigFile(file string) (map[string]any, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	configRaw := v.Sub(configurationKey)
+	if configRaw == nil {
+		return nil, fmt.Errorf("missing %s key in %s", configurationKey, file)
+	}
+	return configRaw.AllSettings(), nil
+}
+
+// Helper to list drop-in files for a configuration file, sorted by name
+func configDropIns(file string) ([]string, error) {
+	var dropIns []string
+	for _, ext := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(file), configDropInDir, ext))
+		if err != nil {
+			return nil, err
+		}
+		dropIns = append(dropIns, matches...)
+	}
+	sort.Strings(dropIns)
+	return dropIns, nil
+}
+
+// Function to load the configuration file with defaults and drop-ins, a missing default file is not an error
+func loadConfigurationLayers(file string, required bool) (*LayeredConfiguration, error) {
+	layers := newLayeredConfiguration()
+	layers.Merge(defaultConfigValues(), OriginDefault, "built-in")
+	if file == "" {
+		return layers, nil
+	}
+	if !required && !checkFileExist(file) {
+		return layers, nil
+	}
+	values, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	layers.Merge(values, OriginFile, file)
+	dropIns, err := configDropIns(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dropIns {
+		values, err := readConfigFile(d)
+		if err != nil {
+			return nil, err
+		}
+		layers.Merge(values, OriginDropIn, d)
+	}
+	return layers, nil
+}
+
+// ApplyEnv assigns values from environment variables of the CLI flags, using lookup to read them
+func (l *LayeredConfiguration) ApplyEnv(cliFlags []cli.Flag, lookup func(string) (string, bool)) error {
+	for _, f := range cliFlags {
+		key, ok := configFlagKeys[f.Names()[0]]
+		if !ok {
+			continue
+		}
+		var envVars []string
+		_, isBool := f.(*cli.BoolFlag)
+		switch ff := f.(type) {
+		case *cli.StringFlag:
+			envVars = ff.EnvVars
+		case *cli.BoolFlag:
+			envVars = ff.EnvVars
+		}
+		for _, e := range envVars {
+			value, found := lookup(e)
+			if !found {
+				continue
+			}
+			if !isBool {
+				l.Set(key, value, OriginEnv, e)
+				break
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s - %v", value, e, err)
+			}
+			l.Set(key, b, OriginEnv, e)
+			break
+		}
+	}
+	return nil
+}
+
+// ApplyFlags assigns values from CLI flags set in the command line
+func (l *LayeredConfiguration) ApplyFlags(c *cli.Context) {
+	set := make(map[string]bool)
+	for _, n := range c.FlagNames() {
+		set[n] = true
+	}
+	for name, key := range configFlagKeys {
+		if !set[name] {
+			continue
+		}
+		switch c.Value(name).(type) {
+		case bool:
+			l.Set(key, c.Bool(name), OriginFlag, "--"+name)
+		default:
+			l.Set(key, c.String(name), OriginFlag, "--"+name)
+		}
+	}
 }
 
 // Function to load the configuration file and assign to variables
 func loadConfiguration(file string, verbose bool) (JSONConfiguration, error) {
-	var cfg JSONConfiguration
 	if verbose {
-		log.Printf("Loading %s", file)
+		logger.Info(fmt.Sprintf("Loading %s", file), LogFieldPath, file)
 	}
-	// Load file and read config
-	viper.SetConfigFile(file)
-	if err := viper.ReadInConfig(); err != nil {
-		return cfg, err
+	layers, err := loadConfigurationLayers(file, true)
+	if err != nil {
+		return JSONConfiguration{}, err
 	}
-	// Configuration values
-	configRaw := viper.Sub(configurationKey)
-	if err := configRaw.Unmarshal(&cfg); err != nil {
-		return cfg, err
+	p, err := getPlatform(platformName)
+	if err != nil {
+		return JSONConfiguration{}, err
 	}
-	// No errors!
-	return cfg, nil
+	if err := layers.Decrypt(func() ([]byte, error) {
+		return loadEncryptionKey(resolveKeyFile(keyFile, p))
+	}); err != nil {
+		return JSONConfiguration{}, err
+	}
+	return layers.Configuration()
+}
+
+// Helper to return the effective configuration flattened with the origin of each value.
+// Values not set by any layer are derived defaults
+func effectiveConfiguration(cfg JSONConfiguration, layers *LayeredConfiguration) (map[string]ConfigValue, error) {
+	values, err := flattenConfiguration(cfg)
+	if err != nil {
+		return nil, err
+	}
+	effective := make(map[string]ConfigValue)
+	for k, v := range values {
+		origin := ConfigValue{Origin: OriginDefault, Source: "built-in"}
+		if layers != nil {
+			if o, ok := layers.Get(k); ok {
+				origin = o
+			}
+		}
+		effective[k] = ConfigValue{Value: v, Origin: origin.Origin, Source: origin.Source, Encrypted: origin.Encrypted}
+	}
+	return effective, nil
+}
+
+// Helper to flatten a configuration into keys separated with dots
+func flattenConfiguration(cfg JSONConfiguration) (map[string]any, error) {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	return flattenConfig("", values), nil
+}
+
+// Helper to return the keys of a configuration map, sorted
+func sortedConfigKeys(values map[string]ConfigValue) []string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Helper to resolve the configuration file to load, and if it is required to exist.
+// Without configuration file, the system one is used if it exists
+func resolveConfigFile(p Platform) (string, bool) {
+	if configFile != "" {
+		return configFile, true
+	}
+	return systemConfigFile(p), false
+}
+
+// Function to build the configuration, merging defaults, configuration files, drop-ins, environment and flags
+func buildConfiguration(c *cli.Context, p Platform) (LoadedConfiguration, error) {
+	var loaded LoadedConfiguration
+	file, required := resolveConfigFile(p)
+	layers, err := loadConfigurationLayers(file, required)
+	if err != nil {
+		return loaded, fmt.Errorf("error reading configuration file (%s) - %v", file, err)
+	}
+	if err := layers.ApplyEnv(flags, os.LookupEnv); err != nil {
+		return loaded, fmt.Errorf("error reading environment - %v", err)
+	}
+	layers.ApplyFlags(c)
+	// Encrypted values are decrypted only in memory
+	if err := layers.Decrypt(func() ([]byte, error) {
+		return loadEncryptionKey(resolveKeyFile(keyFile, p))
+	}); err != nil {
+		return loaded, fmt.Errorf("error decrypting configuration - %v", err)
+	}
+	loaded.Layers = layers
+	// Logging, audit, backups, state, lock, metrics, control and update are configured with top level values, shared by all profiles
+	root, err := layers.Configuration()
+	if err != nil {
+		return loaded, err
+	}
+	loaded.Log = root.Log
+	loaded.Audit = root.Audit
+	if loaded.Audit.File == defEmptyValue {
+		loaded.Audit.File = genFullPath(p.ConfigDir(), defAuditFile)
+	}
+	loaded.Backups = root.Backups
+	if loaded.Backups.Dir == defEmptyValue {
+		loaded.Backups.Dir = genFullPath(p.ConfigDir(), defBackupDir)
+	}
+	loaded.State = root.State
+	if loaded.State.Dir == defEmptyValue {
+		loaded.State.Dir = genFullPath(p.ConfigDir(), defStateDir)
+	}
+	loaded.Lock = root.Lock
+	loaded.Metrics = root.Metrics
+	loaded.Control = root.Control
+	if loaded.Control.Socket == defEmptyValue {
+		loaded.Control.Socket = genFullPath(loaded.State.Dir, defControlSocket)
+	}
+	loaded.Update = root.Update
+	loaded.Verbose = root.Verbose
+	// Resolved values are recorded before profiles are built, so all profiles report them
+	root.Audit, root.Backups, root.State, root.Control = loaded.Audit, loaded.Backups, loaded.State, loaded.Control
+	if err := layers.Resolve(root, OriginDefault, p.Name()+" platform", "audit.file", "backups.dir", "state.dir"); err != nil {
+		return loaded, err
+	}
+	if err := layers.Resolve(root, OriginDerived, "state.dir", "control.socket"); err != nil {
+		return loaded, err
+	}
+	names := layers.ProfileNames()
+	if len(names) == 0 {
+		pr, err := buildProfile(defProfile, layers, p)
+		if err != nil {
+			return loaded, err
+		}
+		loaded.Profiles = []*Profile{pr}
+		return loaded, nil
+	}
+	for _, n := range names {
+		pr, err := buildProfile(n, layers.Profile(n), p)
+		if err != nil {
+			return loaded, fmt.Errorf("error with profile %s - %v", n, err)
+		}
+		loaded.Profiles = append(loaded.Profiles, pr)
+	}
+	return loaded, nil
+}
+
+// Helper to resolve the system configuration file, when none is provided
+func systemConfigFile(p Platform) string {
+	return genFullPath(p.ConfigDir(), defConfigFile)
 }
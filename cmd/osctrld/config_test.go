@@ -1,8 +1,12 @@
 package main
 
-
 import (
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
 )
 
 func TestLoadConfigurationInvalid(t *testing.T) {
@@ -15,8 +19,121 @@ func TestLoadConfigurationInvalid(t *testing.T) {
 
 func TestLoadConfigurationValid(t *testing.T) {
 	// Test with valid file
-	_, err = loadConfiguration("tests/osctrld-test.json", false)
+	_, err = loadConfiguration("../../tests/osctrld-test.json", false)
 	if err != nil {
 		t.Errorf("Expected nil, got %s", err)
 	}
 }
+
+func TestLoadConfigurationKeys(t *testing.T) {
+	cfg, err := loadConfiguration("../../tests/osctrld-test.json", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "dev", cfg.Environment)
+	assert.Equal(t, "/Users/javier/Github/osctrl/tmp/osctrl-uuid.flags", cfg.FlagFile)
+	assert.Equal(t, "/Users/javier/Github/osctrl/osctrl.crt", cfg.CertFile)
+	assert.True(t, cfg.Force)
+}
+
+func TestLoadConfigurationLayers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "osctrld.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"osctrld": {"environment": "dev", "baseurl": "https://osctrl", "force": true}}`), 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, configDropInDir), 0700))
+	dropIn := filepath.Join(dir, configDropInDir, "10-canary.yaml")
+	assert.NoError(t, os.WriteFile(dropIn, []byte("osctrld:\n  environment: canary\n  osqueryLayout:\n    name: deb\n"), 0600))
+
+	layers, err := loadConfigurationLayers(file, true)
+	assert.NoError(t, err)
+	env := map[string]string{"OSCTRL_URL": "https://env", "OSCTRL_INSECURE": "true"}
+	err = layers.ApplyEnv(flags, func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+	assert.NoError(t, err)
+	cfg, err := layers.Configuration()
+	assert.NoError(t, err)
+	assert.Equal(t, "canary", cfg.Environment)
+	assert.Equal(t, "https://env", cfg.BaseURL)
+	assert.Equal(t, LayoutDeb, cfg.OsqueryLayout.Name)
+	assert.True(t, cfg.Force)
+	assert.True(t, cfg.Insecure)
+
+	v, ok := layers.Get("environment")
+	assert.True(t, ok)
+	assert.Equal(t, OriginDropIn, v.Origin)
+	assert.Equal(t, dropIn, v.Source)
+	v, _ = layers.Get("baseurl")
+	assert.Equal(t, OriginEnv, v.Origin)
+	v, _ = layers.Get("verbose")
+	assert.Equal(t, OriginDefault, v.Origin)
+
+	effective, err := effectiveConfiguration(cfg, layers)
+	assert.NoError(t, err)
+	assert.Equal(t, OriginFile, effective["force"].Origin)
+	assert.Equal(t, OriginDefault, effective["secretFile"].Origin)
+}
+
+func TestLoadConfigurationLayersErrors(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.json")
+	_, err := loadConfigurationLayers(missing, true)
+	assert.Error(t, err)
+	layers, err := loadConfigurationLayers(missing, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, layers)
+	noKey := filepath.Join(dir, "nokey.json")
+	assert.NoError(t, os.WriteFile(noKey, []byte(`{"osctrl": {"environment": "dev"}}`), 0600))
+	_, err = loadConfigurationLayers(noKey, true)
+	assert.Error(t, err)
+	layers = newLayeredConfiguration()
+	err = layers.ApplyEnv([]cli.Flag{&cli.BoolFlag{Name: "force", EnvVars: []string{"OSCTRL_FORCE"}}}, func(string) (string, bool) {
+		return "maybe", true
+	})
+	assert.Error(t, err)
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "osctrld.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"osctrld": {"environment": "dev", "baseurl": "osctrl.url", "flagfile": "typo"}}`), 0600))
+	layers, err := loadConfigurationLayers(file, true)
+	assert.NoError(t, err)
+	cfg, err := layers.Configuration()
+	assert.NoError(t, err)
+	cfg.SecretFile = filepath.Join(dir, "osquery.secret")
+	cfg.FlagFile = filepath.Join(dir, "osquery.flags")
+	cfg.CertFile = filepath.Join(dir, "missing", "osctrl.crt")
+	cfg.OsqueryVersion.Min = "five"
+	problems := validateConfiguration(cfg, layers)
+	assert.Len(t, problems, 4)
+	assert.Contains(t, problems[0], "unknown key flagfile")
+
+	cfg.BaseURL = "https://osctrl.url"
+	cfg.CertFile = filepath.Join(dir, "osctrl.crt")
+	cfg.OsqueryVersion.Min = "5.0.0"
+	assert.Len(t, validateConfiguration(cfg, nil), 0)
+	cfg.Environment = ""
+	assert.Len(t, validateConfiguration(cfg, nil), 1)
+}
+
+func TestRedactConfigValue(t *testing.T) {
+	assert.Equal(t, redactedValue, redactConfigValue("secret", "thisisthesecret"))
+	assert.Equal(t, "", redactConfigValue("secret", ""))
+	assert.Equal(t, "dev", redactConfigValue("environment", "dev"))
+}
+
+func TestGenerateConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []string{ConfigFormatYAML, ConfigFormatJSON} {
+		content, err := generateConfiguration(windowsPlatform{}, format)
+		assert.NoError(t, err)
+		file := filepath.Join(dir, "osctrld."+format)
+		assert.NoError(t, os.WriteFile(file, content, 0600))
+		cfg, err := loadConfiguration(file, false)
+		assert.NoError(t, err)
+		assert.Equal(t, defWindowsPath+defFlagFile, cfg.FlagFile)
+		assert.Equal(t, LayoutAuto, cfg.OsqueryLayout.Name)
+	}
+	_, err := generateConfiguration(linuxPlatform{}, "toml")
+	assert.Error(t, err)
+}
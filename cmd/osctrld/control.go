@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// Default socket for the control API, inside the state directory
+	defControlSocket = appName + ".sock"
+	// Host used in requests to the control API, the socket is the only destination
+	controlHost = "http://" + appName
+	// Maximum length of a unix socket path, the lowest of supported platforms
+	controlSocketMaxLength = 104
+	// Timeout for requests to the control API, a sync waits for the reconcile of all profiles
+	controlTimeout = 5 * time.Minute
+)
+
+const (
+	// ControlPathStatus to get the status of the daemon and its profiles
+	ControlPathStatus = "/v1/status"
+	// ControlPathVerify to get the last verification of each profile
+	ControlPathVerify = "/v1/verify"
+	// ControlPathSync to reconcile profiles now
+	ControlPathSync = "/v1/sync"
+	// ControlPathPause to pause remediation for a duration
+	ControlPathPause = "/v1/pause"
+	// ControlPathResume to resume remediation
+	ControlPathResume = "/v1/resume"
+	// ControlPathReload to reload the configuration
+	ControlPathReload = "/v1/reload"
+)
+
+// ControlConfiguration to hold the configuration of the control API of the daemon
+type ControlConfiguration struct {
+	Enabled bool   `json:"enabled"`
+	Socket  string `json:"socket"`
+}
+
+// ControlStatus is the status of the daemon returned by the control API
+type ControlStatus struct {
+	Version     string                   `json:"version"`
+	Pid         int                      `json:"pid"`
+	Started     time.Time                `json:"started"`
+	Interval    string                   `json:"interval"`
+	PausedUntil *time.Time               `json:"pausedUntil,omitempty"`
+	Profiles    map[string]*ProfileState `json:"profiles"`
+}
+
+// ControlPauseRequest to pause remediation, a zero duration resumes it
+type ControlPauseRequest struct {
+	Duration string `json:"duration"`
+}
+
+// ControlResponse for requests to the control API that change the daemon
+type ControlResponse struct {
+	Message     string     `json:"message,omitempty"`
+	Profiles    []string   `json:"profiles,omitempty"`
+	PausedUntil *time.Time `json:"pausedUntil,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// ControlAPI is implemented by the daemon to answer the control API, profile is empty for all profiles
+type ControlAPI interface {
+	Status(profile string) (ControlStatus, error)
+	Verify(profile string) (map[string]*VerifyReport, error)
+	Sync(ctx context.Context, profile string) ([]string, error)
+	Pause(d time.Duration) time.Time
+	Reload() (int, error)
+}
+
+// ControlClient sends requests to the control API of a running daemon
+type ControlClient struct {
+	socket string
+	client *http.Client
+}
+
+// Helper to validate the control configuration
+func validateControlConfiguration(cfg ControlConfiguration) []string {
+	var problems []string
+	if len(cfg.Socket) >= controlSocketMaxLength {
+		problems = append(problems, fmt.Sprintf("control.socket %s is longer than %d characters", cfg.Socket, controlSocketMaxLength-1))
+	}
+	return problems
+}
+
+// Helper to parse the duration of a pause, a number is minutes
+func parsePauseDuration(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%dm", minutes)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid pause duration %s", value)
+	}
+	return d, nil
+}
+
+// Function to listen in the control socket, only accessible by the user running osctrld
+// A socket left behind by a daemon that is not running anymore is removed
+func listenControl(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating control directory - %v", err)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another osctrld daemon is listening in %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale control socket - %v", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening in control socket - %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("error restricting control socket - %v", err)
+	}
+	return ln, nil
+}
+
+// Function to serve the control API in a unix socket
+func serveControl(path string, api ControlAPI) (*http.Server, error) {
+	ln, err := listenControl(path)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: controlHandler(api), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("error serving control API - %v", err))
+		}
+	}()
+	return srv, nil
+}
+
+// Helper to write a JSON response of the control API
+func writeControlJSON(w http.ResponseWriter, code int, data any) {
+	w.Header().Set(ContentType, JSONApplication)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logger.Warn(fmt.Sprintf("error writing control response - %v", err))
+	}
+}
+
+// Helper to write an error of the control API
+func writeControlError(w http.ResponseWriter, code int, err error) {
+	writeControlJSON(w, code, ControlResponse{Error: err.Error()})
+}
+
+// Helper to allow only one method for a path of the control API
+func controlMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Function to route requests of the control API to the daemon
+func controlHandler(api ControlAPI) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ControlPathStatus, controlMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		status, err := api.Status(r.URL.Query().Get("profile"))
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, status)
+	}))
+	mux.HandleFunc(ControlPathVerify, controlMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		reports, err := api.Verify(r.URL.Query().Get("profile"))
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, reports)
+	}))
+	mux.HandleFunc(ControlPathSync, controlMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		profiles, err := api.Sync(r.Context(), r.URL.Query().Get("profile"))
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, ControlResponse{Message: fmt.Sprintf("%d profiles reconciled", len(profiles)), Profiles: profiles})
+	}))
+	mux.HandleFunc(ControlPathPause, controlMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var req ControlPauseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid pause request - %v", err))
+			return
+		}
+		d, err := parsePauseDuration(req.Duration)
+		if err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		until := api.Pause(d)
+		if d == 0 {
+			writeControlJSON(w, http.StatusOK, ControlResponse{Message: "remediation resumed"})
+			return
+		}
+		writeControlJSON(w, http.StatusOK, ControlResponse{Message: fmt.Sprintf("remediation paused for %s", d), PausedUntil: &until})
+	}))
+	mux.HandleFunc(ControlPathResume, controlMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		api.Pause(0)
+		writeControlJSON(w, http.StatusOK, ControlResponse{Message: "remediation resumed"})
+	}))
+	mux.HandleFunc(ControlPathReload, controlMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		changes, err := api.Reload()
+		if err != nil {
+			writeControlError(w, http.StatusConflict, err)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, ControlResponse{Message: fmt.Sprintf("configuration reloaded, %d changes", changes)})
+	}))
+	return mux
+}
+
+// Helper to create a client for the control API in a unix socket
+func newControlClient(socket string) *ControlClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &ControlClient{socket: socket, client: &http.Client{Transport: transport, Timeout: controlTimeout}}
+}
+
+// Do sends a request to the control API and decodes the response in out, returns the raw response
+func (cc *ControlClient) Do(method, path, profile string, body any, out any) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request - %v", err)
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	u := controlHost + path
+	if profile != defEmptyValue {
+		u += "?profile=" + url.QueryEscape(profile)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ContentType, JSONApplication)
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to daemon in %s, is it running? - %v", cc.socket, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response - %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e ControlResponse
+		if err := json.Unmarshal(content, &e); err == nil && e.Error != defEmptyValue {
+			return content, fmt.Errorf("%s", e.Error)
+		}
+		return content, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.Unmarshal(content, out); err != nil {
+			return content, fmt.Errorf("error parsing response - %v", err)
+		}
+	}
+	return content, nil
+}
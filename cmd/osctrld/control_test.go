@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeControl answers the control API without a daemon
+type fakeControl struct {
+	synced  []string
+	paused  time.Duration
+	reloads int
+}
+
+func (f *fakeControl) Status(profile string) (ControlStatus, error) {
+	if profile != defEmptyValue && profile != "default" {
+		return ControlStatus{}, fmt.Errorf("profile %s is not managed by the daemon", profile)
+	}
+	return ControlStatus{Version: OsctrldVersion, Pid: os.Getpid(), Interval: "5m0s", Profiles: map[string]*ProfileState{"default": {Environment: "dev"}}}, nil
+}
+
+func (f *fakeControl) Verify(profile string) (map[string]*VerifyReport, error) {
+	return map[string]*VerifyReport{"default": {Checks: []VerifyCheck{{Check: "flags", Message: "flags mismatch"}}}}, nil
+}
+
+func (f *fakeControl) Sync(ctx context.Context, profile string) ([]string, error) {
+	f.synced = append(f.synced, "default")
+	return []string{"default"}, nil
+}
+
+func (f *fakeControl) Pause(d time.Duration) time.Time {
+	f.paused = d
+	return time.Now().Add(d)
+}
+
+func (f *fakeControl) Reload() (int, error) {
+	f.reloads++
+	if f.reloads > 1 {
+		return 0, fmt.Errorf("keeping current configuration, new one has 1 problems")
+	}
+	return 2, nil
+}
+
+// Helper to get a socket path short enough for all platforms
+func testControlSocket(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "osctrld")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, defControlSocket)
+}
+
+func TestParsePauseDuration(t *testing.T) {
+	d, err := parsePauseDuration("15")
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, d)
+	d, err = parsePauseDuration("1h30m")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, d)
+	_, err = parsePauseDuration("-5")
+	assert.Error(t, err)
+	_, err = parsePauseDuration("soon")
+	assert.Error(t, err)
+}
+
+func TestControlAPI(t *testing.T) {
+	socket := testControlSocket(t)
+	api := &fakeControl{}
+	srv, err := serveControl(socket, api)
+	assert.NoError(t, err)
+	defer srv.Close()
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := newControlClient(socket)
+	t.Run("status", func(t *testing.T) {
+		var status ControlStatus
+		_, err := client.Do(http.MethodGet, ControlPathStatus, defEmptyValue, nil, &status)
+		assert.NoError(t, err)
+		assert.Equal(t, os.Getpid(), status.Pid)
+		assert.Equal(t, "dev", status.Profiles["default"].Environment)
+		_, err = client.Do(http.MethodGet, ControlPathStatus, "prod", nil, &status)
+		assert.EqualError(t, err, "profile prod is not managed by the daemon")
+	})
+	t.Run("verify", func(t *testing.T) {
+		var reports map[string]*VerifyReport
+		_, err := client.Do(http.MethodGet, ControlPathVerify, defEmptyValue, nil, &reports)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, reports["default"].Failed())
+	})
+	t.Run("sync", func(t *testing.T) {
+		var resp ControlResponse
+		_, err := client.Do(http.MethodPost, ControlPathSync, defEmptyValue, nil, &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"default"}, resp.Profiles)
+		_, err = client.Do(http.MethodGet, ControlPathSync, defEmptyValue, nil, nil)
+		assert.EqualError(t, err, "method GET not allowed")
+	})
+	t.Run("pause", func(t *testing.T) {
+		var resp ControlResponse
+		_, err := client.Do(http.MethodPost, ControlPathPause, defEmptyValue, ControlPauseRequest{Duration: "30"}, &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Minute, api.paused)
+		assert.NotNil(t, resp.PausedUntil)
+		_, err = client.Do(http.MethodPost, ControlPathPause, defEmptyValue, ControlPauseRequest{Duration: "later"}, nil)
+		assert.EqualError(t, err, "invalid pause duration later")
+		_, err = client.Do(http.MethodPost, ControlPathResume, defEmptyValue, nil, &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), api.paused)
+	})
+	t.Run("reload", func(t *testing.T) {
+		var resp ControlResponse
+		_, err := client.Do(http.MethodPost, ControlPathReload, defEmptyValue, nil, &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, "configuration reloaded, 2 changes", resp.Message)
+		_, err = client.Do(http.MethodPost, ControlPathReload, defEmptyValue, nil, &resp)
+		assert.Error(t, err)
+	})
+}
+
+func TestListenControl(t *testing.T) {
+	socket := testControlSocket(t)
+	ln, err := listenControl(socket)
+	assert.NoError(t, err)
+	// Only one daemon can listen in a socket
+	_, err = listenControl(socket)
+	assert.ErrorContains(t, err, "another osctrld daemon")
+	ln.Close()
+	// A socket left behind is removed
+	assert.NoError(t, os.WriteFile(socket, nil, 0600))
+	ln, err = listenControl(socket)
+	assert.NoError(t, err)
+	ln.Close()
+
+	_, err = newControlClient(filepath.Join(filepath.Dir(socket), "missing.sock")).Do(http.MethodGet, ControlPathStatus, defEmptyValue, nil, nil)
+	assert.ErrorContains(t, err, "is it running?")
+}
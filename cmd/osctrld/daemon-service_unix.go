@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// Helper to run the daemon as a Windows service, other platforms run it directly
+func runDaemonService(d *Daemon, profiles []*Profile) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,60 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// daemonService runs the daemon for the Windows service manager
+type daemonService struct {
+	daemon   *Daemon
+	profiles []*Profile
+}
+
+// Helper to run the daemon as a Windows service, if it was started by the service manager
+func runDaemonService(d *Daemon, profiles []*Profile) (bool, error) {
+	service, err := svc.IsWindowsService()
+	if err != nil {
+		return false, fmt.Errorf("error checking windows service - %v", err)
+	}
+	if !service {
+		return false, nil
+	}
+	return true, svc.Run(windowsOsctrldService, &daemonService{daemon: d, profiles: profiles})
+}
+
+// Execute runs the daemon until it is stopped by the service manager
+func (s *daemonService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.daemon.Run(s.profiles)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				logger.Error(fmt.Sprintf("daemon stopped - %v", err))
+				return false, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				// Stop may be requested more than once, it is pending already if the channel is full
+				select {
+				case s.daemon.stop <- os.Interrupt:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// Default interval for the daemon to reconcile flags and certificate
+	defDaemonInterval = 5 * time.Minute
+	// Time to wait for more changes in configuration files before reloading
+	reloadDebounce = time.Second
+)
+
+// Daemon to run osctrld as resident process, reconciling each profile concurrently
+type Daemon struct {
+	ctx      *cli.Context
+	interval time.Duration
+	metrics  MetricsConfiguration
+	control  ControlConfiguration
+	update   UpdateConfiguration
+	updating atomic.Bool
+	started  time.Time
+	mutex    sync.Mutex
+	workers  map[string]*daemonWorker
+	paused   time.Time
+	reloads  chan chan reloadResult
+	stop     chan os.Signal
+	wg       sync.WaitGroup
+}
+
+// daemonWorker reconciles a single profile, isolated from the rest
+type daemonWorker struct {
+	mutex   sync.RWMutex
+	profile *Profile
+	stop    chan struct{}
+	syncs   chan chan struct{}
+}
+
+// reloadResult is the result of a reload requested by the control API
+type reloadResult struct {
+	changes int
+	err     error
+}
+
+// Function to action on daemon command
+func runDaemon(c *cli.Context, profiles []*Profile) error {
+	d := &Daemon{
+		ctx:      c,
+		interval: c.Duration("interval"),
+		metrics:  loadedConfig.Metrics,
+		control:  loadedConfig.Control,
+		update:   loadedConfig.Update,
+		started:  time.Now().UTC(),
+		workers:  make(map[string]*daemonWorker),
+		reloads:  make(chan chan reloadResult),
+		stop:     make(chan os.Signal, 1),
+	}
+	// Started by the Windows service manager, the daemon is stopped by it
+	if service, err := runDaemonService(d, profiles); service || err != nil {
+		return err
+	}
+	return d.Run(profiles)
+}
+
+// Run reconciles all profiles periodically until the process is stopped, reloading configuration on SIGHUP or file changes
+func (d *Daemon) Run(profiles []*Profile) error {
+	if d.interval <= 0 {
+		return fmt.Errorf("invalid interval %s", d.interval)
+	}
+	logger.Info(fmt.Sprintf("%s daemon started for profiles %v, reconciling every %s", appName, profileNames(profiles), d.interval), emoji("🚀"))
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	if d.stop == nil {
+		d.stop = make(chan os.Signal, 1)
+	}
+	signal.Notify(d.stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(hup)
+	defer signal.Stop(d.stop)
+	// Changes in configuration files are debounced, editors often write more than once
+	var changes <-chan fsnotify.Event
+	watcher, err := watchConfiguration(osPlatform)
+	if err != nil {
+		logger.Error(fmt.Sprintf("configuration files will not be watched - %v", err))
+	} else {
+		defer watcher.Close()
+		changes = watcher.Events
+	}
+	if d.metrics.Listen != defEmptyValue {
+		srv, err := serveMetrics(d.metrics.Listen)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		logger.Info(fmt.Sprintf("serving metrics in http://%s%s", d.metrics.Listen, metricsPath), emoji("📈"))
+	}
+	if d.control.Enabled {
+		srv, err := serveControl(d.control.Socket, d)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			srv.Close()
+			os.Remove(d.control.Socket)
+		}()
+		logger.Info(fmt.Sprintf("serving control API in %s", d.control.Socket), emoji("🎛️"), LogFieldPath, d.control.Socket)
+	}
+	var updates <-chan time.Time
+	if d.update.Auto {
+		interval, _, err := parseUpdateConfiguration(d.update)
+		if err != nil {
+			return fmt.Errorf("invalid update configuration - %v", err)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		updates = ticker.C
+		logger.Info(fmt.Sprintf("checking for updates of %s every %s", appName, interval), emoji("🆕"))
+	}
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	for _, pr := range profiles {
+		d.start(pr)
+	}
+	for {
+		select {
+		case <-hup:
+			d.reload("SIGHUP")
+		case ev := <-changes:
+			file, _ := resolveConfigFile(osPlatform)
+			if isConfigurationEvent(ev, file) {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			d.reload("configuration change")
+		case <-updates:
+			// Checks are not waited for, downloads must not hold reloads or signals
+			if d.updating.CompareAndSwap(false, true) {
+				go func() {
+					defer d.updating.Store(false)
+					d.selfUpdate()
+				}()
+			}
+		case done := <-d.reloads:
+			changes, err := d.reload("control API")
+			done <- reloadResult{changes: changes, err: err}
+		case s := <-d.stop:
+			for name := range d.workers {
+				d.remove(name)
+			}
+			d.wg.Wait()
+			logger.Info(fmt.Sprintf("%s daemon stopped by %s", appName, s), emoji("👋"))
+			return nil
+		}
+	}
+}
+
+// Function to start reconciling a profile in its own goroutine
+func (d *Daemon) start(pr *Profile) {
+	w := &daemonWorker{profile: pr, stop: make(chan struct{}), syncs: make(chan chan struct{})}
+	d.mutex.Lock()
+	d.workers[pr.Name] = w
+	d.mutex.Unlock()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		w.run(d)
+	}()
+	// Not waited for when stopping, a long poll can be held by osctrl
+	go w.poll(d)
+}
+
+// Function to stop reconciling a profile
+func (d *Daemon) remove(name string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if w, ok := d.workers[name]; ok {
+		close(w.stop)
+		delete(d.workers, name)
+	}
+}
+
+// profiles returns the active profiles, sorted by name
+func (d *Daemon) profiles() []*Profile {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var profiles []*Profile
+	for _, name := range sortedKeys(d.workers) {
+		profiles = append(profiles, d.workers[name].current())
+	}
+	return profiles
+}
+
+// Function to run after each reconcile, collecting metrics to serve and writing them for the textfile collector if enabled
+func (d *Daemon) reconciled() {
+	if d.metrics.Listen == defEmptyValue && d.metrics.Textfile == defEmptyValue {
+		return
+	}
+	collectMetrics(metrics, d.profiles())
+	if d.metrics.Textfile == defEmptyValue {
+		return
+	}
+	if err := writeMetricsTextfile(metrics, d.metrics.Textfile); err != nil {
+		logger.Error(fmt.Sprintf("error writing metrics to %s - %v", d.metrics.Textfile, err), LogFieldPath, d.metrics.Textfile)
+	}
+}
+
+// Function to update the osctrld binary if there is a new release, restarting the service to run it
+func (d *Daemon) selfUpdate() {
+	var pr *Profile
+	if profiles := d.profiles(); len(profiles) > 0 {
+		pr = profiles[0]
+	}
+	u, err := newUpdater(d.update, pr, osPlatform)
+	if err != nil {
+		logger.Error(fmt.Sprintf("error checking for updates - %v", err))
+		return
+	}
+	info, newer, err := u.Check()
+	if err != nil {
+		logger.Error(fmt.Sprintf("error checking for updates - %v", err))
+		return
+	}
+	if !newer {
+		logger.Debug(fmt.Sprintf("%s %s is up to date", appName, OsctrldVersion))
+		return
+	}
+	if err := u.Apply(info); err != nil {
+		logger.Error(fmt.Sprintf("error updating to %s - %v", info.Version, err))
+		return
+	}
+	logger.Info(fmt.Sprintf("%s updated from %s to %s, restarting", appName, OsctrldVersion, info.Version), emoji("🆕"))
+	if err := u.restart(); err != nil {
+		logger.Error(fmt.Sprintf("%s %s will run after restarting the service - %v", appName, info.Version, err))
+	}
+}
+
+// Function to reload the configuration, keeping the current one if the new one is invalid. Returns the number of changes
+func (d *Daemon) reload(reason string) (int, error) {
+	logger.Info(fmt.Sprintf("reloading configuration (%s)", reason), emoji("🔄"))
+	loaded, err := buildConfiguration(d.ctx, osPlatform)
+	if err != nil {
+		logger.Error(fmt.Sprintf("keeping current configuration - %v", err))
+		return 0, fmt.Errorf("keeping current configuration - %v", err)
+	}
+	profiles, err := selectProfiles(loaded.Profiles, profileName)
+	if err != nil {
+		logger.Error(fmt.Sprintf("keeping current configuration - %v", err))
+		return 0, fmt.Errorf("keeping current configuration - %v", err)
+	}
+	if problems := validateProfilesConfiguration(profiles); len(problems) > 0 {
+		for _, p := range problems {
+			logger.Error(p)
+		}
+		logger.Error(fmt.Sprintf("keeping current configuration, new one has %d problems", len(problems)))
+		return 0, fmt.Errorf("keeping current configuration, new one has %d problems: %s", len(problems), strings.Join(problems, "; "))
+	}
+	changed := d.reloadRoot(loaded)
+	seen := make(map[string]bool)
+	for _, pr := range profiles {
+		seen[pr.Name] = true
+		w, ok := d.workers[pr.Name]
+		if !ok {
+			d.start(pr)
+			pr.log().Info(fmt.Sprintf("profile %s added", pr.Name), emoji("➕"))
+			changed++
+			continue
+		}
+		old := w.swap(pr)
+		changes := configChanges(old.Config, old.Layers, pr.Config, pr.Layers)
+		for _, k := range sortedKeys(changes) {
+			// Top level settings are the same for all profiles, they are reloaded once
+			if isRootConfigKey(k) {
+				continue
+			}
+			pr.log().Info(fmt.Sprintf("[%s] %s", pr.Name, changes[k]), emoji("📝"))
+			changed++
+		}
+	}
+	for name := range d.workers {
+		if !seen[name] {
+			d.remove(name)
+			logger.Info(fmt.Sprintf("profile %s removed", name), emoji("➖"), LogFieldProfile, name)
+			changed++
+		}
+	}
+	if changed == 0 {
+		logger.Info("configuration reloaded, no changes", emoji("✅"))
+		return 0, nil
+	}
+	logger.Info(fmt.Sprintf("configuration reloaded, %d changes", changed), emoji("✅"))
+	return changed, nil
+}
+
+// Function to apply the changes in top level settings that can be applied live, the rest are logged as they need a
+// restart of the daemon. Returns the number of changes applied
+func (d *Daemon) reloadRoot(loaded LoadedConfiguration) int {
+	changes := configChanges(rootConfiguration(loadedConfig), nil, rootConfiguration(loaded), nil)
+	applied := 0
+	var restart []string
+	for _, k := range sortedKeys(changes) {
+		if !isLiveConfigKey(k) {
+			restart = append(restart, k)
+			continue
+		}
+		logger.Info(changes[k], emoji("📝"))
+		applied++
+	}
+	if applied > 0 || loaded.Verbose != loadedConfig.Verbose {
+		if err := setLogLevel(loaded.Log, loaded.Verbose); err != nil {
+			logger.Error(fmt.Sprintf("keeping log level - %v", err))
+		} else {
+			loadedConfig.Log.Level = loaded.Log.Level
+			loadedConfig.Verbose = loaded.Verbose
+		}
+	}
+	loadedConfig.Layers = loaded.Layers
+	loadedConfig.Profiles = loaded.Profiles
+	if len(restart) > 0 {
+		logger.Warn(fmt.Sprintf("restart %s to apply changes in %s", appName, strings.Join(restart, ", ")), emoji("⚠️"))
+	}
+	return applied
+}
+
+// pausedUntil returns the time remediation is paused until, zero if it is not paused
+func (d *Daemon) pausedUntil() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if time.Now().After(d.paused) {
+		return time.Time{}
+	}
+	return d.paused
+}
+
+// Function to select the workers of a profile, or all of them if no profile is provided
+func (d *Daemon) selectWorkers(profile string) ([]*daemonWorker, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if profile != defEmptyValue {
+		w, ok := d.workers[profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %s is not managed by the daemon", profile)
+		}
+		return []*daemonWorker{w}, nil
+	}
+	var workers []*daemonWorker
+	for _, name := range sortedKeys(d.workers) {
+		workers = append(workers, d.workers[name])
+	}
+	return workers, nil
+}
+
+// Status returns the status of the daemon and the state of the selected profiles
+func (d *Daemon) Status(profile string) (ControlStatus, error) {
+	status := ControlStatus{
+		Version:  OsctrldVersion,
+		Pid:      os.Getpid(),
+		Started:  d.started,
+		Interval: d.interval.String(),
+		Profiles: make(map[string]*ProfileState),
+	}
+	if until := d.pausedUntil(); !until.IsZero() {
+		status.PausedUntil = &until
+	}
+	workers, err := d.selectWorkers(profile)
+	if err != nil {
+		return status, err
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		return status, err
+	}
+	for _, w := range workers {
+		name := w.current().Name
+		status.Profiles[name] = state.Profiles[name]
+	}
+	return status, nil
+}
+
+// Verify returns the last verification of the selected profiles, nil if never verified
+func (d *Daemon) Verify(profile string) (map[string]*VerifyReport, error) {
+	status, err := d.Status(profile)
+	if err != nil {
+		return nil, err
+	}
+	reports := make(map[string]*VerifyReport)
+	for name, ps := range status.Profiles {
+		reports[name] = nil
+		if ps != nil {
+			reports[name] = ps.Verify
+		}
+	}
+	return reports, nil
+}
+
+// Sync reconciles the selected profiles now, even if remediation is paused, and waits until they are done
+func (d *Daemon) Sync(ctx context.Context, profile string) ([]string, error) {
+	workers, err := d.selectWorkers(profile)
+	if err != nil {
+		return nil, err
+	}
+	var dones []chan struct{}
+	var names []string
+	for _, w := range workers {
+		done := make(chan struct{})
+		select {
+		case w.syncs <- done:
+		case <-w.stop:
+			continue
+		case <-ctx.Done():
+			return names, ctx.Err()
+		}
+		dones = append(dones, done)
+		names = append(names, w.current().Name)
+	}
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return names, ctx.Err()
+		}
+	}
+	return names, nil
+}
+
+// Pause stops remediation for a duration and returns when it resumes, zero duration resumes it now
+func (d *Daemon) Pause(duration time.Duration) time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if duration == 0 {
+		d.paused = time.Time{}
+		logger.Info("remediation resumed", emoji("▶️"))
+		return d.paused
+	}
+	d.paused = time.Now().Add(duration).UTC()
+	logger.Info(fmt.Sprintf("remediation paused for %s, until %s", duration, d.paused.Local().Format(time.RFC3339)), emoji("⏸️"))
+	return d.paused
+}
+
+// Reload reloads the configuration in the daemon loop, returns the number of changes
+func (d *Daemon) Reload() (int, error) {
+	done := make(chan reloadResult, 1)
+	d.reloads <- done
+	r := <-done
+	return r.changes, r.err
+}
+
+// Function to reconcile the profile periodically while remediation is not paused, and when a sync is requested, until stopped
+func (w *daemonWorker) run(d *Daemon) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	// Heartbeats are sent even if remediation is paused, the interval is read again after each one
+	heartbeat := time.NewTimer(0)
+	defer heartbeat.Stop()
+	w.reconcile(d.ctx)
+	d.reconciled()
+	for {
+		select {
+		case <-heartbeat.C:
+			heartbeat.Reset(w.heartbeat())
+		case <-ticker.C:
+			if until := d.pausedUntil(); !until.IsZero() {
+				pr := w.current()
+				pr.log().Info(fmt.Sprintf("[%s] remediation paused until %s, skipping reconcile", pr.Name, until.Local().Format(time.RFC3339)))
+				continue
+			}
+			w.reconcile(d.ctx)
+			d.reconciled()
+		case done := <-w.syncs:
+			w.reconcile(d.ctx)
+			d.reconciled()
+			close(done)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Function to reconcile flags and certificate of the profile with osctrl
+func (w *daemonWorker) reconcile(c *cli.Context) {
+	pr := w.current()
+	lock, err := lockProfile(pr, c.Command.FullName())
+	if err != nil {
+		pr.log().Error(fmt.Sprintf("[%s] skipping reconcile - %v", pr.Name, err), LogFieldError, err)
+		return
+	}
+	defer lock.Release()
+	if err := getFlags(c, pr); err != nil {
+		pr.log().Error(fmt.Sprintf("[%s] error reconciling flags - %v", pr.Name, err), LogFieldArtifact, "flags", LogFieldError, err)
+	}
+	if err := getCert(c, pr); err != nil {
+		pr.log().Error(fmt.Sprintf("[%s] error reconciling cert - %v", pr.Name, err), LogFieldArtifact, "cert", LogFieldError, err)
+	}
+}
+
+// Function to send the heartbeat of the profile if enabled, returns the time until the next one
+func (w *daemonWorker) heartbeat() time.Duration {
+	pr := w.current()
+	interval, err := parseHeartbeatInterval(pr.Config.Heartbeat.Interval)
+	if err != nil {
+		interval = defHeartbeatInterval
+	}
+	if !pr.Config.Heartbeat.Enabled {
+		return interval
+	}
+	if err := sendHeartbeat(pr); err != nil {
+		pr.log().Warn(fmt.Sprintf("[%s] %v", pr.Name, err), LogFieldURL, pr.URLs.Heartbeat, LogFieldError, err)
+	}
+	return interval
+}
+
+// Function to poll osctrl for remote actions of the profile while remediation is not paused, until stopped
+func (w *daemonWorker) poll(d *Daemon) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(w.actions(d))
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Function to poll and run remote actions of the profile if enabled, returns the time until the next poll
+func (w *daemonWorker) actions(d *Daemon) time.Duration {
+	pr := w.current()
+	interval, _, _, err := parseActionsConfiguration(pr.Config.Actions)
+	if err != nil {
+		interval = defActionsInterval
+	}
+	if !pr.Config.Actions.Enabled || !d.pausedUntil().IsZero() {
+		return interval
+	}
+	ra, err := newRemoteActions(d.ctx, pr, osPlatform)
+	if err == nil {
+		_, err = ra.Run()
+	}
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("[%s] %v", pr.Name, err), LogFieldURL, pr.URLs.Actions, LogFieldError, err)
+	}
+	return interval
+}
+
+// current returns the active profile, a reload may replace it at any time
+func (w *daemonWorker) current() *Profile {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.profile
+}
+
+// swap replaces the active profile atomically and returns the previous one
+func (w *daemonWorker) swap(pr *Profile) *Profile {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	old := w.profile
+	w.profile = pr
+	return old
+}
+
+// Helper to watch the configuration file and drop-ins. Directories are watched because editors replace files
+func watchConfiguration(p Platform) (*fsnotify.Watcher, error) {
+	file, _ := resolveConfigFile(p)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watched := 0
+	for _, dir := range []string{filepath.Dir(file), filepath.Join(filepath.Dir(file), configDropInDir)} {
+		if !checkFileExist(dir) {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("error watching %s - %v", dir, err)
+		}
+		watched++
+	}
+	if watched == 0 {
+		watcher.Close()
+		return nil, fmt.Errorf("no configuration directory to watch for %s", file)
+	}
+	return watcher, nil
+}
+
+// Helper to check if a file system event affects the configuration file or its drop-ins
+func isConfigurationEvent(ev fsnotify.Event, file string) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	if filepath.Clean(ev.Name) == filepath.Clean(file) {
+		return true
+	}
+	if filepath.Dir(ev.Name) != filepath.Join(filepath.Dir(file), configDropInDir) {
+		return false
+	}
+	switch filepath.Ext(ev.Name) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// Helper to describe the changes between two configurations by key, secrets are never included
+func configChanges(oldCfg JSONConfiguration, oldLayers *LayeredConfiguration, newCfg JSONConfiguration, newLayers *LayeredConfiguration) map[string]string {
+	oldValues, err := effectiveConfiguration(oldCfg, oldLayers)
+	if err != nil {
+		return map[string]string{"": fmt.Sprintf("unknown changes - %v", err)}
+	}
+	newValues, err := effectiveConfiguration(newCfg, newLayers)
+	if err != nil {
+		return map[string]string{"": fmt.Sprintf("unknown changes - %v", err)}
+	}
+	changes := make(map[string]string)
+	for k, n := range newValues {
+		o := oldValues[k]
+		if fmt.Sprint(o.Value) == fmt.Sprint(n.Value) {
+			continue
+		}
+		if o.Encrypted || n.Encrypted || redactConfigValue(k, n.Value) == redactedValue || redactConfigValue(k, o.Value) == redactedValue {
+			changes[k] = fmt.Sprintf("%s changed", k)
+			continue
+		}
+		changes[k] = fmt.Sprintf("%s changed from %v to %v", k, o.Value, n.Value)
+	}
+	return changes
+}
+
+// Helper to get the top level settings, shared by all profiles, as configuration
+func rootConfiguration(l LoadedConfiguration) JSONConfiguration {
+	return JSONConfiguration{
+		Log:     l.Log,
+		Audit:   l.Audit,
+		Backups: l.Backups,
+		State:   l.State,
+		Lock:    l.Lock,
+		Metrics: l.Metrics,
+		Control: l.Control,
+		Update:  l.Update,
+	}
+}
+
+// Helper to check if a configuration key is a top level setting, shared by all profiles
+func isRootConfigKey(key string) bool {
+	for _, prefix := range []string{"log", "audit", "backups", "state", "lock", "metrics", "control", "update"} {
+		if strings.HasPrefix(strings.ToLower(key), prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper to check if a top level setting is applied when reloading, the rest need a restart of the daemon
+func isLiveConfigKey(key string) bool {
+	return strings.ToLower(key) == "log.level"
+}
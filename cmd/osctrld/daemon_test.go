@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsConfigurationEvent(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "osctrld.json")
+	dropIns := filepath.Join(dir, configDropInDir)
+	t.Run("configuration file", func(t *testing.T) {
+		assert.True(t, isConfigurationEvent(fsnotify.Event{Name: file, Op: fsnotify.Write}, file))
+		assert.True(t, isConfigurationEvent(fsnotify.Event{Name: file, Op: fsnotify.Create}, file))
+		assert.False(t, isConfigurationEvent(fsnotify.Event{Name: file, Op: fsnotify.Chmod}, file))
+	})
+	t.Run("drop-ins", func(t *testing.T) {
+		assert.True(t, isConfigurationEvent(fsnotify.Event{Name: filepath.Join(dropIns, "10-env.yaml"), Op: fsnotify.Write}, file))
+		assert.True(t, isConfigurationEvent(fsnotify.Event{Name: filepath.Join(dropIns, "20-url.json"), Op: fsnotify.Remove}, file))
+		assert.False(t, isConfigurationEvent(fsnotify.Event{Name: filepath.Join(dropIns, "20-url.json.swp"), Op: fsnotify.Write}, file))
+	})
+	t.Run("other files", func(t *testing.T) {
+		assert.False(t, isConfigurationEvent(fsnotify.Event{Name: filepath.Join(dir, "other.json"), Op: fsnotify.Write}, file))
+		assert.False(t, isConfigurationEvent(fsnotify.Event{Name: filepath.Join(dir, "osctrld.key"), Op: fsnotify.Write}, file))
+	})
+}
+
+func TestConfigChanges(t *testing.T) {
+	oldCfg := JSONConfiguration{Environment: "dev", BaseURL: "https://osctrl.old", Secret: "old-secret"}
+	newCfg := JSONConfiguration{Environment: "prod", BaseURL: "https://osctrl.old", Secret: "new-secret"}
+	t.Run("changes", func(t *testing.T) {
+		changes := configChanges(oldCfg, nil, newCfg, nil)
+		assert.Equal(t, map[string]string{"environment": "environment changed from dev to prod", "secret": "secret changed"}, changes)
+	})
+	t.Run("no changes", func(t *testing.T) {
+		assert.Empty(t, configChanges(oldCfg, nil, oldCfg, nil))
+	})
+	t.Run("encrypted values", func(t *testing.T) {
+		oldLayers := newLayeredConfiguration()
+		oldLayers.Set("environment", "dev", OriginFile, "osctrld.json")
+		newLayers := newLayeredConfiguration()
+		newLayers.values["environment"] = ConfigValue{Value: "prod", Origin: OriginFile, Source: "osctrld.json", Encrypted: true}
+		changes := configChanges(oldCfg, oldLayers, JSONConfiguration{Environment: "prod", BaseURL: "https://osctrl.old", Secret: "old-secret"}, newLayers)
+		assert.Equal(t, map[string]string{"environment": "environment changed"}, changes)
+	})
+}
+
+func TestReloadRoot(t *testing.T) {
+	saved, savedLevel := loadedConfig, logLevel.Level()
+	defer func() {
+		loadedConfig = saved
+		logLevel.Set(savedLevel)
+	}()
+	loadedConfig = LoadedConfiguration{Log: LogConfiguration{Level: "info"}, State: StateConfiguration{Dir: "/etc/osctrld/state"}}
+	loaded := LoadedConfiguration{Log: LogConfiguration{Level: "debug"}, State: StateConfiguration{Dir: "/var/lib/osctrld"}}
+	d := &Daemon{}
+	// The log level is applied, the state directory needs a restart
+	assert.Equal(t, 1, d.reloadRoot(loaded))
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, "debug", loadedConfig.Log.Level)
+	assert.Equal(t, "/etc/osctrld/state", loadedConfig.State.Dir)
+	assert.Equal(t, 0, d.reloadRoot(loaded))
+	assert.True(t, isRootConfigKey("metrics.listen"))
+	assert.False(t, isRootConfigKey("environment"))
+}
+
+func TestWatchConfiguration(t *testing.T) {
+	configFile = filepath.Join(t.TempDir(), "missing", "osctrld.json")
+	defer func() { configFile = "" }()
+	_, err := watchConfiguration(linuxPlatform{})
+	assert.Error(t, err)
+	configFile = filepath.Join(t.TempDir(), "osctrld.json")
+	watcher, err := watchConfiguration(linuxPlatform{})
+	assert.NoError(t, err)
+	watcher.Close()
+}
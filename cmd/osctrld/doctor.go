@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default timeout for each network step of doctor
+	defDoctorTimeout = 10 * time.Second
+	// Clock skew with osctrl reported as a problem
+	doctorMaxSkew = time.Minute
+)
+
+const (
+	// DoctorOK for steps that passed
+	DoctorOK = "ok"
+	// DoctorWarn for steps that passed with a problem that may cause failures
+	DoctorWarn = "warn"
+	// DoctorFail for steps that failed
+	DoctorFail = "fail"
+	// DoctorSkip for steps not run because a previous step failed
+	DoctorSkip = "skip"
+)
+
+// DoctorStep keeps the result of a step of doctor, with the diagnosis of the problem if there is one
+type DoctorStep struct {
+	Step      string `json:"step"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail"`
+	Diagnosis string `json:"diagnosis,omitempty"`
+}
+
+// DoctorReport keeps the results of all the steps of doctor for a profile
+type DoctorReport struct {
+	Profile string       `json:"profile"`
+	Steps   []DoctorStep `json:"steps"`
+}
+
+// Doctor to check step by step what osctrld needs to work with osctrl
+type Doctor struct {
+	pr      *Profile
+	timeout time.Duration
+	// Trusted CAs to verify osctrl, the system ones if nil
+	roots  *x509.CertPool
+	report *DoctorReport
+}
+
+// Failed returns the number of failed steps
+func (r *DoctorReport) Failed() int {
+	failed := 0
+	for _, s := range r.Steps {
+		if s.Status == DoctorFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Helper to add the result of a step to the report
+func (d *Doctor) add(step, status, detail, diagnosis string) {
+	d.report.Steps = append(d.report.Steps, DoctorStep{Step: step, Status: status, Detail: detail, Diagnosis: diagnosis})
+}
+
+// Helper to skip steps because of a failed one
+func (d *Doctor) skip(reason string, steps ...string) {
+	for _, s := range steps {
+		d.add(s, DoctorSkip, reason, "")
+	}
+}
+
+// Function to run all the steps of doctor for a profile. Network steps that depend on a failed one are skipped
+func (d *Doctor) Run() *DoctorReport {
+	d.report = &DoctorReport{Profile: d.pr.Name}
+	network := []string{"dns", "tcp", "tls", "clock", "urls", "secret"}
+	host, port, secure, err := doctorTarget(d.pr.Config.BaseURL)
+	if err != nil {
+		d.add("baseurl", DoctorFail, err.Error(), "set baseurl to the URL of osctrl, like https://osctrl.example.com")
+		d.skip("invalid baseurl", network...)
+	} else if !d.checkDNS(host) {
+		d.skip("DNS resolution failed", network[1:]...)
+	} else if !d.checkTCP(host, port) {
+		d.skip("TCP connect failed", network[2:]...)
+	} else {
+		tlsOK := true
+		if secure {
+			tlsOK = d.checkTLS(host, port)
+		} else {
+			d.add("tls", DoctorWarn, "baseurl is not https", "secrets and flags are sent in clear text, use https for osctrl")
+		}
+		d.checkClock()
+		if tlsOK {
+			d.checkURLs()
+			d.checkSecret()
+		} else {
+			d.skip("TLS verification failed", "urls", "secret")
+		}
+	}
+	d.checkPaths()
+	return d.report
+}
+
+// Helper to get the host, port and if TLS is used from the osctrl base URL
+func doctorTarget(baseURL string) (string, string, bool, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Hostname() == defEmptyValue {
+		return "", "", false, fmt.Errorf("baseurl %q is not a valid URL", baseURL)
+	}
+	switch u.Scheme {
+	case "https":
+		if u.Port() == defEmptyValue {
+			return u.Hostname(), "443", true, nil
+		}
+		return u.Hostname(), u.Port(), true, nil
+	case "http":
+		if u.Port() == defEmptyValue {
+			return u.Hostname(), "80", false, nil
+		}
+		return u.Hostname(), u.Port(), false, nil
+	}
+	return "", "", false, fmt.Errorf("baseurl %q must be http or https", baseURL)
+}
+
+// Function to check the DNS resolution of the osctrl host
+func (d *Doctor) checkDNS(host string) bool {
+	if net.ParseIP(host) != nil {
+		d.add("dns", DoctorOK, fmt.Sprintf("%s is an IP address", host), "")
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err == nil {
+		d.add("dns", DoctorOK, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), "")
+		return true
+	}
+	diagnosis := "check the DNS servers of the host and that they can resolve the name"
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			diagnosis = fmt.Sprintf("%s does not exist in DNS, check the host in baseurl for typos", host)
+		case dnsErr.IsTimeout:
+			diagnosis = "DNS servers did not answer in time, check the resolver configuration and that DNS traffic is allowed"
+		}
+	}
+	d.add("dns", DoctorFail, err.Error(), diagnosis)
+	return false
+}
+
+// Function to check the TCP connection to the osctrl host
+func (d *Doctor) checkTCP(host, port string) bool {
+	address := net.JoinHostPort(host, port)
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, d.timeout)
+	if err == nil {
+		conn.Close()
+		d.add("tcp", DoctorOK, fmt.Sprintf("connected to %s in %s", address, time.Since(start).Round(time.Millisecond)), "")
+		return true
+	}
+	diagnosis := "check the network route to osctrl"
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "refused"):
+		diagnosis = fmt.Sprintf("nothing is listening in %s, check the port in baseurl and that osctrl is running", address)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		diagnosis = fmt.Sprintf("no answer from %s in %s, a firewall or proxy may be dropping the traffic", address, d.timeout)
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH):
+		diagnosis = fmt.Sprintf("there is no route to %s, check the network configuration of the host", host)
+	}
+	d.add("tcp", DoctorFail, err.Error(), diagnosis)
+	return false
+}
+
+// Helper to explain why a certificate chain is not valid
+func diagnoseCertificate(err error, host string, leaf *x509.Certificate, trust string) string {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Sprintf("the certificate is issued by %q, which is not trusted by %s", leaf.Issuer.String(), trust)
+	case errors.As(err, &hostname):
+		names := leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{leaf.Subject.CommonName}
+		}
+		return fmt.Sprintf("the certificate is for %s, not %s, check the host in baseurl", strings.Join(names, ", "), host)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return fmt.Sprintf("the certificate is valid from %s to %s, renew it in osctrl or check the clock of the host", leaf.NotBefore.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("the certificate chain is not valid for %s", trust)
+}
+
+// Helper to read the certificates of a PEM file as pool
+func readCertPool(path string) (*x509.CertPool, int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	pool := x509.NewCertPool()
+	count := 0
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return nil, 0, fmt.Errorf("no PEM certificates")
+	}
+	return pool, count, nil
+}
+
+// Function to check the TLS handshake with osctrl and the chain of its certificate, against the CAs trusted by
+// osctrld and against the certificate file used by osquery. Returns false if osctrld can not verify osctrl
+func (d *Doctor) checkTLS(host, port string) bool {
+	address := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: d.timeout}
+	// The chain is verified after the handshake, to explain why it is not valid
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		d.add("tls", DoctorFail, err.Error(), fmt.Sprintf("TLS handshake with %s failed, check that the port in baseurl serves TLS and no proxy intercepts it", address))
+		return false
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	chain := state.PeerCertificates
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	roots := d.roots
+	if roots == nil {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			d.add("tls", DoctorFail, err.Error(), "the CAs of the system can not be loaded")
+			return false
+		}
+	}
+	ok := true
+	detail := fmt.Sprintf("%s, certificate for %s issued by %q, valid until %s", tls.VersionName(state.Version), leaf.Subject.CommonName, leaf.Issuer.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+	switch {
+	case err == nil:
+		d.add("tls", DoctorOK, detail, "")
+	case d.pr.Config.Insecure:
+		d.add("tls", DoctorWarn, err.Error(), diagnoseCertificate(err, host, leaf, "the system")+", it is ignored because insecure is enabled")
+	default:
+		d.add("tls", DoctorFail, err.Error(), diagnoseCertificate(err, host, leaf, "the system")+", add its CA to the system or enable insecure")
+		ok = false
+	}
+	// osquery verifies osctrl with the certificate file written by osctrld
+	certFile := d.pr.Config.CertFile
+	pool, count, err := readCertPool(certFile)
+	switch {
+	case os.IsNotExist(err):
+		d.add("tls-osquery", DoctorWarn, fmt.Sprintf("%s does not exist", certFile), "osquery can not verify osctrl until the certificate is retrieved, run osctrld cert")
+	case err != nil:
+		d.add("tls-osquery", DoctorFail, fmt.Sprintf("error reading %s - %v", certFile, err), "the certificate file is not valid PEM, retrieve it again with osctrld cert")
+	default:
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool, Intermediates: intermediates}); err != nil {
+			d.add("tls-osquery", DoctorFail, err.Error(), diagnoseCertificate(err, host, leaf, certFile)+", retrieve it again with osctrld cert")
+		} else {
+			d.add("tls-osquery", DoctorOK, fmt.Sprintf("verified with %d certificates of %s", count, certFile), "")
+		}
+	}
+	return ok
+}
+
+// Function to check the clock skew with osctrl, with the Date header of its response. The certificate is not
+// verified, a wrong clock is a common reason for certificates not to be valid
+func (d *Doctor) checkClock() {
+	client := &http.Client{
+		Timeout:   d.timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	start := time.Now()
+	resp, err := client.Get(d.pr.Config.BaseURL)
+	if err != nil {
+		d.add("clock", DoctorFail, err.Error(), "osctrl did not answer HTTP requests")
+		return
+	}
+	resp.Body.Close()
+	// The server time is compared with the middle of the request
+	local := start.Add(time.Since(start) / 2)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.add("clock", DoctorWarn, "no Date header in the response", "the clock can not be compared with osctrl")
+		return
+	}
+	skew := local.Sub(date).Round(time.Second)
+	detail := fmt.Sprintf("local clock is %s from osctrl", skew)
+	if skew.Abs() <= doctorMaxSkew {
+		d.add("clock", DoctorOK, detail, "")
+		return
+	}
+	direction := "ahead of"
+	if skew < 0 {
+		direction = "behind"
+	}
+	d.add("clock", DoctorFail, detail, fmt.Sprintf("the clock is %s %s osctrl, certificates may not be valid yet or expired, sync it with NTP", skew.Abs(), direction))
+}
+
+// Function to check that each osctrl URL answers. Requests have no secret, osctrl must reject them but not with not found or errors
+func (d *Doctor) checkURLs() {
+	urls := reflect.ValueOf(d.pr.URLs)
+	for i := 0; i < urls.NumField(); i++ {
+		name := urls.Type().Field(i).Name
+		u := urls.Field(i).String()
+		if name == "URL" || u == defEmptyValue {
+			continue
+		}
+		step := "url " + strings.ToLower(name)
+		// HEAD does not change anything in osctrl, URLs that only accept POST answer it with method not allowed
+		code, _, err := SendRequest(http.MethodHead, u, nil, map[string]string{}, d.pr.Config.Insecure)
+		switch {
+		case err != nil:
+			d.add(step, DoctorFail, fmt.Sprintf("%s - %v", u, err), "the request failed after connecting, a proxy may be interfering")
+		case code == http.StatusNotFound:
+			d.add(step, DoctorFail, fmt.Sprintf("%s - HTTP %d", u, code), fmt.Sprintf("osctrl does not know this URL, check that environment %s exists and osctrl supports osctrld", d.pr.Config.Environment))
+		case code >= http.StatusInternalServerError:
+			d.add(step, DoctorFail, fmt.Sprintf("%s - HTTP %d", u, code), "osctrl failed to answer, check its logs")
+		default:
+			d.add(step, DoctorOK, fmt.Sprintf("%s - HTTP %d", u, code), "")
+		}
+	}
+}
+
+// Function to check that osctrl accepts the secret, retrieving flags without writing them
+func (d *Doctor) checkSecret() {
+	secret, err := getSecret(d.pr)
+	if err != nil {
+		d.add("secret", DoctorFail, err.Error(), "configure secret, secretFile or a secret store reference")
+		return
+	}
+	req := FlagsRequest{Secret: secret, SecretFile: d.pr.Config.SecretFile, CertFile: d.pr.Config.CertFile}
+	body, err := json.Marshal(req)
+	if err != nil {
+		d.add("secret", DoctorFail, err.Error(), "")
+		return
+	}
+	code, _, err := SendRequest(http.MethodPost, d.pr.URLs.Flags, strings.NewReader(string(body)), map[string]string{}, d.pr.Config.Insecure)
+	switch {
+	case err != nil:
+		d.add("secret", DoctorFail, err.Error(), "the request failed after connecting, a proxy may be interfering")
+	case code == http.StatusOK:
+		d.add("secret", DoctorOK, fmt.Sprintf("accepted by osctrl for environment %s", d.pr.Config.Environment), "")
+	case code == http.StatusForbidden || code == http.StatusUnauthorized || code == http.StatusBadRequest:
+		d.add("secret", DoctorFail, fmt.Sprintf("HTTP %d", code), fmt.Sprintf("osctrl rejected the secret, check that it is the enroll secret of environment %s", d.pr.Config.Environment))
+	default:
+		d.add("secret", DoctorFail, fmt.Sprintf("HTTP %d", code), "osctrl did not accept the request, check its logs")
+	}
+}
+
+// Function to check write permission on every path managed by osctrld
+func (d *Doctor) checkPaths() {
+	type managedPath struct {
+		name string
+		path string
+		dir  bool
+	}
+	paths := []managedPath{
+		{name: "secretFile", path: d.pr.Config.SecretFile},
+		{name: "flags", path: d.pr.Config.FlagFile},
+		{name: "cert", path: d.pr.Config.CertFile},
+		{name: "state", path: loadedConfig.State.Dir, dir: true},
+		{name: "backups", path: loadedConfig.Backups.Dir, dir: true},
+	}
+	if loadedConfig.Audit.Enabled {
+		paths = append(paths, managedPath{name: "audit", path: loadedConfig.Audit.File})
+	}
+	if loadedConfig.Log.File != defEmptyValue {
+		paths = append(paths, managedPath{name: "log", path: loadedConfig.Log.File})
+	}
+	for _, p := range paths {
+		step := "write " + p.name
+		if p.path == defEmptyValue {
+			d.add(step, DoctorSkip, "not configured", "")
+			continue
+		}
+		var err error
+		if p.dir {
+			err = checkDirWritable(p.path)
+		} else {
+			err = checkWritable(p.path)
+		}
+		switch {
+		case err == nil:
+			d.add(step, DoctorOK, fmt.Sprintf("%s is writable", p.path), "")
+		case os.IsPermission(err):
+			d.add(step, DoctorFail, err.Error(), fmt.Sprintf("the user running osctrld can not write %s, run it as root or give it permission", p.path))
+		case os.IsNotExist(err):
+			d.add(step, DoctorFail, err.Error(), fmt.Sprintf("directory %s does not exist, create it or install osquery first", filepath.Dir(p.path)))
+		default:
+			d.add(step, DoctorFail, err.Error(), "")
+		}
+	}
+}
+
+// Helper to check if a directory can be written, or created by osctrld if it does not exist yet
+func checkDirWritable(dir string) error {
+	for !checkFileExist(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	// The file is not created, only a temporary file in the directory
+	return checkWritable(filepath.Join(dir, ".osctrld-doctor"))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to get the steps of a doctor report by name
+func doctorSteps(r *DoctorReport) map[string]DoctorStep {
+	steps := make(map[string]DoctorStep)
+	for _, s := range r.Steps {
+		steps[s.Step] = s
+	}
+	return steps
+}
+
+// Helper to serve osctrl for doctor, only the flags URL of environment dev accepts the secret good
+func testDoctorServer(t *testing.T, date *time.Time) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if date != nil {
+			w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		}
+		// Doctor must not change anything in osctrl, only flags are retrieved to check the secret
+		if r.Method == http.MethodPost && !strings.HasSuffix(r.URL.Path, "/osctrld-flags") {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		if !strings.HasPrefix(r.URL.Path, "/dev/") {
+			http.NotFound(w, r)
+			return
+		}
+		var req FlagsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.HasSuffix(r.URL.Path, "/osctrld-flags") && req.Secret == "good" {
+			w.Write([]byte("--host_identifier=uuid"))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	// The TCP step connects without handshake, which the server logs
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Helper to get a profile for doctor, with managed files in a directory
+func testDoctorProfile(t *testing.T, baseURL, secret string) *Profile {
+	dir := t.TempDir()
+	pr := testStateProfile("default")
+	pr.Config.BaseURL = baseURL
+	pr.Config.Insecure = true
+	pr.Config.SecretFile = filepath.Join(dir, "osquery.secret")
+	pr.Config.FlagFile = filepath.Join(dir, "osquery.flags")
+	pr.Config.CertFile = filepath.Join(dir, "osctrl.crt")
+	pr.Secret = newLazySecret(literalSecret{value: secret})
+	pr.URLs = genURLs(baseURL, pr.Config.Environment, LinuxOS, false)
+	return pr
+}
+
+func TestDoctorTarget(t *testing.T) {
+	host, port, secure, err := doctorTarget("https://osctrl.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"osctrl.example.com", "443", true}, []any{host, port, secure})
+	host, port, secure, err = doctorTarget("http://10.0.0.1:8080/")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"10.0.0.1", "8080", false}, []any{host, port, secure})
+	_, _, _, err = doctorTarget("osctrl.example.com")
+	assert.Error(t, err)
+	_, _, _, err = doctorTarget("ftp://osctrl.example.com")
+	assert.EqualError(t, err, `baseurl "ftp://osctrl.example.com" must be http or https`)
+}
+
+func TestDoctorRun(t *testing.T) {
+	saved := loadedConfig
+	defer func() { loadedConfig = saved }()
+	loadedConfig = LoadedConfiguration{
+		State:   StateConfiguration{Dir: filepath.Join(t.TempDir(), "state")},
+		Backups: BackupConfiguration{Dir: filepath.Join(t.TempDir(), "backups")},
+	}
+	server := testDoctorServer(t, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	t.Run("healthy", func(t *testing.T) {
+		pr := testDoctorProfile(t, server.URL, "good")
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		assert.NoError(t, os.WriteFile(pr.Config.CertFile, cert, 0600))
+		report := (&Doctor{pr: pr, timeout: time.Second, roots: roots}).Run()
+		steps := doctorSteps(report)
+		assert.Equal(t, 0, report.Failed(), report.Steps)
+		for _, s := range []string{"dns", "tcp", "tls", "tls-osquery", "clock", "url flags", "url heartbeat", "secret", "write flags", "write state", "write backups"} {
+			assert.Equal(t, DoctorOK, steps[s].Status, s)
+		}
+		assert.NotContains(t, steps, "url url")
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		pr := testDoctorProfile(t, server.URL, "good")
+		pr.Config.Insecure = false
+		report := (&Doctor{pr: pr, timeout: time.Second, roots: x509.NewCertPool()}).Run()
+		steps := doctorSteps(report)
+		assert.Equal(t, DoctorFail, steps["tls"].Status)
+		assert.Contains(t, steps["tls"].Diagnosis, "which is not trusted by the system")
+		assert.Equal(t, DoctorWarn, steps["tls-osquery"].Status)
+		assert.Equal(t, DoctorSkip, steps["secret"].Status)
+		// With insecure, osctrld works but the certificate is reported
+		pr.Config.Insecure = true
+		steps = doctorSteps((&Doctor{pr: pr, timeout: time.Second, roots: x509.NewCertPool()}).Run())
+		assert.Equal(t, DoctorWarn, steps["tls"].Status)
+		assert.Equal(t, DoctorOK, steps["secret"].Status)
+	})
+	t.Run("rejected secret", func(t *testing.T) {
+		pr := testDoctorProfile(t, server.URL, "bad")
+		steps := doctorSteps((&Doctor{pr: pr, timeout: time.Second, roots: roots}).Run())
+		assert.Equal(t, DoctorFail, steps["secret"].Status)
+		assert.Equal(t, "HTTP 403", steps["secret"].Detail)
+		assert.Contains(t, steps["secret"].Diagnosis, "enroll secret of environment dev")
+	})
+	t.Run("unknown environment", func(t *testing.T) {
+		pr := testDoctorProfile(t, server.URL, "good")
+		pr.Config.Environment = "prod"
+		pr.URLs = genURLs(server.URL, "prod", LinuxOS, false)
+		steps := doctorSteps((&Doctor{pr: pr, timeout: time.Second, roots: roots}).Run())
+		assert.Equal(t, DoctorFail, steps["url flags"].Status)
+		assert.Contains(t, steps["url flags"].Diagnosis, "check that environment prod exists")
+	})
+	t.Run("clock skew", func(t *testing.T) {
+		past := time.Now().Add(-10 * time.Minute)
+		skewed := testDoctorServer(t, &past)
+		pr := testDoctorProfile(t, skewed.URL, "good")
+		steps := doctorSteps((&Doctor{pr: pr, timeout: time.Second, roots: roots}).Run())
+		assert.Equal(t, DoctorFail, steps["clock"].Status)
+		assert.Contains(t, steps["clock"].Diagnosis, "ahead of osctrl")
+	})
+	t.Run("connection refused", func(t *testing.T) {
+		listener := httptest.NewServer(http.NotFoundHandler())
+		address := listener.URL
+		listener.Close()
+		pr := testDoctorProfile(t, address, "good")
+		report := (&Doctor{pr: pr, timeout: time.Second}).Run()
+		steps := doctorSteps(report)
+		assert.Equal(t, DoctorFail, steps["tcp"].Status)
+		assert.Contains(t, steps["tcp"].Diagnosis, "nothing is listening")
+		assert.Equal(t, DoctorSkip, steps["tls"].Status)
+		assert.Equal(t, DoctorOK, steps["write flags"].Status)
+		assert.Equal(t, 1, report.Failed())
+	})
+	t.Run("invalid baseurl", func(t *testing.T) {
+		pr := testDoctorProfile(t, "osctrl", "good")
+		steps := doctorSteps((&Doctor{pr: pr, timeout: time.Second}).Run())
+		assert.Equal(t, DoctorFail, steps["baseurl"].Status)
+		assert.Equal(t, DoctorSkip, steps["dns"].Status)
+	})
+	t.Run("not writable", func(t *testing.T) {
+		pr := testDoctorProfile(t, "osctrl", "good")
+		pr.Config.FlagFile = filepath.Join(t.TempDir(), "missing", "osquery.flags")
+		steps := doctorSteps((&Doctor{pr: pr, timeout: time.Second}).Run())
+		assert.Equal(t, DoctorFail, steps["write flags"].Status)
+		assert.Contains(t, steps["write flags"].Diagnosis, "does not exist")
+		// Directories are created by osctrld if they do not exist
+		assert.Equal(t, DoctorOK, steps["write state"].Status)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// EncryptedPrefix for encrypted configuration values
+	EncryptedPrefix = "enc:"
+	// Version of the format for encrypted values
+	encryptedVersion = "v1"
+	// Size in bytes of keys for AES-256-GCM
+	encryptionKeySize = 32
+	// Default key file name, inside the platform configuration directory
+	defKeyFile = "osctrld.key"
+)
+
+// encryptedValueRegex to find encrypted values inside configuration files
+var encryptedValueRegex = regexp.MustCompile(`enc:v1:[0-9a-f]+:[A-Za-z0-9+/=]+`)
+
+// Helper to check if a configuration value is encrypted
+func isEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+// Helper to identify a key without exposing it, used to detect values encrypted with another key
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Helper to generate a new random encryption key
+func generateEncryptionKey() ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating key - %v", err)
+	}
+	return key, nil
+}
+
+// Helper to read an encryption key file, with the key encoded in base64
+func loadEncryptionKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file - %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key file %s - %v", path, err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid key size in %s, expected %d bytes", path, encryptionKeySize)
+	}
+	return key, nil
+}
+
+// Helper to write an encryption key file, readable only by the owner
+func writeEncryptionKey(path string, key []byte) error {
+	return writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
+
+// Helper to encrypt a value with AES-256-GCM, the output is enc:v1:<key id>:<base64 of nonce and ciphertext>
+func encryptValue(plain string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce - %v", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return fmt.Sprintf("%s%s:%s:%s", EncryptedPrefix, encryptedVersion, encryptionKeyID(key), base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Helper to decrypt a value generated by encryptValue
+func decryptValue(value string, key []byte) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, EncryptedPrefix), ":", 3)
+	if len(parts) != 3 || parts[0] != encryptedVersion {
+		return "", fmt.Errorf("invalid encrypted value format")
+	}
+	if parts[1] != encryptionKeyID(key) {
+		return "", fmt.Errorf("value was encrypted with key %s, but key is %s", parts[1], encryptionKeyID(key))
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted value - %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting value - %v", err)
+	}
+	return string(plain), nil
+}
+
+// Helper to prepare AES-256-GCM with a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error with key - %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Helper to re-encrypt all encrypted values inside the content of a configuration file, returns how many were changed
+func rekeyContent(content string, oldKey, newKey []byte) (string, int, error) {
+	var rekeyErr error
+	count := 0
+	rekeyed := encryptedValueRegex.ReplaceAllStringFunc(content, func(v string) string {
+		if rekeyErr != nil {
+			return v
+		}
+		plain, err := decryptValue(v, oldKey)
+		if err != nil {
+			rekeyErr = err
+			return v
+		}
+		enc, err := encryptValue(plain, newKey)
+		if err != nil {
+			rekeyErr = err
+			return v
+		}
+		count++
+		return enc
+	})
+	if rekeyErr != nil {
+		return content, 0, rekeyErr
+	}
+	return rekeyed, count, nil
+}
+
+// Helper to resolve the key file, using the default for the platform if not provided
+func resolveKeyFile(file string, p Platform) string {
+	if file != "" {
+		return file
+	}
+	return genFullPath(p.ConfigDir(), defKeyFile)
+}
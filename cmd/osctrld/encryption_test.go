@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecryptValue(t *testing.T) {
+	key, err := generateEncryptionKey()
+	assert.NoError(t, err)
+	enc, err := encryptValue("thisisthesecret", key)
+	assert.NoError(t, err)
+	assert.True(t, isEncryptedValue(enc))
+	assert.True(t, encryptedValueRegex.MatchString(enc))
+	assert.NotContains(t, enc, "thisisthesecret")
+	plain, err := decryptValue(enc, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "thisisthesecret", plain)
+
+	otherKey, _ := generateEncryptionKey()
+	_, err = decryptValue(enc, otherKey)
+	assert.Error(t, err)
+	tampered := enc[:len(enc)-4] + "AAA="
+	_, err = decryptValue(tampered, key)
+	assert.Error(t, err)
+	_, err = decryptValue("enc:v2:abc:def", key)
+	assert.Error(t, err)
+}
+
+func TestEncryptionKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defKeyFile)
+	_, err := loadEncryptionKey(path)
+	assert.Error(t, err)
+	key, _ := generateEncryptionKey()
+	assert.NoError(t, writeEncryptionKey(path, key))
+	loaded, err := loadEncryptionKey(path)
+	assert.NoError(t, err)
+	assert.Equal(t, key, loaded)
+	assert.Equal(t, "/etc/osctrld/"+defKeyFile, resolveKeyFile("", linuxPlatform{}))
+	assert.Equal(t, path, resolveKeyFile(path, linuxPlatform{}))
+}
+
+func TestRekeyContent(t *testing.T) {
+	oldKey, _ := generateEncryptionKey()
+	newKey, _ := generateEncryptionKey()
+	enc, _ := encryptValue("thisisthesecret", oldKey)
+	content := `{"osctrld": {"secret": "` + enc + `", "environment": "dev"}}`
+	rekeyed, count, err := rekeyContent(content, oldKey, newKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NotContains(t, rekeyed, enc)
+	assert.True(t, strings.Contains(rekeyed, `"environment": "dev"`))
+	newEnc := encryptedValueRegex.FindString(rekeyed)
+	plain, err := decryptValue(newEnc, newKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "thisisthesecret", plain)
+	_, _, err = rekeyContent(content, newKey, oldKey)
+	assert.Error(t, err)
+}
+
+func TestApplyRekey(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, defKeyFile)
+	oldKey, _ := generateEncryptionKey()
+	newKey, _ := generateEncryptionKey()
+	assert.NoError(t, writeEncryptionKey(keyPath, oldKey))
+	before, _ := encryptValue("thisisthesecret", oldKey)
+	after, _ := encryptValue("thisisthesecret", newKey)
+	config := filepath.Join(dir, "osctrld.json")
+	assert.NoError(t, os.WriteFile(config, []byte(before), 0600))
+	files := []rekeyedFile{{path: config, before: before, after: after, perm: 0600}}
+
+	// A file that can not be written restores the ones already written and keeps the key
+	failing := append(files, rekeyedFile{path: filepath.Join(dir, "missing", "drop-in.json"), before: before, after: after, perm: 0600})
+	assert.ErrorContains(t, applyRekey(failing, keyPath, newKey, false), "error writing")
+	content, _ := os.ReadFile(config)
+	assert.Equal(t, before, string(content))
+	key, err := loadEncryptionKey(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	assert.NoFileExists(t, keyPath+".old")
+
+	// A file that does not decrypt with the new key restores the files and the key
+	other, _ := generateEncryptionKey()
+	assert.ErrorContains(t, applyRekey(files, keyPath, other, false), "error verifying")
+	content, _ = os.ReadFile(config)
+	assert.Equal(t, before, string(content))
+	key, _ = loadEncryptionKey(keyPath)
+	assert.Equal(t, oldKey, key)
+	assert.NoFileExists(t, keyPath+".old")
+
+	// The old key is kept only if requested
+	assert.NoError(t, applyRekey(files, keyPath, newKey, true))
+	key, err = loadEncryptionKey(keyPath + ".old")
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	assert.NoError(t, os.Rename(keyPath+".old", keyPath))
+	assert.NoError(t, os.WriteFile(config, []byte(before), 0600))
+
+	assert.NoError(t, applyRekey(files, keyPath, newKey, false))
+	content, _ = os.ReadFile(config)
+	assert.Equal(t, after, string(content))
+	key, err = loadEncryptionKey(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, key)
+	assert.NoFileExists(t, keyPath+".old")
+}
+
+func TestLayeredConfigurationDecrypt(t *testing.T) {
+	key, _ := generateEncryptionKey()
+	enc, _ := encryptValue("thisisthesecret", key)
+	layers := newLayeredConfiguration()
+	layers.Set("secret", enc, OriginFile, "osctrld.json")
+	layers.Set("environment", "dev", OriginFile, "osctrld.json")
+	loads := 0
+	err := layers.Decrypt(func() ([]byte, error) {
+		loads++
+		return key, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loads)
+	v, _ := layers.Get("secret")
+	assert.Equal(t, "thisisthesecret", v.Value)
+	assert.True(t, v.Encrypted)
+	v, _ = layers.Get("environment")
+	assert.False(t, v.Encrypted)
+}
@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Whole file is locked, with the maximum length
+const lockFileLength = ^uint32(0)
+
+// Helper to lock a file, blocking until the lock is acquired. Shared locks allow other readers
+func lockFile(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, lockFileLength, lockFileLength, &windows.Overlapped{})
+}
+
+// Helper to unlock a file locked with lockFile
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, lockFileLength, lockFileLength, &windows.Overlapped{})
+}
+
+// Helper to try to lock a file exclusively without blocking, returns false if another process holds the lock
+func tryLockFile(f *os.File) (bool, error) {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, lockFileLength, lockFileLength, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
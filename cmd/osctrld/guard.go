@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time osqueryd is watched after a change
+	defGuardWindow = 60 * time.Second
+	// Default time between health checks of osqueryd during the window
+	defGuardInterval = 5 * time.Second
+	// Default number of times osqueryd can be restarted by its service manager during the window
+	defGuardMaxRestarts = 1
+	// Query used to check that osqueryi answers with the new flags
+	guardQuery = "SELECT version FROM osquery_info;"
+	// Flag for osqueryi to use its own database, the one of osqueryd is locked while it runs
+	flagDatabasePath = "--database_path"
+	// Flag for osqueryi to not enroll with osctrl as another node
+	flagDisableEnrollment = "--disable_enrollment"
+)
+
+// GuardConfiguration to hold the configuration of guarded changes, osqueryd is restarted and watched after each change
+type GuardConfiguration struct {
+	Enabled     bool   `json:"enabled"`
+	Window      string `json:"window"`
+	Interval    string `json:"interval"`
+	MaxRestarts int    `json:"maxRestarts"`
+	Query       bool   `json:"query"`
+}
+
+// ReportRequest to report a change that has been rolled back to osctrl
+type ReportRequest struct {
+	Secret     string `json:"secret"`
+	Artifact   string `json:"artifact"`
+	Path       string `json:"path"`
+	Failed     string `json:"failed"`
+	Restored   string `json:"restored"`
+	RolledBack bool   `json:"rolledBack"`
+	Reason     string `json:"reason"`
+}
+
+// Guard restarts osqueryd after a change and watches it, restoring the previous version if osqueryd is not healthy
+type Guard struct {
+	window      time.Duration
+	interval    time.Duration
+	maxRestarts int
+	restart     func() error
+	probe       func() ([]OsquerydInstance, error)
+	query       func() error
+	report      func(ReportRequest) error
+	reject      func(artifact, hash string)
+}
+
+// rejectedChanges keeps the content rolled back for each file in this process, also when the state can not be written
+var rejectedChanges = struct {
+	sync.Mutex
+	hashes map[string]string
+}{hashes: make(map[string]string)}
+
+// Helper to parse the durations of the guard configuration, empty values use the defaults
+func parseGuardDurations(cfg GuardConfiguration) (time.Duration, time.Duration, error) {
+	window := defGuardWindow
+	interval := defGuardInterval
+	var err error
+	if cfg.Window != defEmptyValue {
+		if window, err = time.ParseDuration(cfg.Window); err != nil || window <= 0 {
+			return 0, 0, fmt.Errorf("invalid guard window %s", cfg.Window)
+		}
+	}
+	if cfg.Interval != defEmptyValue {
+		if interval, err = time.ParseDuration(cfg.Interval); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("invalid guard interval %s", cfg.Interval)
+		}
+	}
+	if interval > window {
+		return 0, 0, fmt.Errorf("guard interval %s is longer than window %s", interval, window)
+	}
+	return window, interval, nil
+}
+
+// Helper to create the guard for a profile, watching the osqueryd that uses its flagfile
+func newGuard(pr *Profile, p Platform, secret string) (*Guard, error) {
+	window, interval, err := parseGuardDurations(pr.Config.Guard)
+	if err != nil {
+		return nil, err
+	}
+	g := &Guard{
+		window:      window,
+		interval:    interval,
+		maxRestarts: pr.Config.Guard.MaxRestarts,
+		restart: func() error {
+			return restartOsqueryd(p)
+		},
+		probe: func() ([]OsquerydInstance, error) {
+			instances, err := discoverOsqueryd(pr.Config.OsqueryLayout.Binary)
+			if err != nil {
+				return nil, err
+			}
+			daemons := osquerydDaemons(instances)
+			if own := osquerydWithFlagfile(daemons, pr.Config.FlagFile); len(own) > 0 {
+				daemons = own
+			}
+			// With the watchdog, a bad change usually makes the worker crash while the watchdog keeps running
+			return append(daemons, osquerydWorkers(instances, daemons)...), nil
+		},
+		report: func(r ReportRequest) error {
+			r.Secret = secret
+			_, err := genericRetrieve(pr.URLs.Report, pr.Config.Insecure, r)
+			return err
+		},
+		reject: func(artifact, hash string) {
+			recordRejected(pr, artifact, hash)
+		},
+	}
+	if pr.Config.Guard.Query {
+		g.query = func() error {
+			return queryOsqueryi(pr.Config.OsqueryLayout.Binary, pr.Config.FlagFile)
+		}
+	}
+	return g, nil
+}
+
+// Helper to check that osqueryi answers a query with the flagfile, osqueryd runs as shell with -S.
+// The flagfile is shared with osqueryd, so osqueryi uses a temporary database and does not enroll
+func queryOsqueryi(binary, flagFile string) error {
+	dir, err := os.MkdirTemp("", "osctrld-osqueryi-")
+	if err != nil {
+		return fmt.Errorf("error creating osqueryi database - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// Flags after the flagfile override its values
+	args := []string{"-S", FlagFlagfile + "=" + flagFile, flagDatabasePath + "=" + dir, flagDisableEnrollment, "--json", guardQuery}
+	out, err := exec.Command(binary, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("osqueryi did not answer - %v - %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Check watches osqueryd during the window, returns an error if it is not running or it keeps restarting.
+// Restarts count new daemons and also new workers respawned by the same watchdog
+func (g *Guard) Check() error {
+	pids := make(map[int32]bool)
+	workers := make(map[int32]map[int32]bool)
+	down := 0
+	deadline := time.Now().Add(g.window)
+	for time.Now().Before(deadline) {
+		time.Sleep(g.interval)
+		instances, err := g.probe()
+		if err != nil {
+			return err
+		}
+		// osqueryd may be briefly down while its service manager restarts it
+		daemons := osquerydDaemons(instances)
+		if len(daemons) == 0 {
+			down++
+			if down > 1 {
+				return fmt.Errorf("osqueryd is not running")
+			}
+			continue
+		}
+		down = 0
+		for _, d := range daemons {
+			pids[d.Pid] = true
+		}
+		for _, w := range instances {
+			if w.Role != OsquerydRoleWorker {
+				continue
+			}
+			if workers[w.Ppid] == nil {
+				workers[w.Ppid] = make(map[int32]bool)
+			}
+			workers[w.Ppid][w.Pid] = true
+		}
+		restarts := len(pids) - 1
+		for _, w := range workers {
+			restarts += len(w) - 1
+		}
+		if restarts > g.maxRestarts {
+			return fmt.Errorf("osqueryd restarted %d times in %s", restarts, g.window)
+		}
+	}
+	if down > 0 {
+		return fmt.Errorf("osqueryd is not running")
+	}
+	if g.query != nil {
+		return g.query()
+	}
+	return nil
+}
+
+// Apply restarts osqueryd after a change to a file and rolls the change back if osqueryd is not healthy
+// before is the hash of the file before the change, empty if the file did not exist
+func (g *Guard) Apply(artifact, path, before string) error {
+	failed := auditFileHash(path)
+	r := AuditRecord{Action: AuditActionHealth, Artifact: artifact, Path: path, Before: before, After: failed}
+	err := g.restart()
+	if err == nil {
+		err = g.Check()
+	}
+	auditOutcome(r, err)
+	if err == nil {
+		return nil
+	}
+	reason := err.Error()
+	l := logger.With(LogFieldArtifact, artifact, LogFieldPath, path)
+	l.Error(fmt.Sprintf("osqueryd is not healthy after %s change - %s", artifact, reason))
+	rejectChange(path, failed)
+	if g.reject != nil {
+		g.reject(artifact, failed)
+	}
+	report := ReportRequest{Artifact: artifact, Path: path, Failed: failed, Reason: reason}
+	rollbackErr := g.rollback(artifact, path, before)
+	if rollbackErr == nil {
+		report.Restored = before
+		report.RolledBack = true
+		l.Warn(fmt.Sprintf("%s rolled back to previous version", artifact))
+		if err := g.restart(); err != nil {
+			rollbackErr = err
+		}
+	}
+	if err := g.report(report); err != nil {
+		l.Warn(fmt.Sprintf("error reporting failed %s change - %v", artifact, err))
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("%s change failed (%s) and could not be rolled back - %v", artifact, reason, rollbackErr)
+	}
+	return fmt.Errorf("%s change failed and was rolled back - %s", artifact, reason)
+}
+
+// Function to restore the version of a file with the given hash from backups
+func (g *Guard) rollback(artifact, path, hash string) error {
+	if hash == defEmptyValue {
+		return fmt.Errorf("there is no previous version of %s", path)
+	}
+	if backupStore == nil {
+		return fmt.Errorf("backups are disabled")
+	}
+	v, err := backupStore.Find(artifact, path, hash)
+	if err != nil {
+		return err
+	}
+	_, err = rollbackArtifact(backupStore, artifact, path, v.Version)
+	return err
+}
+
+// Helper to remember content that has been rolled back for a file
+func rejectChange(path, hash string) {
+	rejectedChanges.Lock()
+	defer rejectedChanges.Unlock()
+	rejectedChanges.hashes[path] = hash
+}
+
+// Helper to check if content has been rolled back for a file before, by this process or a previous one
+func isRejectedChange(pr *Profile, artifact, path, content string) bool {
+	hash := auditHash([]byte(content))
+	rejectedChanges.Lock()
+	rejected := rejectedChanges.hashes[path] == hash
+	rejectedChanges.Unlock()
+	return rejected || wasRejected(pr, artifact, hash)
+}
+
+// Function to write retrieved content for an artifact of a profile, guarded by a health check of osqueryd if enabled
+func applyContent(pr *Profile, secret, artifact, path, content, url string) error {
+	if pr.Config.Guard.Enabled && isRejectedChange(pr, artifact, path, content) {
+		return fmt.Errorf("%s from %s was rolled back before, it will not be applied again", artifact, url)
+	}
+	before := auditFileHash(path)
+	if err := writeContentExists(path, content, artifact, url, pr.Config.Force); err != nil {
+		return err
+	}
+	if auditFileHash(path) == before {
+		return nil
+	}
+	metrics.Add(MetricDrift, 1, "profile", pr.Name, "artifact", artifact)
+	if !pr.Config.Guard.Enabled {
+		return nil
+	}
+	g, err := newGuard(pr, osPlatform, secret)
+	if err != nil {
+		return err
+	}
+	pr.log().Info(fmt.Sprintf("restarting osqueryd and watching it for %s", g.window), emoji("🩺"), LogFieldArtifact, artifact, LogFieldPath, path)
+	return g.Apply(artifact, path, before)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create a guard for tests, the probe returns the given pids in order and the last one afterwards
+func testGuard(pids ...[]int32) (*Guard, *[]ReportRequest, *int) {
+	reports := &[]ReportRequest{}
+	restarts := new(int)
+	n := 0
+	g := &Guard{
+		window:      50 * time.Millisecond,
+		interval:    10 * time.Millisecond,
+		maxRestarts: 1,
+		restart: func() error {
+			*restarts++
+			return nil
+		},
+		probe: func() ([]OsquerydInstance, error) {
+			current := pids[len(pids)-1]
+			if n < len(pids) {
+				current = pids[n]
+			}
+			n++
+			var daemons []OsquerydInstance
+			for _, p := range current {
+				daemons = append(daemons, OsquerydInstance{Pid: p})
+			}
+			return daemons, nil
+		},
+		report: func(r ReportRequest) error {
+			*reports = append(*reports, r)
+			return nil
+		},
+	}
+	return g, reports, restarts
+}
+
+func TestParseGuardDurations(t *testing.T) {
+	window, interval, err := parseGuardDurations(GuardConfiguration{})
+	assert.NoError(t, err)
+	assert.Equal(t, defGuardWindow, window)
+	assert.Equal(t, defGuardInterval, interval)
+	_, _, err = parseGuardDurations(GuardConfiguration{Window: "soon"})
+	assert.Error(t, err)
+	_, _, err = parseGuardDurations(GuardConfiguration{Window: "10s", Interval: "1m"})
+	assert.Error(t, err)
+}
+
+func TestGuardCheck(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100})
+		assert.NoError(t, g.Check())
+	})
+	t.Run("one restart", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100}, []int32{}, []int32{101})
+		assert.NoError(t, g.Check())
+	})
+	t.Run("restart loop", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100}, []int32{101}, []int32{102})
+		err := g.Check()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "restarted 2 times")
+	})
+	t.Run("worker restart loop", func(t *testing.T) {
+		// The watchdog keeps its pid while it respawns the worker that crashes with the new flags
+		g, _, _ := testGuard([]int32{100})
+		worker := int32(200)
+		g.probe = func() ([]OsquerydInstance, error) {
+			worker++
+			return []OsquerydInstance{
+				{Pid: 100, Role: OsquerydRoleWatchdog},
+				{Pid: worker, Ppid: 100, Role: OsquerydRoleWorker},
+			}, nil
+		}
+		err := g.Check()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "restarted 2 times")
+	})
+	t.Run("stable worker", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100})
+		g.probe = func() ([]OsquerydInstance, error) {
+			return []OsquerydInstance{
+				{Pid: 100, Role: OsquerydRoleWatchdog},
+				{Pid: 200, Ppid: 100, Role: OsquerydRoleWorker},
+			}, nil
+		}
+		assert.NoError(t, g.Check())
+	})
+	t.Run("not running", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100}, []int32{})
+		err := g.Check()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not running")
+	})
+	t.Run("query", func(t *testing.T) {
+		g, _, _ := testGuard([]int32{100})
+		g.query = func() error { return fmt.Errorf("osqueryi did not answer") }
+		assert.Error(t, g.Check())
+	})
+}
+
+func TestGuardApply(t *testing.T) {
+	dir := t.TempDir()
+	backupStore = testBackupStore(t, 10, "")
+	auditLog = newAuditLog(filepath.Join(dir, defAuditFile), "flags")
+	defer func() {
+		backupStore = nil
+		auditLog = nil
+	}()
+	file := filepath.Join(dir, "osquery.flags")
+	url := "https://osctrl.url/dev/osctrld-flags"
+	assert.NoError(t, writeContentExists(file, "--host_identifier=uuid", "flags", url, false))
+	before := auditFileHash(file)
+	assert.NoError(t, writeContentExists(file, "--unknown_flag=true", "flags", url, true))
+
+	t.Run("healthy", func(t *testing.T) {
+		g, reports, restarts := testGuard([]int32{100})
+		assert.NoError(t, g.Apply("flags", file, before))
+		assert.Equal(t, 1, *restarts)
+		assert.Empty(t, *reports)
+		assert.True(t, checkFileContent(file, "--unknown_flag=true"))
+	})
+	t.Run("rolled back", func(t *testing.T) {
+		g, reports, restarts := testGuard([]int32{100}, []int32{101}, []int32{102})
+		err := g.Apply("flags", file, before)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "rolled back")
+		assert.Equal(t, 2, *restarts)
+		assert.True(t, checkFileContent(file, "--host_identifier=uuid"))
+		assert.Len(t, *reports, 1)
+		assert.True(t, (*reports)[0].RolledBack)
+		assert.Equal(t, auditHash([]byte("--unknown_flag=true")), (*reports)[0].Failed)
+		assert.Equal(t, before, (*reports)[0].Restored)
+		assert.True(t, isRejectedChange(testStateProfile("default"), "flags", file, "--unknown_flag=true"))
+		last, err := lastAuditRecord(auditLog.path)
+		assert.NoError(t, err)
+		assert.Equal(t, AuditActionRollback, last.Action)
+	})
+	t.Run("no previous version", func(t *testing.T) {
+		other := filepath.Join(dir, "osctrl.crt")
+		assert.NoError(t, os.WriteFile(other, []byte("certificate"), 0600))
+		g, reports, _ := testGuard([]int32{})
+		err := g.Apply("cert", other, "")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "could not be rolled back")
+		assert.Len(t, *reports, 1)
+		assert.False(t, (*reports)[0].RolledBack)
+	})
+}
+
+func TestRejectedChangePersisted(t *testing.T) {
+	stateStore = newStateStore(t.TempDir())
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("default")
+	path := filepath.Join(t.TempDir(), "osquery.flags")
+	assert.False(t, isRejectedChange(pr, "flags", path, "--unknown_flag=true"))
+	g, _, _ := testGuard([]int32{})
+	g.reject = func(artifact, hash string) {
+		recordRejected(pr, artifact, hash)
+	}
+	assert.NoError(t, os.WriteFile(path, []byte("--unknown_flag=true"), 0600))
+	assert.Error(t, g.Apply("flags", path, ""))
+	// A later run does not have the rejected changes of this process
+	rejectedChanges.Lock()
+	delete(rejectedChanges.hashes, path)
+	rejectedChanges.Unlock()
+	assert.True(t, isRejectedChange(pr, "flags", path, "--unknown_flag=true"))
+	assert.False(t, isRejectedChange(pr, "cert", path, "--unknown_flag=true"))
+	for i := 0; i < rejectedKeep+2; i++ {
+		recordRejected(pr, "flags", fmt.Sprintf("hash-%d", i))
+	}
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Profiles["default"].Artifacts["flags"].Rejected, rejectedKeep)
+}
+
+func TestQueryOsqueryi(t *testing.T) {
+	if runtime.GOOS == WindowsOS {
+		t.Skip("shell scripts are not supported")
+	}
+	dir := t.TempDir()
+	args := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "osqueryi")
+	assert.NoError(t, os.WriteFile(binary, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"), 0755))
+	assert.NoError(t, queryOsqueryi(binary, "/etc/osquery/osquery.flags"))
+	content, err := os.ReadFile(args)
+	assert.NoError(t, err)
+	// The database and enrollment of osqueryd are not used, flags after the flagfile override it
+	assert.Regexp(t, `^-S --flagfile=/etc/osquery/osquery.flags --database_path=\S+ --disable_enrollment --json `, string(content))
+	assert.NotContains(t, string(content), "--database_path=/var/osquery")
+}
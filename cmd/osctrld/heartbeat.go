@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+const (
+	// Default interval to send heartbeats to osctrl
+	defHeartbeatInterval = time.Minute
+)
+
+// HeartbeatConfiguration to hold the configuration of heartbeats, the status of the node sent periodically to osctrl
+type HeartbeatConfiguration struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+}
+
+// HostFacts keeps the details of the host sent with each heartbeat
+type HostFacts struct {
+	Hostname        string `json:"hostname"`
+	HostID          string `json:"hostId"`
+	OS              string `json:"os"`
+	Platform        string `json:"platform"`
+	PlatformVersion string `json:"platformVersion"`
+	KernelVersion   string `json:"kernelVersion"`
+	Arch            string `json:"arch"`
+	Uptime          uint64 `json:"uptime"`
+	BootTime        uint64 `json:"bootTime"`
+}
+
+// HeartbeatOsqueryd keeps the details of a running osqueryd sent with each heartbeat
+type HeartbeatOsqueryd struct {
+	Pid     int32     `json:"pid"`
+	Role    string    `json:"role"`
+	Started time.Time `json:"started"`
+	Stale   []string  `json:"stale"`
+}
+
+// HeartbeatArtifact keeps the hashes of an artifact sent with each heartbeat
+type HeartbeatArtifact struct {
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Applied   string    `json:"applied"`
+	LastApply time.Time `json:"lastApply"`
+}
+
+// HeartbeatRequest to send the status of the node to osctrl
+type HeartbeatRequest struct {
+	Secret          string                       `json:"secret"`
+	Time            time.Time                    `json:"time"`
+	OsctrldVersion  string                       `json:"osctrldVersion"`
+	Host            HostFacts                    `json:"host"`
+	OsqueryVersion  string                       `json:"osqueryVersion"`
+	OsquerydRunning bool                         `json:"osquerydRunning"`
+	Osqueryd        []HeartbeatOsqueryd          `json:"osqueryd"`
+	Artifacts       map[string]HeartbeatArtifact `json:"artifacts"`
+	Verify          *VerifyReport                `json:"verify"`
+}
+
+// Helper to parse the heartbeat interval, empty value uses the default
+func parseHeartbeatInterval(interval string) (time.Duration, error) {
+	if interval == defEmptyValue {
+		return defHeartbeatInterval, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid heartbeat interval %s, it must be a duration of at least 1s", interval)
+	}
+	return d, nil
+}
+
+// Helper to get the facts of the host
+func getHostFacts() (HostFacts, error) {
+	info, err := host.Info()
+	if err != nil {
+		return HostFacts{OS: runtime.GOOS, Arch: runtime.GOARCH}, fmt.Errorf("error getting host facts - %v", err)
+	}
+	return HostFacts{
+		Hostname:        info.Hostname,
+		HostID:          info.HostID,
+		OS:              info.OS,
+		Platform:        info.Platform,
+		PlatformVersion: info.PlatformVersion,
+		KernelVersion:   info.KernelVersion,
+		Arch:            runtime.GOARCH,
+		Uptime:          info.Uptime,
+		BootTime:        info.BootTime,
+	}, nil
+}
+
+// Function to generate the heartbeat of a profile, without secret. Problems collecting a value are logged and it is left empty
+func genHeartbeat(pr *Profile) HeartbeatRequest {
+	l := pr.log()
+	hb := HeartbeatRequest{
+		Time:           time.Now().UTC(),
+		OsctrldVersion: OsctrldVersion,
+		Artifacts:      make(map[string]HeartbeatArtifact),
+	}
+	var err error
+	if hb.Host, err = getHostFacts(); err != nil {
+		l.Debug(err.Error())
+	}
+	binary := pr.Config.OsqueryLayout.Binary
+	if checkFileExist(binary) {
+		hb.OsqueryVersion = getOsqueryVersion(binary)
+	}
+	instances, err := discoverOsqueryd(binary)
+	if err != nil {
+		l.Debug(fmt.Sprintf("error discovering osqueryd - %v", err))
+	}
+	// With several osqueryd on the host, only the ones using the flagfile of this profile are reported
+	daemons := osquerydDaemons(instances)
+	if own := osquerydWithFlagfile(daemons, pr.Config.FlagFile); len(own) > 0 {
+		daemons = own
+	}
+	certFile := defEmptyValue
+	if checkFileExist(pr.Config.CertFile) {
+		certFile = pr.Config.CertFile
+	}
+	for _, d := range daemons {
+		hb.Osqueryd = append(hb.Osqueryd, HeartbeatOsqueryd{
+			Pid:     d.Pid,
+			Role:    d.Role,
+			Started: d.StartTime.UTC(),
+			Stale:   checkStaleOsqueryd(d, pr.Config.FlagFile, certFile),
+		})
+	}
+	hb.OsquerydRunning = len(daemons) > 0
+	var ps *ProfileState
+	if stateStore != nil {
+		state, err := stateStore.Load()
+		if err != nil {
+			l.Debug(fmt.Sprintf("error loading state for heartbeat - %v", err))
+		}
+		ps = state.Profiles[pr.Name]
+	}
+	for _, artifact := range []string{"flags", "cert"} {
+		path, _ := artifactPath(pr, artifact)
+		a := HeartbeatArtifact{Path: path, Hash: auditFileHash(path)}
+		if ps != nil {
+			if as, ok := ps.Artifacts[artifact]; ok {
+				a.Applied = as.Hash
+				a.LastApply = as.LastApply
+			}
+		}
+		hb.Artifacts[artifact] = a
+	}
+	if ps != nil {
+		hb.Verify = ps.Verify
+	}
+	return hb
+}
+
+// Function to send the heartbeat of a profile to osctrl, recorded in the state when it is accepted
+func sendHeartbeat(pr *Profile) error {
+	secret, err := getSecret(pr)
+	if err != nil {
+		return err
+	}
+	hb := genHeartbeat(pr)
+	hb.Secret = secret
+	pr.log().Debug(fmt.Sprintf("Sending heartbeat to %s", pr.URLs.Heartbeat), LogFieldURL, pr.URLs.Heartbeat)
+	if _, err := genericRetrieve(pr.URLs.Heartbeat, pr.Config.Insecure, hb); err != nil {
+		secretRejected(pr, err)
+		return fmt.Errorf("error sending heartbeat - %v", err)
+	}
+	recordHeartbeat(pr, hb.Time)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeartbeatInterval(t *testing.T) {
+	d, err := parseHeartbeatInterval("")
+	assert.NoError(t, err)
+	assert.Equal(t, defHeartbeatInterval, d)
+	d, err = parseHeartbeatInterval("5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, d)
+	_, err = parseHeartbeatInterval("10ms")
+	assert.Error(t, err)
+	_, err = parseHeartbeatInterval("often")
+	assert.Error(t, err)
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	var received HeartbeatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/dev/osctrld-heartbeat", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	stateStore = newStateStore(dir)
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("default")
+	pr.Secret = newLazySecret(literalSecret{value: "s3cr3t"})
+	pr.URLs = genURLs(server.URL, "dev", LinuxOS, false)
+	pr.Config.FlagFile = filepath.Join(dir, "osquery.flags")
+	pr.Config.CertFile = filepath.Join(dir, "osctrl.crt")
+	pr.Config.OsqueryLayout.Binary = filepath.Join(dir, "missing", "osqueryd")
+	assert.NoError(t, os.WriteFile(pr.Config.FlagFile, []byte("--host_identifier=uuid"), 0600))
+	recordApply(pr, "flags", pr.Config.FlagFile, nil)
+	recordVerify(pr, &VerifyReport{Checks: []VerifyCheck{{Check: "running", Message: "osqueryd is NOT running"}}})
+
+	assert.NoError(t, sendHeartbeat(pr))
+	assert.Equal(t, "s3cr3t", received.Secret)
+	assert.Equal(t, OsctrldVersion, received.OsctrldVersion)
+	assert.False(t, received.OsquerydRunning)
+	assert.NotEmpty(t, received.Host.OS)
+	flags := received.Artifacts["flags"]
+	assert.Equal(t, auditHash([]byte("--host_identifier=uuid")), flags.Hash)
+	assert.Equal(t, flags.Hash, flags.Applied)
+	assert.Empty(t, received.Artifacts["cert"].Hash)
+	assert.Equal(t, 1, received.Verify.Failed())
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, received.Time, state.Profiles["default"].LastHeartbeat, time.Millisecond)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	assert.ErrorContains(t, sendHeartbeat(pr), "HTTP 404")
+}
@@ -5,9 +5,10 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"time"
 )
 
 // JSONApplication for Content-Type headers
@@ -28,6 +29,9 @@ const ContentType string = "Content-Type"
 // UserAgent for header key
 const UserAgent string = "User-Agent"
 
+// ETag for header key
+const ETag string = "ETag"
+
 // Authorization for header key
 const Authorization string = "Authorization"
 
@@ -36,15 +40,38 @@ const osctrlUserAgent string = "osctrld-http-client/" + OsctrldVersion
 
 // SendRequest - Helper function to send HTTP requests
 func SendRequest(reqType, reqURL string, params io.Reader, headers map[string]string, insecure bool) (int, []byte, error) {
+	code, _, body, err := SendRequestHeaders(reqType, reqURL, params, headers, insecure)
+	return code, body, err
+}
+
+// SendRequestHeaders - Helper function to send HTTP requests, returning also the response headers
+func SendRequestHeaders(reqType, reqURL string, params io.Reader, headers map[string]string, insecure bool) (int, http.Header, []byte, error) {
+	start := time.Now()
+	code, respHeaders, body, err := sendRequest(reqType, reqURL, params, headers, insecure)
+	observeRequest(requestEndpoint(reqURL), code, err, time.Since(start))
+	return code, respHeaders, body, err
+}
+
+// Helper to get the endpoint of a request for metrics, the last element of the URL path
+func requestEndpoint(reqURL string) string {
+	u, err := url.Parse(reqURL)
+	if err != nil || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		return "unknown"
+	}
+	return path.Base(u.Path)
+}
+
+// Helper function to send HTTP requests
+func sendRequest(reqType, reqURL string, params io.Reader, headers map[string]string, insecure bool) (int, http.Header, []byte, error) {
 	u, err := url.Parse(reqURL)
 	if err != nil {
-		return 0, nil, fmt.Errorf("invalid url: %v", err)
+		return 0, nil, nil, fmt.Errorf("invalid url: %v", err)
 	}
 	client := &http.Client{}
 	if u.Scheme == "https" {
 		certPool, err := x509.SystemCertPool()
 		if err != nil {
-			return 0, nil, fmt.Errorf("error loading x509 certificate pool: %v", err)
+			return 0, nil, nil, fmt.Errorf("error loading x509 certificate pool: %v", err)
 		}
 		tlsCfg := &tls.Config{RootCAs: certPool}
 		if insecure {
@@ -54,7 +81,7 @@ func SendRequest(reqType, reqURL string, params io.Reader, headers map[string]st
 	}
 	req, err := http.NewRequest(reqType, reqURL, params)
 	if err != nil {
-		return 0, []byte("Cound not prepare request"), err
+		return 0, nil, []byte("Cound not prepare request"), err
 	}
 	// Set custom User-Agent
 	req.Header.Set(UserAgent, osctrlUserAgent)
@@ -65,19 +92,19 @@ func SendRequest(reqType, reqURL string, params io.Reader, headers map[string]st
 	// Send request
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, []byte("Error sending request"), err
+		return 0, nil, []byte("Error sending request"), err
 	}
 	//defer resp.Body.Close()
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			log.Printf("Failed to close body %v", err)
+			logger.Warn(fmt.Sprintf("Failed to close body %v", err))
 		}
 	}()
 	// Read body
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return 0, []byte("Can not read response"), err
+		return 0, nil, []byte("Can not read response"), err
 	}
 
-	return resp.StatusCode, bodyBytes, nil
+	return resp.StatusCode, resp.Header, bodyBytes, nil
 }
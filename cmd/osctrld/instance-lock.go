@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// Default time to wait for another osctrld process to release the lock of a profile
+	defLockTimeout = 30 * time.Second
+	// Time between attempts to take the lock
+	lockRetryInterval = 100 * time.Millisecond
+	// Extension for the file with the process holding a lock
+	lockHolderExtension = ".pid"
+)
+
+// LockConfiguration to hold the configuration of the lock taken by commands that change files
+type LockConfiguration struct {
+	Timeout string `json:"timeout"`
+}
+
+// LockHolder keeps the process holding an instance lock
+type LockHolder struct {
+	Pid     int       `json:"pid"`
+	Command string    `json:"command"`
+	Profile string    `json:"profile"`
+	Since   time.Time `json:"since"`
+}
+
+// String returns the holder for error messages
+func (h LockHolder) String() string {
+	return fmt.Sprintf("pid %d (osctrld %s) since %s", h.Pid, h.Command, h.Since.Local().Format(time.RFC3339))
+}
+
+// InstanceLock is an advisory lock, so only one osctrld process changes the files of a profile at a time
+type InstanceLock struct {
+	path string
+	file *os.File
+}
+
+// Helper to parse the lock timeout, empty value uses the default
+func parseLockTimeout(timeout string) (time.Duration, error) {
+	if timeout == defEmptyValue {
+		return defLockTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid lock timeout %s", timeout)
+	}
+	return d, nil
+}
+
+// Helper to get the lock file of a profile in a directory
+func instanceLockPath(dir, profile string) string {
+	return filepath.Join(dir, appName+"-"+profile+stateLockExtension)
+}
+
+// Helper to read the process holding a lock
+func readLockHolder(path string) (LockHolder, error) {
+	var h LockHolder
+	content, err := os.ReadFile(path + lockHolderExtension)
+	if err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal(content, &h); err != nil {
+		return h, fmt.Errorf("invalid lock holder - %v", err)
+	}
+	return h, nil
+}
+
+// Function to take a lock, waiting up to timeout for the process holding it
+func acquireInstanceLock(path string, holder LockHolder, timeout time.Duration) (*InstanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating lock directory - %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock - %v", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error taking lock %s - %v", path, err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, lockHeldError(path, holder.Profile, timeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	// The lock is released when its process exits, a holder left behind is from a process that did not release it
+	if stale, err := readLockHolder(path); err == nil {
+		logger.Warn(fmt.Sprintf("taking stale lock of profile %s, held by %s", holder.Profile, stale), LogFieldProfile, holder.Profile, LogFieldPath, path)
+	}
+	holder.Pid = os.Getpid()
+	holder.Since = time.Now()
+	content, err := json.Marshal(holder)
+	if err == nil {
+		err = writeFileAtomic(path+lockHolderExtension, content, 0600)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, fmt.Errorf("error writing lock holder - %v", err)
+	}
+	return &InstanceLock{path: path, file: f}, nil
+}
+
+// Helper to generate the error when a lock is held by another process, naming the process
+func lockHeldError(path, profile string, timeout time.Duration) error {
+	holder, err := readLockHolder(path)
+	if err != nil {
+		return fmt.Errorf("another osctrld process is changing profile %s, lock %s not released after %s", profile, path, timeout)
+	}
+	running := ""
+	if exists, err := process.PidExists(int32(holder.Pid)); err == nil && !exists {
+		running = ", it is not running but the lock is still held"
+	}
+	return fmt.Errorf("another osctrld process is changing profile %s, lock %s held by %s%s, not released after %s", profile, path, holder, running, timeout)
+}
+
+// Release removes the holder and releases the lock
+func (l *InstanceLock) Release() error {
+	os.Remove(l.path + lockHolderExtension)
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Function to take the lock of a profile for a command, with the configured timeout
+func lockProfile(pr *Profile, command string) (*InstanceLock, error) {
+	timeout, err := parseLockTimeout(loadedConfig.Lock.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return acquireInstanceLock(instanceLockPath(loadedConfig.State.Dir, pr.Name), LockHolder{Command: command, Profile: pr.Name}, timeout)
+}
+
+// Function to wrap actions that change files of a profile, holding its lock
+func lockedWrapper(action func(*cli.Context, *Profile) error) func(*cli.Context, *Profile) error {
+	return func(c *cli.Context, pr *Profile) error {
+		lock, err := lockProfile(pr, c.Command.FullName())
+		if err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with lock - %v", err)
+			return cli.Exit(exitError, 2)
+		}
+		defer lock.Release()
+		return action(c, pr)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLockTimeout(t *testing.T) {
+	d, err := parseLockTimeout("")
+	assert.NoError(t, err)
+	assert.Equal(t, defLockTimeout, d)
+	d, err = parseLockTimeout("0s")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	_, err = parseLockTimeout("-1s")
+	assert.Error(t, err)
+}
+
+func TestInstanceLock(t *testing.T) {
+	path := instanceLockPath(filepath.Join(t.TempDir(), defStateDir), "prod")
+	lock, err := acquireInstanceLock(path, LockHolder{Command: "daemon", Profile: "prod"}, 0)
+	assert.NoError(t, err)
+	holder, err := readLockHolder(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), holder.Pid)
+	assert.Equal(t, "daemon", holder.Command)
+
+	start := time.Now()
+	_, err = acquireInstanceLock(path, LockHolder{Command: "flags", Profile: "prod"}, 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Contains(t, err.Error(), "osctrld daemon")
+	assert.Contains(t, err.Error(), "pid")
+
+	// Released while waiting
+	held := lock
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.Release()
+	}()
+	lock, err = acquireInstanceLock(path, LockHolder{Command: "flags", Profile: "prod"}, 2*time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+	_, err = readLockHolder(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInstanceLockStale(t *testing.T) {
+	path := instanceLockPath(t.TempDir(), "default")
+	stale, _ := json.Marshal(LockHolder{Pid: 999999, Command: "enroll", Profile: "default", Since: time.Now().Add(-time.Hour)})
+	assert.NoError(t, os.WriteFile(path+lockHolderExtension, stale, 0600))
+	lock, err := acquireInstanceLock(path, LockHolder{Command: "cert", Profile: "default"}, 0)
+	assert.NoError(t, err)
+	defer lock.Release()
+	holder, err := readLockHolder(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), holder.Pid)
+	assert.Equal(t, "cert", holder.Command)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LogOutputStderr to write logs to stderr
+	LogOutputStderr = "stderr"
+	// LogOutputFile to write logs to a file, with rotation
+	LogOutputFile = "file"
+	// LogOutputJournald to send logs to journald with its native protocol
+	LogOutputJournald = "journald"
+	// LogOutputSyslog to send logs to syslog in RFC 5424 format
+	LogOutputSyslog = "syslog"
+	// Default socket for the journald native protocol
+	defJournaldSocket = "/run/systemd/journal/socket"
+	// Default address for syslog
+	defSyslogAddress = "unix:///dev/log"
+	// Default syslog facility
+	defSyslogFacility = "daemon"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern":   0,
+	"user":   1,
+	"daemon": 3,
+	"auth":   4,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// Helper to map a log level to a syslog priority, journald uses the same values
+func logPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// logField keeps an attribute flattened as key and value
+type logField struct {
+	Key   string
+	Value string
+}
+
+// sinkHandler collects the attributes of records and sends them with a sink specific format
+type sinkHandler struct {
+	level  slog.Leveler
+	fields []logField
+	group  string
+	sink   *logSink
+}
+
+// logSink keeps the connection to journald or syslog, shared by all handlers derived from the same logger
+type logSink struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	dial   func() (net.Conn, error)
+	format func(r slog.Record, fields []logField) []byte
+}
+
+// Enabled returns true if the level is enabled
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle formats the record and sends it as a single datagram
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := append([]logField{}, h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendLogField(fields, h.group, a)
+		return true
+	})
+	return h.sink.write(h.sink.format(r, fields))
+}
+
+// Function to send a message to the sink, connecting again once if it fails, like after journald or syslog restart
+func (s *logSink) write(msg []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.conn.Write(msg)
+	if err == nil || s.dial == nil {
+		return err
+	}
+	conn, dialErr := s.dial()
+	if dialErr != nil {
+		return fmt.Errorf("%v - error connecting again - %v", err, dialErr)
+	}
+	s.conn.Close()
+	s.conn = conn
+	_, err = s.conn.Write(msg)
+	return err
+}
+
+// WithAttrs returns a handler with the attributes
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.fields = append([]logField{}, h.fields...)
+	for _, a := range attrs {
+		n.fields = appendLogField(n.fields, h.group, a)
+	}
+	return &n
+}
+
+// WithGroup returns a handler that prefixes attribute keys with the group
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	if name == defEmptyValue {
+		return h
+	}
+	n := *h
+	n.group = h.group + name + "."
+	return &n
+}
+
+// Close closes the connection to the sink
+func (s *logSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn.Close()
+}
+
+// Helper to flatten an attribute into fields, groups are joined with dots and the emoji is dropped
+func appendLogField(fields []logField, prefix string, a slog.Attr) []logField {
+	a.Value = a.Value.Resolve()
+	if a.Key == logFieldEmoji && prefix == defEmptyValue {
+		return fields
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != defEmptyValue {
+			p = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			fields = appendLogField(fields, p, ga)
+		}
+		return fields
+	}
+	if a.Key == defEmptyValue {
+		return fields
+	}
+	return append(fields, logField{Key: prefix + a.Key, Value: a.Value.String()})
+}
+
+// Function to create a handler that sends logs to journald with its native protocol
+func newJournaldHandler(socket string, level slog.Leveler) (*sinkHandler, *logSink, error) {
+	if socket == defEmptyValue {
+		socket = defJournaldSocket
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial("unixgram", socket)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to journald - %v", err)
+	}
+	sink := &logSink{conn: conn, dial: dial, format: formatJournald}
+	return &sinkHandler{level: level, sink: sink}, sink, nil
+}
+
+// Helper to format a record with the journald native protocol, fields are prefixed with OSCTRLD_
+func formatJournald(r slog.Record, fields []logField) []byte {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", r.Message)
+	writeJournaldField(&buf, "PRIORITY", fmt.Sprintf("%d", logPriority(r.Level)))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", appName)
+	for _, f := range fields {
+		writeJournaldField(&buf, "OSCTRLD_"+journaldFieldName(f.Key), f.Value)
+	}
+	return buf.Bytes()
+}
+
+// Helper to write a journald field, values with new lines use the binary format
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(value)))
+	buf.Write(size)
+	buf.WriteString(value + "\n")
+}
+
+// Helper to convert a key to a valid journald field name, uppercase letters, digits and underscores
+func journaldFieldName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// Function to create a handler that sends logs to syslog, the address is unix:///path or udp://host:port
+func newSyslogHandler(address, facility string, level slog.Leveler) (*sinkHandler, *logSink, error) {
+	network, addr, err := parseSyslogAddress(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if facility == defEmptyValue {
+		facility = defSyslogFacility
+	}
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid syslog facility %s", facility)
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to syslog - %v", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == defEmptyValue {
+		hostname = "-"
+	}
+	pid := os.Getpid()
+	sink := &logSink{conn: conn, dial: dial, format: func(r slog.Record, fields []logField) []byte {
+		return formatSyslog(r, fields, code, hostname, pid)
+	}}
+	return &sinkHandler{level: level, sink: sink}, sink, nil
+}
+
+// Helper to parse a syslog address into network and address
+func parseSyslogAddress(address string) (string, string, error) {
+	if address == defEmptyValue {
+		address = defSyslogAddress
+	}
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unixgram", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "udp://"):
+		return "udp", strings.TrimPrefix(address, "udp://"), nil
+	}
+	return "", "", fmt.Errorf("invalid syslog address %s, use unix:///path or udp://host:port", address)
+}
+
+// Helper to format a record as RFC 5424 message. osctrld has no private enterprise number for a structured data ID,
+// so attributes are appended to the message as key=value
+func formatSyslog(r slog.Record, fields []logField, facility int, hostname string, pid int) []byte {
+	ts := r.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	var b strings.Builder
+	b.WriteString(r.Message)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%s", syslogFieldName(f.Key), syslogFieldValue(f.Value))
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s", facility*8+logPriority(r.Level), ts.Format(time.RFC3339Nano), hostname, appName, pid, b.String()))
+}
+
+// Helper to quote a field value if it is empty or has spaces, quotes, equals or characters that are not printable
+func syslogFieldValue(value string) string {
+	if value == "" || strings.ContainsAny(value, ` "=\`) || strings.IndexFunc(value, func(r rune) bool { return !strconv.IsPrint(r) }) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// Helper to convert a key to a valid field name, without spaces, equals, quotes or brackets
+func syslogFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == '"' || r == ']' {
+			return '_'
+		}
+		return r
+	}, key)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to read one datagram from a listener, with timeout
+func readDatagram(t *testing.T, conn net.PacketConn) string {
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestLogPriority(t *testing.T) {
+	assert.Equal(t, 7, logPriority(slog.LevelDebug))
+	assert.Equal(t, 6, logPriority(slog.LevelInfo))
+	assert.Equal(t, 4, logPriority(slog.LevelWarn))
+	assert.Equal(t, 3, logPriority(slog.LevelError))
+}
+
+func TestJournaldHandler(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	listener, err := net.ListenPacket("unixgram", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	h, sink, err := newJournaldHandler(socket, slog.LevelInfo)
+	assert.NoError(t, err)
+	defer sink.Close()
+	l := slog.New(h).With(LogFieldCommand, "flags", emoji("✅"))
+	l.Debug("hidden")
+	l.WithGroup("osquery").Warn("flags mismatch", LogFieldPath, "/etc/osquery/osquery.flags")
+	msg := readDatagram(t, listener)
+	assert.Contains(t, msg, "MESSAGE=flags mismatch\n")
+	assert.Contains(t, msg, "PRIORITY=4\n")
+	assert.Contains(t, msg, "SYSLOG_IDENTIFIER=osctrld\n")
+	assert.Contains(t, msg, "OSCTRLD_COMMAND=flags\n")
+	assert.Contains(t, msg, "OSCTRLD_OSQUERY_PATH=/etc/osquery/osquery.flags\n")
+	assert.NotContains(t, msg, "EMOJI")
+
+	l.Error("script failed\nwith output")
+	msg = readDatagram(t, listener)
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len("script failed\nwith output")))
+	assert.Contains(t, msg, "MESSAGE\n"+string(size)+"script failed\nwith output\n")
+	assert.Contains(t, msg, "PRIORITY=3\n")
+}
+
+func TestSyslogHandler(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	h, sink, err := newSyslogHandler("udp://"+listener.LocalAddr().String(), "local3", slog.LevelDebug)
+	assert.NoError(t, err)
+	defer sink.Close()
+	l := slog.New(h).With(LogFieldProfile, "prod")
+	l.Info("flags ready", emoji("✅"), LogFieldPath, `C:\osquery\"osquery".flags`)
+	msg := readDatagram(t, listener)
+	// local3 is 19, info is 6
+	// Without structured data, attributes are appended to the message
+	assert.Regexp(t, regexp.MustCompile(`^<158>1 \S+ \S+ osctrld \d+ - - flags ready `), msg)
+	assert.NotContains(t, msg, "[")
+	assert.True(t, strings.HasSuffix(msg, ` profile=prod path="C:\\osquery\\\"osquery\".flags"`))
+	assert.NotContains(t, msg, "emoji")
+
+	slog.New(h).Debug("no attributes")
+	msg = readDatagram(t, listener)
+	assert.Regexp(t, regexp.MustCompile(`^<159>1 .* - - no attributes$`), msg)
+}
+
+func TestSyslogHandlerUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "log.sock")
+	listener, err := net.ListenPacket("unixgram", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	l, closer, err := newLogger(LogConfiguration{Output: LogOutputSyslog, SyslogAddress: "unix://" + socket}, slog.LevelInfo, nil)
+	assert.NoError(t, err)
+	defer closer.Close()
+	l.Error("cert mismatch")
+	msg := readDatagram(t, listener)
+	// daemon is 3, err is 3
+	assert.True(t, strings.HasPrefix(msg, "<27>1 "))
+}
+
+func TestSyslogHandlerReconnect(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "log.sock")
+	listener, err := net.ListenPacket("unixgram", socket)
+	assert.NoError(t, err)
+	h, sink, err := newSyslogHandler("unix://"+socket, "", slog.LevelInfo)
+	assert.NoError(t, err)
+	defer sink.Close()
+	// syslog restarts, creating its socket again
+	listener.Close()
+	os.Remove(socket)
+	listener, err = net.ListenPacket("unixgram", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	slog.New(h).Warn("after restart")
+	assert.True(t, strings.HasSuffix(readDatagram(t, listener), " after restart"))
+}
+
+func TestSyslogHandlerErrors(t *testing.T) {
+	_, _, err := newSyslogHandler("tcp://127.0.0.1:514", "", slog.LevelInfo)
+	assert.Error(t, err)
+	_, _, err = newSyslogHandler("udp://127.0.0.1:514", "mail", slog.LevelInfo)
+	assert.Error(t, err)
+	_, _, err = newJournaldHandler(filepath.Join(t.TempDir(), "missing.sock"), slog.LevelInfo)
+	assert.Error(t, err)
+}
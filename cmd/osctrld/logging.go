@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LogFormatAuto uses emoji output for interactive terminals and text otherwise
+	LogFormatAuto = "auto"
+	// LogFormatEmoji for human friendly output, as plain messages with emoji
+	LogFormatEmoji = "emoji"
+	// LogFormatText for key=value output
+	LogFormatText = "text"
+	// LogFormatJSON for JSON output, one object per line
+	LogFormatJSON = "json"
+	// Default maximum size in megabytes of the log file before it is rotated
+	defLogMaxSize = 10
+	// Default number of rotated log files to keep
+	defLogMaxBackups = 3
+	// Time format for emoji output, same as the standard logger
+	emojiTimeFormat = "2006/01/02 15:04:05"
+)
+
+const (
+	// LogFieldCommand for the command being executed
+	LogFieldCommand = "command"
+	// LogFieldProfile for the profile in use
+	LogFieldProfile = "profile"
+	// LogFieldEnvironment for the osctrl environment
+	LogFieldEnvironment = "environment"
+	// LogFieldArtifact for what is being managed: flags, cert, secret, script or osqueryd
+	LogFieldArtifact = "artifact"
+	// LogFieldURL for the osctrl URL being requested
+	LogFieldURL = "url"
+	// LogFieldPath for the local file being managed
+	LogFieldPath = "path"
+	// LogFieldError for errors
+	LogFieldError = "error"
+	// Attribute only used by emoji output, dropped by other formats
+	logFieldEmoji = "emoji"
+)
+
+// LogConfiguration to hold the logging configuration
+type LogConfiguration struct {
+	Level          string `json:"level"`
+	Format         string `json:"format"`
+	Output         string `json:"output"`
+	File           string `json:"file"`
+	MaxSize        int    `json:"maxSize"`
+	MaxBackups     int    `json:"maxBackups"`
+	JournaldSocket string `json:"journaldSocket"`
+	SyslogAddress  string `json:"syslogAddress"`
+	SyslogFacility string `json:"syslogFacility"`
+}
+
+// logger is used for all output, it writes emoji output to stderr until the configuration is loaded
+var logger = slog.New(newEmojiHandler(os.Stderr, slog.LevelInfo))
+
+// logLevel of the configured logger, it can be changed while logging
+var logLevel = new(slog.LevelVar)
+
+// logCloser to close the log file, if any, before exiting
+var logCloser io.Closer
+
+// Helper to add the emoji for a message in emoji output
+func emoji(e string) slog.Attr {
+	return slog.String(logFieldEmoji, e)
+}
+
+// Helper to parse a log level, verbose is the same as debug
+func parseLogLevel(level string, verbose bool) (slog.Level, error) {
+	if verbose {
+		return slog.LevelDebug, nil
+	}
+	var l slog.Level
+	if level == defEmptyValue {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %s, valid values are debug, info, warn and error", level)
+	}
+	return l, nil
+}
+
+// Helper to check if a file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Function to create a logger from the configuration, with the given level. Output goes to stderr, the log file, journald or syslog
+func newLogger(cfg LogConfiguration, level slog.Leveler, stderr *os.File) (*slog.Logger, io.Closer, error) {
+	output := strings.ToLower(cfg.Output)
+	if output == defEmptyValue {
+		output = LogOutputStderr
+		if cfg.File != defEmptyValue {
+			output = LogOutputFile
+		}
+	}
+	var w io.Writer = stderr
+	var closer io.Closer
+	interactive := isTerminal(stderr)
+	switch output {
+	case LogOutputStderr:
+	case LogOutputFile:
+		if cfg.File == defEmptyValue {
+			return nil, nil, fmt.Errorf("log file is required for file output")
+		}
+		rw, err := newRotatingWriter(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = rw
+		closer = rw
+		interactive = false
+	case LogOutputJournald:
+		h, sink, err := newJournaldHandler(cfg.JournaldSocket, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return slog.New(h), sink, nil
+	case LogOutputSyslog:
+		h, sink, err := newSyslogHandler(cfg.SyslogAddress, cfg.SyslogFacility, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return slog.New(h), sink, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid log output %s, valid values are stderr, file, journald and syslog", cfg.Output)
+	}
+	format := strings.ToLower(cfg.Format)
+	if format == defEmptyValue || format == LogFormatAuto {
+		format = LogFormatText
+		if interactive {
+			format = LogFormatEmoji
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: dropEmoji}
+	var h slog.Handler
+	switch format {
+	case LogFormatEmoji:
+		h = newEmojiHandler(w, level)
+	case LogFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, fmt.Errorf("invalid log format %s, valid values are auto, emoji, text and json", cfg.Format)
+	}
+	return slog.New(h), closer, nil
+}
+
+// Helper to remove the emoji attribute from structured output
+func dropEmoji(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == logFieldEmoji {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// emojiHandler writes human friendly messages, prefixed with an emoji. Attributes are not written
+type emojiHandler struct {
+	w     io.Writer
+	level slog.Leveler
+	mutex *sync.Mutex
+	emoji string
+}
+
+// Helper to create a handler for emoji output
+func newEmojiHandler(w io.Writer, level slog.Leveler) *emojiHandler {
+	return &emojiHandler{w: w, level: level, mutex: &sync.Mutex{}}
+}
+
+// Enabled returns true if the level is enabled
+func (h *emojiHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle writes the record as a line with time, emoji and message
+func (h *emojiHandler) Handle(_ context.Context, r slog.Record) error {
+	prefix := h.emoji
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == logFieldEmoji {
+			prefix = a.Value.String()
+			return false
+		}
+		return true
+	})
+	if prefix == defEmptyValue {
+		switch {
+		case r.Level >= slog.LevelError:
+			prefix = "❌"
+		case r.Level >= slog.LevelWarn:
+			prefix = "⚠️"
+		}
+	}
+	ts := r.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	line := ts.Format(emojiTimeFormat) + " "
+	if prefix != defEmptyValue {
+		line += prefix + " "
+	}
+	line += r.Message + "\n"
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+// WithAttrs returns a handler with the attributes, only the emoji is used
+func (h *emojiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	for _, a := range attrs {
+		if a.Key == logFieldEmoji {
+			n.emoji = a.Value.String()
+		}
+	}
+	return &n
+}
+
+// WithGroup returns the same handler, groups are not written
+func (h *emojiHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
+
+// rotatingWriter writes to a file and rotates it when it reaches the maximum size
+type rotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// Helper to open a log file with size based rotation, maximum size is in megabytes
+func newRotatingWriter(path string, maxSize, maxBackups int) (*rotatingWriter, error) {
+	if maxSize <= 0 {
+		maxSize = defLogMaxSize
+	}
+	if maxBackups < 0 {
+		maxBackups = defLogMaxBackups
+	}
+	w := &rotatingWriter{path: path, maxSize: int64(maxSize) * 1024 * 1024, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write writes to the log file, rotating it first if it would exceed the maximum size
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var rotateErr error
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		// If rotation fails, logs are still written to the current file
+		if rotateErr = w.rotate(); w.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Close closes the log file
+func (w *rotatingWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// Function to open the log file for appending
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening log file - %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error with log file - %v", err)
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// Function to rotate log files, the current one becomes .1 and the oldest one is removed. If rotation fails, the
+// current log file is opened again so logs are not lost
+func (w *rotatingWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = w.shift()
+	}
+	if openErr := w.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return fmt.Errorf("error rotating log file - %v", err)
+	}
+	return nil
+}
+
+// Function to move the log files one position, the current one is removed if there are no backups
+func (w *rotatingWriter) shift() error {
+	if w.maxBackups == 0 {
+		if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+	for i := w.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	return os.Rename(w.path, w.path+".1")
+}
+
+// Function to configure the logger for a command
+func setupLogging(cfg LogConfiguration, verbose bool, command string) error {
+	if err := setLogLevel(cfg, verbose); err != nil {
+		return err
+	}
+	l, closer, err := newLogger(cfg, logLevel, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if logCloser != nil {
+		logCloser.Close()
+	}
+	logger = l.With(LogFieldCommand, command)
+	logCloser = closer
+	return nil
+}
+
+// Helper to get the logger for a profile, with its fields
+func (pr *Profile) log() *slog.Logger {
+	return logger.With(LogFieldProfile, pr.Name, LogFieldEnvironment, pr.Config.Environment)
+}
+
+// Function to change the level of the configured logger, without replacing it
+func setLogLevel(cfg LogConfiguration, verbose bool) error {
+	level, err := parseLogLevel(cfg.Level, verbose)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	l, err := parseLogLevel("", false)
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelInfo, l)
+	l, err = parseLogLevel("warn", false)
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, l)
+	l, err = parseLogLevel("error", true)
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, l)
+	_, err = parseLogLevel("loud", false)
+	assert.Error(t, err)
+}
+
+func TestEmojiHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(newEmojiHandler(&buf, slog.LevelInfo))
+	l.Debug("hidden")
+	l.Info("flags ready", emoji("✅"), LogFieldPath, "/tmp/osquery.flags")
+	l.Error("flags mismatch")
+	l.With(emoji("🔄")).Info("reloading")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasSuffix(lines[0], " ✅ flags ready"))
+	assert.True(t, strings.HasSuffix(lines[1], " ❌ flags mismatch"))
+	assert.True(t, strings.HasSuffix(lines[2], " 🔄 reloading"))
+}
+
+func TestNewLoggerJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "osctrld.log")
+	l, closer, err := newLogger(LogConfiguration{Format: LogFormatJSON, File: file}, slog.LevelDebug, os.Stderr)
+	assert.NoError(t, err)
+	pr := &Profile{Name: "prod", Config: JSONConfiguration{Environment: "production"}}
+	logger = l.With(LogFieldCommand, "flags")
+	defer func() { logger = slog.New(newEmojiHandler(os.Stderr, slog.LevelInfo)) }()
+	pr.log().Info("flags ready", emoji("✅"), LogFieldArtifact, "flags", LogFieldURL, "https://osctrl.url")
+	assert.NoError(t, closer.Close())
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(content, &entry))
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "flags ready", entry["msg"])
+	assert.Equal(t, "flags", entry[LogFieldCommand])
+	assert.Equal(t, "prod", entry[LogFieldProfile])
+	assert.Equal(t, "production", entry[LogFieldEnvironment])
+	assert.Equal(t, "flags", entry[LogFieldArtifact])
+	assert.Equal(t, "https://osctrl.url", entry[LogFieldURL])
+	assert.NotContains(t, entry, logFieldEmoji)
+}
+
+func TestNewLoggerErrors(t *testing.T) {
+	_, _, err := newLogger(LogConfiguration{Format: "xml"}, slog.LevelInfo, os.Stderr)
+	assert.Error(t, err)
+	_, err = parseLogLevel("loud", false)
+	assert.Error(t, err)
+	_, _, err = newLogger(LogConfiguration{File: filepath.Join(t.TempDir(), "missing", "osctrld.log")}, slog.LevelInfo, os.Stderr)
+	assert.Error(t, err)
+}
+
+func TestRotatingWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "osctrld.log")
+	w, err := newRotatingWriter(file, 1, 2)
+	assert.NoError(t, err)
+	// Rotation is by megabytes, use a smaller size for the test
+	w.maxSize = 10
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := w.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	for name, expected := range map[string]string{file: "fourth\n", file + ".1": "third\n", file + ".2": "second\n"} {
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+	assert.False(t, checkFileExist(file+".3"))
+}
+
+func TestRotatingWriterFailure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "osctrld.log")
+	w, err := newRotatingWriter(file, 1, 1)
+	assert.NoError(t, err)
+	defer w.Close()
+	w.maxSize = 10
+	// A directory that is not empty in the place of the backup makes the rename fail
+	assert.NoError(t, os.MkdirAll(filepath.Join(file+".1", "busy"), 0700))
+	_, err = w.Write([]byte("first\n"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("second\n"))
+	assert.ErrorContains(t, err, "error rotating log file")
+	// Logs are still written to the current file, and rotation works once the problem is fixed
+	assert.NoError(t, os.RemoveAll(file+".1"))
+	_, err = w.Write([]byte("third\n"))
+	assert.NoError(t, err)
+	for name, expected := range map[string]string{file: "third\n", file + ".1": "first\nsecond\n"} {
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"runtime"
 
 	"github.com/urfave/cli/v2"
 )
@@ -43,6 +41,12 @@ const (
 	defLinuxPath = "/etc/osquery/"
 	// Default osquery path for windows
 	defWindowsPath = "C:\\Program Files\\osquery\\"
+	// Default osctrld configuration directory for darwin
+	defDarwinConfigDir = "/private/var/osctrld/"
+	// Default osctrld configuration directory for linux
+	defLinuxConfigDir = "/etc/osctrld/"
+	// Default osctrld configuration directory for windows
+	defWindowsConfigDir = "C:\\ProgramData\\osctrld\\"
 )
 
 const (
@@ -64,9 +68,12 @@ var (
 
 // Variables for flags
 var (
-	configFile string
-	jsonConfig JSONConfiguration
-	osctrlURLs OsctrlURLs
+	configFile   string
+	keyFile      string
+	platformName string
+	profileName  string
+	loadedConfig LoadedConfiguration
+	osPlatform   Platform
 )
 
 // Initialization code
@@ -82,84 +89,141 @@ func init() {
 			Destination: &configFile,
 		},
 		&cli.StringFlag{
-			Name:        "secret",
-			Aliases:     []string{"s"},
+			Name:        "key-file",
+			Aliases:     []string{"K"},
 			Value:       defEmptyValue,
-			Usage:       "Enroll secret to authenticate against osctrl server",
-			EnvVars:     []string{"OSCTRL_SECRET"},
-			Destination: &jsonConfig.Secret,
+			Usage:       "Use `FILE` as key to decrypt encrypted configuration values. Default depends on OS",
+			EnvVars:     []string{"OSCTRLD_KEY_FILE"},
+			Destination: &keyFile,
 		},
 		&cli.StringFlag{
-			Name:        "environment",
-			Aliases:     []string{"e", "env"},
+			Name:        "profile",
+			Aliases:     []string{"P"},
 			Value:       defEmptyValue,
-			Usage:       "Environment in osctrl to enrolled nodes to",
-			EnvVars:     []string{"OSCTRL_ENV"},
-			Destination: &jsonConfig.Environment,
+			Usage:       "Profile in the configuration to use. Default is all profiles for daemon, and the only one for other commands",
+			EnvVars:     []string{"OSCTRLD_PROFILE"},
+			Destination: &profileName,
 		},
 		&cli.StringFlag{
-			Name:        "secret-file",
-			Aliases:     []string{"S"},
-			Value:       defEmptyValue,
-			Usage:       "Use `FILE` as secret file for osquery. Default depends on OS",
-			EnvVars:     []string{"OSQUERY_SECRET"},
-			Destination: &jsonConfig.SecretFile,
+			Name:    "secret",
+			Aliases: []string{"s"},
+			Value:   defEmptyValue,
+			Usage:   "Enroll secret to authenticate against osctrl server, or its source as file:PATH, env:NAME, exec:COMMAND or secret store URL",
+			EnvVars: []string{"OSCTRL_SECRET"},
 		},
 		&cli.StringFlag{
-			Name:        "flagfile",
-			Aliases:     []string{"F"},
-			Value:       defEmptyValue,
-			Usage:       "Use `FILE` as flagfile for osquery. Default depends on OS",
-			EnvVars:     []string{"OSQUERY_FLAGFILE"},
-			Destination: &jsonConfig.FlagFile,
+			Name:    "secret-token",
+			Value:   defEmptyValue,
+			Usage:   "Token for the HTTP secret store, or its source as file:PATH, env:NAME or exec:COMMAND",
+			EnvVars: []string{"OSCTRL_SECRET_TOKEN"},
 		},
 		&cli.StringFlag{
-			Name:        "certificate",
-			Aliases:     []string{"C"},
-			Value:       defEmptyValue,
-			Usage:       "Use `FILE` as certificate for osquery, if needed. Default depends on OS",
-			EnvVars:     []string{"OSQUERY_CERTIFICATE"},
-			Destination: &jsonConfig.CertFile,
+			Name:    "environment",
+			Aliases: []string{"e", "env"},
+			Value:   defEmptyValue,
+			Usage:   "Environment in osctrl to enrolled nodes to",
+			EnvVars: []string{"OSCTRL_ENV"},
 		},
 		&cli.StringFlag{
-			Name:        "osctrl-url",
-			Aliases:     []string{"U"},
-			Value:       defEmptyValue,
-			Usage:       "Base URL for the osctrl server",
-			EnvVars:     []string{"OSCTRL_URL"},
-			Destination: &jsonConfig.BaseURL,
+			Name:    "secret-file",
+			Aliases: []string{"S"},
+			Value:   defEmptyValue,
+			Usage:   "Use `FILE` as secret file for osquery. Default depends on OS",
+			EnvVars: []string{"OSQUERY_SECRET"},
+		},
+		&cli.StringFlag{
+			Name:    "flagfile",
+			Aliases: []string{"F"},
+			Value:   defEmptyValue,
+			Usage:   "Use `FILE` as flagfile for osquery. Default depends on OS",
+			EnvVars: []string{"OSQUERY_FLAGFILE"},
+		},
+		&cli.StringFlag{
+			Name:    "certificate",
+			Aliases: []string{"C"},
+			Value:   defEmptyValue,
+			Usage:   "Use `FILE` as certificate for osquery, if needed. Default depends on OS",
+			EnvVars: []string{"OSQUERY_CERTIFICATE"},
+		},
+		&cli.StringFlag{
+			Name:    "osctrl-url",
+			Aliases: []string{"U"},
+			Value:   defEmptyValue,
+			Usage:   "Base URL for the osctrl server",
+			EnvVars: []string{"OSCTRL_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "osquery-path",
+			Aliases: []string{"osquery", "o"},
+			Value:   defEmptyValue,
+			Usage:   "Use `FILE` as path for osquery installation, if needed. Default depends on OS",
+			EnvVars: []string{"OSQUERY_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "osquery-layout",
+			Aliases: []string{"layout", "L"},
+			Value:   defEmptyValue,
+			Usage:   "Osquery installation layout (auto, deb, rpm, pkg, msi or custom). Default is auto",
+			EnvVars: []string{"OSQUERY_LAYOUT"},
 		},
 		&cli.StringFlag{
-			Name:        "osquery-path",
-			Aliases:     []string{"osquery", "o"},
+			Name:        "platform",
 			Value:       defEmptyValue,
-			Usage:       "Use `FILE` as path for osquery installation, if needed. Default depends on OS",
-			EnvVars:     []string{"OSQUERY_PATH"},
-			Destination: &jsonConfig.OsqueryPath,
+			Usage:       "Platform to simulate and to retrieve scripts for. Default is the running OS",
+			EnvVars:     []string{"OSCTRLD_PLATFORM"},
+			Destination: &platformName,
+			Hidden:      true,
 		},
 		&cli.BoolFlag{
-			Name:        "insecure",
-			Aliases:     []string{"i"},
-			Value:       false,
-			Usage:       "Ignore TLS warnings, often used with self-signed certificates",
-			EnvVars:     []string{"OSCTRL_INSECURE"},
-			Destination: &jsonConfig.Insecure,
+			Name:    "insecure",
+			Aliases: []string{"i"},
+			Value:   false,
+			Usage:   "Ignore TLS warnings, often used with self-signed certificates",
+			EnvVars: []string{"OSCTRL_INSECURE"},
 		},
 		&cli.BoolFlag{
-			Name:        "verbose",
-			Aliases:     []string{"V"},
-			Value:       false,
-			Usage:       "Enable verbose informational messages",
-			EnvVars:     []string{"OSCTRL_VERBOSE"},
-			Destination: &jsonConfig.Verbose,
+			Name:    "verbose",
+			Aliases: []string{"V"},
+			Value:   false,
+			Usage:   "Enable verbose informational messages",
+			EnvVars: []string{"OSCTRL_VERBOSE"},
+		},
+		&cli.StringFlag{
+			Name:    "log-level",
+			Value:   defEmptyValue,
+			Usage:   "Log level (debug, info, warn or error). Default is info, or debug if verbose",
+			EnvVars: []string{"OSCTRLD_LOG_LEVEL"},
+		},
+		&cli.StringFlag{
+			Name:    "log-format",
+			Value:   defEmptyValue,
+			Usage:   "Log format (auto, emoji, text or json). Default is auto, emoji for terminals and text otherwise",
+			EnvVars: []string{"OSCTRLD_LOG_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "log-output",
+			Value:   defEmptyValue,
+			Usage:   "Log destination (stderr, file, journald or syslog). Default is file if log file is set, stderr otherwise",
+			EnvVars: []string{"OSCTRLD_LOG_OUTPUT"},
+		},
+		&cli.StringFlag{
+			Name:    "log-file",
+			Value:   defEmptyValue,
+			Usage:   "Write logs to `FILE` instead of stderr, rotating it by size",
+			EnvVars: []string{"OSCTRLD_LOG_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "lock-timeout",
+			Value:   defEmptyValue,
+			Usage:   "Time to wait for another osctrld process changing the same profile, 0s to fail immediately. Default is 30s",
+			EnvVars: []string{"OSCTRLD_LOCK_TIMEOUT"},
 		},
 		&cli.BoolFlag{
-			Name:        "force",
-			Aliases:     []string{"f"},
-			Value:       false,
-			Usage:       "Overwrite existing files for flags, certificate and secret",
-			EnvVars:     []string{"OSCTRL_FORCE"},
-			Destination: &jsonConfig.Verbose,
+			Name:    "force",
+			Aliases: []string{"f"},
+			Value:   false,
+			Usage:   "Overwrite existing files for flags, certificate and secret",
+			EnvVars: []string{"OSCTRL_FORCE"},
 		},
 	}
 	// Initialize CLI flags commands
@@ -182,131 +246,394 @@ func init() {
 		{
 			Name:   "flags",
 			Usage:  "Retrieve flags for osquery from osctrl and write them locally",
-			Action: cliWrapper(getFlags),
+			Action: cliWrapper(lockedWrapper(getFlags)),
 		},
 		{
 			Name:   "cert",
 			Usage:  "Retrieve server certificate for osquery from osctrl and write it locally",
-			Action: cliWrapper(getCert),
+			Action: cliWrapper(lockedWrapper(getCert)),
+		},
+		{
+			Name:  "daemon",
+			Usage: "Run as resident process, reconciling flags and certificate and reloading configuration on changes or SIGHUP",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:    "interval",
+					Aliases: []string{"I"},
+					Value:   defDaemonInterval,
+					Usage:   "Interval to reconcile flags and certificate with osctrl",
+					EnvVars: []string{"OSCTRLD_INTERVAL"},
+				},
+			},
+			Action: profilesWrapper(runDaemon),
 		},
+		{
+			Name:  "heartbeat",
+			Usage: "Send the status of the node to osctrl once, the daemon sends it periodically if heartbeat is enabled",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the heartbeat as JSON without sending it, the secret is not included",
+				},
+			},
+			Action: profilesWrapper(heartbeatNodes),
+		},
+		{
+			Name:   "actions",
+			Usage:  "Poll osctrl once for remote actions and run them, the daemon polls periodically if actions are enabled",
+			Action: profilesWrapper(runRemoteActions),
+		},
+		{
+			Name:  "update",
+			Usage: "Update the osctrld binary to the latest release, verified with the signature of its checksums",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "check",
+					Usage: "Only check if there is a new release",
+				},
+				&cli.BoolFlag{
+					Name:  "restart",
+					Value: true,
+					Usage: "Restart the osctrld service after updating",
+				},
+			},
+			Action: configWrapper(updateBinary),
+		},
+		{
+			Name:  "doctor",
+			Usage: "Check step by step DNS, TCP, TLS, clock, osctrl URLs, secret and permissions, with a diagnosis of each problem",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Value: defDoctorTimeout,
+					Usage: "Timeout for each network step",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the report as JSON",
+				},
+			},
+			Action: profilesWrapper(doctorNodes),
+		},
+		{
+			Name:  "service",
+			Usage: "Install or uninstall the osctrld service, running the daemon with the configuration file",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "install",
+					Usage: "Write the service definition for this binary and configuration, then enable and start it",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "User to run the service, created if it does not exist. Empty runs it as root, needed to restart osqueryd",
+						},
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Print the service definition and the commands to register it, without changing anything",
+						},
+					},
+					Action: configWrapper(serviceInstall),
+				},
+				{
+					Name:   "uninstall",
+					Usage:  "Stop and disable the service, then remove its definition",
+					Action: configWrapper(serviceUninstall),
+				},
+			},
+		},
+		{
+			Name:  "ctl",
+			Usage: "Control a running daemon through its control API",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the response of the daemon as JSON",
+				},
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:   "status",
+					Usage:  "Show the status of the daemon and the state of its profiles",
+					Action: configWrapper(ctlStatus),
+				},
+				{
+					Name:   "verify",
+					Usage:  "Show the last verification of each profile",
+					Action: configWrapper(ctlVerify),
+				},
+				{
+					Name:   "sync",
+					Usage:  "Reconcile flags and certificate now, even if remediation is paused",
+					Action: configWrapper(ctlSync),
+				},
+				{
+					Name:      "pause",
+					Usage:     "Pause remediation of all profiles, a number is minutes",
+					ArgsUsage: "<duration>",
+					Action:    configWrapper(ctlPause),
+				},
+				{
+					Name:   "resume",
+					Usage:  "Resume remediation now",
+					Action: configWrapper(ctlResume),
+				},
+				{
+					Name:   "reload",
+					Usage:  "Reload the configuration, keeping the current one if the new one is invalid",
+					Action: configWrapper(ctlReload),
+				},
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Show the last sync, fetch and apply of flags and cert from the local state, without contacting osctrl",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the state as JSON",
+				},
+			},
+			Action: configWrapper(showStatus),
+		},
+		{
+			Name:  "metrics",
+			Usage: "Collect metrics and print them, or write them for the node_exporter textfile collector",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Write metrics to `FILE`, with extension .prom. Default is metrics.textfile, or stdout if not set",
+				},
+			},
+			Action: profilesWrapper(writeMetrics),
+		},
+		{
+			Name:   "history",
+			Usage:  "List the backed up versions of flags and cert",
+			Action: configWrapper(showHistory),
+		},
+		{
+			Name:      "rollback",
+			Usage:     "Restore a backed up version of flags or cert, the previous one if no version is provided",
+			ArgsUsage: "<flags|cert> [version]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "restart",
+					Usage: "Restart osqueryd after restoring",
+				},
+			},
+			Action: configWrapper(rollbackNode),
+		},
+		{
+			Name:  "audit",
+			Usage: "Inspect the audit log of changes made by osctrld",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "verify",
+					Usage:  "Verify that the audit log has not been modified or truncated",
+					Action: configWrapper(verifyAudit),
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Inspect, validate and generate the osctrld configuration",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "show",
+					Usage: "Show the effective configuration, with secrets redacted",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "origin",
+							Value: false,
+							Usage: "Show where each effective value came from",
+						},
+					},
+					Action: configWrapper(showConfig),
+				},
+				{
+					Name:   "validate",
+					Usage:  "Validate the configuration, reporting unknown keys, invalid values and paths not writable",
+					Action: configWrapper(validateConfig),
+				},
+				{
+					Name:  "init",
+					Usage: "Generate a starter configuration for the platform",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "output",
+							Aliases: []string{"o"},
+							Value:   defEmptyValue,
+							Usage:   "Write configuration to `FILE` instead of stdout",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Value: ConfigFormatYAML,
+							Usage: "Format for the configuration, yaml (with comments) or json",
+						},
+					},
+					Action: configWrapper(initConfig),
+				},
+				{
+					Name:      "encrypt",
+					Usage:     "Encrypt a value to use in the configuration, read from stdin if not provided. The key is generated if missing",
+					ArgsUsage: "[value]",
+					Action:    platformWrapper(encryptConfig),
+				},
+				{
+					Name:  "rekey",
+					Usage: "Re-encrypt all encrypted values in the configuration files with a new key",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "new-key-file",
+							Value: defEmptyValue,
+							Usage: "Use `FILE` as new key, generated if missing. Default rotates the current key file",
+						},
+						&cli.BoolFlag{
+							Name:  "keep-old-key",
+							Value: false,
+							Usage: "Keep the old key as .old after rotating it, it can still decrypt old copies of the configuration",
+						},
+					},
+					Action: platformWrapper(rekeyConfig),
+				},
+			},
+		},
+	}
+}
+
+// Function to prepare the configuration, merging defaults, configuration files, drop-ins, environment and flags
+func prepareConfiguration(c *cli.Context) error {
+	osPlatform, err = getPlatform(platformName)
+	if err != nil {
+		exitError := fmt.Sprintf("\n❌ Error with platform - %v", err)
+		return cli.Exit(exitError, 2)
+	}
+	loadedConfig, err = buildConfiguration(c, osPlatform)
+	if err != nil {
+		exitError := fmt.Sprintf("\n❌ Error with configuration - %v", err)
+		return cli.Exit(exitError, 2)
+	}
+	if err := setupLogging(loadedConfig.Log, loadedConfig.Verbose, c.Command.FullName()); err != nil {
+		exitError := fmt.Sprintf("\n❌ Error with logging - %v", err)
+		return cli.Exit(exitError, 2)
 	}
+	file, _ := resolveConfigFile(osPlatform)
+	logger.Debug(fmt.Sprintf("Loaded %s", file), LogFieldPath, file)
+	auditLog = nil
+	if loadedConfig.Audit.Enabled {
+		auditLog = newAuditLog(loadedConfig.Audit.File, c.Command.FullName())
+	}
+	stateStore = newStateStore(loadedConfig.State.Dir)
+	backupStore = nil
+	if loadedConfig.Backups.Enabled {
+		if backupStore, err = newBackupStore(loadedConfig.Backups); err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with backups - %v", err)
+			return cli.Exit(exitError, 2)
+		}
+	}
+	return nil
 }
 
-// Function to wrap actions
-func cliWrapper(action func(*cli.Context) error) func(*cli.Context) error {
+// Function to wrap actions that only need the platform, when the configuration can not be loaded yet
+func platformWrapper(action func(*cli.Context) error) func(*cli.Context) error {
 	return func(c *cli.Context) error {
-		if configFile != defEmptyValue {
-			jsonConfig, err = loadConfiguration(configFile, c.Bool("verbose"))
-			if err != nil {
-				exitError := fmt.Sprintf("\n❌ Error reading configuration file (%s) - %v", configFile, err)
-				return cli.Exit(exitError, 2)
-			}
+		osPlatform, err = getPlatform(platformName)
+		if err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with platform - %v", err)
+			return cli.Exit(exitError, 2)
 		}
-		if jsonConfig.Verbose {
-			log.Printf("⏳ Initializing %s...", appName)
-			fmt.Println()
+		return action(c)
+	}
+}
+
+// Function to wrap actions that only need the configuration
+func configWrapper(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := prepareConfiguration(c); err != nil {
+			return err
 		}
-		// Based on OS, assign values for flag and secret file, if they have not been assigned already
-		switch runtime.GOOS {
-		case DarwinOS:
-			if jsonConfig.OsqueryPath == defEmptyValue {
-				jsonConfig.OsqueryPath = defDarwinPath
-			}
-			if jsonConfig.FlagFile == defEmptyValue {
-				jsonConfig.FlagFile = genFullPath(jsonConfig.OsqueryPath, defFlagFile)
-			}
-			if jsonConfig.SecretFile == defEmptyValue {
-				jsonConfig.SecretFile = genFullPath(jsonConfig.OsqueryPath, defSecretFile)
-			}
-			if jsonConfig.CertFile == defEmptyValue {
-				jsonConfig.CertFile = genFullPath(jsonConfig.OsqueryPath, defCertificate)
-			}
-			if jsonConfig.EnrollScript == "" {
-				jsonConfig.EnrollScript = genFullPath(jsonConfig.OsqueryPath, defEnrollScript+shExtension)
-			}
-			if jsonConfig.RemoveScript == "" {
-				jsonConfig.RemoveScript = genFullPath(jsonConfig.OsqueryPath, defRemoveScript+shExtension)
-			}
-		case LinuxOS:
-			if jsonConfig.OsqueryPath == defEmptyValue {
-				jsonConfig.OsqueryPath = defLinuxPath
-			}
-			if jsonConfig.FlagFile == defEmptyValue {
-				jsonConfig.FlagFile = genFullPath(jsonConfig.OsqueryPath, defFlagFile)
-			}
-			if jsonConfig.SecretFile == defEmptyValue {
-				jsonConfig.SecretFile = genFullPath(jsonConfig.OsqueryPath, defSecretFile)
-			}
-			if jsonConfig.CertFile == defEmptyValue {
-				jsonConfig.CertFile = genFullPath(jsonConfig.OsqueryPath, defCertificate)
-			}
-			if jsonConfig.EnrollScript == "" {
-				jsonConfig.EnrollScript = genFullPath(jsonConfig.OsqueryPath, defEnrollScript+shExtension)
-			}
-			if jsonConfig.RemoveScript == "" {
-				jsonConfig.RemoveScript = genFullPath(jsonConfig.OsqueryPath, defRemoveScript+shExtension)
-			}
-		case WindowsOS:
-			if jsonConfig.OsqueryPath == defEmptyValue {
-				jsonConfig.OsqueryPath = defWindowsPath
-			}
-			if jsonConfig.FlagFile == defEmptyValue {
-				jsonConfig.FlagFile = genFullPath(jsonConfig.OsqueryPath, defFlagFile)
-			}
-			if jsonConfig.SecretFile == defEmptyValue {
-				jsonConfig.SecretFile = genFullPath(jsonConfig.OsqueryPath, defSecretFile)
-			}
-			if jsonConfig.CertFile == defEmptyValue {
-				jsonConfig.CertFile = genFullPath(jsonConfig.OsqueryPath, defCertificate)
-			}
-			if jsonConfig.EnrollScript == "" {
-				jsonConfig.EnrollScript = genFullPath(jsonConfig.OsqueryPath, defEnrollScript+ps1Extension)
-			}
-			if jsonConfig.RemoveScript == "" {
-				jsonConfig.RemoveScript = genFullPath(jsonConfig.OsqueryPath, defRemoveScript+ps1Extension)
-			}
+		return action(c)
+	}
+}
+
+// Function to wrap actions for all the selected profiles
+func profilesWrapper(action func(*cli.Context, []*Profile) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := prepareConfiguration(c); err != nil {
+			return err
 		}
-		// Check for required parameters
-		if jsonConfig.Environment == defEmptyValue {
-			exitError := fmt.Sprintln("\n❌ Environment for osctrl is required")
+		profiles, err := selectProfiles(loadedConfig.Profiles, profileName)
+		if err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with profile - %v", err)
 			return cli.Exit(exitError, 2)
 		}
-		if jsonConfig.BaseURL == defEmptyValue {
-			exitError := fmt.Sprintln("\n❌ Base URL for osctrl is required")
-			return cli.Exit(exitError, 2)
+		for _, pr := range profiles {
+			if err := checkProfile(c, pr); err != nil {
+				return err
+			}
 		}
-		// Initialize URLs
-		osctrlURLs = genURLs(jsonConfig.BaseURL, jsonConfig.Environment, jsonConfig.Insecure)
-		if jsonConfig.Verbose {
-			log.Printf("📌 Osquery Path: %s", jsonConfig.OsqueryPath)
-			log.Printf("🔎 Flag file: %s", jsonConfig.FlagFile)
-			log.Printf("🔑 Secret file: %s", jsonConfig.SecretFile)
-			log.Printf("🔏 Certificate: %s", jsonConfig.CertFile)
-			log.Printf("+ Enroll script: %s", jsonConfig.EnrollScript)
-			log.Printf("- Remove script: %s", jsonConfig.RemoveScript)
-			log.Printf("🔗 BaseURL: %s", jsonConfig.BaseURL)
-			log.Printf("📍 Environment: %s", jsonConfig.Environment)
-			log.Printf("🔴 Insecure: %v", jsonConfig.Insecure)
-			log.Printf("📢 Verbose: %v", jsonConfig.Verbose)
-			log.Printf("🦾 Force: %v", jsonConfig.Force)
-			log.Printf("💻 Command: %s", c.Command.Name)
-			fmt.Println()
+		return action(c, profiles)
+	}
+}
+
+// Function to wrap actions for a single profile
+func cliWrapper(action func(*cli.Context, *Profile) error) func(*cli.Context) error {
+	return profilesWrapper(func(c *cli.Context, profiles []*Profile) error {
+		pr, err := selectProfile(profiles, profileName)
+		if err != nil {
+			exitError := fmt.Sprintf("\n❌ Error with profile - %v", err)
+			return cli.Exit(exitError, 2)
 		}
-		return action(c)
+		return action(c, pr)
+	})
+}
+
+// Function to check required parameters for a profile, showing its values if verbose
+func checkProfile(c *cli.Context, pr *Profile) error {
+	l := pr.log()
+	l.Debug(fmt.Sprintf("Initializing %s for profile %s...", appName, pr.Name), emoji("⏳"))
+	// Check for required parameters
+	if pr.Config.Environment == defEmptyValue {
+		exitError := fmt.Sprintf("\n❌ Environment for osctrl is required in profile %s\n", pr.Name)
+		return cli.Exit(exitError, 2)
 	}
+	if pr.Config.BaseURL == defEmptyValue {
+		exitError := fmt.Sprintf("\n❌ Base URL for osctrl is required in profile %s\n", pr.Name)
+		return cli.Exit(exitError, 2)
+	}
+	l.Debug(fmt.Sprintf("Profile: %s", pr.Name), emoji("👤"))
+	l.Debug(fmt.Sprintf("Platform: %s", osPlatform.Name()), emoji("💻"))
+	l.Debug(fmt.Sprintf("Osquery Path: %s", pr.Config.OsqueryPath), emoji("📌"))
+	l.Debug(fmt.Sprintf("Flag file: %s", pr.Config.FlagFile), emoji("🔎"))
+	l.Debug(fmt.Sprintf("Secret source: %s", pr.Secret), emoji("🔐"))
+	l.Debug(fmt.Sprintf("Secret file: %s", pr.Config.SecretFile), emoji("🔑"))
+	l.Debug(fmt.Sprintf("Certificate: %s", pr.Config.CertFile), emoji("🔏"))
+	l.Debug(fmt.Sprintf("Enroll script: %s", pr.Config.EnrollScript), emoji("+"))
+	l.Debug(fmt.Sprintf("Remove script: %s", pr.Config.RemoveScript), emoji("-"))
+	l.Debug(fmt.Sprintf("Osquery layout: %s (%s)", pr.Config.OsqueryLayout.Name, pr.Config.OsqueryLayout.Binary), emoji("📦"))
+	l.Debug(fmt.Sprintf("BaseURL: %s", pr.Config.BaseURL), emoji("🔗"))
+	l.Debug(fmt.Sprintf("Environment: %s", pr.Config.Environment), emoji("📍"))
+	l.Debug(fmt.Sprintf("Insecure: %v", pr.Config.Insecure), emoji("🔴"))
+	l.Debug(fmt.Sprintf("Verbose: %v", pr.Config.Verbose), emoji("📢"))
+	l.Debug(fmt.Sprintf("Force: %v", pr.Config.Force), emoji("🦾"))
+	l.Debug(fmt.Sprintf("Command: %s", c.Command.Name), emoji("💻"))
+	return nil
 }
 
 // Action to run when no flags are provided
 func cliAction(c *cli.Context) error {
 	if c.NumFlags() == 0 {
 		if err := cli.ShowAppHelp(c); err != nil {
-			log.Fatalf("Error with help - %s", err)
+			logger.Error(fmt.Sprintf("Error with help - %s", err))
+			os.Exit(1)
 		}
 		return cli.Exit("❌ No command provided", 2)
 	}
 	if c.Command.Name == "" {
 		if err := cli.ShowAppHelp(c); err != nil {
-			log.Fatalf("Error with help - %s", err)
+			logger.Error(fmt.Sprintf("Error with help - %s", err))
+			os.Exit(1)
 		}
 		return cli.Exit("❌ Invalid command", 2)
 	}
@@ -324,7 +651,12 @@ func main() {
 	app.Flags = flags
 	app.Commands = commands
 	app.Action = cliAction
-	if err := app.Run(os.Args); err != nil {
-		log.Fatalf("Failed to execute %v", err)
+	err := app.Run(os.Args)
+	if logCloser != nil {
+		logCloser.Close()
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to execute %v", err))
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Path to serve metrics in daemon mode
+	metricsPath = "/metrics"
+	// Extension required by the node_exporter textfile collector
+	metricsTextfileExtension = ".prom"
+	// Content type of the Prometheus text format
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+const (
+	// MetricRequests counts requests to osctrl by endpoint and status code
+	MetricRequests = "osctrld_requests_total"
+	// MetricRequestDuration observes the latency of requests to osctrl by endpoint
+	MetricRequestDuration = "osctrld_request_duration_seconds"
+	// MetricLastSync keeps the last successful apply of each artifact
+	MetricLastSync = "osctrld_last_sync_timestamp_seconds"
+	// MetricSyncFailures keeps the failures of each artifact since its last success
+	MetricSyncFailures = "osctrld_sync_failures"
+	// MetricDrift counts changes found between osctrl and local files
+	MetricDrift = "osctrld_drift_detected_total"
+	// MetricRestarts counts restarts of osqueryd triggered by osctrld
+	MetricRestarts = "osctrld_osqueryd_restarts_total"
+	// MetricOsquerydUp is 1 if osqueryd is running for the profile
+	MetricOsquerydUp = "osctrld_osqueryd_up"
+	// MetricOsqueryVersion keeps the installed osquery version as label
+	MetricOsqueryVersion = "osctrld_osquery_version_info"
+	// MetricCertExpiry keeps when the osquery certificate of the profile expires
+	MetricCertExpiry = "osctrld_cert_expiry_timestamp_seconds"
+	// MetricBuildInfo keeps the osctrld version as label
+	MetricBuildInfo = "osctrld_build_info"
+)
+
+// MetricsConfiguration to hold the metrics configuration, served in daemon mode and written for node_exporter
+type MetricsConfiguration struct {
+	Listen   string `json:"listen"`
+	Textfile string `json:"textfile"`
+}
+
+// metricDesc describes a metric family
+type metricDesc struct {
+	kind string
+	help string
+}
+
+// metricDescs for all metrics exposed by osctrld
+var metricDescs = map[string]metricDesc{
+	MetricRequests:        {"counter", "Requests to osctrl by endpoint and status code."},
+	MetricRequestDuration: {"histogram", "Latency of requests to osctrl by endpoint."},
+	MetricLastSync:        {"gauge", "Last time each artifact was applied successfully."},
+	MetricSyncFailures:    {"gauge", "Failures fetching or applying each artifact since its last success."},
+	MetricDrift:           {"counter", "Local files changed because they were different from osctrl."},
+	MetricRestarts:        {"counter", "Restarts of osqueryd triggered by osctrld, by outcome."},
+	MetricOsquerydUp:      {"gauge", "Whether osqueryd is running for the profile."},
+	MetricOsqueryVersion:  {"gauge", "Installed osquery version."},
+	MetricCertExpiry:      {"gauge", "Expiration time of the osquery certificate."},
+	MetricBuildInfo:       {"gauge", "osctrld version."},
+}
+
+// metricBuckets for request latencies, in seconds
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricHistogram keeps the observations of a histogram with labels
+type metricHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics keeps all metric values, by name and labels
+type Metrics struct {
+	mutex      sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*metricHistogram
+}
+
+// metrics collected by osctrld, always enabled
+var metrics = newMetrics()
+
+// Helper to create an empty set of metrics
+func newMetrics() *Metrics {
+	return &Metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*metricHistogram),
+	}
+}
+
+// Helper to format labels as name="value" pairs, from a list of names and values
+func formatMetricLabels(labels ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Add increments a counter
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][formatMetricLabels(labels...)] += value
+}
+
+// Set assigns the value of a gauge
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][formatMetricLabels(labels...)] = value
+}
+
+// Reset removes all values of a gauge, for values that may disappear like versions
+func (m *Metrics) Reset(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.values, name)
+}
+
+// Observe adds an observation to a histogram
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*metricHistogram)
+	}
+	key := formatMetricLabels(labels...)
+	h, ok := m.histograms[name][key]
+	if !ok {
+		h = &metricHistogram{counts: make([]uint64, len(metricBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, b := range metricBuckets {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Helper to format a sample line, joining labels
+func formatMetricSample(name, labels, extra string, value float64) string {
+	all := labels
+	if extra != "" {
+		if all != "" {
+			all += ","
+		}
+		all += extra
+	}
+	if all != "" {
+		name += "{" + all + "}"
+	}
+	return name + " " + formatMetricValue(value) + "\n"
+}
+
+// Helper to format a metric value
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Write writes all metrics in the Prometheus text format, sorted by name and labels
+func (m *Metrics) Write(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for name := range m.values {
+		names = append(names, name)
+	}
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		desc := metricDescs[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, desc.help, name, desc.kind)
+		if values, ok := m.values[name]; ok {
+			for _, labels := range sortedKeys(values) {
+				buf.WriteString(formatMetricSample(name, labels, "", values[labels]))
+			}
+			continue
+		}
+		for _, labels := range sortedKeys(m.histograms[name]) {
+			h := m.histograms[name][labels]
+			for i, b := range metricBuckets {
+				buf.WriteString(formatMetricSample(name+"_bucket", labels, fmt.Sprintf(`le="%s"`, formatMetricValue(b)), float64(h.counts[i])))
+			}
+			buf.WriteString(formatMetricSample(name+"_bucket", labels, `le="+Inf"`, float64(h.count)))
+			buf.WriteString(formatMetricSample(name+"_sum", labels, "", h.sum))
+			buf.WriteString(formatMetricSample(name+"_count", labels, "", float64(h.count)))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Helper to get the sorted keys of a map
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Helper to record a request to osctrl, the endpoint is the last element of the URL path
+func observeRequest(endpoint string, code int, err error, elapsed time.Duration) {
+	status := strconv.Itoa(code)
+	if err != nil {
+		status = "error"
+	}
+	metrics.Add(MetricRequests, 1, "endpoint", endpoint, "code", status)
+	metrics.Observe(MetricRequestDuration, elapsed.Seconds(), "endpoint", endpoint)
+}
+
+// Helper to get the earliest expiration of the certificates in a PEM file
+func certExpiry(path string) (time.Time, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var expiry time.Time
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing certificate - %v", err)
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if expiry.IsZero() {
+		return expiry, fmt.Errorf("no certificates in %s", path)
+	}
+	return expiry, nil
+}
+
+// Function to collect the metrics that are read from the host and the state, before they are written
+func collectMetrics(m *Metrics, profiles []*Profile) {
+	m.Set(MetricBuildInfo, 1, "version", OsctrldVersion)
+	m.Reset(MetricOsqueryVersion)
+	var state State
+	if stateStore != nil {
+		var err error
+		if state, err = stateStore.Load(); err != nil {
+			logger.Warn(fmt.Sprintf("error loading state for metrics - %v", err))
+		}
+	}
+	versions := make(map[string]string)
+	for _, pr := range profiles {
+		if ps, ok := state.Profiles[pr.Name]; ok {
+			for artifact, as := range ps.Artifacts {
+				if !as.LastApply.IsZero() {
+					m.Set(MetricLastSync, float64(as.LastApply.Unix()), "profile", pr.Name, "artifact", artifact)
+				}
+				m.Set(MetricSyncFailures, float64(as.Failures), "profile", pr.Name, "artifact", artifact)
+			}
+		}
+		// With several profiles, only the osqueryd using the flagfile of the profile counts
+		up := 0.0
+		if instances, err := discoverOsqueryd(pr.Config.OsqueryLayout.Binary); err == nil {
+			daemons := osquerydDaemons(instances)
+			if len(osquerydWithFlagfile(daemons, pr.Config.FlagFile)) > 0 || (len(profiles) == 1 && len(daemons) > 0) {
+				up = 1
+			}
+		}
+		m.Set(MetricOsquerydUp, up, "profile", pr.Name)
+		binary := pr.Config.OsqueryLayout.Binary
+		if _, ok := versions[binary]; !ok && checkFileExist(binary) {
+			versions[binary] = getOsqueryVersion(binary)
+		}
+		if v := versions[binary]; v != defEmptyValue {
+			m.Set(MetricOsqueryVersion, 1, "profile", pr.Name, "version", v)
+		}
+		if expiry, err := certExpiry(pr.Config.CertFile); err == nil {
+			m.Set(MetricCertExpiry, float64(expiry.Unix()), "profile", pr.Name)
+		}
+	}
+}
+
+// Helper to validate the metrics configuration
+func validateMetricsConfiguration(cfg MetricsConfiguration) []string {
+	var problems []string
+	if cfg.Listen != defEmptyValue {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics.listen %s is invalid - %v", cfg.Listen, err))
+		}
+	}
+	if cfg.Textfile != defEmptyValue && filepath.Ext(cfg.Textfile) != metricsTextfileExtension {
+		problems = append(problems, fmt.Sprintf("metrics.textfile %s must have extension %s to be read by node_exporter", cfg.Textfile, metricsTextfileExtension))
+	}
+	return problems
+}
+
+// Function to write the metrics as a file for the node_exporter textfile collector
+func writeMetricsTextfile(m *Metrics, path string) error {
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		return err
+	}
+	// The textfile collector only reads complete files, written atomically
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// Function to serve metrics over HTTP, values are collected after each reconcile so requests do not scan the host
+func serveMetrics(address string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics - %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentType, metricsContentType)
+		if err := metrics.Write(w); err != nil {
+			logger.Warn(fmt.Sprintf("error writing metrics - %v", err))
+		}
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("error serving metrics - %v", err))
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to write a self-signed certificate expiring at the given time
+func writeTestCert(t *testing.T, path string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "osctrl.url"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.Add(MetricRequests, 1, "endpoint", "osctrld-flags", "code", "200")
+	m.Add(MetricRequests, 1, "endpoint", "osctrld-flags", "code", "200")
+	m.Set(MetricOsqueryVersion, 1, "profile", `pro"d`, "version", "5.10.2")
+	m.Observe(MetricRequestDuration, 0.2, "endpoint", "osctrld-flags")
+	m.Observe(MetricRequestDuration, 20, "endpoint", "osctrld-flags")
+	var buf bytes.Buffer
+	assert.NoError(t, m.Write(&buf))
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE osctrld_requests_total counter\n")
+	assert.Contains(t, out, `osctrld_requests_total{endpoint="osctrld-flags",code="200"} 2`+"\n")
+	assert.Contains(t, out, `osctrld_osquery_version_info{profile="pro\"d",version="5.10.2"} 1`+"\n")
+	assert.Contains(t, out, "# TYPE osctrld_request_duration_seconds histogram\n")
+	assert.Contains(t, out, `osctrld_request_duration_seconds_bucket{endpoint="osctrld-flags",le="0.1"} 0`+"\n")
+	assert.Contains(t, out, `osctrld_request_duration_seconds_bucket{endpoint="osctrld-flags",le="0.25"} 1`+"\n")
+	assert.Contains(t, out, `osctrld_request_duration_seconds_bucket{endpoint="osctrld-flags",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, `osctrld_request_duration_seconds_sum{endpoint="osctrld-flags"} 20.2`+"\n")
+	assert.Contains(t, out, `osctrld_request_duration_seconds_count{endpoint="osctrld-flags"} 2`+"\n")
+	// Families are sorted by name
+	assert.Less(t, strings.Index(out, MetricOsqueryVersion), strings.Index(out, MetricRequestDuration))
+}
+
+func TestRequestMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	_, _, err := SendRequest(http.MethodPost, server.URL+"/dev/osctrld-metrics-test", nil, map[string]string{}, false)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, metrics.Write(&buf))
+	assert.Contains(t, buf.String(), `osctrld_requests_total{endpoint="osctrld-metrics-test",code="404"} 1`)
+	assert.Equal(t, "unknown", requestEndpoint("http://localhost"))
+}
+
+func TestCollectMetrics(t *testing.T) {
+	dir := t.TempDir()
+	stateStore = newStateStore(dir)
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("default")
+	pr.Config.CertFile = filepath.Join(dir, "osctrl.crt")
+	pr.Config.OsqueryLayout.Binary = filepath.Join(dir, "missing", "osqueryd")
+	expiry := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, pr.Config.CertFile, expiry)
+	recordApply(pr, "cert", pr.Config.CertFile, nil)
+	recordFetch(pr, "flags", "https://osctrl.url/dev/osctrld-flags", "", fmt.Errorf("HTTP 500"))
+
+	m := newMetrics()
+	collectMetrics(m, []*Profile{pr})
+	textfile := filepath.Join(dir, "osctrld.prom")
+	assert.NoError(t, writeMetricsTextfile(m, textfile))
+	content, err := os.ReadFile(textfile)
+	assert.NoError(t, err)
+	out := string(content)
+	assert.Contains(t, out, fmt.Sprintf(`osctrld_cert_expiry_timestamp_seconds{profile="default"} %d`, expiry.Unix()))
+	assert.Contains(t, out, `osctrld_last_sync_timestamp_seconds{profile="default",artifact="cert"}`)
+	assert.NotContains(t, out, `osctrld_last_sync_timestamp_seconds{profile="default",artifact="flags"}`)
+	assert.Contains(t, out, `osctrld_sync_failures{profile="default",artifact="flags"} 1`)
+	assert.Contains(t, out, `osctrld_osqueryd_up{profile="default"} 0`)
+	assert.Contains(t, out, `osctrld_build_info{version="`+OsctrldVersion+`"} 1`)
+}
+
+func TestServeMetrics(t *testing.T) {
+	srv, err := serveMetrics("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer srv.Close()
+	assert.Empty(t, validateMetricsConfiguration(MetricsConfiguration{Listen: "127.0.0.1:9110", Textfile: "/tmp/osctrld.prom"}))
+	assert.Len(t, validateMetricsConfiguration(MetricsConfiguration{Listen: "9110", Textfile: "/tmp/osctrld.txt"}), 2)
+}
+
+func TestServeMetricsRequest(t *testing.T) {
+	metrics.Set(MetricOsquerydUp, 1, "profile", "served")
+	rec := httptest.NewRecorder()
+	srv, err := serveMetrics("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer srv.Close()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, metricsContentType, rec.Header().Get(ContentType))
+	assert.Contains(t, string(body), `osctrld_osqueryd_up{profile="served"} 1`)
+}
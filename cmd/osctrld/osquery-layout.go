@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const (
+	// LayoutAuto to detect the osquery installation layout
+	LayoutAuto = "auto"
+	// LayoutDeb for official osquery deb packages
+	LayoutDeb = "deb"
+	// LayoutRPM for official osquery rpm packages
+	LayoutRPM = "rpm"
+	// LayoutPkg for official osquery pkg packages for darwin
+	LayoutPkg = "pkg"
+	// LayoutMSI for official osquery msi packages for windows
+	LayoutMSI = "msi"
+	// LayoutCustom for custom osquery installations, all values come from configuration
+	LayoutCustom = "custom"
+)
+
+// OsqueryLayout to define where the osquery installation files are
+type OsqueryLayout struct {
+	Name       string `json:"name"`
+	Binary     string `json:"binary"`
+	Service    string `json:"service"`
+	Database   string `json:"database"`
+	Extensions string `json:"extensions"`
+}
+
+var (
+	// OsqueryLayouts with all known installation layouts
+	OsqueryLayouts = map[string]OsqueryLayout{
+		LayoutDeb: {
+			Name:       LayoutDeb,
+			Binary:     "/opt/osquery/bin/osqueryd",
+			Service:    "/lib/systemd/system/osqueryd.service",
+			Database:   "/var/osquery/osquery.db",
+			Extensions: "/etc/osquery/extensions",
+		},
+		LayoutRPM: {
+			Name:       LayoutRPM,
+			Binary:     "/opt/osquery/bin/osqueryd",
+			Service:    "/usr/lib/systemd/system/osqueryd.service",
+			Database:   "/var/osquery/osquery.db",
+			Extensions: "/etc/osquery/extensions",
+		},
+		LayoutPkg: {
+			Name:       LayoutPkg,
+			Binary:     "/opt/osquery/lib/osquery.app/Contents/MacOS/osqueryd",
+			Service:    "/private/var/osquery/io.osquery.agent.plist",
+			Database:   "/private/var/osquery/osquery.db",
+			Extensions: "/private/var/osquery/extensions",
+		},
+		LayoutMSI: {
+			Name:       LayoutMSI,
+			Binary:     "C:\\Program Files\\osquery\\osqueryd\\osqueryd.exe",
+			Service:    "C:\\Program Files\\osquery\\manage-osqueryd.ps1",
+			Database:   "C:\\Program Files\\osquery\\osquery.db",
+			Extensions: "C:\\Program Files\\osquery\\extensions",
+		},
+	}
+)
+
+// Merge returns a new layout where values set in override take precedence
+func (l OsqueryLayout) Merge(override OsqueryLayout) OsqueryLayout {
+	merged := l
+	if override.Binary != "" {
+		merged.Binary = override.Binary
+	}
+	if override.Service != "" {
+		merged.Service = override.Service
+	}
+	if override.Database != "" {
+		merged.Database = override.Database
+	}
+	if override.Extensions != "" {
+		merged.Extensions = override.Extensions
+	}
+	return merged
+}
+
+// Helper to detect the osquery layout, given a list of candidate layouts.
+// Layouts with binary and service present are preferred, then layouts with only the binary present
+// and the first candidate is returned if nothing is found
+func detectOsqueryLayout(candidates []OsqueryLayout) OsqueryLayout {
+	if len(candidates) == 0 {
+		return OsqueryLayout{Name: LayoutCustom}
+	}
+	for _, l := range candidates {
+		if checkFileExist(l.Binary) && checkFileExist(l.Service) {
+			return l
+		}
+	}
+	for _, l := range candidates {
+		if checkFileExist(l.Binary) {
+			return l
+		}
+	}
+	return candidates[0]
+}
+
+// Helper to resolve the osquery layout for a platform, using the configured layout name and values as override
+func resolveOsqueryLayout(p Platform, configured OsqueryLayout) (OsqueryLayout, error) {
+	switch configured.Name {
+	case "", LayoutAuto:
+		detected := detectOsqueryLayout(p.OsqueryLayouts())
+		// Distributions may ship osqueryd in other locations, like /usr/bin/osqueryd
+		if !checkFileExist(detected.Binary) {
+			if bin, err := exec.LookPath("osqueryd"); err == nil {
+				detected.Binary = bin
+			}
+		}
+		return detected.Merge(configured), nil
+	case LayoutCustom:
+		if configured.Binary == "" {
+			return configured, fmt.Errorf("custom osquery layout requires a binary")
+		}
+		return configured, nil
+	}
+	layout, ok := OsqueryLayouts[configured.Name]
+	if !ok {
+		return configured, fmt.Errorf("unknown osquery layout %s", configured.Name)
+	}
+	return layout.Merge(configured), nil
+}
+
+// RequiredFiles returns the files that must be present for the layout
+func (l OsqueryLayout) RequiredFiles() []string {
+	var files []string
+	if l.Service != "" {
+		files = append(files, l.Service)
+	}
+	if l.Binary != "" {
+		files = append(files, l.Binary)
+	}
+	return files
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectOsqueryLayout(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "osqueryd")
+	service := filepath.Join(dir, "osqueryd.service")
+	assert.NoError(t, os.WriteFile(binary, []byte(""), 0700))
+	first := OsqueryLayout{Name: "first", Binary: "/nonexistent/osqueryd", Service: "/nonexistent/osqueryd.service"}
+	second := OsqueryLayout{Name: "second", Binary: binary, Service: "/nonexistent/osqueryd.service"}
+	third := OsqueryLayout{Name: "third", Binary: binary, Service: service}
+
+	assert.Equal(t, "first", detectOsqueryLayout([]OsqueryLayout{first}).Name)
+	assert.Equal(t, "second", detectOsqueryLayout([]OsqueryLayout{first, second, third}).Name)
+	assert.NoError(t, os.WriteFile(service, []byte(""), 0600))
+	assert.Equal(t, "third", detectOsqueryLayout([]OsqueryLayout{first, second, third}).Name)
+	assert.Equal(t, LayoutCustom, detectOsqueryLayout(nil).Name)
+}
+
+func TestResolveOsqueryLayout(t *testing.T) {
+	t.Run("named", func(t *testing.T) {
+		l, err := resolveOsqueryLayout(linuxPlatform{}, OsqueryLayout{Name: LayoutDeb, Database: "/tmp/osquery.db"})
+		assert.NoError(t, err)
+		assert.Equal(t, OsqueryLayouts[LayoutDeb].Binary, l.Binary)
+		assert.Equal(t, "/tmp/osquery.db", l.Database)
+	})
+	t.Run("custom", func(t *testing.T) {
+		l, err := resolveOsqueryLayout(linuxPlatform{}, OsqueryLayout{Name: LayoutCustom, Binary: "/usr/bin/osqueryd"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/usr/bin/osqueryd"}, l.RequiredFiles())
+		_, err = resolveOsqueryLayout(linuxPlatform{}, OsqueryLayout{Name: LayoutCustom})
+		assert.Error(t, err)
+	})
+	t.Run("auto", func(t *testing.T) {
+		l, err := resolveOsqueryLayout(darwinPlatform{}, OsqueryLayout{Service: "/tmp/osquery.plist"})
+		assert.NoError(t, err)
+		assert.Equal(t, LayoutPkg, l.Name)
+		assert.Equal(t, "/tmp/osquery.plist", l.Service)
+	})
+	t.Run("unknown", func(t *testing.T) {
+		_, err := resolveOsqueryLayout(linuxPlatform{}, OsqueryLayout{Name: "snap"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Helper to get the command to install an osquery package, by its extension
+func packageInstallCommand(pkg string) ([]string, error) {
+	switch strings.ToLower(path.Ext(pkg)) {
+	case ".deb":
+		return []string{"dpkg", "-i", pkg}, nil
+	case ".rpm":
+		return []string{"rpm", "-U", "--force", pkg}, nil
+	case ".pkg":
+		return []string{"installer", "-pkg", pkg, "-target", "/"}, nil
+	case ".msi":
+		return []string{"msiexec", "/i", pkg, "/qn", "/norestart"}, nil
+	}
+	return nil, fmt.Errorf("unsupported package %s, it must be .deb, .rpm, .pkg or .msi", pkg)
+}
+
+// Function to download an osquery package, verify its SHA-256 and write it in a directory, returns its path
+func downloadPackage(pkgURL, sum, dir string, insecure bool) (string, error) {
+	u, err := url.Parse(pkgURL)
+	if err != nil || u.Path == defEmptyValue {
+		return "", fmt.Errorf("invalid package url %s", pkgURL)
+	}
+	if _, err := packageInstallCommand(u.Path); err != nil {
+		return "", err
+	}
+	code, body, err := SendRequest(http.MethodGet, pkgURL, nil, map[string]string{}, insecure)
+	if err != nil {
+		return "", fmt.Errorf("error downloading %s - %v", pkgURL, err)
+	}
+	if code != http.StatusOK {
+		return "", fmt.Errorf("error downloading %s - HTTP %d", pkgURL, code)
+	}
+	digest := sha256.Sum256(body)
+	if got := hex.EncodeToString(digest[:]); !strings.EqualFold(got, sum) {
+		return "", fmt.Errorf("checksum mismatch for %s, expected %s and got %s", pkgURL, sum, got)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("error creating directory - %v", err)
+	}
+	f, err := os.CreateTemp(dir, "osquery-*"+path.Ext(u.Path))
+	if err != nil {
+		return "", fmt.Errorf("error creating package file - %v", err)
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing package - %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing package - %v", err)
+	}
+	return f.Name(), nil
+}
+
+// Function to upgrade osquery with the package in params url, verified with params sha256. If params
+// version is provided, the installed version must match it
+func upgradeOsquery(pr *Profile, p Platform, params map[string]string) (string, error) {
+	pkgURL, sum := params["url"], params["sha256"]
+	if pkgURL == defEmptyValue || sum == defEmptyValue {
+		return "", fmt.Errorf("url and sha256 of the package are required")
+	}
+	before := getOsqueryVersion(pr.Config.OsqueryLayout.Binary)
+	pkg, err := downloadPackage(pkgURL, sum, loadedConfig.State.Dir, pr.Config.Insecure)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(pkg)
+	command, _ := packageInstallCommand(pkg)
+	r := AuditRecord{Action: AuditActionInstall, Artifact: "osqueryd", URL: pkgURL, Exec: command, After: strings.ToLower(sum)}
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("error installing %s - %v - %s", pkgURL, err, strings.TrimSpace(string(out)))
+	}
+	auditOutcome(r, err)
+	if err != nil {
+		return "", err
+	}
+	if err := restartOsqueryd(p); err != nil {
+		return "", err
+	}
+	after := getOsqueryVersion(pr.Config.OsqueryLayout.Binary)
+	if v := params["version"]; v != defEmptyValue {
+		installed, errA := parseOsqueryVersion(after)
+		expected, errE := parseOsqueryVersion(v)
+		if errA != nil || errE != nil || installed.Compare(expected) != 0 {
+			return "", fmt.Errorf("osquery %s installed, expected %s", after, v)
+		}
+	}
+	return fmt.Sprintf("osquery upgraded from %s to %s", before, after), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OsqueryVersion keeps a parsed osquery version, following SemVer
+type OsqueryVersion struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease []string
+	Build      string
+}
+
+// VersionPolicy to define which osquery versions are acceptable, all values are optional
+type VersionPolicy struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+	Pin string `json:"pin"`
+}
+
+// Helper to parse a version string like 5.9.1, v5.9.1, 5.10.0-rc1 or 5.9.1+build.2
+func parseOsqueryVersion(raw string) (OsqueryVersion, error) {
+	var v OsqueryVersion
+	s := strings.TrimPrefix(strings.TrimSpace(raw), "v")
+	if s == "" {
+		return v, fmt.Errorf("empty version")
+	}
+	if idx := strings.Index(s, "+"); idx >= 0 {
+		v.Build = s[idx+1:]
+		s = s[:idx]
+	}
+	if idx := strings.Index(s, "-"); idx >= 0 {
+		pre := s[idx+1:]
+		if pre == "" {
+			return v, fmt.Errorf("invalid version %s - empty pre-release", raw)
+		}
+		v.PreRelease = strings.Split(pre, ".")
+		s = s[:idx]
+	}
+	segments := strings.Split(s, ".")
+	if len(segments) > 3 {
+		return v, fmt.Errorf("invalid version %s - too many segments", raw)
+	}
+	nums := make([]int, 3)
+	for i, seg := range segments {
+		n, err := strconv.Atoi(seg)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %s - segment %q is not a number", raw, seg)
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+// String returns the version formatted as SemVer
+func (v OsqueryVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1 if v is lower than o, 1 if higher and 0 if they are the same.
+// Build metadata is ignored and pre-releases are lower than the release
+func (v OsqueryVersion) Compare(o OsqueryVersion) int {
+	if c := compareInt(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	return comparePreRelease(v.PreRelease, o.PreRelease)
+}
+
+// Helper to compare two integers
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Helper to compare pre-release identifiers, numeric identifiers are lower than alphanumeric ones
+func comparePreRelease(a, b []string) int {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) == 0 {
+		return 1
+	}
+	if len(b) == 0 {
+		return -1
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		aNum, aErr := strconv.Atoi(a[i])
+		bNum, bErr := strconv.Atoi(b[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := compareInt(aNum, bNum); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(a), len(b))
+}
+
+// Merge returns a new policy where values set in override take precedence
+func (p VersionPolicy) Merge(override VersionPolicy) VersionPolicy {
+	merged := p
+	if override.Min != "" {
+		merged.Min = override.Min
+	}
+	if override.Max != "" {
+		merged.Max = override.Max
+	}
+	if override.Pin != "" {
+		merged.Pin = override.Pin
+	}
+	return merged
+}
+
+// String returns a readable description of the policy
+func (p VersionPolicy) String() string {
+	if p.Pin != "" {
+		return "pinned to " + p.Pin
+	}
+	var parts []string
+	if p.Min != "" {
+		parts = append(parts, ">= "+p.Min)
+	}
+	if p.Max != "" {
+		parts = append(parts, "<= "+p.Max)
+	}
+	if len(parts) == 0 {
+		return "any version"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Helper to evaluate an existing osquery version against a policy
+// returns the list of violations, empty if the version is valid
+func evaluateVersionPolicy(existing string, policy VersionPolicy) ([]string, error) {
+	ex, err := parseOsqueryVersion(existing)
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	if policy.Pin != "" {
+		pin, err := parseOsqueryVersion(policy.Pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned version - %v", err)
+		}
+		if ex.Compare(pin) != 0 {
+			violations = append(violations, fmt.Sprintf("does not match pinned version (%s)", policy.Pin))
+		}
+	}
+	if policy.Min != "" {
+		min, err := parseOsqueryVersion(policy.Min)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minimum version - %v", err)
+		}
+		if ex.Compare(min) < 0 {
+			violations = append(violations, fmt.Sprintf("is lower than required (%s)", policy.Min))
+		}
+	}
+	if policy.Max != "" {
+		max, err := parseOsqueryVersion(policy.Max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maximum version - %v", err)
+		}
+		if ex.Compare(max) > 0 {
+			violations = append(violations, fmt.Sprintf("is higher than allowed (%s)", policy.Max))
+		}
+	}
+	return violations, nil
+}
+
+// Helper to extract the version from the output of "osqueryd -version", like "osqueryd version 5.9.1"
+func extractOsqueryVersion(output string) string {
+	fields := strings.Fields(output)
+	for i, f := range fields {
+		if f == "version" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	if len(fields) > 0 {
+		return fields[len(fields)-1]
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOsqueryVersion(t *testing.T) {
+	v, err := parseOsqueryVersion("5.9.1")
+	assert.NoError(t, err)
+	assert.Equal(t, OsqueryVersion{Major: 5, Minor: 9, Patch: 1}, v)
+	v, err = parseOsqueryVersion("v5.10.0-rc.1+build.7")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rc", "1"}, v.PreRelease)
+	assert.Equal(t, "build.7", v.Build)
+	assert.Equal(t, "5.10.0-rc.1+build.7", v.String())
+	v, err = parseOsqueryVersion("5.9")
+	assert.NoError(t, err)
+	assert.Equal(t, "5.9.0", v.String())
+	_, err = parseOsqueryVersion("")
+	assert.Error(t, err)
+	_, err = parseOsqueryVersion("a.0.0")
+	assert.Error(t, err)
+	_, err = parseOsqueryVersion("1.2.3.4")
+	assert.Error(t, err)
+	_, err = parseOsqueryVersion("1.2.3-")
+	assert.Error(t, err)
+}
+
+func TestOsqueryVersionCompareType(t *testing.T) {
+	cmp := func(a, b string) int {
+		va, err := parseOsqueryVersion(a)
+		assert.NoError(t, err)
+		vb, err := parseOsqueryVersion(b)
+		assert.NoError(t, err)
+		return va.Compare(vb)
+	}
+	assert.Equal(t, 1, cmp("5.1.0", "4.9.0"))
+	assert.Equal(t, -1, cmp("4.9.0", "5.1.0"))
+	assert.Equal(t, 1, cmp("5.10.0", "5.9.0"))
+	assert.Equal(t, 0, cmp("5.9.1+a", "5.9.1+b"))
+	assert.Equal(t, -1, cmp("5.9.1-rc1", "5.9.1"))
+	assert.Equal(t, -1, cmp("5.9.1-alpha", "5.9.1-alpha.1"))
+	assert.Equal(t, -1, cmp("5.9.1-1", "5.9.1-alpha"))
+	assert.Equal(t, -1, cmp("5.9.1-alpha.2", "5.9.1-alpha.10"))
+}
+
+func TestEvaluateVersionPolicy(t *testing.T) {
+	violations, err := evaluateVersionPolicy("5.9.1", VersionPolicy{Min: "5.0.0", Max: "5.10.0"})
+	assert.NoError(t, err)
+	assert.Empty(t, violations)
+	violations, err = evaluateVersionPolicy("4.9.0", VersionPolicy{Min: "5.0.0"})
+	assert.NoError(t, err)
+	assert.Len(t, violations, 1)
+	violations, err = evaluateVersionPolicy("5.11.0", VersionPolicy{Max: "5.10.0"})
+	assert.NoError(t, err)
+	assert.Len(t, violations, 1)
+	violations, err = evaluateVersionPolicy("5.9.1", VersionPolicy{Pin: "5.9.0"})
+	assert.NoError(t, err)
+	assert.Len(t, violations, 1)
+	_, err = evaluateVersionPolicy("", VersionPolicy{})
+	assert.Error(t, err)
+	_, err = evaluateVersionPolicy("5.9.1", VersionPolicy{Min: "x"})
+	assert.Error(t, err)
+}
+
+func TestVersionPolicyMerge(t *testing.T) {
+	merged := VersionPolicy{Min: "5.0.0", Max: "6.0.0"}.Merge(VersionPolicy{Min: "5.2.0", Pin: "5.9.1"})
+	assert.Equal(t, VersionPolicy{Min: "5.2.0", Max: "6.0.0", Pin: "5.9.1"}, merged)
+	assert.Equal(t, "pinned to 5.9.1", merged.String())
+	assert.Equal(t, ">= 5.0.0", VersionPolicy{Min: "5.0.0"}.String())
+}
+
+func TestExtractOsqueryVersion(t *testing.T) {
+	assert.Equal(t, "5.9.1", extractOsqueryVersion("osqueryd version 5.9.1\n"))
+	assert.Equal(t, "5.9.1", extractOsqueryVersion("5.9.1"))
+	assert.Equal(t, "", extractOsqueryVersion(""))
+}
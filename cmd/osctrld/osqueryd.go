@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+const (
+	// FlagFlagfile to identify the flagfile argument of osqueryd
+	FlagFlagfile = "--flagfile"
+	// Name of the flag for TLS server certificates, without dashes
+	flagNameTLSServerCerts = "tls_server_certs"
+	// Name of the flagfile flag, without dashes
+	flagNameFlagfile = "flagfile"
+)
+
+const (
+	// OsquerydRoleWatchdog for the osqueryd watchdog process
+	OsquerydRoleWatchdog = "watchdog"
+	// OsquerydRoleWorker for the osqueryd worker process, child of the watchdog
+	OsquerydRoleWorker = "worker"
+	// OsquerydRoleStandalone for osqueryd running without watchdog
+	OsquerydRoleStandalone = "standalone"
+)
+
+// OsquerydInstance keeps the details of a running osqueryd process
+type OsquerydInstance struct {
+	Pid         int32
+	Ppid        int32
+	Exe         string
+	User        string
+	Role        string
+	Cmdline     []string
+	FlagFile    string
+	InlineFlags map[string]string
+	StartTime   time.Time
+	CPU         float64
+	RSS         uint64
+}
+
+// Uptime returns for how long the osqueryd instance has been running
+func (i OsquerydInstance) Uptime() time.Duration {
+	return time.Since(i.StartTime).Truncate(time.Second)
+}
+
+// Helper function to check if a process is osqueryd, given its executable, first argument and the expected binary
+func matchOsquerydProcess(exe, argv0, binary string) bool {
+	// osqueryi is often a link to osqueryd, and it can run with --daemonize
+	argv0Base := strings.TrimSuffix(filepath.Base(argv0), ".exe")
+	if argv0Base == "osqueryi" {
+		return false
+	}
+	if exe != "" {
+		// Linux reports replaced binaries, after an upgrade, with a suffix
+		return samePath(strings.TrimSuffix(exe, " (deleted)"), binary)
+	}
+	// Executable is not always readable, fall back to the first argument
+	if argv0 == "" {
+		return false
+	}
+	if strings.ContainsAny(argv0, "/\\") {
+		return samePath(argv0, binary)
+	}
+	return argv0Base == strings.TrimSuffix(filepath.Base(binary), ".exe")
+}
+
+// Helper function to assign roles to osqueryd instances, based on parent and child relationships
+func classifyOsquerydInstances(instances []OsquerydInstance) {
+	pids := make(map[int32]bool)
+	for _, i := range instances {
+		pids[i.Pid] = true
+	}
+	parents := make(map[int32]bool)
+	for _, i := range instances {
+		if pids[i.Ppid] {
+			parents[i.Ppid] = true
+		}
+	}
+	for n := range instances {
+		switch {
+		case pids[instances[n].Ppid]:
+			instances[n].Role = OsquerydRoleWorker
+		case parents[instances[n].Pid]:
+			instances[n].Role = OsquerydRoleWatchdog
+		default:
+			instances[n].Role = OsquerydRoleStandalone
+		}
+	}
+}
+
+// Helper function to return the osqueryd daemons, excluding workers
+func osquerydDaemons(instances []OsquerydInstance) []OsquerydInstance {
+	var daemons []OsquerydInstance
+	for _, i := range instances {
+		if i.Role != OsquerydRoleWorker {
+			daemons = append(daemons, i)
+		}
+	}
+	return daemons
+}
+
+// Helper function to return the workers of osqueryd daemons, the watchdog respawns them when they crash
+func osquerydWorkers(instances, daemons []OsquerydInstance) []OsquerydInstance {
+	parents := make(map[int32]bool)
+	for _, d := range daemons {
+		parents[d.Pid] = true
+	}
+	var workers []OsquerydInstance
+	for _, i := range instances {
+		if i.Role == OsquerydRoleWorker && parents[i.Ppid] {
+			workers = append(workers, i)
+		}
+	}
+	return workers
+}
+
+// Helper function to filter osqueryd daemons running with a flagfile, used when several profiles share the host
+func osquerydWithFlagfile(daemons []OsquerydInstance, flagFile string) []OsquerydInstance {
+	var matched []OsquerydInstance
+	for _, d := range daemons {
+		if d.FlagFile != "" && samePath(d.FlagFile, flagFile) {
+			matched = append(matched, d)
+		}
+	}
+	return matched
+}
+
+// Helper function to parse osqueryd arguments, returning the flagfile and all inline flags
+func parseOsquerydArgs(args []string) (string, map[string]string) {
+	var flagfile string
+	inline := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		if strings.Contains(name, "=") {
+			parts := strings.SplitN(name, "=", 2)
+			name, value = parts[0], parts[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			value = args[i+1]
+			i++
+		} else {
+			value = "true"
+		}
+		if name == flagNameFlagfile {
+			flagfile = value
+			continue
+		}
+		inline[name] = value
+	}
+	return flagfile, inline
+}
+
+// Helper function to collect the details of a running osqueryd process
+func getOsquerydInstance(p *process.Process, exe string) (OsquerydInstance, error) {
+	inst := OsquerydInstance{Pid: p.Pid, Exe: exe}
+	cmdline, err := p.CmdlineSlice()
+	if err != nil {
+		return inst, fmt.Errorf("error getting command line for pid %d - %v", p.Pid, err)
+	}
+	inst.Cmdline = cmdline
+	if len(cmdline) > 1 {
+		inst.FlagFile, inst.InlineFlags = parseOsquerydArgs(cmdline[1:])
+	} else {
+		inst.InlineFlags = make(map[string]string)
+	}
+	created, err := p.CreateTime()
+	if err != nil {
+		return inst, fmt.Errorf("error getting start time for pid %d - %v", p.Pid, err)
+	}
+	inst.StartTime = time.UnixMilli(created)
+	// Details below are informational, errors are not fatal
+	inst.Ppid, _ = p.Ppid()
+	inst.User, _ = p.Username()
+	inst.CPU, _ = p.CPUPercent()
+	if mem, err := p.MemoryInfo(); err == nil && mem != nil {
+		inst.RSS = mem.RSS
+	}
+	return inst, nil
+}
+
+// Helper function to discover all running osqueryd processes for the given binary
+func discoverOsqueryd(binary string) ([]OsquerydInstance, error) {
+	ps, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("error getting processes - %s", err)
+	}
+	var instances []OsquerydInstance
+	for _, p := range ps {
+		exe, _ := p.Exe()
+		cmdline, _ := p.CmdlineSlice()
+		argv0 := ""
+		if len(cmdline) > 0 {
+			argv0 = cmdline[0]
+		}
+		if !matchOsquerydProcess(exe, argv0, binary) {
+			continue
+		}
+		inst, err := getOsquerydInstance(p, exe)
+		if err != nil {
+			// Process may have exited while being inspected
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	classifyOsquerydInstances(instances)
+	return instances, nil
+}
+
+// Helper function to check if two paths point to the same file
+func samePath(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, errA := os.Stat(a)
+	bInfo, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// Helper function to check if a file was modified after the given time
+func modifiedAfter(path string, t time.Time) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.ModTime().After(t)
+}
+
+// Helper function to check if the running osqueryd uses stale flags or certificate
+// returns the list of reasons why a restart is required, empty if none. Empty certFile skips the certificate
+func checkStaleOsqueryd(rt OsquerydInstance, flagFile, certFile string) []string {
+	var reasons []string
+	if rt.FlagFile == "" {
+		reasons = append(reasons, fmt.Sprintf("osqueryd is running without %s, expected %s", FlagFlagfile, flagFile))
+	} else if !samePath(rt.FlagFile, flagFile) {
+		reasons = append(reasons, fmt.Sprintf("osqueryd is using flagfile %s, expected %s", rt.FlagFile, flagFile))
+	}
+	if modifiedAfter(flagFile, rt.StartTime) {
+		reasons = append(reasons, fmt.Sprintf("flagfile %s is newer than osqueryd (started %s)", flagFile, rt.StartTime.Format(time.RFC3339)))
+	}
+	if certFile == "" {
+		return reasons
+	}
+	if inlineCert, ok := rt.InlineFlags[flagNameTLSServerCerts]; ok && !samePath(inlineCert, certFile) {
+		reasons = append(reasons, fmt.Sprintf("osqueryd is using certificate %s, expected %s", inlineCert, certFile))
+	}
+	if modifiedAfter(certFile, rt.StartTime) {
+		reasons = append(reasons, fmt.Sprintf("certificate %s is newer than osqueryd (started %s)", certFile, rt.StartTime.Format(time.RFC3339)))
+	}
+	return reasons
+}
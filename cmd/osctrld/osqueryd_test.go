@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOsquerydArgs(t *testing.T) {
+	t.Run("flagfile with equal", func(t *testing.T) {
+		flagfile, inline := parseOsquerydArgs([]string{"--flagfile=/etc/osquery/osquery.flags", "--verbose"})
+		assert.Equal(t, "/etc/osquery/osquery.flags", flagfile)
+		assert.Equal(t, map[string]string{"verbose": "true"}, inline)
+	})
+	t.Run("flagfile with space", func(t *testing.T) {
+		flagfile, inline := parseOsquerydArgs([]string{"-flagfile", "/etc/osquery/osquery.flags", "--tls_server_certs", "/tmp/osctrl.crt"})
+		assert.Equal(t, "/etc/osquery/osquery.flags", flagfile)
+		assert.Equal(t, map[string]string{"tls_server_certs": "/tmp/osctrl.crt"}, inline)
+	})
+	t.Run("no flagfile", func(t *testing.T) {
+		flagfile, inline := parseOsquerydArgs([]string{})
+		assert.Equal(t, "", flagfile)
+		assert.Empty(t, inline)
+	})
+}
+
+func TestCheckStaleOsqueryd(t *testing.T) {
+	dir := t.TempDir()
+	flagFile := filepath.Join(dir, "osquery.flags")
+	certFile := filepath.Join(dir, "osctrl.crt")
+	assert.NoError(t, os.WriteFile(flagFile, []byte("--host_identifier=uuid"), 0600))
+	assert.NoError(t, os.WriteFile(certFile, []byte("CERT"), 0600))
+	past := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(flagFile, past, past))
+	assert.NoError(t, os.Chtimes(certFile, past, past))
+
+	t.Run("current", func(t *testing.T) {
+		rt := OsquerydInstance{FlagFile: flagFile, StartTime: time.Now()}
+		assert.Empty(t, checkStaleOsqueryd(rt, flagFile, certFile))
+	})
+	t.Run("newer flagfile and cert", func(t *testing.T) {
+		rt := OsquerydInstance{FlagFile: flagFile, StartTime: past.Add(-time.Minute)}
+		assert.Len(t, checkStaleOsqueryd(rt, flagFile, certFile), 2)
+	})
+	t.Run("different flagfile", func(t *testing.T) {
+		rt := OsquerydInstance{FlagFile: "/other/osquery.flags", StartTime: time.Now()}
+		assert.Len(t, checkStaleOsqueryd(rt, flagFile, ""), 1)
+	})
+	t.Run("missing flagfile", func(t *testing.T) {
+		rt := OsquerydInstance{StartTime: time.Now()}
+		assert.Len(t, checkStaleOsqueryd(rt, flagFile, ""), 1)
+	})
+	t.Run("different inline cert", func(t *testing.T) {
+		rt := OsquerydInstance{
+			FlagFile:    flagFile,
+			InlineFlags: map[string]string{flagNameTLSServerCerts: "/other/osctrl.crt"},
+			StartTime:   time.Now(),
+		}
+		assert.Len(t, checkStaleOsqueryd(rt, flagFile, certFile), 1)
+	})
+}
+
+func TestMatchOsquerydProcess(t *testing.T) {
+	binary := "/opt/osquery/bin/osqueryd"
+	assert.True(t, matchOsquerydProcess(binary, binary, binary))
+	assert.True(t, matchOsquerydProcess(binary+" (deleted)", binary, binary))
+	assert.True(t, matchOsquerydProcess("", "osqueryd", binary))
+	assert.True(t, matchOsquerydProcess("", binary, binary))
+	assert.False(t, matchOsquerydProcess("/usr/bin/vim", "vim", binary))
+	assert.False(t, matchOsquerydProcess(binary, "/usr/bin/osqueryi", binary))
+	assert.False(t, matchOsquerydProcess("", "/usr/local/bin/osqueryd", binary))
+	assert.False(t, matchOsquerydProcess("", "", binary))
+}
+
+func TestClassifyOsquerydInstances(t *testing.T) {
+	instances := []OsquerydInstance{
+		{Pid: 100, Ppid: 1},
+		{Pid: 101, Ppid: 100},
+		{Pid: 200, Ppid: 1},
+	}
+	classifyOsquerydInstances(instances)
+	assert.Equal(t, OsquerydRoleWatchdog, instances[0].Role)
+	assert.Equal(t, OsquerydRoleWorker, instances[1].Role)
+	assert.Equal(t, OsquerydRoleStandalone, instances[2].Role)
+	assert.Len(t, osquerydDaemons(instances), 2)
+	workers := osquerydWorkers(instances, instances[:1])
+	assert.Len(t, workers, 1)
+	assert.Equal(t, int32(101), workers[0].Pid)
+	assert.Empty(t, osquerydWorkers(instances, instances[2:]))
+}
+
+func TestOsquerydWithFlagfile(t *testing.T) {
+	daemons := []OsquerydInstance{
+		{Pid: 100, FlagFile: "/etc/osquery/prod.flags"},
+		{Pid: 200, FlagFile: "/etc/osquery/canary.flags"},
+		{Pid: 300},
+	}
+	matched := osquerydWithFlagfile(daemons, "/etc/osquery/../osquery/canary.flags")
+	assert.Len(t, matched, 1)
+	assert.Equal(t, int32(200), matched[0].Pid)
+	assert.Empty(t, osquerydWithFlagfile(daemons, "/etc/osquery/other.flags"))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Platform to abstract all the OS specific behavior of osctrld
+type Platform interface {
+	// Name returns the platform name, as GOOS value
+	Name() string
+	// DefaultPath returns the default osquery path
+	DefaultPath() string
+	// ConfigDir returns the default directory for the osctrld configuration
+	ConfigDir() string
+	// ScriptExtension returns the extension for enroll and remove scripts
+	ScriptExtension() string
+	// OsqueryLayouts returns the candidate osquery layouts, in order of preference
+	OsqueryLayouts() []OsqueryLayout
+	// ServiceManager returns the service manager that controls osqueryd
+	ServiceManager() ServiceManager
+	// ScriptInterpreter returns the command to execute a script file
+	ScriptInterpreter(script string) []string
+}
+
+// ServiceManager to abstract how the osqueryd service is controlled
+type ServiceManager interface {
+	// Name returns the service manager name
+	Name() string
+	// RestartCommand returns the command to restart the osqueryd service
+	RestartCommand() []string
+	// RestartOsctrldCommand returns the command to restart the osctrld service
+	RestartOsctrldCommand() []string
+	// OsctrldDefinition returns where and how the osctrld service is defined
+	OsctrldDefinition() ServiceDefinition
+	// ReloadCommand returns the command to run after a service definition changes, nil if it is not needed
+	ReloadCommand() []string
+	// InstallOsctrldCommands returns the commands to register, enable and start the osctrld service, once it is defined
+	InstallOsctrldCommands(s OsctrldService) [][]string
+	// UninstallOsctrldCommands returns the commands to stop, disable and unregister the osctrld service, before its definition is removed
+	UninstallOsctrldCommands(s OsctrldService) [][]string
+}
+
+// ServiceDefinition keeps the name of the osctrld service, and the file and embedded template that define it.
+// Without file, the service is defined by its install commands
+type ServiceDefinition struct {
+	Name     string
+	Path     string
+	Template string
+}
+
+const (
+	// Service name for osqueryd in systemd
+	systemdOsqueryService = "osqueryd"
+	// Service label for osqueryd in launchd
+	launchdOsqueryService = "io.osquery.agent"
+	// Service name for osqueryd in windows
+	windowsOsqueryService = "osqueryd"
+	// Service name for osctrld in systemd
+	systemdOsctrldService = "osctrld"
+	// Service label for osctrld in launchd
+	launchdOsctrldService = "net.osctrl.daemon"
+	// Service name for osctrld in windows
+	windowsOsctrldService = "osctrld"
+	// Directory for systemd units
+	systemdUnitDir = "/etc/systemd/system"
+	// Directory for launchd daemons
+	launchdDaemonDir = "/Library/LaunchDaemons"
+)
+
+// systemdManager for linux hosts
+type systemdManager struct{}
+
+// Name returns the service manager name
+func (systemdManager) Name() string {
+	return "systemd"
+}
+
+// RestartCommand returns the command to restart osqueryd with systemctl
+func (systemdManager) RestartCommand() []string {
+	return []string{"systemctl", "restart", systemdOsqueryService}
+}
+
+// RestartOsctrldCommand returns the command to restart osctrld with systemctl
+func (systemdManager) RestartOsctrldCommand() []string {
+	return []string{"systemctl", "restart", systemdOsctrldService}
+}
+
+// OsctrldDefinition returns the systemd unit for osctrld
+func (systemdManager) OsctrldDefinition() ServiceDefinition {
+	return ServiceDefinition{
+		Name:     systemdOsctrldService,
+		Path:     genFullPath(systemdUnitDir, systemdOsctrldService+".service"),
+		Template: "service/systemd.service",
+	}
+}
+
+// ReloadCommand returns the command to reload systemd units
+func (systemdManager) ReloadCommand() []string {
+	return []string{"systemctl", "daemon-reload"}
+}
+
+// InstallOsctrldCommands returns the commands to enable and start osctrld with systemctl, restarting it if it was running
+func (systemdManager) InstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{
+		{"systemctl", "enable", s.Name},
+		{"systemctl", "restart", s.Name},
+	}
+}
+
+// UninstallOsctrldCommands returns the commands to stop and disable osctrld with systemctl
+func (systemdManager) UninstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{{"systemctl", "disable", "--now", s.Name}}
+}
+
+// launchdManager for darwin hosts
+type launchdManager struct{}
+
+// Name returns the service manager name
+func (launchdManager) Name() string {
+	return "launchd"
+}
+
+// RestartCommand returns the command to restart osqueryd with launchctl
+func (launchdManager) RestartCommand() []string {
+	return []string{"launchctl", "kickstart", "-k", "system/" + launchdOsqueryService}
+}
+
+// RestartOsctrldCommand returns the command to restart osctrld with launchctl
+func (launchdManager) RestartOsctrldCommand() []string {
+	return []string{"launchctl", "kickstart", "-k", "system/" + launchdOsctrldService}
+}
+
+// OsctrldDefinition returns the launchd daemon for osctrld
+func (launchdManager) OsctrldDefinition() ServiceDefinition {
+	return ServiceDefinition{
+		Name:     launchdOsctrldService,
+		Path:     genFullPath(launchdDaemonDir, launchdOsctrldService+".plist"),
+		Template: "service/launchd.plist",
+	}
+}
+
+// ReloadCommand returns nil, launchd reads the definition when the daemon is bootstrapped
+func (launchdManager) ReloadCommand() []string {
+	return nil
+}
+
+// InstallOsctrldCommands returns the commands to enable and bootstrap osctrld with launchctl
+func (launchdManager) InstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{
+		{"launchctl", "enable", "system/" + s.Name},
+		{"launchctl", "bootstrap", "system", s.Definition},
+	}
+}
+
+// UninstallOsctrldCommands returns the command to stop and unload osctrld with launchctl
+func (launchdManager) UninstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{{"launchctl", "bootout", "system/" + s.Name}}
+}
+
+// windowsServiceManager for windows hosts
+type windowsServiceManager struct{}
+
+// Name returns the service manager name
+func (windowsServiceManager) Name() string {
+	return "windows"
+}
+
+// RestartCommand returns the command to restart osqueryd with powershell
+func (windowsServiceManager) RestartCommand() []string {
+	return []string{"powershell.exe", "-NoProfile", "-Command", "Restart-Service -Name " + windowsOsqueryService}
+}
+
+// RestartOsctrldCommand returns the command to restart osctrld with powershell
+func (windowsServiceManager) RestartOsctrldCommand() []string {
+	return []string{"powershell.exe", "-NoProfile", "-Command", "Restart-Service -Name " + windowsOsctrldService}
+}
+
+// OsctrldDefinition returns the name of the osctrld service, it is defined with sc.exe
+func (windowsServiceManager) OsctrldDefinition() ServiceDefinition {
+	return ServiceDefinition{Name: windowsOsctrldService}
+}
+
+// ReloadCommand returns nil, services are defined with sc.exe
+func (windowsServiceManager) ReloadCommand() []string {
+	return nil
+}
+
+// InstallOsctrldCommands returns the commands to create and start osctrld with sc.exe, as an automatic service
+func (windowsServiceManager) InstallOsctrldCommands(s OsctrldService) [][]string {
+	binPath := fmt.Sprintf("\"%s\" --config \"%s\" daemon", s.Binary, s.Config)
+	return [][]string{
+		{"sc.exe", "create", s.Name, "binPath=", binPath, "start=", "auto", "DisplayName=", s.Name},
+		{"sc.exe", "description", s.Name, s.Description},
+		{"sc.exe", "start", s.Name},
+	}
+}
+
+// UninstallOsctrldCommands returns the commands to stop and delete osctrld with sc.exe
+func (windowsServiceManager) UninstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{
+		{"sc.exe", "stop", s.Name},
+		{"sc.exe", "delete", s.Name},
+	}
+}
+
+// linuxPlatform implements Platform for linux
+type linuxPlatform struct{}
+
+// Name returns the platform name
+func (linuxPlatform) Name() string {
+	return LinuxOS
+}
+
+// DefaultPath returns the default osquery path
+func (linuxPlatform) DefaultPath() string {
+	return defLinuxPath
+}
+
+// ConfigDir returns the default directory for the osctrld configuration
+func (linuxPlatform) ConfigDir() string {
+	return defLinuxConfigDir
+}
+
+// ScriptExtension returns the extension for scripts
+func (linuxPlatform) ScriptExtension() string {
+	return shExtension
+}
+
+// OsqueryLayouts returns the candidate osquery layouts
+func (linuxPlatform) OsqueryLayouts() []OsqueryLayout {
+	return []OsqueryLayout{OsqueryLayouts[LayoutRPM], OsqueryLayouts[LayoutDeb]}
+}
+
+// ServiceManager returns the service manager
+func (linuxPlatform) ServiceManager() ServiceManager {
+	return systemdManager{}
+}
+
+// ScriptInterpreter returns the command to execute a script file
+func (linuxPlatform) ScriptInterpreter(script string) []string {
+	return []string{"/bin/sh", script}
+}
+
+// darwinPlatform implements Platform for darwin
+type darwinPlatform struct{}
+
+// Name returns the platform name
+func (darwinPlatform) Name() string {
+	return DarwinOS
+}
+
+// DefaultPath returns the default osquery path
+func (darwinPlatform) DefaultPath() string {
+	return defDarwinPath
+}
+
+// ConfigDir returns the default directory for the osctrld configuration
+func (darwinPlatform) ConfigDir() string {
+	return defDarwinConfigDir
+}
+
+// ScriptExtension returns the extension for scripts
+func (darwinPlatform) ScriptExtension() string {
+	return shExtension
+}
+
+// OsqueryLayouts returns the candidate osquery layouts
+func (darwinPlatform) OsqueryLayouts() []OsqueryLayout {
+	return []OsqueryLayout{OsqueryLayouts[LayoutPkg]}
+}
+
+// ServiceManager returns the service manager
+func (darwinPlatform) ServiceManager() ServiceManager {
+	return launchdManager{}
+}
+
+// ScriptInterpreter returns the command to execute a script file
+func (darwinPlatform) ScriptInterpreter(script string) []string {
+	return []string{"/bin/sh", script}
+}
+
+// windowsPlatform implements Platform for windows
+type windowsPlatform struct{}
+
+// Name returns the platform name
+func (windowsPlatform) Name() string {
+	return WindowsOS
+}
+
+// DefaultPath returns the default osquery path
+func (windowsPlatform) DefaultPath() string {
+	return defWindowsPath
+}
+
+// ConfigDir returns the default directory for the osctrld configuration
+func (windowsPlatform) ConfigDir() string {
+	return defWindowsConfigDir
+}
+
+// ScriptExtension returns the extension for scripts
+func (windowsPlatform) ScriptExtension() string {
+	return ps1Extension
+}
+
+// OsqueryLayouts returns the candidate osquery layouts
+func (windowsPlatform) OsqueryLayouts() []OsqueryLayout {
+	return []OsqueryLayout{OsqueryLayouts[LayoutMSI]}
+}
+
+// ServiceManager returns the service manager
+func (windowsPlatform) ServiceManager() ServiceManager {
+	return windowsServiceManager{}
+}
+
+// ScriptInterpreter returns the command to execute a script file
+func (windowsPlatform) ScriptInterpreter(script string) []string {
+	return []string{"powershell.exe", "-NoProfile", "-ExecutionPolicy", "Bypass", "-File", script}
+}
+
+// Platforms keeps all supported platforms, by GOOS value
+var Platforms = map[string]Platform{
+	LinuxOS:   linuxPlatform{},
+	DarwinOS:  darwinPlatform{},
+	WindowsOS: windowsPlatform{},
+}
+
+// Helper to get a platform by name, empty name returns the platform for the running OS
+func getPlatform(name string) (Platform, error) {
+	if name == "" {
+		name = runtime.GOOS
+	}
+	p, ok := Platforms[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported platform %s, valid values are %v", name, platformNames())
+	}
+	return p, nil
+}
+
+// Helper to get the names of all supported platforms, sorted
+func platformNames() []string {
+	var names []string
+	for n := range Platforms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Helper to assign default values to the configuration, based on platform, if they have not been assigned already
+func applyPlatformDefaults(cfg *JSONConfiguration, p Platform) {
+	if cfg.OsqueryPath == defEmptyValue {
+		cfg.OsqueryPath = p.DefaultPath()
+	}
+	if cfg.FlagFile == defEmptyValue {
+		cfg.FlagFile = genFullPath(cfg.OsqueryPath, defFlagFile)
+	}
+	if cfg.SecretFile == defEmptyValue {
+		cfg.SecretFile = genFullPath(cfg.OsqueryPath, defSecretFile)
+	}
+	if cfg.CertFile == defEmptyValue {
+		cfg.CertFile = genFullPath(cfg.OsqueryPath, defCertificate)
+	}
+	if cfg.EnrollScript == defEmptyValue {
+		cfg.EnrollScript = genFullPath(cfg.OsqueryPath, defEnrollScript+p.ScriptExtension())
+	}
+	if cfg.RemoveScript == defEmptyValue {
+		cfg.RemoveScript = genFullPath(cfg.OsqueryPath, defRemoveScript+p.ScriptExtension())
+	}
+}
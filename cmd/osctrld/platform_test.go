@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPlatform(t *testing.T) {
+	p, err := getPlatform("")
+	assert.NoError(t, err)
+	assert.Equal(t, runtime.GOOS, p.Name())
+	p, err = getPlatform(WindowsOS)
+	assert.NoError(t, err)
+	assert.Equal(t, ps1Extension, p.ScriptExtension())
+	assert.Equal(t, "powershell.exe", p.ScriptInterpreter("script.ps1")[0])
+	_, err = getPlatform("plan9")
+	assert.Error(t, err)
+	assert.Equal(t, []string{DarwinOS, LinuxOS, WindowsOS}, platformNames())
+}
+
+func TestApplyPlatformDefaults(t *testing.T) {
+	t.Run("darwin", func(t *testing.T) {
+		var cfg JSONConfiguration
+		applyPlatformDefaults(&cfg, darwinPlatform{})
+		assert.Equal(t, defDarwinPath, cfg.OsqueryPath)
+		assert.Equal(t, defDarwinPath+defFlagFile, cfg.FlagFile)
+		assert.Equal(t, defDarwinPath+defEnrollScript+shExtension, cfg.EnrollScript)
+		assert.Equal(t, "launchd", darwinPlatform{}.ServiceManager().Name())
+	})
+	t.Run("windows", func(t *testing.T) {
+		var cfg JSONConfiguration
+		applyPlatformDefaults(&cfg, windowsPlatform{})
+		assert.Equal(t, defWindowsPath, cfg.OsqueryPath)
+		assert.Equal(t, defWindowsPath+defRemoveScript+ps1Extension, cfg.RemoveScript)
+		assert.Equal(t, LayoutMSI, windowsPlatform{}.OsqueryLayouts()[0].Name)
+	})
+	t.Run("existing values", func(t *testing.T) {
+		cfg := JSONConfiguration{OsqueryPath: "/tmp", FlagFile: "/etc/custom.flags"}
+		applyPlatformDefaults(&cfg, linuxPlatform{})
+		assert.Equal(t, "/tmp", cfg.OsqueryPath)
+		assert.Equal(t, "/etc/custom.flags", cfg.FlagFile)
+		assert.Equal(t, "/tmp/"+defSecretFile, cfg.SecretFile)
+		assert.Equal(t, []string{"systemctl", "restart", "osqueryd"}, linuxPlatform{}.ServiceManager().RestartCommand())
+		assert.Equal(t, []string{"systemctl", "restart", "osctrld"}, linuxPlatform{}.ServiceManager().RestartOsctrldCommand())
+	})
+}
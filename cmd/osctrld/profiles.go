@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// Configuration key for named profiles
+	profilesKey = "profiles"
+	// Name of the profile when no profiles are configured
+	defProfile = "default"
+)
+
+// Profile keeps the configuration for one osctrl environment managed by osctrld, isolated from other profiles
+type Profile struct {
+	Name   string
+	Config JSONConfiguration
+	Layers *LayeredConfiguration
+	Secret *LazySecret
+	URLs   OsctrlURLs
+}
+
+// ProfileNames returns the names of all configured profiles, sorted
+func (l *LayeredConfiguration) ProfileNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for k := range l.values {
+		name, _, ok := splitProfileKey(k)
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the layers for a profile. Values from the top level are shared by all profiles and values
+// for the profile override them, unless they come from environment variables or command line flags
+func (l *LayeredConfiguration) Profile(name string) *LayeredConfiguration {
+	profile := newLayeredConfiguration()
+	for k, v := range l.values {
+		if _, _, ok := splitProfileKey(k); !ok && k != profilesKey {
+			profile.values[k] = v
+		}
+	}
+	for k, v := range l.values {
+		n, key, ok := splitProfileKey(k)
+		if !ok || n != name {
+			continue
+		}
+		if base, exists := profile.values[key]; exists && (base.Origin == OriginEnv || base.Origin == OriginFlag) {
+			continue
+		}
+		profile.values[key] = v
+	}
+	return profile
+}
+
+// Helper to split a key like profiles.<name>.<key> into profile name and key
+func splitProfileKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, profilesKey+".") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, profilesKey+"."), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Function to build a profile from its layers, resolving defaults for the platform
+func buildProfile(name string, layers *LayeredConfiguration, p Platform) (*Profile, error) {
+	cfg, err := layers.Configuration()
+	if err != nil {
+		return nil, err
+	}
+	// Secret is resolved lazily, only when an action needs it
+	secretSource, err := parseSecretSource(cfg.Secret, cfg.SecretToken, cfg.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("error with secret - %v", err)
+	}
+	// Based on platform, assign values for flag and secret file, if they have not been assigned already
+	applyPlatformDefaults(&cfg, p)
+	if err := layers.Resolve(cfg, OriginDefault, p.Name()+" platform", "osquery"); err != nil {
+		return nil, err
+	}
+	if err := layers.Resolve(cfg, OriginDerived, "osquery", "flags", "secretFile", "cert", "enrollScript", "removeScript"); err != nil {
+		return nil, err
+	}
+	// Resolve the osquery installation layout, detected from the installed osquery unless it is configured
+	configured := cfg.OsqueryLayout.Name
+	cfg.OsqueryLayout, err = resolveOsqueryLayout(p, cfg.OsqueryLayout)
+	if err != nil {
+		return nil, fmt.Errorf("error with osquery layout - %v", err)
+	}
+	layoutOrigin, layoutSource := OriginDetected, "installed osquery"
+	if configured != defEmptyValue && configured != LayoutAuto {
+		layoutOrigin, layoutSource = OriginDerived, "osqueryLayout.name"
+	}
+	if err := layers.Resolve(cfg, layoutOrigin, layoutSource, "osqueryLayout"); err != nil {
+		return nil, err
+	}
+	return &Profile{
+		Name:   name,
+		Config: cfg,
+		Layers: layers,
+		Secret: newLazySecret(secretSource),
+		URLs:   genURLs(cfg.BaseURL, cfg.Environment, p.Name(), cfg.Insecure),
+	}, nil
+}
+
+// Helper to select profiles by name, empty name selects all of them
+func selectProfiles(profiles []*Profile, name string) ([]*Profile, error) {
+	if name == defEmptyValue {
+		return profiles, nil
+	}
+	for _, pr := range profiles {
+		if pr.Name == strings.ToLower(name) {
+			return []*Profile{pr}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile %s, valid values are %v", name, profileNames(profiles))
+}
+
+// Helper to select a single profile by name, empty name is only valid with one profile
+func selectProfile(profiles []*Profile, name string) (*Profile, error) {
+	selected, err := selectProfiles(profiles, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) != 1 {
+		return nil, fmt.Errorf("%d profiles configured, select one of %v with --profile", len(selected), profileNames(selected))
+	}
+	return selected[0], nil
+}
+
+// Helper to get the names of profiles
+func profileNames(profiles []*Profile) []string {
+	var names []string
+	for _, pr := range profiles {
+		names = append(names, pr.Name)
+	}
+	return names
+}
+
+// Helper to check that profiles do not share the files they manage, so their state is isolated
+func validateProfiles(profiles []*Profile) []string {
+	var problems []string
+	owners := make(map[string]string)
+	for _, pr := range profiles {
+		files := map[string]string{
+			"secretFile": pr.Config.SecretFile,
+			"flags":      pr.Config.FlagFile,
+			"cert":       pr.Config.CertFile,
+		}
+		for _, k := range []string{"secretFile", "flags", "cert"} {
+			f := files[k]
+			if f == defEmptyValue {
+				continue
+			}
+			if owner, ok := owners[f]; ok && owner != pr.Name {
+				problems = append(problems, fmt.Sprintf("%s %s in profile %s is also used by profile %s", k, f, pr.Name, owner))
+				continue
+			}
+			owners[f] = pr.Name
+		}
+	}
+	return problems
+}
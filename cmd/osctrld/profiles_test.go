@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testProfilesConfig = `osctrld:
+  baseurl: "https://osctrl.url"
+  secret: "shared"
+  osqueryLayout:
+    name: deb
+  profiles:
+    Prod:
+      environment: "prod"
+      flags: "/etc/osquery/prod.flags"
+      secretFile: "/etc/osquery/prod.secret"
+      cert: "/etc/osquery/prod.crt"
+    canary:
+      environment: "canary"
+      secret: "env:CANARY_SECRET"
+      flags: "/etc/osquery/canary.flags"
+      secretFile: "/etc/osquery/canary.secret"
+      cert: "/etc/osquery/canary.crt"
+`
+
+func loadTestProfiles(t *testing.T) (*LayeredConfiguration, []*Profile) {
+	file := filepath.Join(t.TempDir(), "osctrld.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(testProfilesConfig), 0600))
+	layers, err := loadConfigurationLayers(file, true)
+	assert.NoError(t, err)
+	var profiles []*Profile
+	for _, n := range layers.ProfileNames() {
+		pr, err := buildProfile(n, layers.Profile(n), linuxPlatform{})
+		assert.NoError(t, err)
+		profiles = append(profiles, pr)
+	}
+	return layers, profiles
+}
+
+func TestProfiles(t *testing.T) {
+	layers, profiles := loadTestProfiles(t)
+	assert.Equal(t, []string{"canary", "prod"}, layers.ProfileNames())
+	assert.Len(t, profiles, 2)
+	t.Run("shared values", func(t *testing.T) {
+		for _, pr := range profiles {
+			assert.Equal(t, "https://osctrl.url", pr.Config.BaseURL)
+			assert.Equal(t, LayoutDeb, pr.Config.OsqueryLayout.Name)
+		}
+	})
+	t.Run("profile values", func(t *testing.T) {
+		assert.Equal(t, "canary", profiles[0].Config.Environment)
+		assert.Equal(t, "env:CANARY_SECRET", profiles[0].Config.Secret)
+		assert.Equal(t, "/etc/osquery/canary.flags", profiles[0].Config.FlagFile)
+		assert.Equal(t, "prod", profiles[1].Config.Environment)
+		assert.Equal(t, "shared", profiles[1].Config.Secret)
+		assert.Equal(t, "https://osctrl.url/prod/osctrld-flags", profiles[1].URLs.Flags)
+	})
+	t.Run("env and flags override profiles", func(t *testing.T) {
+		layers.Set("environment", "override", OriginEnv, "OSCTRL_ENV")
+		cfg, err := layers.Profile("prod").Configuration()
+		assert.NoError(t, err)
+		assert.Equal(t, "override", cfg.Environment)
+	})
+	t.Run("validation", func(t *testing.T) {
+		assert.Empty(t, validateProfiles(profiles))
+		profiles[0].Config.CertFile = profiles[1].Config.CertFile
+		problems := validateProfiles(profiles)
+		assert.Len(t, problems, 1)
+		assert.Contains(t, problems[0], "also used by profile")
+	})
+}
+
+func TestProfileResolvedOrigins(t *testing.T) {
+	newLayers := func() *LayeredConfiguration {
+		layers := newLayeredConfiguration()
+		layers.Merge(defaultConfigValues(), OriginDefault, "built-in")
+		layers.Set("osquery", "/opt/osquery", OriginFile, "osctrld.yaml")
+		return layers
+	}
+	pr, err := buildProfile(defProfile, newLayers(), linuxPlatform{})
+	assert.NoError(t, err)
+	effective, err := effectiveConfiguration(pr.Config, pr.Layers)
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigValue{Value: "/opt/osquery/osquery.flags", Origin: OriginDerived, Source: "osquery"}, effective["flags"])
+	assert.Equal(t, OriginFile, effective["osquery"].Origin)
+	assert.Equal(t, pr.Config.OsqueryLayout.Name, effective["osqueryLayout.name"].Value)
+	assert.Equal(t, OriginDetected, effective["osqueryLayout.name"].Origin)
+	// Configured layouts are not detected, their values come from the layout
+	layers := newLayers()
+	layers.Set("osqueryLayout.name", LayoutRPM, OriginFile, "osctrld.yaml")
+	pr, err = buildProfile(defProfile, layers, linuxPlatform{})
+	assert.NoError(t, err)
+	effective, err = effectiveConfiguration(pr.Config, pr.Layers)
+	assert.NoError(t, err)
+	assert.Equal(t, OriginFile, effective["osqueryLayout.name"].Origin)
+	assert.Equal(t, ConfigValue{Value: OsqueryLayouts[LayoutRPM].Binary, Origin: OriginDerived, Source: "osqueryLayout.name"}, effective["osqueryLayout.binary"])
+}
+
+func TestSelectProfile(t *testing.T) {
+	_, profiles := loadTestProfiles(t)
+	selected, err := selectProfiles(profiles, "")
+	assert.NoError(t, err)
+	assert.Len(t, selected, 2)
+	pr, err := selectProfile(profiles, "PROD")
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", pr.Name)
+	_, err = selectProfile(profiles, "")
+	assert.Error(t, err)
+	_, err = selectProfile(profiles, "staging")
+	assert.Error(t, err)
+	pr, err = selectProfile(profiles[:1], "")
+	assert.NoError(t, err)
+	assert.Equal(t, "canary", pr.Name)
+}
+
+func TestSplitProfileKey(t *testing.T) {
+	name, key, ok := splitProfileKey("profiles.prod.osqueryversion.min")
+	assert.True(t, ok)
+	assert.Equal(t, "prod", name)
+	assert.Equal(t, "osqueryversion.min", key)
+	_, _, ok = splitProfileKey("profiles.prod")
+	assert.False(t, ok)
+	_, _, ok = splitProfileKey("environment")
+	assert.False(t, ok)
+}
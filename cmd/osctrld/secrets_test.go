@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecretSource(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "osctrl.secret")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("filesecret\n"), 0600))
+	t.Setenv("OSCTRLD_TEST_SECRET", "envsecret")
+
+	t.Run("literal", func(t *testing.T) {
+		s, err := parseSecretSource("thisisthesecret", "", false)
+		assert.NoError(t, err)
+		v, err := s.Resolve()
+		assert.NoError(t, err)
+		assert.Equal(t, "thisisthesecret", v)
+		assert.NotContains(t, s.String(), "thisisthesecret")
+	})
+	t.Run("file", func(t *testing.T) {
+		s, err := parseSecretSource(SecretPrefixFile+secretFile, "", false)
+		assert.NoError(t, err)
+		v, err := s.Resolve()
+		assert.NoError(t, err)
+		assert.Equal(t, "filesecret", v)
+		s, _ = parseSecretSource(SecretPrefixFile+filepath.Join(dir, "missing"), "", false)
+		_, err = s.Resolve()
+		assert.Error(t, err)
+	})
+	t.Run("env", func(t *testing.T) {
+		s, err := parseSecretSource(SecretPrefixEnv+"OSCTRLD_TEST_SECRET", "", false)
+		assert.NoError(t, err)
+		v, err := s.Resolve()
+		assert.NoError(t, err)
+		assert.Equal(t, "envsecret", v)
+		s, _ = parseSecretSource(SecretPrefixEnv+"OSCTRLD_TEST_MISSING", "", false)
+		_, err = s.Resolve()
+		assert.Error(t, err)
+	})
+	t.Run("exec", func(t *testing.T) {
+		s, err := parseSecretSource(SecretPrefixExec+"echo execsecret", "", false)
+		assert.NoError(t, err)
+		v, err := s.Resolve()
+		assert.NoError(t, err)
+		assert.Equal(t, "execsecret", v)
+	})
+	t.Run("http", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(Authorization) != "Bearer envsecret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"secret": "storesecret"}`))
+		}))
+		defer srv.Close()
+		s, err := parseSecretSource(srv.URL+"/osctrl", SecretPrefixEnv+"OSCTRLD_TEST_SECRET", false)
+		assert.NoError(t, err)
+		v, err := s.Resolve()
+		assert.NoError(t, err)
+		assert.Equal(t, "storesecret", v)
+		s, _ = parseSecretSource(srv.URL+"/osctrl", "wrongtoken", false)
+		_, err = s.Resolve()
+		assert.Error(t, err)
+		_, err = parseSecretSource(srv.URL, srv.URL, false)
+		assert.Error(t, err)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, ref := range []string{SecretPrefixFile, SecretPrefixEnv, SecretPrefixExec} {
+			_, err := parseSecretSource(ref, "", false)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestLazySecret(t *testing.T) {
+	t.Setenv("OSCTRLD_TEST_SECRET", "first")
+	l := newLazySecret(envSecret{name: "OSCTRLD_TEST_SECRET"})
+	v, err := l.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", v)
+	t.Setenv("OSCTRLD_TEST_SECRET", "second")
+	v, _ = l.Get()
+	assert.Equal(t, "first", v)
+	l.Invalidate()
+	v, _ = l.Get()
+	assert.Equal(t, "second", v)
+	_, err = newLazySecret(literalSecret{}).Get()
+	assert.Error(t, err)
+	assert.True(t, isSecretReference("file:/run/secrets/osctrl"))
+	assert.False(t, isSecretReference("thisisthesecret"))
+}
+
+// flakySecret fails the first time it is resolved
+type flakySecret struct {
+	calls *int
+}
+
+func (f flakySecret) Resolve() (string, error) {
+	*f.calls++
+	if *f.calls == 1 {
+		return "", fmt.Errorf("secret store timed out")
+	}
+	return "resolved", nil
+}
+
+func (f flakySecret) String() string {
+	return "flaky"
+}
+
+func TestLazySecretRetry(t *testing.T) {
+	calls := 0
+	l := newLazySecret(flakySecret{calls: &calls})
+	_, err := l.Get()
+	assert.EqualError(t, err, "secret store timed out")
+	v, err := l.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "resolved", v)
+	v, _ = l.Get()
+	assert.Equal(t, "resolved", v)
+	assert.Equal(t, 2, calls)
+}
+
+func TestSecretRejected(t *testing.T) {
+	t.Setenv("OSCTRLD_TEST_SECRET", "first")
+	pr := &Profile{Name: "default", Secret: newLazySecret(envSecret{name: "OSCTRLD_TEST_SECRET"})}
+	v, _ := getSecret(pr)
+	assert.Equal(t, "first", v)
+	t.Setenv("OSCTRLD_TEST_SECRET", "second")
+	secretRejected(pr, fmt.Errorf("error sending heartbeat - %w", &StatusError{Code: http.StatusInternalServerError}))
+	v, _ = getSecret(pr)
+	assert.Equal(t, "first", v)
+	secretRejected(pr, fmt.Errorf("error sending heartbeat - %w", &StatusError{Code: http.StatusForbidden}))
+	v, _ = getSecret(pr)
+	assert.Equal(t, "second", v)
+}
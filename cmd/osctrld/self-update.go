@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Default interval for the daemon to check for new releases of osctrld
+	defUpdateInterval = 24 * time.Hour
+	// Time to wait for the new binary to answer --version
+	updateSmokeTimeout = 30 * time.Second
+	// Extension of the previous binary, kept to roll back
+	updateBackupExtension = ".old"
+	// Extension of the new binary, before it replaces the current one
+	updateNewExtension = ".new"
+	// Extension of the signature of the checksums file
+	updateSignatureExtension = ".sig"
+)
+
+// UpdateConfiguration to hold the configuration of self-updates of the osctrld binary. Releases are
+// checked in osctrl or in the manifest of url, and the checksums file must be signed with publicKey
+type UpdateConfiguration struct {
+	Auto      bool   `json:"auto"`
+	URL       string `json:"url"`
+	PublicKey string `json:"publicKey"`
+	Interval  string `json:"interval"`
+}
+
+// UpdateRequest to check in osctrl for a new release of osctrld
+type UpdateRequest struct {
+	Secret  string `json:"secret"`
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+// UpdateInfo keeps the latest release of osctrld and the base URL of its archives and checksums
+type UpdateInfo struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+}
+
+// Updater to replace the osctrld binary with a new release, rolling back if it does not work
+type Updater struct {
+	exe      string
+	key      ed25519.PublicKey
+	insecure bool
+	check    func() (UpdateInfo, error)
+	smoke    func(exe, version string) error
+	restart  func() error
+}
+
+// Helper to parse the update configuration, returns the interval between checks and the public key
+func parseUpdateConfiguration(cfg UpdateConfiguration) (time.Duration, ed25519.PublicKey, error) {
+	interval := defUpdateInterval
+	if cfg.Interval != defEmptyValue {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d < time.Minute {
+			return 0, nil, fmt.Errorf("invalid interval %s, it must be a duration of at least 1m", cfg.Interval)
+		}
+		interval = d
+	}
+	if cfg.PublicKey == defEmptyValue {
+		if cfg.Auto {
+			return 0, nil, fmt.Errorf("publicKey is required to verify releases")
+		}
+		return interval, nil, nil
+	}
+	key, err := parsePublicKey(cfg.PublicKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	return interval, key, nil
+}
+
+// Helper to get the name of the release archive for a platform, as generated by goreleaser
+func releaseArchiveName(version, goos, goarch string) string {
+	ext := "tar.gz"
+	if goos == WindowsOS {
+		ext = "zip"
+	}
+	return fmt.Sprintf("%s_%s_%s_%s.%s", appName, strings.TrimPrefix(version, "v"), goos, goarch, ext)
+}
+
+// Helper to get the name of the checksums file of a release, as generated by goreleaser
+func releaseChecksumsName(version string) string {
+	return fmt.Sprintf("%s_%s_checksums.txt", appName, strings.TrimPrefix(version, "v"))
+}
+
+// Helper to parse a checksums file with lines of SHA-256 and file name, returns the checksums by file name
+func parseChecksums(content []byte) map[string]string {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums
+}
+
+// Helper to verify the Ed25519 signature of the checksums file, raw or base64 encoded
+func verifyChecksumsSignature(checksums, signature []byte, key ed25519.PublicKey) error {
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return fmt.Errorf("invalid signature of checksums")
+		}
+		signature = decoded
+	}
+	if !ed25519.Verify(key, checksums, signature) {
+		return fmt.Errorf("invalid signature of checksums")
+	}
+	return nil
+}
+
+// Helper to extract a binary from a release archive, tar.gz or zip, by the base name of its entry
+func extractBinary(archive []byte, zipped bool, name string) ([]byte, error) {
+	if zipped {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive - %v", err)
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || path.Base(f.Name) != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s from archive - %v", f.Name, err)
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+		return nil, fmt.Errorf("%s not found in archive", name)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive - %v", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in archive", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive - %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// Helper to copy a file, keeping its permissions
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, info.Mode().Perm())
+}
+
+// Function to replace a binary with new content, keeping the previous one to roll back. The new binary is
+// written next to the current one and renamed over it, which is atomic. Windows does not allow replacing a
+// running binary, but it can be renamed, so it is moved away first
+func swapBinary(exe string, content []byte) error {
+	next := exe + updateNewExtension
+	backup := exe + updateBackupExtension
+	info, err := os.Stat(exe)
+	if err != nil {
+		return fmt.Errorf("error reading %s - %v", exe, err)
+	}
+	if err := os.WriteFile(next, content, info.Mode().Perm()); err != nil {
+		os.Remove(next)
+		return fmt.Errorf("error writing %s - %v", next, err)
+	}
+	os.Remove(backup)
+	if runtime.GOOS == WindowsOS {
+		if err := os.Rename(exe, backup); err != nil {
+			os.Remove(next)
+			return fmt.Errorf("error moving %s - %v", exe, err)
+		}
+	} else if err := copyFile(exe, backup); err != nil {
+		os.Remove(next)
+		return fmt.Errorf("error keeping %s - %v", backup, err)
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Remove(next)
+		if runtime.GOOS == WindowsOS {
+			os.Rename(backup, exe)
+		}
+		return fmt.Errorf("error replacing %s - %v", exe, err)
+	}
+	return nil
+}
+
+// Function to restore the binary kept by swapBinary
+func restoreBinary(exe string) error {
+	if err := os.Rename(exe+updateBackupExtension, exe); err != nil {
+		return fmt.Errorf("error restoring %s - %v", exe, err)
+	}
+	return nil
+}
+
+// Function to check that a binary runs and reports the expected version with --version
+func smokeTestBinary(exe, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateSmokeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, exe, "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s --version - %v - %s", exe, err, strings.TrimSpace(string(out)))
+	}
+	// The output is like "osctrld version 0.4.1", the same format as osqueryd
+	reported, errR := parseOsqueryVersion(extractOsqueryVersion(string(out)))
+	expected, errE := parseOsqueryVersion(version)
+	if errR != nil || errE != nil || reported.Compare(expected) != 0 {
+		return fmt.Errorf("%s --version reports %s, expected %s", exe, strings.TrimSpace(string(out)), version)
+	}
+	return nil
+}
+
+// Function to restart the osctrld service with the service manager for the platform
+func restartOsctrld(p Platform) error {
+	command := p.ServiceManager().RestartOsctrldCommand()
+	r := AuditRecord{Action: AuditActionRestart, Artifact: appName, Exec: command}
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("error restarting %s with %s - %v - %s", appName, p.ServiceManager().Name(), err, strings.TrimSpace(string(out)))
+	}
+	auditOutcome(r, err)
+	return err
+}
+
+// Function to check the release manifest in url, the base URL of the release is the one of the manifest if it is not provided
+func checkReleaseURL(manifestURL string) (UpdateInfo, error) {
+	var info UpdateInfo
+	code, body, err := SendRequest(http.MethodGet, manifestURL, nil, map[string]string{}, false)
+	if err != nil {
+		return info, fmt.Errorf("error checking %s - %v", manifestURL, err)
+	}
+	if code != http.StatusOK {
+		return info, fmt.Errorf("error checking %s - HTTP %d", manifestURL, code)
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return info, fmt.Errorf("error parsing %s - %v", manifestURL, err)
+	}
+	if info.URL == defEmptyValue {
+		info.URL = manifestURL[:strings.LastIndex(manifestURL, "/")]
+	}
+	return info, nil
+}
+
+// Function to check in osctrl for a new release of osctrld
+func checkOsctrlRelease(pr *Profile) (UpdateInfo, error) {
+	var info UpdateInfo
+	secret, err := getSecret(pr)
+	if err != nil {
+		return info, err
+	}
+	req := UpdateRequest{Secret: secret, Version: OsctrldVersion, OS: runtime.GOOS, Arch: runtime.GOARCH}
+	body, err := genericRetrieve(pr.URLs.Update, pr.Config.Insecure, req)
+	if err != nil {
+		return info, fmt.Errorf("error checking for updates - %v", err)
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return info, fmt.Errorf("error parsing update - %v", err)
+	}
+	return info, nil
+}
+
+// Function to create an updater for the running binary. Without url in the configuration, releases are checked in osctrl with the profile
+func newUpdater(cfg UpdateConfiguration, pr *Profile, p Platform) (*Updater, error) {
+	_, key, err := parseUpdateConfiguration(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("update.publicKey is required to verify releases")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("error getting osctrld binary - %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, fmt.Errorf("error getting osctrld binary - %v", err)
+	}
+	u := &Updater{
+		exe:   exe,
+		key:   key,
+		smoke: smokeTestBinary,
+		restart: func() error {
+			return restartOsctrld(p)
+		},
+	}
+	switch {
+	case cfg.URL != defEmptyValue:
+		u.check = func() (UpdateInfo, error) {
+			return checkReleaseURL(cfg.URL)
+		}
+	case pr != nil:
+		u.insecure = pr.Config.Insecure
+		u.check = func() (UpdateInfo, error) {
+			return checkOsctrlRelease(pr)
+		}
+	default:
+		return nil, fmt.Errorf("update.url or a profile is required to check for updates")
+	}
+	return u, nil
+}
+
+// Check returns the latest release and if it is newer than the running version
+func (u *Updater) Check() (UpdateInfo, bool, error) {
+	info, err := u.check()
+	if err != nil || info.Version == defEmptyValue {
+		return info, false, err
+	}
+	current, err := parseOsqueryVersion(OsctrldVersion)
+	if err != nil {
+		return info, false, err
+	}
+	latest, err := parseOsqueryVersion(info.Version)
+	if err != nil {
+		return info, false, fmt.Errorf("invalid release version - %v", err)
+	}
+	return info, latest.Compare(current) > 0, nil
+}
+
+// Helper to download a file of a release
+func (u *Updater) download(fileURL string) ([]byte, error) {
+	code, body, err := SendRequest(http.MethodGet, fileURL, nil, map[string]string{}, u.insecure)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s - %v", fileURL, err)
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("error downloading %s - HTTP %d", fileURL, code)
+	}
+	return body, nil
+}
+
+// Apply downloads the release for the running platform, verifies the signature of its checksums and the checksum
+// of the archive, and replaces the binary. If the new binary does not pass the smoke test, the previous one is restored
+func (u *Updater) Apply(info UpdateInfo) error {
+	base := strings.TrimSuffix(info.URL, "/")
+	checksumsURL := base + "/" + releaseChecksumsName(info.Version)
+	checksums, err := u.download(checksumsURL)
+	if err != nil {
+		return err
+	}
+	signature, err := u.download(checksumsURL + updateSignatureExtension)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksumsSignature(checksums, signature, u.key); err != nil {
+		return err
+	}
+	archive := releaseArchiveName(info.Version, runtime.GOOS, runtime.GOARCH)
+	sum, ok := parseChecksums(checksums)[archive]
+	if !ok {
+		return fmt.Errorf("no checksum for %s", archive)
+	}
+	archiveURL := base + "/" + archive
+	content, err := u.download(archiveURL)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(content)
+	if got := hex.EncodeToString(digest[:]); got != sum {
+		return fmt.Errorf("checksum mismatch for %s, expected %s and got %s", archive, sum, got)
+	}
+	name := appName
+	if runtime.GOOS == WindowsOS {
+		name += ".exe"
+	}
+	binary, err := extractBinary(content, strings.HasSuffix(archive, ".zip"), name)
+	if err != nil {
+		return err
+	}
+	r := AuditRecord{Action: AuditActionUpdate, Artifact: appName, Path: u.exe, URL: archiveURL, Before: OsctrldVersion, After: info.Version}
+	err = swapBinary(u.exe, binary)
+	if err == nil {
+		if err = u.smoke(u.exe, info.Version); err != nil {
+			if rerr := restoreBinary(u.exe); rerr != nil {
+				err = fmt.Errorf("%v, and %v", err, rerr)
+			} else {
+				err = fmt.Errorf("%v, rolled back to %s", err, OsctrldVersion)
+			}
+		}
+	}
+	auditOutcome(r, err)
+	return err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create a tar.gz release archive with a binary, as goreleaser does
+func testReleaseArchive(t *testing.T, name string, content []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{{"README.md", []byte("osctrld")}, {name, content}} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0755, Size: int64(len(f.content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(f.content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// Helper to serve a release with its archive, checksums of the summed archive and signature of the checksums
+func testReleaseServer(t *testing.T, key ed25519.PrivateKey, version string, archive, summed []byte) *httptest.Server {
+	name := releaseArchiveName(version, runtime.GOOS, runtime.GOARCH)
+	digest := sha256.Sum256(summed)
+	checksums := []byte(fmt.Sprintf("%s  %s\n%s  osctrld_%s_other_arch.tar.gz\n", hex.EncodeToString(digest[:]), name, hex.EncodeToString(digest[:]), version))
+	files := map[string][]byte{
+		"/" + name:                          archive,
+		"/" + releaseChecksumsName(version): checksums,
+		"/" + releaseChecksumsName(version) + updateSignatureExtension: ed25519.Sign(key, checksums),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseUpdateConfiguration(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	interval, key, err := parseUpdateConfiguration(UpdateConfiguration{})
+	assert.NoError(t, err)
+	assert.Equal(t, defUpdateInterval, interval)
+	assert.Nil(t, key)
+	_, key, err = parseUpdateConfiguration(UpdateConfiguration{Auto: true, PublicKey: base64.StdEncoding.EncodeToString(pub)})
+	assert.NoError(t, err)
+	assert.Equal(t, pub, key)
+	_, _, err = parseUpdateConfiguration(UpdateConfiguration{Auto: true})
+	assert.EqualError(t, err, "publicKey is required to verify releases")
+	_, _, err = parseUpdateConfiguration(UpdateConfiguration{Interval: "10s"})
+	assert.Error(t, err)
+}
+
+func TestReleaseNames(t *testing.T) {
+	assert.Equal(t, "osctrld_1.1.0_linux_amd64.tar.gz", releaseArchiveName("v1.1.0", LinuxOS, "amd64"))
+	assert.Equal(t, "osctrld_1.1.0_windows_arm64.zip", releaseArchiveName("1.1.0", WindowsOS, "arm64"))
+	assert.Equal(t, "osctrld_1.1.0_checksums.txt", releaseChecksumsName("v1.1.0"))
+}
+
+func TestVerifyChecksumsSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	checksums := []byte("abc  osctrld_1.1.0_linux_amd64.tar.gz\n")
+	signature := ed25519.Sign(priv, checksums)
+	assert.NoError(t, verifyChecksumsSignature(checksums, signature, pub))
+	assert.NoError(t, verifyChecksumsSignature(checksums, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), pub))
+	assert.EqualError(t, verifyChecksumsSignature([]byte("tampered"), signature, pub), "invalid signature of checksums")
+	assert.EqualError(t, verifyChecksumsSignature(checksums, []byte("not a signature"), pub), "invalid signature of checksums")
+	assert.Equal(t, map[string]string{"osctrld_1.1.0_linux_amd64.tar.gz": "abc"}, parseChecksums(checksums))
+}
+
+func TestExtractBinary(t *testing.T) {
+	binary, err := extractBinary(testReleaseArchive(t, "bin/osctrld", []byte("new binary")), false, "osctrld")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new binary"), binary)
+	_, err = extractBinary(testReleaseArchive(t, "bin/other", []byte("new binary")), false, "osctrld")
+	assert.EqualError(t, err, "osctrld not found in archive")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("bin/osctrld.exe")
+	assert.NoError(t, err)
+	f.Write([]byte("new exe"))
+	assert.NoError(t, zw.Close())
+	binary, err = extractBinary(buf.Bytes(), true, "osctrld.exe")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new exe"), binary)
+}
+
+func TestUpdaterCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"99.0.0"}`))
+	}))
+	defer server.Close()
+	info, err := checkReleaseURL(server.URL + "/releases/latest.json")
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateInfo{Version: "99.0.0", URL: server.URL + "/releases"}, info)
+
+	u := &Updater{check: func() (UpdateInfo, error) { return info, nil }}
+	_, newer, err := u.Check()
+	assert.NoError(t, err)
+	assert.True(t, newer)
+	for _, v := range []string{OsctrldVersion, "0.9.0", ""} {
+		u.check = func() (UpdateInfo, error) { return UpdateInfo{Version: v}, nil }
+		_, newer, err = u.Check()
+		assert.NoError(t, err)
+		assert.False(t, newer, v)
+	}
+}
+
+func TestUpdaterApply(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	name := appName
+	if runtime.GOOS == WindowsOS {
+		name += ".exe"
+	}
+	archive := testReleaseArchive(t, "bin/"+name, []byte("new binary"))
+	server := testReleaseServer(t, priv, "99.0.0", archive, archive)
+	info := UpdateInfo{Version: "99.0.0", URL: server.URL}
+	newExe := func(t *testing.T) string {
+		exe := filepath.Join(t.TempDir(), name)
+		assert.NoError(t, os.WriteFile(exe, []byte("old binary"), 0755))
+		return exe
+	}
+	assertBinary := func(t *testing.T, exe, expected string) {
+		content, err := os.ReadFile(exe)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	t.Run("updated", func(t *testing.T) {
+		exe := newExe(t)
+		var smoked string
+		u := &Updater{exe: exe, key: pub, smoke: func(exe, version string) error {
+			smoked = version
+			return nil
+		}}
+		assert.NoError(t, u.Apply(info))
+		assert.Equal(t, "99.0.0", smoked)
+		assertBinary(t, exe, "new binary")
+		assertBinary(t, exe+updateBackupExtension, "old binary")
+		assert.NoFileExists(t, exe+updateNewExtension)
+	})
+	t.Run("smoke test fails", func(t *testing.T) {
+		exe := newExe(t)
+		u := &Updater{exe: exe, key: pub, smoke: func(string, string) error {
+			return fmt.Errorf("exit status 2")
+		}}
+		assert.EqualError(t, u.Apply(info), fmt.Sprintf("exit status 2, rolled back to %s", OsctrldVersion))
+		assertBinary(t, exe, "old binary")
+	})
+	t.Run("other key", func(t *testing.T) {
+		exe := newExe(t)
+		other, _, _ := ed25519.GenerateKey(rand.Reader)
+		u := &Updater{exe: exe, key: other}
+		assert.EqualError(t, u.Apply(info), "invalid signature of checksums")
+		assertBinary(t, exe, "old binary")
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		exe := newExe(t)
+		tampered := testReleaseServer(t, priv, "99.0.0", testReleaseArchive(t, "bin/"+name, []byte("tampered binary")), archive)
+		u := &Updater{exe: exe, key: pub}
+		assert.ErrorContains(t, u.Apply(UpdateInfo{Version: "99.0.0", URL: tampered.URL}), "checksum mismatch")
+		assertBinary(t, exe, "old binary")
+	})
+	t.Run("missing release", func(t *testing.T) {
+		exe := newExe(t)
+		u := &Updater{exe: exe, key: pub}
+		assert.ErrorContains(t, u.Apply(UpdateInfo{Version: "98.0.0", URL: server.URL}), "HTTP 404")
+		assertBinary(t, exe, "old binary")
+	})
+}
+
+func TestSmokeTestBinary(t *testing.T) {
+	if runtime.GOOS == WindowsOS {
+		t.Skip("shell scripts are not supported")
+	}
+	exe := filepath.Join(t.TempDir(), "osctrld")
+	assert.NoError(t, os.WriteFile(exe, []byte("#!/bin/sh\necho osctrld version 99.0.0\n"), 0755))
+	assert.NoError(t, smokeTestBinary(exe, "v99.0.0"))
+	assert.ErrorContains(t, smokeTestBinary(exe, "98.0.0"), "expected 98.0.0")
+	assert.ErrorContains(t, smokeTestBinary(exe, "9.0.0"), "expected 9.0.0")
+	prefix := filepath.Join(t.TempDir(), "osctrld")
+	assert.NoError(t, os.WriteFile(prefix, []byte("#!/bin/sh\necho osctrld version 0.4.10\n"), 0755))
+	assert.ErrorContains(t, smokeTestBinary(prefix, "0.4.1"), "expected 0.4.1")
+	assert.NoError(t, smokeTestBinary(prefix, "v0.4.10"))
+	assert.ErrorContains(t, smokeTestBinary(filepath.Join(t.TempDir(), "missing"), "99.0.0"), "error running")
+}
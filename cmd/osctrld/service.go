@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Templates of the osctrld service definitions
+//
+//go:embed service
+var serviceTemplates embed.FS
+
+const (
+	// Log file of osctrld when it runs with launchd, without journald
+	defServiceLogFile = "/var/log/osctrld.log"
+	// Shell for the osctrld user, it does not log in
+	serviceUserShell = "/usr/sbin/nologin"
+)
+
+// OsctrldService keeps the values to define the osctrld service, resolved from the running binary and configuration
+type OsctrldService struct {
+	Name        string
+	Description string
+	Definition  string
+	Binary      string
+	Config      string
+	User        string
+	Group       string
+	WorkingDir  string
+	LogFile     string
+}
+
+// Helper to escape a value for XML
+func xmlEscape(value string) (string, error) {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(value)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Function to render the definition of the osctrld service from its embedded template
+func renderServiceDefinition(def ServiceDefinition, s OsctrldService) ([]byte, error) {
+	content, err := serviceTemplates.ReadFile(def.Template)
+	if err != nil {
+		return nil, fmt.Errorf("error reading template %s - %v", def.Template, err)
+	}
+	tmpl, err := template.New(def.Template).Funcs(template.FuncMap{"xml": xmlEscape}).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template %s - %v", def.Template, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return nil, fmt.Errorf("error rendering template %s - %v", def.Template, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Function to resolve the osctrld service for the running binary and configuration file, which must exist
+func resolveOsctrldService(sm ServiceManager, p Platform, username string) (OsctrldService, error) {
+	def := sm.OsctrldDefinition()
+	s := OsctrldService{
+		Name:        def.Name,
+		Description: appUsage,
+		Definition:  def.Path,
+		User:        username,
+		Group:       username,
+		WorkingDir:  loadedConfig.State.Dir,
+		LogFile:     defServiceLogFile,
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return s, fmt.Errorf("error getting osctrld binary - %v", err)
+	}
+	if s.Binary, err = filepath.EvalSymlinks(exe); err != nil {
+		return s, fmt.Errorf("error getting osctrld binary - %v", err)
+	}
+	file, _ := resolveConfigFile(p)
+	if s.Config, err = filepath.Abs(file); err != nil {
+		return s, fmt.Errorf("error getting configuration file - %v", err)
+	}
+	if !checkFileExist(s.Config) {
+		return s, fmt.Errorf("configuration file %s does not exist, generate it with osctrld config init", s.Config)
+	}
+	return s, nil
+}
+
+// Function to execute a command to register or unregister the osctrld service, recorded in the audit log
+func runServiceCommand(command []string) error {
+	r := AuditRecord{Action: AuditActionService, Artifact: appName, Exec: command}
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("error running %s - %v - %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+	}
+	auditOutcome(r, err)
+	return err
+}
+
+// Function to get the user to run the osctrld service, creating it as system user if it does not exist.
+// Users are only created in linux
+func ensureServiceUser(p Platform, username string, run func([]string) error) (*user.User, error) {
+	if u, err := user.Lookup(username); err == nil {
+		return u, nil
+	}
+	if p.Name() != LinuxOS {
+		return nil, fmt.Errorf("user %s does not exist, create it first", username)
+	}
+	if err := run([]string{"useradd", "--system", "--user-group", "--no-create-home", "--shell", serviceUserShell, username}); err != nil {
+		return nil, err
+	}
+	return user.Lookup(username)
+}
+
+// Function to create the directories written by the osctrld service, owned by its user if there is one.
+// Existing directories are not changed
+func ensureServiceDirs(dirs []string, u *user.User) error {
+	for _, dir := range dirs {
+		if checkFileExist(dir) {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("error creating %s - %v", dir, err)
+		}
+		if u == nil {
+			continue
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("error changing owner of %s - %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Helper to get the directories written by the osctrld service
+func serviceDirs() []string {
+	dirs := []string{loadedConfig.State.Dir, loadedConfig.Backups.Dir}
+	if loadedConfig.Audit.Enabled {
+		dirs = append(dirs, filepath.Dir(loadedConfig.Audit.File))
+	}
+	if loadedConfig.Log.File != defEmptyValue {
+		dirs = append(dirs, filepath.Dir(loadedConfig.Log.File))
+	}
+	return dirs
+}
+
+// Function to install the osctrld service: its definition is written and it is registered, enabled and started
+func installService(sm ServiceManager, s OsctrldService, run func([]string) error) error {
+	def := sm.OsctrldDefinition()
+	if def.Path != defEmptyValue {
+		content, err := renderServiceDefinition(def, s)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(def.Path), 0755); err != nil {
+			return fmt.Errorf("error creating directory - %v", err)
+		}
+		r := AuditRecord{Action: AuditActionWrite, Artifact: "service", Path: def.Path, Before: auditFileHash(def.Path)}
+		err = os.WriteFile(def.Path, content, 0644)
+		r.After = auditFileHash(def.Path)
+		auditOutcome(r, err)
+		if err != nil {
+			return fmt.Errorf("error writing %s - %v", def.Path, err)
+		}
+		if reload := sm.ReloadCommand(); reload != nil {
+			if err := run(reload); err != nil {
+				return err
+			}
+		}
+	}
+	for _, command := range sm.InstallOsctrldCommands(s) {
+		if err := run(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to uninstall the osctrld service: it is stopped and unregistered, and its definition removed.
+// Commands that fail are logged, the service may be already stopped or partially installed
+func uninstallService(sm ServiceManager, s OsctrldService, run func([]string) error) error {
+	for _, command := range sm.UninstallOsctrldCommands(s) {
+		if err := run(command); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+	def := sm.OsctrldDefinition()
+	if def.Path == defEmptyValue {
+		return nil
+	}
+	if checkFileExist(def.Path) {
+		r := AuditRecord{Action: AuditActionWrite, Artifact: "service", Path: def.Path, Before: auditFileHash(def.Path)}
+		err := os.Remove(def.Path)
+		auditOutcome(r, err)
+		if err != nil {
+			return fmt.Errorf("error removing %s - %v", def.Path, err)
+		}
+	}
+	if reload := sm.ReloadCommand(); reload != nil {
+		if err := run(reload); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServiceManager defines the osctrld service in a directory, with commands that are only recorded
+type fakeServiceManager struct {
+	dir string
+}
+
+func (fakeServiceManager) Name() string {
+	return "fake"
+}
+
+func (fakeServiceManager) RestartCommand() []string {
+	return []string{"fake", "restart", "osqueryd"}
+}
+
+func (fakeServiceManager) RestartOsctrldCommand() []string {
+	return []string{"fake", "restart", "osctrld"}
+}
+
+func (fakeServiceManager) ReloadCommand() []string {
+	return []string{"fake", "reload"}
+}
+
+func (m fakeServiceManager) OsctrldDefinition() ServiceDefinition {
+	return ServiceDefinition{Name: "osctrld", Path: filepath.Join(m.dir, "osctrld.service"), Template: "service/systemd.service"}
+}
+
+func (fakeServiceManager) InstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{{"fake", "enable", s.Name}, {"fake", "start", s.Name}}
+}
+
+func (fakeServiceManager) UninstallOsctrldCommands(s OsctrldService) [][]string {
+	return [][]string{{"fake", "stop", s.Name}, {"fake", "disable", s.Name}}
+}
+
+// Helper to get a service for tests
+func testOsctrldService(def ServiceDefinition) OsctrldService {
+	return OsctrldService{
+		Name:        def.Name,
+		Description: appUsage,
+		Definition:  def.Path,
+		Binary:      "/usr/local/bin/osctrld",
+		Config:      "/etc/osctrld/osctrld.yaml",
+		WorkingDir:  "/etc/osctrld/state",
+		LogFile:     defServiceLogFile,
+	}
+}
+
+func TestRenderServiceDefinition(t *testing.T) {
+	t.Run("systemd", func(t *testing.T) {
+		def := systemdManager{}.OsctrldDefinition()
+		assert.Equal(t, "/etc/systemd/system/osctrld.service", def.Path)
+		s := testOsctrldService(def)
+		content, err := renderServiceDefinition(def, s)
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "ExecStart=\"/usr/local/bin/osctrld\" \"--config=/etc/osctrld/osctrld.yaml\" daemon\n")
+		assert.Contains(t, string(content), "WorkingDirectory=/etc/osctrld/state\n")
+		assert.NotContains(t, string(content), "User=")
+		s.User, s.Group = "osctrld", "osctrld"
+		content, err = renderServiceDefinition(def, s)
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "User=osctrld\nGroup=osctrld\n")
+	})
+	t.Run("launchd", func(t *testing.T) {
+		def := launchdManager{}.OsctrldDefinition()
+		assert.Equal(t, "/Library/LaunchDaemons/net.osctrl.daemon.plist", def.Path)
+		s := testOsctrldService(def)
+		s.Config = "/Users/R&D/osctrld.yaml"
+		s.User, s.Group = "osctrld", "staff"
+		content, err := renderServiceDefinition(def, s)
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "<string>net.osctrl.daemon</string>")
+		assert.Contains(t, string(content), "<string>--config=/Users/R&amp;D/osctrld.yaml</string>")
+		assert.Contains(t, string(content), "<key>UserName</key>\n  <string>osctrld</string>")
+		// The definition must be valid XML
+		decoder := xml.NewDecoder(strings.NewReader(string(content)))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			if err != nil {
+				break
+			}
+		}
+	})
+	t.Run("windows", func(t *testing.T) {
+		def := windowsServiceManager{}.OsctrldDefinition()
+		assert.Empty(t, def.Path)
+		s := testOsctrldService(def)
+		s.Binary, s.Config = `C:\Program Files\osctrld\osctrld.exe`, `C:\ProgramData\osctrld\osctrld.json`
+		commands := windowsServiceManager{}.InstallOsctrldCommands(s)
+		assert.Equal(t, []string{"sc.exe", "create", "osctrld", "binPath=", `"C:\Program Files\osctrld\osctrld.exe" --config "C:\ProgramData\osctrld\osctrld.json" daemon`, "start=", "auto", "DisplayName=", "osctrld"}, commands[0])
+	})
+}
+
+func TestInstallService(t *testing.T) {
+	sm := fakeServiceManager{dir: filepath.Join(t.TempDir(), "units")}
+	def := sm.OsctrldDefinition()
+	s := testOsctrldService(def)
+	var executed []string
+	run := func(command []string) error {
+		executed = append(executed, strings.Join(command, " "))
+		if command[1] == "stop" {
+			return fmt.Errorf("not running")
+		}
+		return nil
+	}
+
+	assert.NoError(t, installService(sm, s, run))
+	content, err := os.ReadFile(def.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "ExecStart=\"/usr/local/bin/osctrld\"")
+	assert.Equal(t, []string{"fake reload", "fake enable osctrld", "fake start osctrld"}, executed)
+
+	// Commands that fail do not stop uninstalling
+	executed = nil
+	assert.NoError(t, uninstallService(sm, s, run))
+	assert.NoFileExists(t, def.Path)
+	assert.Equal(t, []string{"fake stop osctrld", "fake disable osctrld", "fake reload"}, executed)
+
+	// Commands that fail stop installing
+	executed = nil
+	failing := func(command []string) error {
+		executed = append(executed, strings.Join(command, " "))
+		return fmt.Errorf("failed")
+	}
+	assert.EqualError(t, installService(sm, s, failing), "failed")
+	assert.Equal(t, []string{"fake reload"}, executed)
+}
+
+func TestEnsureServiceDirs(t *testing.T) {
+	dir := t.TempDir()
+	dirs := []string{filepath.Join(dir, "state"), filepath.Join(dir, "backups", "nested"), dir}
+	assert.NoError(t, ensureServiceDirs(dirs, nil))
+	for _, d := range dirs {
+		assert.DirExists(t, d)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Default directory for the state, inside the platform configuration directory
+	defStateDir = "state"
+	// State file name, inside the state directory
+	stateFile = "state.json"
+	// Extension for the file locked while the state is read or written
+	stateLockExtension = ".lock"
+	// Extension for state files that could not be parsed, kept for inspection
+	stateCorruptExtension = ".corrupt"
+	// Version of the state file format, newer versions are not read
+	stateVersion = 1
+	// Number of rolled back contents kept for each artifact
+	rejectedKeep = 10
+)
+
+// StateConfiguration to hold the state configuration
+type StateConfiguration struct {
+	Dir string `json:"dir"`
+}
+
+// ArtifactState keeps what osctrld knows about an artifact of a profile
+type ArtifactState struct {
+	Path      string    `json:"path"`
+	URL       string    `json:"url"`
+	Hash      string    `json:"hash"`
+	ETag      string    `json:"etag"`
+	LastFetch time.Time `json:"lastFetch"`
+	LastApply time.Time `json:"lastApply"`
+	LastError string    `json:"lastError"`
+	ErrorTime time.Time `json:"errorTime"`
+	Failures  int       `json:"failures"`
+	Rejected  []string  `json:"rejected,omitempty"`
+}
+
+// VerifyCheck keeps the result of a check of a verification
+type VerifyCheck struct {
+	Check   string `json:"check"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// VerifyReport keeps the result of the last verification of a profile
+type VerifyReport struct {
+	Time   time.Time     `json:"time"`
+	Checks []VerifyCheck `json:"checks"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Failed returns the number of failed checks
+func (r *VerifyReport) Failed() int {
+	failed := 0
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed++
+		}
+	}
+	return failed
+}
+
+// ProfileState keeps what osctrld knows about a profile
+type ProfileState struct {
+	Environment   string                    `json:"environment"`
+	Server        string                    `json:"server"`
+	LastSync      time.Time                 `json:"lastSync"`
+	Artifacts     map[string]*ArtifactState `json:"artifacts"`
+	Verify        *VerifyReport             `json:"verify,omitempty"`
+	LastHeartbeat time.Time                 `json:"lastHeartbeat"`
+	Actions       map[string]*ActionResult  `json:"actions,omitempty"`
+}
+
+// State of osctrld, persisted across runs
+type State struct {
+	Version  int                      `json:"version"`
+	Updated  time.Time                `json:"updated"`
+	Profiles map[string]*ProfileState `json:"profiles"`
+}
+
+// StateStore reads and writes the state file, locked so several osctrld processes can share it
+type StateStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// stateStore keeps the state of osctrld, nil until the configuration is loaded
+var stateStore *StateStore
+
+// Helper to create a state store in a directory, the directory is created with the first update
+func newStateStore(dir string) *StateStore {
+	return &StateStore{path: filepath.Join(dir, stateFile)}
+}
+
+// Function to lock the state, returns the function to unlock it
+func (s *StateStore) lock(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating state directory - %v", err)
+	}
+	f, err := os.OpenFile(s.path+stateLockExtension, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state lock - %v", err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking state - %v", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Function to read the state file, an empty state is returned if it does not exist
+func (s *StateStore) read() (State, error) {
+	state := State{Version: stateVersion, Profiles: make(map[string]*ProfileState)}
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("error reading state - %v", err)
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("error parsing state %s - %v", s.path, err)
+	}
+	if state.Version > stateVersion {
+		return state, fmt.Errorf("state %s has version %d, newer than supported version %d", s.path, state.Version, stateVersion)
+	}
+	if state.Profiles == nil {
+		state.Profiles = make(map[string]*ProfileState)
+	}
+	return state, nil
+}
+
+// Load returns the current state, it does not need the state directory to be writable
+func (s *StateStore) Load() (State, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return State{Version: stateVersion, Profiles: make(map[string]*ProfileState)}, nil
+	}
+	unlock, err := s.lock(false)
+	if err != nil {
+		// Reading without lock is safe, the state file is always replaced atomically
+		return s.read()
+	}
+	defer unlock()
+	return s.read()
+}
+
+// Update modifies the state with the lock held, the state file is replaced atomically
+func (s *StateStore) Update(modify func(*State)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := s.read()
+	if err != nil {
+		if state.Version > stateVersion {
+			return err
+		}
+		// A state that can not be parsed is kept aside and started again, it is only a cache of what happened
+		logger.Warn(fmt.Sprintf("starting with empty state - %v", err), LogFieldPath, s.path)
+		if err := os.Rename(s.path, s.path+stateCorruptExtension); err != nil {
+			return fmt.Errorf("error moving corrupt state - %v", err)
+		}
+		state = State{Profiles: make(map[string]*ProfileState)}
+	}
+	modify(&state)
+	state.Version = stateVersion
+	state.Updated = time.Now().UTC()
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state - %v", err)
+	}
+	if err := writeFileAtomic(s.path, content, 0600); err != nil {
+		return fmt.Errorf("error writing state - %v", err)
+	}
+	return nil
+}
+
+// Helper to get the state of a profile, created if it does not exist
+func (st *State) profile(pr *Profile) *ProfileState {
+	ps, ok := st.Profiles[pr.Name]
+	if !ok {
+		ps = &ProfileState{Artifacts: make(map[string]*ArtifactState)}
+		st.Profiles[pr.Name] = ps
+	}
+	if ps.Artifacts == nil {
+		ps.Artifacts = make(map[string]*ArtifactState)
+	}
+	ps.Environment = pr.Config.Environment
+	ps.Server = pr.Config.BaseURL
+	return ps
+}
+
+// Helper to get the state of an artifact of a profile, created if it does not exist
+func (st *State) artifact(pr *Profile, artifact string) *ArtifactState {
+	ps := st.profile(pr)
+	as, ok := ps.Artifacts[artifact]
+	if !ok {
+		as = &ArtifactState{}
+		ps.Artifacts[artifact] = as
+	}
+	if path, err := artifactPath(pr, artifact); err == nil {
+		as.Path = path
+	}
+	return as
+}
+
+// Helper to record an error for an artifact, failures are counted until the next success
+func (as *ArtifactState) failed(err error) {
+	as.LastError = err.Error()
+	as.ErrorTime = time.Now().UTC()
+	as.Failures++
+}
+
+// Helper to update the state of an artifact of a profile, if the state is available. Errors are logged
+func updateArtifactState(pr *Profile, artifact string, modify func(*ProfileState, *ArtifactState)) {
+	if stateStore == nil {
+		return
+	}
+	err := stateStore.Update(func(st *State) {
+		as := st.artifact(pr, artifact)
+		modify(st.Profiles[pr.Name], as)
+	})
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error updating state of %s - %v", artifact, err), LogFieldArtifact, artifact)
+	}
+}
+
+// Function to record the result of fetching an artifact from osctrl
+func recordFetch(pr *Profile, artifact, url, etag string, err error) {
+	updateArtifactState(pr, artifact, func(_ *ProfileState, as *ArtifactState) {
+		as.URL = url
+		if err != nil {
+			as.failed(err)
+			return
+		}
+		as.LastFetch = time.Now().UTC()
+		as.ETag = etag
+	})
+}
+
+// Function to record the result of applying an artifact to a local file
+func recordApply(pr *Profile, artifact, path string, err error) {
+	updateArtifactState(pr, artifact, func(ps *ProfileState, as *ArtifactState) {
+		if err != nil {
+			as.failed(err)
+			return
+		}
+		now := time.Now().UTC()
+		as.LastApply = now
+		as.Hash = auditFileHash(path)
+		as.LastError = defEmptyValue
+		as.Failures = 0
+		ps.LastSync = now
+	})
+}
+
+// Function to record the report of the last verification of a profile, if the state is available
+func recordVerify(pr *Profile, report *VerifyReport) {
+	if stateStore == nil {
+		return
+	}
+	err := stateStore.Update(func(st *State) {
+		st.profile(pr).Verify = report
+	})
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error updating state of verification - %v", err))
+	}
+}
+
+// Function to record the last heartbeat accepted by osctrl for a profile, if the state is available
+func recordHeartbeat(pr *Profile, t time.Time) {
+	if stateStore == nil {
+		return
+	}
+	err := stateStore.Update(func(st *State) {
+		st.profile(pr).LastHeartbeat = t
+	})
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error updating state of heartbeat - %v", err))
+	}
+}
+
+// Function to record content of an artifact rolled back by the guard, so it is not applied again by later runs
+func recordRejected(pr *Profile, artifact, hash string) {
+	updateArtifactState(pr, artifact, func(_ *ProfileState, as *ArtifactState) {
+		for _, h := range as.Rejected {
+			if h == hash {
+				return
+			}
+		}
+		as.Rejected = append(as.Rejected, hash)
+		if len(as.Rejected) > rejectedKeep {
+			as.Rejected = as.Rejected[len(as.Rejected)-rejectedKeep:]
+		}
+	})
+}
+
+// Helper to check if content of an artifact has been rolled back by the guard, in any run
+func wasRejected(pr *Profile, artifact, hash string) bool {
+	if stateStore == nil {
+		return false
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error loading state of %s - %v", artifact, err), LogFieldArtifact, artifact)
+		return false
+	}
+	if ps, ok := state.Profiles[pr.Name]; ok {
+		if as, ok := ps.Artifacts[artifact]; ok {
+			for _, h := range as.Rejected {
+				if h == hash {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Helper to get the result of an action already run for a profile, nil if it has not been run
+func executedAction(pr *Profile, id string) *ActionResult {
+	if stateStore == nil {
+		return nil
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error loading state of actions - %v", err))
+		return nil
+	}
+	if ps, ok := state.Profiles[pr.Name]; ok {
+		return ps.Actions[id]
+	}
+	return nil
+}
+
+// Function to record the result of an action of a profile, keeping only the most recent results
+func recordAction(pr *Profile, result ActionResult) {
+	if stateStore == nil {
+		return
+	}
+	err := stateStore.Update(func(st *State) {
+		ps := st.profile(pr)
+		if ps.Actions == nil {
+			ps.Actions = make(map[string]*ActionResult)
+		}
+		ps.Actions[result.ID] = &result
+		for len(ps.Actions) > actionsKeep {
+			oldest := defEmptyValue
+			for id, r := range ps.Actions {
+				if oldest == defEmptyValue || r.Finished.Before(ps.Actions[oldest].Finished) {
+					oldest = id
+				}
+			}
+			delete(ps.Actions, oldest)
+		}
+	})
+	if err != nil {
+		pr.log().Warn(fmt.Sprintf("error updating state of action %s - %v", result.ID, err))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create a profile for state tests
+func testStateProfile(name string) *Profile {
+	return &Profile{Name: name, Config: JSONConfiguration{Environment: "dev", BaseURL: "https://osctrl.url"}}
+}
+
+func TestStateStoreUpdate(t *testing.T) {
+	s := newStateStore(filepath.Join(t.TempDir(), defStateDir))
+	state, err := s.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, state.Profiles)
+
+	pr := testStateProfile("default")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Update(func(st *State) {
+				st.artifact(pr, "flags").Failures++
+			}))
+		}()
+	}
+	wg.Wait()
+	state, err = s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, stateVersion, state.Version)
+	assert.False(t, state.Updated.IsZero())
+	assert.Equal(t, 10, state.Profiles["default"].Artifacts["flags"].Failures)
+	assert.Equal(t, "https://osctrl.url", state.Profiles["default"].Server)
+}
+
+func TestStateStoreInvalid(t *testing.T) {
+	t.Run("newer version", func(t *testing.T) {
+		s := newStateStore(t.TempDir())
+		assert.NoError(t, os.WriteFile(s.path, []byte(fmt.Sprintf(`{"version": %d}`, stateVersion+1)), 0600))
+		_, err := s.Load()
+		assert.Error(t, err)
+		assert.Error(t, s.Update(func(st *State) {}))
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		s := newStateStore(t.TempDir())
+		assert.NoError(t, os.WriteFile(s.path, []byte(`{"version": 1, "profiles": {`), 0600))
+		_, err := s.Load()
+		assert.Error(t, err)
+		assert.NoError(t, s.Update(func(st *State) {}))
+		assert.FileExists(t, s.path+stateCorruptExtension)
+		_, err = s.Load()
+		assert.NoError(t, err)
+	})
+}
+
+func TestRecordFetchApply(t *testing.T) {
+	dir := t.TempDir()
+	stateStore = newStateStore(filepath.Join(dir, defStateDir))
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("prod")
+	file := filepath.Join(dir, "osquery.flags")
+	url := "https://osctrl.url/dev/osctrld-flags"
+
+	recordFetch(pr, "flags", url, "", fmt.Errorf("HTTP 500"))
+	recordFetch(pr, "flags", url, `"v1"`, nil)
+	recordApply(pr, "flags", file, fmt.Errorf("flags mismatch"))
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	as := state.Profiles["prod"].Artifacts["flags"]
+	assert.Equal(t, 2, as.Failures)
+	assert.Equal(t, "flags mismatch", as.LastError)
+	assert.Equal(t, `"v1"`, as.ETag)
+	assert.False(t, as.LastFetch.IsZero())
+	assert.True(t, as.LastApply.IsZero())
+
+	assert.NoError(t, os.WriteFile(file, []byte("--host_identifier=uuid"), 0600))
+	recordApply(pr, "flags", file, nil)
+	state, err = stateStore.Load()
+	assert.NoError(t, err)
+	as = state.Profiles["prod"].Artifacts["flags"]
+	assert.Equal(t, 0, as.Failures)
+	assert.Empty(t, as.LastError)
+	assert.Equal(t, auditHash([]byte("--host_identifier=uuid")), as.Hash)
+	assert.Equal(t, as.LastApply, state.Profiles["prod"].LastSync)
+}
+
+func TestRecordVerify(t *testing.T) {
+	stateStore = newStateStore(t.TempDir())
+	defer func() { stateStore = nil }()
+	pr := testStateProfile("prod")
+	report := &VerifyReport{Time: time.Now().UTC(), Checks: []VerifyCheck{
+		{Check: "secret", OK: true, Message: "osquery secret is valid"},
+		{Check: "flags", Message: "flags mismatch"},
+	}}
+	recordVerify(pr, report)
+	state, err := stateStore.Load()
+	assert.NoError(t, err)
+	ps := state.Profiles["prod"]
+	assert.Equal(t, 1, ps.Verify.Failed())
+	assert.Equal(t, "flags mismatch", ps.Verify.Checks[1].Message)
+	assert.NotNil(t, ps.Artifacts)
+}
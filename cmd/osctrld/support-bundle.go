@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// How much of the end of the audit log and the log file is included in a support bundle
+	bundleTailSize = 256 * 1024
+)
+
+// Helper to read the end of a file, at most size bytes
+func readFileTail(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > size {
+		if _, err := f.Seek(info.Size()-size, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(f)
+}
+
+// Function to collect a support bundle for a profile, as tar.gz: effective configuration with secrets
+// redacted, state, status of the node, flags and the end of the audit log and the log file
+func supportBundle(pr *Profile) ([]byte, error) {
+	type bundleFile struct {
+		name    string
+		content []byte
+	}
+	var files []bundleFile
+	add := func(name string, content []byte) {
+		files = append(files, bundleFile{name: name, content: content})
+	}
+	platform := runtime.GOOS
+	if osPlatform != nil {
+		platform = osPlatform.Name()
+	}
+	add("osctrld.txt", []byte(fmt.Sprintf("osctrld %s\nprofile %s\nplatform %s\ncollected %s\n", OsctrldVersion, pr.Name, platform, time.Now().UTC().Format(time.RFC3339))))
+	if lines, err := formatConfiguration(pr, true); err == nil {
+		add("config.txt", []byte(strings.Join(lines, "\n")+"\n"))
+	} else {
+		add("config.txt", []byte(err.Error()+"\n"))
+	}
+	// The heartbeat has host facts, osqueryd running, hashes of flags and cert and the last verification
+	if content, err := json.MarshalIndent(genHeartbeat(pr), "", "  "); err == nil {
+		add("node.json", content)
+	}
+	if stateStore != nil {
+		if state, err := stateStore.Load(); err == nil {
+			if content, err := json.MarshalIndent(state, "", "  "); err == nil {
+				add("state.json", content)
+			}
+		}
+	}
+	if content, err := os.ReadFile(pr.Config.FlagFile); err == nil {
+		add("osquery.flags", content)
+	}
+	if loadedConfig.Audit.Enabled {
+		if content, err := readFileTail(loadedConfig.Audit.File, bundleTailSize); err == nil {
+			add("audit.log", content)
+		}
+	}
+	if loadedConfig.Log.File != defEmptyValue {
+		if content, err := readFileTail(loadedConfig.Log.File, bundleTailSize); err == nil {
+			add("osctrld.log", content)
+		}
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, fmt.Errorf("error writing support bundle - %v", err)
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return nil, fmt.Errorf("error writing support bundle - %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("error writing support bundle - %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("error writing support bundle - %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"fmt"
-	"runtime"
-	"strconv"
 	"strings"
 )
 
@@ -16,22 +14,39 @@ const (
 	OsctrlURLCert = "%s/osctrld-cert"
 	// OsctrlURLVerify to send request for verification
 	OsctrlURLVerify = "%s/osctrld-verify"
+	// OsctrlURLReport to report changes that have been rolled back
+	OsctrlURLReport = "%s/osctrld-report"
+	// OsctrlURLHeartbeat to send the status of the node
+	OsctrlURLHeartbeat = "%s/osctrld-heartbeat"
+	// OsctrlURLActions to poll for actions requested by osctrl
+	OsctrlURLActions = "%s/osctrld-actions"
+	// OsctrlURLActionResult to report the result of actions
+	OsctrlURLActionResult = "%s/osctrld-action-result"
+	// OsctrlURLUpdate to check for new releases of osctrld
+	OsctrlURLUpdate = "%s/osctrld-update"
 	// OsctrlURLScript to send request for enroll/remove
 	OsctrlURLScript = "%s/%s/%s/osctrld-script"
 	// OsctrlEnroll to identify enrolls
 	OsctrlEnroll = "enroll"
 	// OsctrlRemove to identify removals
 	OsctrlRemove = "remove"
+	// Characters of hashes shown to users
+	shortHashLength = 12
 )
 
 // OsctrlURLs keeps all osctrl URLs
 type OsctrlURLs struct {
-	URL    string
-	Flags  string
-	Cert   string
-	Verify string
-	Enroll string
-	Remove string
+	URL          string
+	Flags        string
+	Cert         string
+	Verify       string
+	Enroll       string
+	Remove       string
+	Report       string
+	Heartbeat    string
+	Actions      string
+	ActionResult string
+	Update       string
 }
 
 // Helper to generate osctrl main URL
@@ -54,6 +69,31 @@ func genVerifyURL(osctrl string) string {
 	return fmt.Sprintf(OsctrlURLVerify, osctrl)
 }
 
+// Helper to generate osctrl report URL
+func genReportURL(osctrl string) string {
+	return fmt.Sprintf(OsctrlURLReport, osctrl)
+}
+
+// Helper to generate osctrl heartbeat URL
+func genHeartbeatURL(osctrl string) string {
+	return fmt.Sprintf(OsctrlURLHeartbeat, osctrl)
+}
+
+// Helper to generate osctrl actions URL
+func genActionsURL(osctrl string) string {
+	return fmt.Sprintf(OsctrlURLActions, osctrl)
+}
+
+// Helper to generate osctrl action result URL
+func genActionResultURL(osctrl string) string {
+	return fmt.Sprintf(OsctrlURLActionResult, osctrl)
+}
+
+// Helper to generate osctrl update URL
+func genUpdateURL(osctrl string) string {
+	return fmt.Sprintf(OsctrlURLUpdate, osctrl)
+}
+
 // Helper to generate osctrl script URL for enrolling/removing osquery nodes
 func genScriptURL(osctrl, action, platform string) string {
 	return fmt.Sprintf(OsctrlURLScript, osctrl, action, platform)
@@ -69,57 +109,30 @@ func genRemoveURL(osctrl, platform string) string {
 	return fmt.Sprintf(OsctrlURLScript, osctrl, OsctrlRemove, platform)
 }
 
-// Helper to generate all URLs
-func genURLs(host, env string, insecure bool) OsctrlURLs {
+// Helper to generate all URLs, scripts are generated for the given platform
+func genURLs(host, env, platform string, insecure bool) OsctrlURLs {
 	var urls OsctrlURLs
 	osctrlURL := genOsctrlURL(host, env)
 	urls.URL = osctrlURL
 	urls.Flags = genFlagsURL(osctrlURL)
 	urls.Cert = genCertURL(osctrlURL)
 	urls.Verify = genVerifyURL(osctrlURL)
-	urls.Enroll = genEnrollURL(osctrlURL, runtime.GOOS)
-	urls.Remove = genRemoveURL(osctrlURL, runtime.GOOS)
+	urls.Enroll = genEnrollURL(osctrlURL, platform)
+	urls.Remove = genRemoveURL(osctrlURL, platform)
+	urls.Report = genReportURL(osctrlURL)
+	urls.Heartbeat = genHeartbeatURL(osctrlURL)
+	urls.Actions = genActionsURL(osctrlURL)
+	urls.ActionResult = genActionResultURL(osctrlURL)
+	urls.Update = genUpdateURL(osctrlURL)
 	return urls
 }
 
-// Helper to compare SemVer strings and return the highest or zero if they are the same
-// returns 1 if existing is higher, 2 if required is higher, 0 is they are the same, and -1 if error
-func osqueryVersionCompare(existing, required string) int {
-	if existing == required {
-		return 0
-	}
-	if existing == "" || required == "" {
-		return -1
-	}
-	ex := strings.Split(existing, ".")
-	req := strings.Split(required, ".")
-	// Make sure both slices are the same length
-	if len(ex) > len(req) {
-		for i := 0; i < len(ex)-len(req); i++ {
-			req = append(req, "0")
-		}
-	}
-	if len(req) > len(ex) {
-		for i := 0; i < len(req)-len(ex); i++ {
-			ex = append(ex, "0")
-		}
-	}
-	res := 2
-	// Iterate through all elements to compare and check what is higher
-	for v := 0; v < len(ex); v++ {
-		exConv, err := strconv.Atoi(ex[v])
-		if err != nil {
-			return -1
-		}
-		reqConv, err := strconv.Atoi(req[v])
-		if err != nil {
-			return -1
-		}
-		if exConv > reqConv {
-			return 1
-		}
+// Helper to shorten a hash for display, hashes shorter than that are returned as they are
+func shortHash(hash string) string {
+	if len(hash) <= shortHashLength {
+		return hash
 	}
-	return res
+	return hash[:shortHashLength]
 }
 
 // Helper to compose a full path given partial path and file
@@ -131,8 +144,22 @@ func genFullPath(path, file string) string {
 	if strings.HasPrefix(file, "/") {
 		fFile = file[1:]
 	}
-	if strings.HasSuffix(path, "/") {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, "\\") {
 		return fmt.Sprintf("%s%s", path, fFile)
 	}
 	return fmt.Sprintf("%s/%s", path, fFile)
 }
+
+// Helper to format a size in bytes as human readable
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -27,6 +27,20 @@ func TestGenVerifyURL(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf(OsctrlURLVerify, "http://localhost:8080/dev"), verifyURL)
 }
 
+func TestGenHeartbeatURL(t *testing.T) {
+	heartbeatURL := genHeartbeatURL("http://localhost:8080/dev")
+	assert.Equal(t, fmt.Sprintf(OsctrlURLHeartbeat, "http://localhost:8080/dev"), heartbeatURL)
+}
+
+func TestGenActionsURL(t *testing.T) {
+	assert.Equal(t, fmt.Sprintf(OsctrlURLActions, "http://localhost:8080/dev"), genActionsURL("http://localhost:8080/dev"))
+	assert.Equal(t, fmt.Sprintf(OsctrlURLActionResult, "http://localhost:8080/dev"), genActionResultURL("http://localhost:8080/dev"))
+}
+
+func TestGenUpdateURL(t *testing.T) {
+	assert.Equal(t, fmt.Sprintf(OsctrlURLUpdate, "http://localhost:8080/dev"), genUpdateURL("http://localhost:8080/dev"))
+}
+
 func TestGenScriptURL(t *testing.T) {
 	scriptURL := genScriptURL("http://localhost:8080/dev", OsctrlEnroll, "darwin")
 	assert.Equal(t, fmt.Sprintf(OsctrlURLScript, "http://localhost:8080/dev", OsctrlEnroll, "darwin"), scriptURL)
@@ -43,20 +57,24 @@ func TestGenRemoveURL(t *testing.T) {
 }
 
 func TestGenURLs(t *testing.T) {
-	urls := genURLs("http://localhost:8080", "dev", true)
+	urls := genURLs("http://localhost:8080", "dev", DarwinOS, true)
 	assert.Equal(t, "http://localhost:8080/dev", urls.URL)
 	assert.Equal(t, fmt.Sprintf(OsctrlURLFlags, "http://localhost:8080/dev"), urls.Flags)
 	assert.Equal(t, fmt.Sprintf(OsctrlURLCert, "http://localhost:8080/dev"), urls.Cert)
 	assert.Equal(t, fmt.Sprintf(OsctrlURLVerify, "http://localhost:8080/dev"), urls.Verify)
 	assert.Equal(t, fmt.Sprintf(OsctrlURLScript, "http://localhost:8080/dev", OsctrlEnroll, "darwin"), urls.Enroll)
 	assert.Equal(t, fmt.Sprintf(OsctrlURLScript, "http://localhost:8080/dev", OsctrlRemove, "darwin"), urls.Remove)
+	assert.Equal(t, fmt.Sprintf(OsctrlURLReport, "http://localhost:8080/dev"), urls.Report)
+	assert.Equal(t, fmt.Sprintf(OsctrlURLHeartbeat, "http://localhost:8080/dev"), urls.Heartbeat)
+	assert.Equal(t, fmt.Sprintf(OsctrlURLActions, "http://localhost:8080/dev"), urls.Actions)
+	assert.Equal(t, fmt.Sprintf(OsctrlURLActionResult, "http://localhost:8080/dev"), urls.ActionResult)
+	assert.Equal(t, fmt.Sprintf(OsctrlURLUpdate, "http://localhost:8080/dev"), urls.Update)
 }
 
-func TestOsqueryVersionCompare(t *testing.T) {
-	assert.Equal(t, 0, osqueryVersionCompare("1.2.3", "1.2.3"))
-	assert.Equal(t, 1, osqueryVersionCompare("4.0.0", "3.0.0"))
-	assert.Equal(t, 2, osqueryVersionCompare("3.0.0", "4.0.0"))
-	assert.Equal(t, -1, osqueryVersionCompare("3.0.0", "a.0.0"))
+func TestShortHash(t *testing.T) {
+	assert.Equal(t, "0123456789ab", shortHash("0123456789abcdef"))
+	assert.Equal(t, "abc", shortHash("abc"))
+	assert.Equal(t, "", shortHash(""))
 }
 
 func TestGenFullPath(t *testing.T) {
@@ -64,4 +82,5 @@ func TestGenFullPath(t *testing.T) {
 	assert.Equal(t, "/tmp/foobar", genFullPath("/tmp/", "foobar"))
 	assert.Equal(t, "/tmp/foobar", genFullPath("/tmp", "/foobar"))
 	assert.Equal(t, "/tmp/foobar", genFullPath("/tmp/", "/foobar"))
+	assert.Equal(t, "C:\\osquery\\foobar", genFullPath("C:\\osquery\\", "foobar"))
 }
@@ -2,11 +2,14 @@ module github.com/jmpsec/osctrld
 
 go 1.24.3
 
-require github.com/urfave/cli/v2 v2.8.1
+require (
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/urfave/cli/v2 v2.8.1
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/google/go-cmp v0.5.8 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
@@ -26,7 +29,6 @@ require (
 	github.com/tklauser/go-sysconf v0.3.10 // indirect
 	github.com/tklauser/numcpus v0.4.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/ini.v1 v1.66.4 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect